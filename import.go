@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/babbarshaer/usage-api/usage"
+)
+
+// csvColumns is the default order of the columns in a CSV file
+// which comes without a header row.
+var csvColumns = []string{"user", "resolution", "timestamp", "temperature", "consumption"}
+
+type importOptions struct {
+	File         string
+	Format       string
+	BatchSize    int
+	DryRun       bool
+	ProgressFile string
+	Restart      bool
+}
+
+// importProgress is checkpointed after every committed batch so that
+// an interrupted import continues from the first uncommitted line. The
+// size and modification time of the file tell whether the checkpoint
+// still belongs to it.
+type importProgress struct {
+	Size       int64  `json:"size"`
+	ModTime    string `json:"mod_time"`
+	Offset     int64  `json:"offset"`
+	Line       int    `json:"line"`
+	Inserted   int    `json:"inserted"`
+	Duplicates int    `json:"duplicates"`
+	Rejected   int    `json:"rejected"`
+}
+
+// importBatch collects the parsed readings along with the line
+// they were read from, to report the rejected rows by line.
+type importBatch struct {
+	readings []usage.UserReading
+	lines    []int
+}
+
+// runImport implements the `import` subcommand which loads historic
+// readings from CSV or JSON Lines files into the storage.
+func runImport(args []string) error {
+
+	options := importOptions{}
+	config := usage.Config{}
+
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.StringVar(&config.Driver, "driver", "sqlite3", "storage driver, sqlite3 or postgres")
+	flags.StringVar(&config.DBLocation, "db", "./usage/resource/usage_prod.db", "location of the database, or the connection string")
+	flags.StringVar(&options.Format, "format", "", "format of the file, csv or jsonl (default: from the extension)")
+	flags.IntVar(&options.BatchSize, "batch", 1000, "number of rows written per transaction")
+	flags.BoolVar(&options.DryRun, "dry-run", false, "validate the file without writing to the database")
+	flags.StringVar(&options.ProgressFile, "progress", "", "file tracking the progress (default: <file>.progress)")
+	flags.BoolVar(&options.Restart, "restart", false, "ignore the progress of an earlier run")
+
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: usage-api import [flags] <file>")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("Expected exactly one file to import")
+	}
+
+	options.File = flags.Arg(0)
+
+	processor, err := usage.NewProcessor(config)
+	if err != nil {
+		return err
+	}
+
+	progress, err := importFile(processor, options, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %s: inserted %d, skipped %d duplicates, rejected %d\n",
+		options.File, progress.Inserted, progress.Duplicates, progress.Rejected)
+
+	return nil
+}
+
+// importFile streams the file into the storage in batches. Rejected
+// rows are reported to the log as they are encountered.
+func importFile(processor usage.UsageProcessor, options importOptions, log io.Writer) (importProgress, error) {
+
+	// Stage1: Fill in the defaults for the options.
+	if options.Format == "" {
+		switch strings.ToLower(filepath.Ext(options.File)) {
+		case ".csv":
+			options.Format = "csv"
+		case ".jsonl", ".ndjson":
+			options.Format = "jsonl"
+		default:
+			return importProgress{}, fmt.Errorf("Unable to detect the format of: %s, use -format", options.File)
+		}
+	}
+
+	if options.Format != "csv" && options.Format != "jsonl" {
+		return importProgress{}, fmt.Errorf("Unknown format: %s", options.Format)
+	}
+
+	if options.BatchSize <= 0 {
+		options.BatchSize = 1000
+	}
+
+	if options.ProgressFile == "" {
+		options.ProgressFile = options.File + ".progress"
+	}
+
+	file, err := os.Open(options.File)
+	if err != nil {
+		return importProgress{}, err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return importProgress{}, err
+	}
+
+	progress := importProgress{Size: info.Size(), ModTime: info.ModTime().UTC().Format(time.RFC3339Nano)}
+	columns := csvColumns
+
+	// Stage2: The header of a CSV file is needed even when resuming.
+	if options.Format == "csv" {
+
+		header := csv.NewReader(file)
+		header.FieldsPerRecord = -1
+
+		record, _ := header.Read()
+		if len(record) > 0 && strings.TrimSpace(strings.ToLower(record[0])) == "user" {
+
+			columns = make([]string, len(record))
+			for i, name := range record {
+				columns[i] = strings.TrimSpace(strings.ToLower(name))
+			}
+
+			progress.Offset = header.InputOffset()
+			progress.Line = 1
+		}
+	}
+
+	// Stage3: Continue from where an earlier run left off, as long as
+	// the file has not changed since.
+	if !options.Restart && !options.DryRun {
+
+		if byt, err := ioutil.ReadFile(options.ProgressFile); err == nil {
+
+			saved := importProgress{}
+			if err := json.Unmarshal(byt, &saved); err != nil {
+				return importProgress{}, fmt.Errorf("Unable to read the progress file: %s", err.Error())
+			}
+
+			if saved.Size != progress.Size || saved.ModTime != progress.ModTime {
+				return importProgress{}, fmt.Errorf("File has changed since the progress was saved: %s, use -restart",
+					options.File)
+			}
+
+			progress = saved
+			fmt.Fprintf(log, "Resuming the import at line %d\n", progress.Line+1)
+		}
+	}
+
+	if _, err := file.Seek(progress.Offset, io.SeekStart); err != nil {
+		return importProgress{}, err
+	}
+
+	// Stage4: Stream the rows in batches to the storage.
+	users := make(map[string]usage.User)
+	batch := importBatch{}
+	offset := progress.Offset
+	lineNumber := progress.Line
+
+	flush := func() error {
+
+		result, err := processor.ImportReadings(batch.readings, options.DryRun)
+		if err != nil {
+			return err
+		}
+
+		for _, rejected := range result.Rejected {
+			fmt.Fprintf(log, "line %d: %s: %s\n", batch.lines[rejected.Index], rejected.Field, rejected.Reason)
+		}
+
+		progress.Inserted += result.Inserted
+		progress.Duplicates += result.Duplicates
+		progress.Rejected += len(uniqueRows(result.Rejected))
+		progress.Offset = offset
+		progress.Line = lineNumber
+
+		batch = importBatch{}
+
+		if options.DryRun {
+			return nil
+		}
+
+		return saveProgress(options.ProgressFile, progress)
+	}
+
+	add := func(line int, reading usage.UserReading, reason string) error {
+
+		if reason != "" {
+			fmt.Fprintf(log, "line %d: %s\n", line, reason)
+			progress.Rejected++
+		} else {
+			batch.readings = append(batch.readings, reading)
+			batch.lines = append(batch.lines, line)
+		}
+
+		if len(batch.readings) >= options.BatchSize {
+			return flush()
+		}
+
+		return nil
+	}
+
+	if options.Format == "csv" {
+
+		// NOTE: A single reader goes over the rest of the file, as the
+		// quoted fields of a row may span several lines.
+		reader := csv.NewReader(file)
+		reader.FieldsPerRecord = -1
+		start, firstLine := offset, lineNumber
+
+		for {
+
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+
+			offset = start + reader.InputOffset()
+
+			var reading usage.UserReading
+			var line int
+			reason := ""
+
+			perr, malformed := err.(*csv.ParseError)
+			switch {
+			case malformed:
+				line, lineNumber = firstLine+perr.StartLine, firstLine+perr.Line
+				reason = fmt.Sprintf("Malformed CSV row: %s", perr.Err.Error())
+			case err != nil:
+				return progress, err
+			default:
+
+				line, _ = reader.FieldPos(0)
+				line += firstLine
+				lineNumber = line
+				for _, field := range record {
+					lineNumber += strings.Count(field, "\n")
+				}
+
+				reading, reason = parseCSVRow(processor, users, columns, record)
+			}
+
+			if err := add(line, reading, reason); err != nil {
+				return progress, err
+			}
+		}
+	} else {
+
+		reader := bufio.NewReader(file)
+		for {
+
+			line, err := reader.ReadString('\n')
+			if err != nil && err != io.EOF {
+				return progress, err
+			}
+
+			if len(line) > 0 {
+
+				lineNumber++
+				offset += int64(len(line))
+
+				if strings.TrimSpace(line) != "" {
+					reading, reason := parseJSONRow(processor, users, line)
+					if err := add(lineNumber, reading, reason); err != nil {
+						return progress, err
+					}
+				}
+			}
+
+			if err == io.EOF {
+				break
+			}
+		}
+	}
+
+	if len(batch.readings) > 0 {
+		if err := flush(); err != nil {
+			return progress, err
+		}
+	}
+
+	if !options.DryRun {
+		os.Remove(options.ProgressFile)
+	}
+
+	return progress, nil
+}
+
+// uniqueRows returns the indexes of the rows which have been rejected,
+// as a single row can be rejected for more than one reason.
+func uniqueRows(rejected []usage.RowError) map[int]bool {
+
+	rows := make(map[int]bool)
+	for _, row := range rejected {
+		rows[row.Index] = true
+	}
+
+	return rows
+}
+
+// saveProgress writes the progress through a temporary file so that
+// a crash while writing cannot leave a truncated progress file behind.
+func saveProgress(location string, progress importProgress) error {
+
+	byt, _ := json.Marshal(progress)
+
+	tmp := location + ".tmp"
+	if err := ioutil.WriteFile(tmp, byt, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, location)
+}
+
+// resolveUser looks up the user, caching the result as the
+// same users repeat over millions of rows.
+func resolveUser(processor usage.UsageProcessor, users map[string]usage.User, username string) (usage.User, bool) {
+
+	if user, ok := users[username]; ok {
+		return user, user.UserId != 0
+	}
+
+	user, err := processor.GetUserByName(username)
+	if err != nil {
+		user = usage.User{}
+	}
+
+	users[username] = user
+	return user, user.UserId != 0
+}
+
+func parseCSVRow(
+	processor usage.UsageProcessor,
+	users map[string]usage.User,
+	columns []string,
+	record []string) (usage.UserReading, string) {
+
+	if len(record) != len(columns) {
+		return usage.UserReading{}, fmt.Sprintf("Expected %d columns, found %d", len(columns), len(record))
+	}
+
+	fields := make(map[string]string)
+	for i, name := range columns {
+		fields[name] = strings.TrimSpace(record[i])
+	}
+
+	user, ok := resolveUser(processor, users, fields["user"])
+	if !ok {
+		return usage.UserReading{}, fmt.Sprintf("Unknown user: %s", fields["user"])
+	}
+
+	reading := usage.Reading{
+		Resolution: fields["resolution"],
+		Timestamp:  fields["timestamp"],
+	}
+
+	for _, field := range []struct {
+		name   string
+		target **usage.Decimal
+	}{
+		{"temperature", &reading.Temperature},
+		{"consumption", &reading.Consumption},
+	} {
+
+		if fields[field.name] == "" {
+			continue
+		}
+
+		val, err := usage.ParseDecimal(fields[field.name])
+		if err != nil {
+			return usage.UserReading{}, fmt.Sprintf("Invalid %s: %s", field.name, fields[field.name])
+		}
+
+		*field.target = &val
+	}
+
+	// NOTE: The meter column is optional, the readings without one
+	// go to the default electricity meter of the user.
+	if fields["meter"] != "" {
+		meter, err := strconv.Atoi(fields["meter"])
+		if err != nil {
+			return usage.UserReading{}, fmt.Sprintf("Invalid meter: %s", fields["meter"])
+		}
+
+		reading.Meter = meter
+	}
+
+	return usage.UserReading{UserId: user.UserId, Location: user.Location(), Reading: reading}, ""
+}
+
+func parseJSONRow(
+	processor usage.UsageProcessor,
+	users map[string]usage.User,
+	line string) (usage.UserReading, string) {
+
+	row := struct {
+		User string `json:"user"`
+		usage.Reading
+	}{}
+
+	if err := json.Unmarshal([]byte(line), &row); err != nil {
+		return usage.UserReading{}, fmt.Sprintf("Malformed JSON row: %s", err.Error())
+	}
+
+	user, ok := resolveUser(processor, users, row.User)
+	if !ok {
+		return usage.UserReading{}, fmt.Sprintf("Unknown user: %s", row.User)
+	}
+
+	return usage.UserReading{UserId: user.UserId, Location: user.Location(), Reading: row.Reading}, ""
+}
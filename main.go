@@ -1,9 +1,13 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -15,14 +19,46 @@ type Router struct {
 	processor usage.UsageProcessor
 }
 
-func (router Router) authenticateUser(r *http.Request) (usage.User, error) {
+// errInsufficientScope is returned when the request is authenticated
+// with an API token which has not been granted the needed scope.
+var errInsufficientScope = errors.New("Token is missing the scope for the request")
+
+// errInvalidToken is returned when the API token of the request is
+// unknown or has been revoked.
+var errInvalidToken = errors.New("Unable to locate the token")
+
+// authenticateUser resolves the user either from an API token passed as
+// `Authorization: Bearer <token>`, which needs to carry the scope, or
+// from the Basic credentials which grant every scope.
+func (router Router) authenticateUser(r *http.Request, scope string) (usage.User, error) {
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return router.authenticateBasicUser(r)
+	}
+
+	user, token, err := router.processor.GetUserForToken(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+	if err != nil {
+		return usage.User{}, errInvalidToken
+	}
+
+	if !token.HasScope(scope) {
+		return usage.User{}, errInsufficientScope
+	}
+
+	return user, nil
+}
+
+// authenticateBasicUser only accepts the Basic credentials of the user.
+// It guards the endpoints which manage the API tokens themselves.
+func (router Router) authenticateBasicUser(r *http.Request) (usage.User, error) {
 
 	username, password, ok := r.BasicAuth()
 	if !ok {
 		return usage.User{}, fmt.Errorf("Unable to extract authentication information")
 	}
 
-	user, err := router.processor.Storage.GetUser(username, password)
+	user, err := router.processor.GetUser(username, password)
 	if err != nil {
 		return usage.User{}, fmt.Errorf("Unable to locate the user")
 	}
@@ -30,6 +66,27 @@ func (router Router) authenticateUser(r *http.Request) (usage.User, error) {
 	return user, nil
 }
 
+// writeAuthError responds to a request which failed the authentication.
+func writeAuthError(rw http.ResponseWriter, err error) {
+
+	if err == errInsufficientScope {
+		rw.WriteHeader(403)
+		rw.Write([]byte(`{"error": {"code": 403, "reason": "Forbidden"}}`))
+		return
+	}
+
+	// NOTE: A failed token is not challenged for the password, so that
+	// the clients do not fall back to asking for one.
+	if err == errInvalidToken {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="Usage", error="invalid_token"`)
+	} else {
+		rw.Header().Set("WWW-Authenticate", `Basic realm="Usage"`)
+	}
+
+	rw.WriteHeader(401)
+	rw.Write([]byte("401 Unauthorized\n"))
+}
+
 func (router Router) pingHandler(rw http.ResponseWriter, r *http.Request) {
 	rw.Write([]byte(`{"response": "pong!!"}`))
 }
@@ -38,20 +95,68 @@ func (router Router) getUsageLimitsHandler(rw http.ResponseWriter, r *http.Reque
 
 	fmt.Println("Received a request to fetch the usage for the customer")
 
-	user, err := router.authenticateUser(r)
+	user, err := router.authenticateUser(r, usage.ScopeLimitsRead)
 	if err != nil {
 		fmt.Println(err)
-		rw.Header().Set("WWW-Authenticate", `Basic realm="Usage"`)
-		rw.WriteHeader(401)
-		rw.Write([]byte("401 Unauthorized\n"))
+		writeAuthError(rw, err)
+		return
+	}
+
+	loc, err := locationFor(r, user)
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Unknown time zone"}}`))
+		return
+	}
+
+	values := r.URL.Query()
+
+	meter, utility, ok := meterParams(values)
+
+	// NOTE: The range is optional, the limits cover all of the
+	// readings up to the end or from the start when left out.
+	var start, end time.Time
+	if len(values["start"]) > 0 {
+		if start, err = usage.ParseTimestamp(values.Get("start"), loc); err != nil {
+			ok = false
+		}
+	}
+
+	if len(values["end"]) > 0 {
+		if end, err = usage.ParseTimestamp(values.Get("end"), loc); err != nil || !end.After(start) {
+			ok = false
+		}
+	}
+
+	if !ok {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+		return
+	}
+
+	if !servedInZone(loc, user, "D", false) {
+		writeValidationError(rw, errStoredZone)
 		return
 	}
 
-	limits, err := router.processor.GetLimitsForUser(user.UserId)
+	query := usage.LimitsQuery{
+		Start:    usage.FormatTimestamp(start),
+		End:      usage.FormatTimestamp(end),
+		Meter:    meter,
+		Utility:  utility,
+		Units:    values.Get("units"),
+		Location: loc,
+	}
+	limits, err := router.processor.GetLimitsForUser(user.UserId, query)
 
 	if err != nil {
 
 		fmt.Printf("Error while fetching the limits for the user: %s", err.Error())
+		if verr, ok := err.(usage.ValidationError); ok {
+			writeValidationError(rw, verr)
+			return
+		}
+
 		http.Error(rw, `{"error": "Internal Server Error"}`, 500)
 		return
 	}
@@ -64,17 +169,26 @@ func (router Router) getDataHandler(rw http.ResponseWriter, r *http.Request) {
 
 	fmt.Println("Received a request to fetch data for the user")
 
-	user, err := router.authenticateUser(r)
+	user, err := router.authenticateUser(r, usage.ScopeDataRead)
 	if err != nil {
-		rw.Header().Set("WWW-Authenticate", `Basic realm="Usage"`)
-		rw.WriteHeader(401)
-		rw.Write([]byte("401 Unauthorized\n"))
+		writeAuthError(rw, err)
 		return
 	}
 
 	values := r.URL.Query()
 
-	if len(values["resolution"]) == 0 || len(values["count"]) == 0 || len(values["start"]) == 0 {
+	loc, err := locationFor(r, user)
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Unknown time zone"}}`))
+		return
+	}
+
+	// NOTE: The count can only be left out when the range is bounded
+	// by an end date, the start when continuing behind a cursor.
+	if len(values["resolution"]) == 0 ||
+		(len(values["start"]) == 0 && len(values["cursor"]) == 0) ||
+		(len(values["count"]) == 0 && len(values["end"]) == 0 && len(values["cursor"]) == 0) {
 		rw.WriteHeader(400)
 		rw.Write([]byte(`{"error": {"code": 400, "reason": "Missing mandatory query params"}}`))
 		return
@@ -82,17 +196,96 @@ func (router Router) getDataHandler(rw http.ResponseWriter, r *http.Request) {
 
 	badRequest := false
 
-	if strings.TrimSpace(values["resolution"][0]) != "M" && strings.TrimSpace(values["resolution"][0]) != "D" {
+	resolution := strings.TrimSpace(values["resolution"][0])
+	if _, ok := usage.GetResolution(resolution); !ok && !usage.IsRollup(resolution) {
+		badRequest = true
+	}
+
+	derived, ok := sourceParam(values, resolution)
+	if !ok {
+		fmt.Println("Failed source")
+		badRequest = true
+	}
+
+	var start, end time.Time
+	if len(values["start"]) > 0 {
+		if start, err = usage.ParseTimestamp(values["start"][0], loc); err != nil {
+			fmt.Println("Failed start")
+			badRequest = true
+		}
+	}
+
+	var cursor *usage.Cursor
+	if len(values["cursor"]) > 0 {
+		if decoded, err := usage.DecodeCursor(strings.TrimSpace(values["cursor"][0])); err != nil {
+			fmt.Println(err)
+			badRequest = true
+		} else {
+			cursor = &decoded
+		}
+	}
+
+	if len(values["end"]) > 0 {
+		if end, err = usage.ParseTimestamp(values["end"][0], loc); err != nil || !end.After(start) {
+			fmt.Println("Failed end")
+			badRequest = true
+		}
+	}
+
+	if len(values["count"]) > 0 {
+		if val, err := strconv.Atoi(strings.TrimSpace(values["count"][0])); err != nil || val <= 0 {
+			fmt.Println("Failed count")
+			badRequest = true
+		}
+	}
+
+	if order := strings.TrimSpace(values.Get("order")); order != "" && order != "asc" && order != "desc" {
+		fmt.Println("Failed order")
+		badRequest = true
+	}
+
+	// NOTE: as_of returns the data as it was at that instant,
+	// before the corrections which have been sent since.
+	var asOf time.Time
+	if len(values["as_of"]) > 0 {
+		if asOf, err = usage.ParseTimestamp(values["as_of"][0], loc); err != nil {
+			fmt.Println("Failed as_of")
+			badRequest = true
+		}
+	}
+
+	meter, utility, ok := meterParams(values)
+	if !ok {
+		fmt.Println("Failed meter")
+		badRequest = true
+	}
+
+	cost := strings.TrimSpace(values.Get("cost"))
+	if cost != "" && cost != "true" && cost != "false" {
+		fmt.Println("Failed cost")
+		badRequest = true
+	}
+
+	degreeDays := strings.TrimSpace(values.Get("degree_days"))
+	normalized := strings.TrimSpace(values.Get("normalized"))
+	if (degreeDays != "" && degreeDays != "true" && degreeDays != "false") ||
+		(normalized != "" && normalized != "true" && normalized != "false") {
+		fmt.Println("Failed degree days")
 		badRequest = true
 	}
 
-	if _, err := time.Parse("2006-01-02", strings.TrimSpace(values["start"][0])); err != nil {
-		fmt.Println("Failed start")
+	anomalies := strings.TrimSpace(values.Get("anomalies"))
+	if anomalies != "" && anomalies != "true" && anomalies != "false" {
+		fmt.Println("Failed anomalies")
 		badRequest = true
 	}
 
-	if val, err := strconv.Atoi(strings.TrimSpace(values["count"][0])); err != nil || val <= 0 {
-		fmt.Println("Failed count")
+	// NOTE: Filling the gaps reports them as well.
+	gaps := strings.TrimSpace(values.Get("gaps"))
+	fill := strings.TrimSpace(values.Get("fill"))
+	if (gaps != "" && gaps != "true" && gaps != "false") ||
+		(fill != "" && fill != "null" && fill != "zero" && fill != "previous" && fill != "linear") {
+		fmt.Println("Failed gaps")
 		badRequest = true
 	}
 
@@ -102,53 +295,1619 @@ func (router Router) getDataHandler(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	count, _ := strconv.Atoi(strings.TrimSpace(values["count"][0]))
-	resolution := strings.TrimSpace(values["resolution"][0])
-	start := strings.TrimSpace(values["start"][0])
+	if !servedInZone(loc, user, resolution, derived) {
+		writeValidationError(rw, errStoredZone)
+		return
+	}
+
+	query := usage.DataQuery{
+		Resolution:      resolution,
+		Start:           usage.FormatTimestamp(start),
+		End:             usage.FormatTimestamp(end),
+		Descending:      strings.TrimSpace(values.Get("order")) == "desc",
+		After:           cursor,
+		Derived:         derived,
+		Location:        loc,
+		AsOf:            usage.FormatTimestamp(asOf),
+		Meter:           meter,
+		Utility:         utility,
+		Units:           values.Get("units"),
+		Cost:            cost == "true",
+		DegreeDays:      degreeDays == "true",
+		Normalized:      normalized == "true",
+		BaseTemperature: strings.TrimSpace(values.Get("base")),
+		Anomalies:       anomalies == "true",
+		Sensitivity:     strings.TrimSpace(values.Get("sensitivity")),
+		Gaps:            gaps == "true",
+		Fill:            fill,
+	}
+
+	if len(values["count"]) > 0 {
+		query.Count, _ = strconv.Atoi(strings.TrimSpace(values["count"][0]))
+	}
 
-	payload, err := router.processor.GetDataForUser(user.UserId, count, resolution, start)
+	page, err := router.processor.GetDataForUser(user.UserId, query)
 	if err != nil {
 
 		fmt.Println(err)
+		if verr, ok := err.(usage.ValidationError); ok {
+			writeValidationError(rw, verr)
+			return
+		}
+
 		rw.WriteHeader(500)
 		rw.Write([]byte(`{"error": {"code": 500, "reason": {"Internal Server Error"}}`))
 		return
 	}
 
 	response := struct {
-		Data [][]interface{} `json:"data"`
+		Columns []string        `json:"columns,omitempty"`
+		Units   *usage.Units    `json:"units,omitempty"`
+		Data    [][]interface{} `json:"data"`
+		Gaps    []usage.Gap     `json:"gaps,omitempty"`
+		Next    string          `json:"next,omitempty"`
+		HasMore bool            `json:"has_more"`
 	}{
-		Data: payload,
+		Columns: page.Columns,
+		Units:   page.Units,
+		Data:    page.Data,
+		Gaps:    page.Gaps,
+		HasMore: page.HasMore,
+	}
+
+	if page.HasMore {
+		response.Next = page.Next.Encode()
 	}
 
 	byt, _ := json.Marshal(response)
 	rw.Write(byt)
 }
 
-func main() {
+// tokensHandler lists (GET), creates (POST) and revokes (DELETE) the
+// API tokens of the user. Tokens cannot be used to manage tokens.
+func (router Router) tokensHandler(rw http.ResponseWriter, r *http.Request) {
 
-	fmt.Println("Starting with the TLS server")
+	fmt.Println("Received a request to manage the tokens for the user")
 
-	// Stage1: Setup the configuration
-	// parameters to be used by the processor.
-	config := usage.Config{
-		DBLocation: "./usage/resource/usage_prod.db",
+	user, err := router.authenticateBasicUser(r)
+	if err != nil {
+		writeAuthError(rw, err)
+		return
 	}
 
-	// Stage2: Set up the processor which will be used
-	// by the router which invokes the handler functions for the endpoints.
-	processor, err := usage.NewProcessor(config)
+	switch r.Method {
+
+	case "GET":
+
+		tokens, err := router.processor.GetTokensForUser(user.UserId)
+		if err != nil {
+			fmt.Println(err)
+			rw.WriteHeader(500)
+			rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+			return
+		}
+
+		response := struct {
+			Tokens []usage.Token `json:"tokens"`
+		}{
+			Tokens: tokens,
+		}
+
+		byt, _ := json.Marshal(response)
+		rw.Write(byt)
+
+	case "POST":
+
+		request := struct {
+			Name      string   `json:"name"`
+			Scopes    []string `json:"scopes"`
+			ExpiresAt string   `json:"expires_at"`
+		}{}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rw.WriteHeader(400)
+			rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+			return
+		}
+
+		var expiresAt time.Time
+		if request.ExpiresAt != "" {
+			if expiresAt, err = time.Parse(time.RFC3339, request.ExpiresAt); err != nil {
+				rw.WriteHeader(400)
+				rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+				return
+			}
+		}
+
+		token, secret, err := router.processor.CreateToken(user.UserId, request.Name, request.Scopes, expiresAt)
+		if err != nil {
+			fmt.Println(err)
+			if verr, ok := err.(usage.ValidationError); ok {
+				writeValidationError(rw, verr)
+				return
+			}
+
+			rw.WriteHeader(500)
+			rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+			return
+		}
+
+		response := struct {
+			usage.Token
+			Secret string `json:"token"`
+		}{
+			Token:  token,
+			Secret: secret,
+		}
+
+		byt, _ := json.Marshal(response)
+		rw.WriteHeader(201)
+		rw.Write(byt)
+
+	case "DELETE":
+
+		tokenId, err := strconv.Atoi(strings.TrimSpace(r.URL.Query().Get("id")))
+		if err != nil {
+			rw.WriteHeader(400)
+			rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+			return
+		}
+
+		err = router.processor.RevokeToken(user.UserId, tokenId)
+		if err == sql.ErrNoRows {
+			rw.WriteHeader(404)
+			rw.Write([]byte(`{"error": {"code": 404, "reason": "Not Found"}}`))
+			return
+		}
+
+		if err != nil {
+			fmt.Println(err)
+			rw.WriteHeader(500)
+			rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+			return
+		}
+
+		rw.WriteHeader(204)
+
+	default:
+		rw.WriteHeader(405)
+		rw.Write([]byte(`{"error": {"code": 405, "reason": "Method Not Allowed"}}`))
+	}
+}
+
+// meterParams reads the meter or the utility the readings are summed
+// over, the electricity meters of the user being used when neither is set.
+func meterParams(values url.Values) (int, string, bool) {
+
+	var meter int
+	if raw := strings.TrimSpace(values.Get("meter")); raw != "" {
+
+		var err error
+		if meter, err = strconv.Atoi(raw); err != nil || meter <= 0 {
+			return 0, "", false
+		}
+	}
+
+	return meter, strings.TrimSpace(values.Get("utility")), true
+}
+
+// sourceParam reads whether the resolution is to be derived from the
+// readings of a finer one. The source picks between the stored monthly
+// readings and the monthly rollup derived from the daily readings.
+func sourceParam(values url.Values, resolution string) (bool, bool) {
+
+	source := strings.TrimSpace(values.Get("source"))
+	if _, ok := usage.GetResolution(resolution); (source == "stored" && !ok) ||
+		(source == "derived" && !usage.IsRollup(resolution)) ||
+		(source != "" && source != "stored" && source != "derived") {
+		return false, false
+	}
+
+	return source == "derived", true
+}
+
+// metersHandler lists (GET) and adds (POST) the meters of the user.
+func (router Router) metersHandler(rw http.ResponseWriter, r *http.Request) {
+
+	fmt.Println("Received a request to manage the meters for the user")
+
+	scope := usage.ScopeDataRead
+	if r.Method == "POST" {
+		scope = usage.ScopeDataWrite
+	}
+
+	user, err := router.authenticateUser(r, scope)
 	if err != nil {
-		panic(err)
+		writeAuthError(rw, err)
+		return
 	}
 
-	router := Router{processor: processor}
+	switch r.Method {
 
-	http.HandleFunc("/ping", router.pingHandler)
-	http.HandleFunc("/limits", router.getUsageLimitsHandler)
-	http.HandleFunc("/data", router.getDataHandler)
+	case "GET":
+
+		meters, err := router.processor.GetMetersForUser(user.UserId)
+		if err != nil {
+			fmt.Println(err)
+			rw.WriteHeader(500)
+			rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+			return
+		}
+
+		byt, _ := json.Marshal(map[string][]usage.Meter{"meters": meters})
+		rw.Write(byt)
+
+	case "POST":
+
+		request := struct {
+			Utility string `json:"utility"`
+			Unit    string `json:"unit"`
+			Label   string `json:"label"`
+		}{}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rw.WriteHeader(400)
+			rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+			return
+		}
+
+		meter, err := router.processor.AddMeterForUser(user.UserId, request.Utility, request.Unit, request.Label)
+		if err != nil {
+			fmt.Println(err)
+			if verr, ok := err.(usage.ValidationError); ok {
+				writeValidationError(rw, verr)
+				return
+			}
+
+			rw.WriteHeader(500)
+			rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+			return
+		}
+
+		byt, _ := json.Marshal(meter)
+		rw.WriteHeader(201)
+		rw.Write(byt)
+
+	default:
+		rw.WriteHeader(405)
+		rw.Write([]byte(`{"error": {"code": 405, "reason": "Method Not Allowed"}}`))
+	}
+}
+
+// tariffsHandler lists (GET), adds (POST) and removes (DELETE) the
+// tariffs of the user, the validity being given in the time zone of the user.
+func (router Router) tariffsHandler(rw http.ResponseWriter, r *http.Request) {
+
+	fmt.Println("Received a request to manage the tariffs for the user")
+
+	scope := usage.ScopeDataRead
+	if r.Method != "GET" {
+		scope = usage.ScopeDataWrite
+	}
+
+	user, err := router.authenticateUser(r, scope)
+	if err != nil {
+		writeAuthError(rw, err)
+		return
+	}
+
+	switch r.Method {
+
+	case "GET":
+
+		tariffs, err := router.processor.GetTariffsForUser(user.UserId, strings.TrimSpace(r.URL.Query().Get("utility")))
+		if err != nil {
+			fmt.Println(err)
+			if verr, ok := err.(usage.ValidationError); ok {
+				writeValidationError(rw, verr)
+				return
+			}
+
+			rw.WriteHeader(500)
+			rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+			return
+		}
+
+		byt, _ := json.Marshal(map[string][]usage.Tariff{"tariffs": tariffs})
+		rw.Write(byt)
+
+	case "POST":
+
+		loc, err := locationFor(r, user)
+		if err != nil {
+			rw.WriteHeader(400)
+			rw.Write([]byte(`{"error": {"code": 400, "reason": "Unknown time zone"}}`))
+			return
+		}
+
+		var request usage.Tariff
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rw.WriteHeader(400)
+			rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+			return
+		}
+
+		tariff, err := router.processor.AddTariffForUser(user.UserId, request, loc)
+		if err != nil {
+			fmt.Println(err)
+			if verr, ok := err.(usage.ValidationError); ok {
+				writeValidationError(rw, verr)
+				return
+			}
+
+			rw.WriteHeader(500)
+			rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+			return
+		}
+
+		byt, _ := json.Marshal(tariff)
+		rw.WriteHeader(201)
+		rw.Write(byt)
+
+	case "DELETE":
+
+		tariffId, err := strconv.Atoi(strings.TrimSpace(r.URL.Query().Get("id")))
+		if err != nil {
+			rw.WriteHeader(400)
+			rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+			return
+		}
+
+		err = router.processor.DeleteTariffForUser(user.UserId, tariffId)
+		if err == sql.ErrNoRows {
+			rw.WriteHeader(404)
+			rw.Write([]byte(`{"error": {"code": 404, "reason": "Not Found"}}`))
+			return
+		}
+
+		if err != nil {
+			fmt.Println(err)
+			rw.WriteHeader(500)
+			rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+			return
+		}
+
+		rw.WriteHeader(204)
+
+	default:
+		rw.WriteHeader(405)
+		rw.Write([]byte(`{"error": {"code": 405, "reason": "Method Not Allowed"}}`))
+	}
+}
+
+// budgetsHandler lists (GET), adds (POST) and removes (DELETE) the
+// budgets of the user, the periods following the time zone of the user.
+func (router Router) budgetsHandler(rw http.ResponseWriter, r *http.Request) {
+
+	fmt.Println("Received a request to manage the budgets for the user")
+
+	scope := usage.ScopeDataRead
+	if r.Method != "GET" {
+		scope = usage.ScopeDataWrite
+	}
+
+	user, err := router.authenticateUser(r, scope)
+	if err != nil {
+		writeAuthError(rw, err)
+		return
+	}
+
+	switch r.Method {
+
+	case "GET":
+
+		budgets, err := router.processor.GetBudgetsForUser(user.UserId)
+		if err != nil {
+			fmt.Println(err)
+			rw.WriteHeader(500)
+			rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+			return
+		}
+
+		byt, _ := json.Marshal(map[string][]usage.Budget{"budgets": budgets})
+		rw.Write(byt)
+
+	case "POST":
+
+		loc, err := locationFor(r, user)
+		if err != nil {
+			rw.WriteHeader(400)
+			rw.Write([]byte(`{"error": {"code": 400, "reason": "Unknown time zone"}}`))
+			return
+		}
+
+		var request usage.Budget
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rw.WriteHeader(400)
+			rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+			return
+		}
+
+		budget, err := router.processor.AddBudgetForUser(user.UserId, request, loc)
+		if err != nil {
+			fmt.Println(err)
+			if verr, ok := err.(usage.ValidationError); ok {
+				writeValidationError(rw, verr)
+				return
+			}
+
+			rw.WriteHeader(500)
+			rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+			return
+		}
+
+		byt, _ := json.Marshal(budget)
+		rw.WriteHeader(201)
+		rw.Write(byt)
+
+	case "DELETE":
+
+		budgetId, err := strconv.Atoi(strings.TrimSpace(r.URL.Query().Get("id")))
+		if err != nil {
+			rw.WriteHeader(400)
+			rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+			return
+		}
+
+		err = router.processor.DeleteBudgetForUser(user.UserId, budgetId)
+		if err == sql.ErrNoRows {
+			rw.WriteHeader(404)
+			rw.Write([]byte(`{"error": {"code": 404, "reason": "Not Found"}}`))
+			return
+		}
+
+		if err != nil {
+			fmt.Println(err)
+			rw.WriteHeader(500)
+			rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+			return
+		}
+
+		rw.WriteHeader(204)
+
+	default:
+		rw.WriteHeader(405)
+		rw.Write([]byte(`{"error": {"code": 405, "reason": "Method Not Allowed"}}`))
+	}
+}
+
+// alertsHandler lists the alerts raised for the budgets of the user.
+func (router Router) alertsHandler(rw http.ResponseWriter, r *http.Request) {
+
+	fmt.Println("Received a request to fetch the alerts for the user")
+
+	user, err := router.authenticateUser(r, usage.ScopeDataRead)
+	if err != nil {
+		writeAuthError(rw, err)
+		return
+	}
+
+	if r.Method != "GET" {
+		rw.WriteHeader(405)
+		rw.Write([]byte(`{"error": {"code": 405, "reason": "Method Not Allowed"}}`))
+		return
+	}
+
+	alerts, err := router.processor.GetAlertsForUser(user.UserId)
+	if err != nil {
+		fmt.Println(err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+		return
+	}
+
+	byt, _ := json.Marshal(map[string][]usage.Alert{"alerts": alerts})
+	rw.Write(byt)
+}
+
+// webhooksHandler lists (GET), adds (POST) and removes (DELETE) the
+// webhooks of the user. The secret of a webhook is only returned once,
+// when it is added.
+func (router Router) webhooksHandler(rw http.ResponseWriter, r *http.Request) {
+
+	fmt.Println("Received a request to manage the webhooks for the user")
+
+	scope := usage.ScopeDataRead
+	if r.Method != "GET" {
+		scope = usage.ScopeDataWrite
+	}
+
+	user, err := router.authenticateUser(r, scope)
+	if err != nil {
+		writeAuthError(rw, err)
+		return
+	}
+
+	switch r.Method {
+
+	case "GET":
+
+		webhooks, err := router.processor.GetWebhooksForUser(user.UserId)
+		if err != nil {
+			fmt.Println(err)
+			rw.WriteHeader(500)
+			rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+			return
+		}
+
+		byt, _ := json.Marshal(map[string][]usage.Webhook{"webhooks": webhooks})
+		rw.Write(byt)
+
+	case "POST":
+
+		request := struct {
+			URL    string   `json:"url"`
+			Events []string `json:"events"`
+		}{}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rw.WriteHeader(400)
+			rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+			return
+		}
+
+		webhook, err := router.processor.AddWebhookForUser(user.UserId, request.URL, request.Events)
+		if err != nil {
+			fmt.Println(err)
+			if verr, ok := err.(usage.ValidationError); ok {
+				writeValidationError(rw, verr)
+				return
+			}
+
+			rw.WriteHeader(500)
+			rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+			return
+		}
+
+		byt, _ := json.Marshal(webhook)
+		rw.WriteHeader(201)
+		rw.Write(byt)
+
+	case "DELETE":
+
+		webhookId, err := strconv.Atoi(strings.TrimSpace(r.URL.Query().Get("id")))
+		if err != nil {
+			rw.WriteHeader(400)
+			rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+			return
+		}
+
+		err = router.processor.DeleteWebhookForUser(user.UserId, webhookId)
+		if err == sql.ErrNoRows {
+			rw.WriteHeader(404)
+			rw.Write([]byte(`{"error": {"code": 404, "reason": "Not Found"}}`))
+			return
+		}
+
+		if err != nil {
+			fmt.Println(err)
+			rw.WriteHeader(500)
+			rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+			return
+		}
+
+		rw.WriteHeader(204)
+
+	default:
+		rw.WriteHeader(405)
+		rw.Write([]byte(`{"error": {"code": 405, "reason": "Method Not Allowed"}}`))
+	}
+}
+
+// getDeliveriesHandler lists the latest deliveries of the webhook
+// along with the outcome of their latest attempt.
+func (router Router) getDeliveriesHandler(rw http.ResponseWriter, r *http.Request) {
+
+	fmt.Println("Received a request to fetch the deliveries of a webhook for the user")
+
+	user, err := router.authenticateUser(r, usage.ScopeDataRead)
+	if err != nil {
+		writeAuthError(rw, err)
+		return
+	}
+
+	webhookId, err := strconv.Atoi(strings.TrimSpace(r.URL.Query().Get("id")))
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+		return
+	}
+
+	deliveries, err := router.processor.GetDeliveriesForUser(user.UserId, webhookId)
+	if err == sql.ErrNoRows {
+		rw.WriteHeader(404)
+		rw.Write([]byte(`{"error": {"code": 404, "reason": "Not Found"}}`))
+		return
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+		return
+	}
+
+	byt, _ := json.Marshal(map[string][]usage.Delivery{"deliveries": deliveries})
+	rw.Write(byt)
+}
+
+// statsHandler summarizes the consumption and the temperature of the
+// readings of the user in the range at the resolution.
+func (router Router) statsHandler(rw http.ResponseWriter, r *http.Request) {
+
+	fmt.Println("Received a request to fetch the stats for the user")
+
+	user, err := router.authenticateUser(r, usage.ScopeDataRead)
+	if err != nil {
+		writeAuthError(rw, err)
+		return
+	}
+
+	values := r.URL.Query()
+
+	loc, err := locationFor(r, user)
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Unknown time zone"}}`))
+		return
+	}
+
+	if len(values["resolution"]) == 0 || len(values["start"]) == 0 || len(values["end"]) == 0 {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Missing mandatory query params"}}`))
+		return
+	}
+
+	start, startErr := usage.ParseTimestamp(values.Get("start"), loc)
+	end, endErr := usage.ParseTimestamp(values.Get("end"), loc)
+	meter, utility, ok := meterParams(values)
+	derived, sourceOk := sourceParam(values, strings.TrimSpace(values.Get("resolution")))
+
+	if startErr != nil || endErr != nil || !end.After(start) || !ok || !sourceOk {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+		return
+	}
+
+	if !servedInZone(loc, user, strings.TrimSpace(values.Get("resolution")), derived) {
+		writeValidationError(rw, errStoredZone)
+		return
+	}
+
+	query := usage.StatsQuery{
+		Resolution:  strings.TrimSpace(values.Get("resolution")),
+		Derived:     derived,
+		Start:       usage.FormatTimestamp(start),
+		End:         usage.FormatTimestamp(end),
+		Meter:       meter,
+		Utility:     utility,
+		Units:       values.Get("units"),
+		Location:    loc,
+		Percentiles: values.Get("percentiles"),
+	}
+
+	stats, err := router.processor.GetStatsForUser(user.UserId, query)
+	if err != nil {
+
+		fmt.Println(err)
+		if verr, ok := err.(usage.ValidationError); ok {
+			writeValidationError(rw, verr)
+			return
+		}
+
+		rw.WriteHeader(500)
+		rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+		return
+	}
+
+	byt, _ := json.Marshal(stats)
+	rw.Write(byt)
+}
+
+// compareHandler compares the data of the user in the range to the one
+// in another range, or in the range moved by an offset like -1y.
+func (router Router) compareHandler(rw http.ResponseWriter, r *http.Request) {
+
+	fmt.Println("Received a request to compare the data for the user")
+
+	user, err := router.authenticateUser(r, usage.ScopeDataRead)
+	if err != nil {
+		writeAuthError(rw, err)
+		return
+	}
+
+	values := r.URL.Query()
+
+	loc, err := locationFor(r, user)
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Unknown time zone"}}`))
+		return
+	}
+
+	if len(values["resolution"]) == 0 || len(values["start"]) == 0 || len(values["end"]) == 0 {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Missing mandatory query params"}}`))
+		return
+	}
+
+	start, startErr := usage.ParseTimestamp(values.Get("start"), loc)
+	end, endErr := usage.ParseTimestamp(values.Get("end"), loc)
+	meter, utility, ok := meterParams(values)
+	derived, sourceOk := sourceParam(values, strings.TrimSpace(values.Get("resolution")))
+
+	if startErr != nil || endErr != nil || !end.After(start) || !ok || !sourceOk {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+		return
+	}
+
+	if !servedInZone(loc, user, strings.TrimSpace(values.Get("resolution")), derived) {
+		writeValidationError(rw, errStoredZone)
+		return
+	}
+
+	query := usage.CompareQuery{
+		Resolution: strings.TrimSpace(values.Get("resolution")),
+		Derived:    derived,
+		Start:      usage.FormatTimestamp(start),
+		End:        usage.FormatTimestamp(end),
+		Offset:     strings.TrimSpace(values.Get("offset")),
+		Meter:      meter,
+		Utility:    utility,
+		Units:      values.Get("units"),
+		Location:   loc,
+	}
+
+	// NOTE: The range to compare to is optional, as the offset
+	// can take its place.
+	for param, target := range map[string]*string{"compare_start": &query.CompareStart, "compare_end": &query.CompareEnd} {
+
+		if len(values[param]) == 0 {
+			continue
+		}
+
+		t, err := usage.ParseTimestamp(values.Get(param), loc)
+		if err != nil {
+			rw.WriteHeader(400)
+			rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+			return
+		}
+
+		*target = usage.FormatTimestamp(t)
+	}
+
+	comparison, err := router.processor.GetComparisonForUser(user.UserId, query)
+	if err != nil {
+
+		fmt.Println(err)
+		if verr, ok := err.(usage.ValidationError); ok {
+			writeValidationError(rw, verr)
+			return
+		}
+
+		rw.WriteHeader(500)
+		rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+		return
+	}
+
+	byt, _ := json.Marshal(comparison)
+	rw.Write(byt)
+}
+
+// normalizedHandler fits the consumption of the user in the range to
+// the degree days and normalizes it to the weather.
+func (router Router) normalizedHandler(rw http.ResponseWriter, r *http.Request) {
+
+	fmt.Println("Received a request to normalize the data for the user")
+
+	user, err := router.authenticateUser(r, usage.ScopeDataRead)
+	if err != nil {
+		writeAuthError(rw, err)
+		return
+	}
+
+	values := r.URL.Query()
+
+	loc, err := locationFor(r, user)
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Unknown time zone"}}`))
+		return
+	}
+
+	if len(values["resolution"]) == 0 || len(values["start"]) == 0 || len(values["end"]) == 0 {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Missing mandatory query params"}}`))
+		return
+	}
+
+	start, startErr := usage.ParseTimestamp(values.Get("start"), loc)
+	end, endErr := usage.ParseTimestamp(values.Get("end"), loc)
+	meter, utility, ok := meterParams(values)
+	derived, sourceOk := sourceParam(values, strings.TrimSpace(values.Get("resolution")))
+
+	if startErr != nil || endErr != nil || !end.After(start) || !ok || !sourceOk {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+		return
+	}
+
+	if !servedInZone(loc, user, strings.TrimSpace(values.Get("resolution")), derived) {
+		writeValidationError(rw, errStoredZone)
+		return
+	}
+
+	query := usage.NormalizedQuery{
+		Resolution:      strings.TrimSpace(values.Get("resolution")),
+		Derived:         derived,
+		Start:           usage.FormatTimestamp(start),
+		End:             usage.FormatTimestamp(end),
+		Meter:           meter,
+		Utility:         utility,
+		Units:           values.Get("units"),
+		Location:        loc,
+		BaseTemperature: strings.TrimSpace(values.Get("base")),
+	}
+
+	normalization, err := router.processor.GetNormalizedForUser(user.UserId, query)
+	if err != nil {
+
+		fmt.Println(err)
+		if verr, ok := err.(usage.ValidationError); ok {
+			writeValidationError(rw, verr)
+			return
+		}
+
+		rw.WriteHeader(500)
+		rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+		return
+	}
+
+	byt, _ := json.Marshal(normalization)
+	rw.Write(byt)
+}
+
+// forecastHandler forecasts the daily consumption of the user for the
+// days ahead, or backtests the forecast on the days before the start.
+func (router Router) forecastHandler(rw http.ResponseWriter, r *http.Request) {
+
+	fmt.Println("Received a request to forecast the consumption for the user")
+
+	user, err := router.authenticateUser(r, usage.ScopeDataRead)
+	if err != nil {
+		writeAuthError(rw, err)
+		return
+	}
+
+	values := r.URL.Query()
+
+	loc, err := locationFor(r, user)
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Unknown time zone"}}`))
+		return
+	}
+
+	if len(values["days"]) == 0 {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Missing mandatory query params"}}`))
+		return
+	}
+
+	badRequest := false
+
+	query := usage.ForecastQuery{
+		Units:           values.Get("units"),
+		Location:        loc,
+		BaseTemperature: strings.TrimSpace(values.Get("base")),
+	}
+
+	// NOTE: The history and level are optional, zero picks the defaults.
+	for param, target := range map[string]*int{"days": &query.Days, "history": &query.History, "level": &query.Level} {
+
+		if len(values[param]) == 0 {
+			continue
+		}
+
+		if *target, err = strconv.Atoi(strings.TrimSpace(values.Get(param))); err != nil || *target <= 0 {
+			badRequest = true
+		}
+	}
+
+	if len(values["start"]) > 0 {
+		start, err := usage.ParseTimestamp(values.Get("start"), loc)
+		if err != nil {
+			badRequest = true
+		}
+		query.Start = usage.FormatTimestamp(start)
+	}
+
+	backtest := strings.TrimSpace(values.Get("backtest"))
+	if backtest != "" && backtest != "true" && backtest != "false" {
+		badRequest = true
+	}
+
+	meter, utility, ok := meterParams(values)
+	if badRequest || !ok {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+		return
+	}
+
+	if !servedInZone(loc, user, "D", false) {
+		writeValidationError(rw, errStoredZone)
+		return
+	}
+
+	query.Meter, query.Utility, query.Backtest = meter, utility, backtest == "true"
+
+	forecast, err := router.processor.GetForecastForUser(user.UserId, query)
+	if err != nil {
+
+		fmt.Println(err)
+		if verr, ok := err.(usage.ValidationError); ok {
+			writeValidationError(rw, verr)
+			return
+		}
+
+		rw.WriteHeader(500)
+		rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+		return
+	}
+
+	byt, _ := json.Marshal(forecast)
+	rw.Write(byt)
+}
+
+// anomaliesHandler detects the anomalies in the daily consumption of
+// the user in the range, leaving out the acknowledged ones unless
+// requested.
+func (router Router) anomaliesHandler(rw http.ResponseWriter, r *http.Request) {
+
+	fmt.Println("Received a request to detect the anomalies for the user")
+
+	user, err := router.authenticateUser(r, usage.ScopeDataRead)
+	if err != nil {
+		writeAuthError(rw, err)
+		return
+	}
+
+	if r.Method != "GET" {
+		rw.WriteHeader(405)
+		rw.Write([]byte(`{"error": {"code": 405, "reason": "Method Not Allowed"}}`))
+		return
+	}
+
+	values := r.URL.Query()
+
+	loc, err := locationFor(r, user)
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Unknown time zone"}}`))
+		return
+	}
+
+	if len(values["start"]) == 0 || len(values["end"]) == 0 {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Missing mandatory query params"}}`))
+		return
+	}
+
+	start, startErr := usage.ParseTimestamp(values.Get("start"), loc)
+	end, endErr := usage.ParseTimestamp(values.Get("end"), loc)
+	meter, utility, ok := meterParams(values)
+	acknowledged := strings.TrimSpace(values.Get("acknowledged"))
+
+	if startErr != nil || endErr != nil || !end.After(start) || !ok ||
+		(acknowledged != "" && acknowledged != "true" && acknowledged != "false") {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+		return
+	}
+
+	if !servedInZone(loc, user, "D", false) {
+		writeValidationError(rw, errStoredZone)
+		return
+	}
+
+	query := usage.AnomalyQuery{
+		Start:        usage.FormatTimestamp(start),
+		End:          usage.FormatTimestamp(end),
+		Sensitivity:  strings.TrimSpace(values.Get("sensitivity")),
+		Acknowledged: acknowledged == "true",
+		Meter:        meter,
+		Utility:      utility,
+		Units:        values.Get("units"),
+		Location:     loc,
+	}
+
+	anomalies, err := router.processor.GetAnomaliesForUser(user.UserId, query)
+	if err != nil {
+
+		fmt.Println(err)
+		if verr, ok := err.(usage.ValidationError); ok {
+			writeValidationError(rw, verr)
+			return
+		}
+
+		rw.WriteHeader(500)
+		rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+		return
+	}
+
+	byt, _ := json.Marshal(map[string][]usage.Anomaly{"anomalies": anomalies})
+	rw.Write(byt)
+}
+
+// acknowledgeAnomalyHandler acknowledges an anomaly of the user, so
+// that it is not raised again.
+func (router Router) acknowledgeAnomalyHandler(rw http.ResponseWriter, r *http.Request) {
+
+	fmt.Println("Received a request to acknowledge an anomaly for the user")
+
+	user, err := router.authenticateUser(r, usage.ScopeDataWrite)
+	if err != nil {
+		writeAuthError(rw, err)
+		return
+	}
+
+	if r.Method != "POST" {
+		rw.WriteHeader(405)
+		rw.Write([]byte(`{"error": {"code": 405, "reason": "Method Not Allowed"}}`))
+		return
+	}
+
+	anomalyId, err := strconv.Atoi(strings.TrimSpace(r.URL.Query().Get("id")))
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+		return
+	}
+
+	err = router.processor.AcknowledgeAnomalyForUser(user.UserId, anomalyId)
+	if err == sql.ErrNoRows {
+		rw.WriteHeader(404)
+		rw.Write([]byte(`{"error": {"code": 404, "reason": "Not Found"}}`))
+		return
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+		return
+	}
+
+	rw.WriteHeader(204)
+}
+
+// gapsHandler lists the ranges of the stored resolution without
+// readings of the user, so that they can be chased with the utility.
+func (router Router) gapsHandler(rw http.ResponseWriter, r *http.Request) {
+
+	fmt.Println("Received a request to find the gaps for the user")
+
+	user, err := router.authenticateUser(r, usage.ScopeDataRead)
+	if err != nil {
+		writeAuthError(rw, err)
+		return
+	}
+
+	if r.Method != "GET" {
+		rw.WriteHeader(405)
+		rw.Write([]byte(`{"error": {"code": 405, "reason": "Method Not Allowed"}}`))
+		return
+	}
+
+	values := r.URL.Query()
+
+	loc, err := locationFor(r, user)
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Unknown time zone"}}`))
+		return
+	}
+
+	if len(values["resolution"]) == 0 {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Missing mandatory query params"}}`))
+		return
+	}
+
+	// NOTE: Without a start or an end, the range starts or ends with
+	// the readings.
+	var start, end time.Time
+	var startErr, endErr error
+
+	if len(values["start"]) > 0 {
+		start, startErr = usage.ParseTimestamp(values.Get("start"), loc)
+	}
+
+	if len(values["end"]) > 0 {
+		end, endErr = usage.ParseTimestamp(values.Get("end"), loc)
+	}
+
+	meter, utility, ok := meterParams(values)
+
+	if startErr != nil || endErr != nil || (!start.IsZero() && !end.IsZero() && !end.After(start)) || !ok {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+		return
+	}
+
+	if !servedInZone(loc, user, strings.TrimSpace(values.Get("resolution")), false) {
+		writeValidationError(rw, errStoredZone)
+		return
+	}
+
+	query := usage.GapsQuery{
+		Resolution: strings.TrimSpace(values.Get("resolution")),
+		Start:      usage.FormatTimestamp(start),
+		End:        usage.FormatTimestamp(end),
+		Meter:      meter,
+		Utility:    utility,
+		Location:   loc,
+	}
+
+	gaps, err := router.processor.GetGapsForUser(user.UserId, query)
+	if err != nil {
+
+		fmt.Println(err)
+		if verr, ok := err.(usage.ValidationError); ok {
+			writeValidationError(rw, verr)
+			return
+		}
+
+		rw.WriteHeader(500)
+		rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+		return
+	}
+
+	byt, _ := json.Marshal(gaps)
+	rw.Write(byt)
+}
+
+// costHandler prices the consumption of the user in the range by the
+// tariffs, bucketed at the resolution.
+func (router Router) costHandler(rw http.ResponseWriter, r *http.Request) {
+
+	fmt.Println("Received a request to fetch the cost for the user")
+
+	user, err := router.authenticateUser(r, usage.ScopeDataRead)
+	if err != nil {
+		writeAuthError(rw, err)
+		return
+	}
+
+	values := r.URL.Query()
+
+	loc, err := locationFor(r, user)
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Unknown time zone"}}`))
+		return
+	}
+
+	if len(values["resolution"]) == 0 || len(values["start"]) == 0 || len(values["end"]) == 0 {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Missing mandatory query params"}}`))
+		return
+	}
+
+	start, startErr := usage.ParseTimestamp(values.Get("start"), loc)
+	end, endErr := usage.ParseTimestamp(values.Get("end"), loc)
+	meter, utility, ok := meterParams(values)
+	derived, sourceOk := sourceParam(values, strings.TrimSpace(values.Get("resolution")))
+
+	if startErr != nil || endErr != nil || !end.After(start) || !ok || !sourceOk {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+		return
+	}
+
+	if !servedInZone(loc, user, strings.TrimSpace(values.Get("resolution")), derived) {
+		writeValidationError(rw, errStoredZone)
+		return
+	}
+
+	query := usage.CostQuery{
+		Resolution: strings.TrimSpace(values.Get("resolution")),
+		Derived:    derived,
+		Start:      usage.FormatTimestamp(start),
+		End:        usage.FormatTimestamp(end),
+		Meter:      meter,
+		Utility:    utility,
+		Location:   loc,
+	}
+
+	page, err := router.processor.GetCostForUser(user.UserId, query)
+	if err != nil {
+
+		fmt.Println(err)
+		if verr, ok := err.(usage.ValidationError); ok {
+			writeValidationError(rw, verr)
+			return
+		}
+
+		rw.WriteHeader(500)
+		rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+		return
+	}
+
+	byt, _ := json.Marshal(page)
+	rw.Write(byt)
+}
+
+// writeValidationError responds with the reason the input of the client
+// was rejected along with the problems found in the individual rows.
+func writeValidationError(rw http.ResponseWriter, verr usage.ValidationError) {
+
+	reason := struct {
+		Code   int              `json:"code"`
+		Reason string           `json:"reason"`
+		Rows   []usage.RowError `json:"rows,omitempty"`
+	}{
+		Code:   400,
+		Reason: verr.Reason,
+		Rows:   verr.Rows,
+	}
+
+	byt, _ := json.Marshal(map[string]interface{}{"error": reason})
+
+	rw.WriteHeader(400)
+	rw.Write(byt)
+}
+
+// errStoredZone refuses a tz query param for the daily and monthly readings.
+var errStoredZone = usage.ValidationError{Reason: "Daily and monthly readings are only served in the time zone of the user"}
+
+// servedInZone reports whether the data at the resolution can be served
+// in the location. The daily and monthly readings are stored at the
+// midnight of the zone of the user and would show up on the day before
+// or after in another zone, so only the hourly and quarter hourly ones,
+// along with the days derived from the hours, follow the tz query param.
+func servedInZone(loc *time.Location, user usage.User, resolution string, derived bool) bool {
+
+	switch {
+	case loc.String() == user.Location().String():
+		return true
+	case resolution == "H" || resolution == "Q15":
+		return true
+	}
+
+	return resolution == "D" && derived
+}
+
+// locationFor returns the time zone in which the request is served, the
+// zone passed as the `tz` query param or else the zone of the user.
+func locationFor(r *http.Request, user usage.User) (*time.Location, error) {
+
+	tz := strings.TrimSpace(r.URL.Query().Get("tz"))
+	if tz == "" {
+		return user.Location(), nil
+	}
+
+	if tz == "Local" {
+		return nil, fmt.Errorf("Unknown time zone: %s", tz)
+	}
+
+	return time.LoadLocation(tz)
+}
+
+// userHandler shows (GET) and updates (PUT) the settings of the user,
+// which currently consist of the time zone.
+func (router Router) userHandler(rw http.ResponseWriter, r *http.Request) {
+
+	fmt.Println("Received a request for the settings of the user")
+
+	user, err := router.authenticateBasicUser(r)
+	if err != nil {
+		writeAuthError(rw, err)
+		return
+	}
+
+	switch r.Method {
+
+	case "GET":
+
+	case "PUT":
+
+		request := struct {
+			TimeZone string `json:"timezone"`
+		}{}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			rw.WriteHeader(400)
+			rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+			return
+		}
+
+		if err := router.processor.SetTimeZoneForUser(user.UserId, request.TimeZone); err != nil {
+
+			fmt.Println(err)
+			if verr, ok := err.(usage.ValidationError); ok {
+				writeValidationError(rw, verr)
+				return
+			}
+
+			rw.WriteHeader(500)
+			rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+			return
+		}
+
+		user.TimeZone = request.TimeZone
+
+	default:
+		rw.WriteHeader(405)
+		rw.Write([]byte(`{"error": {"code": 405, "reason": "Method Not Allowed"}}`))
+		return
+	}
+
+	response := struct {
+		UserId   int    `json:"id"`
+		UserName string `json:"username"`
+		TimeZone string `json:"timezone"`
+	}{
+		UserId:   user.UserId,
+		UserName: user.UserName,
+		TimeZone: user.TimeZone,
+	}
+
+	byt, _ := json.Marshal(response)
+	rw.Write(byt)
+}
+
+// dataHandler dispatches the requests on /data based on the method.
+func (router Router) dataHandler(rw http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case "GET":
+		router.getDataHandler(rw, r)
+	case "POST":
+		router.postDataHandler(rw, r)
+	default:
+		rw.Header().Set("Allow", "GET, POST")
+		rw.WriteHeader(405)
+		rw.Write([]byte(`{"error": {"code": 405, "reason": "Method Not Allowed"}}`))
+	}
+}
+
+// getRevisionsHandler lists the earlier values of the reading at the
+// resolution and timestamp, which were replaced by corrections.
+func (router Router) getRevisionsHandler(rw http.ResponseWriter, r *http.Request) {
+
+	fmt.Println("Received a request to fetch the revisions of a reading for the user")
+
+	user, err := router.authenticateUser(r, usage.ScopeDataRead)
+	if err != nil {
+		writeAuthError(rw, err)
+		return
+	}
+
+	loc, err := locationFor(r, user)
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Unknown time zone"}}`))
+		return
+	}
+
+	values := r.URL.Query()
+	if len(values["resolution"]) == 0 || len(values["timestamp"]) == 0 {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Missing mandatory query params"}}`))
+		return
+	}
+
+	timestamp, err := usage.ParseTimestamp(values["timestamp"][0], loc)
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+		return
+	}
+
+	resolution := strings.TrimSpace(values["resolution"][0])
+	if !servedInZone(loc, user, resolution, false) {
+		writeValidationError(rw, errStoredZone)
+		return
+	}
+
+	revisions, err := router.processor.GetRevisionsForUser(user.UserId, resolution, timestamp, loc)
+	if err != nil {
+
+		fmt.Println(err)
+		if verr, ok := err.(usage.ValidationError); ok {
+			writeValidationError(rw, verr)
+			return
+		}
+
+		rw.WriteHeader(500)
+		rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+		return
+	}
+
+	byt, _ := json.Marshal(map[string][]usage.Revision{"revisions": revisions})
+	rw.Write(byt)
+}
+
+// postDataHandler stores a single reading sent as the JSON body.
+func (router Router) postDataHandler(rw http.ResponseWriter, r *http.Request) {
+
+	fmt.Println("Received a request to add data for the user")
+
+	reading := usage.Reading{}
+	router.addReadings(rw, r, &reading, func() []usage.Reading {
+		return []usage.Reading{reading}
+	})
+}
+
+// postDataBatchHandler stores a JSON array of readings all-or-nothing.
+func (router Router) postDataBatchHandler(rw http.ResponseWriter, r *http.Request) {
+
+	fmt.Println("Received a request to add a batch of data for the user")
+
+	if r.Method != "POST" {
+		rw.WriteHeader(405)
+		rw.Write([]byte(`{"error": {"code": 405, "reason": "Method Not Allowed"}}`))
+		return
+	}
+
+	var readings []usage.Reading
+	router.addReadings(rw, r, &readings, func() []usage.Reading {
+		return readings
+	})
+}
+
+// addReadings authenticates the user, decodes the body into the target
+// and writes the readings returned by the callback through the processor.
+func (router Router) addReadings(
+	rw http.ResponseWriter,
+	r *http.Request,
+	target interface{},
+	readings func() []usage.Reading) {
+
+	user, err := router.authenticateUser(r, usage.ScopeDataWrite)
+	if err != nil {
+		writeAuthError(rw, err)
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(target); err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Bad Request"}}`))
+		return
+	}
+
+	loc, err := locationFor(r, user)
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(`{"error": {"code": 400, "reason": "Unknown time zone"}}`))
+		return
+	}
+
+	// NOTE: Readings for timestamps which already have one are
+	// rejected unless the duplicates are to be replaced or merged.
+	policy := usage.DuplicatePolicy(strings.TrimSpace(r.URL.Query().Get("duplicates")))
+
+	batch := readings()
+	for _, reading := range batch {
+		if !servedInZone(loc, user, reading.Resolution, false) {
+			writeValidationError(rw, errStoredZone)
+			return
+		}
+	}
+
+	inserted, updated, err := router.processor.AddReadingsForUser(user.UserId, loc, batch, policy, user.UserName)
+	if err != nil {
+
+		fmt.Println(err)
+		if verr, ok := err.(usage.ValidationError); ok {
+			writeValidationError(rw, verr)
+			return
+		}
+
+		rw.WriteHeader(500)
+		rw.Write([]byte(`{"error": {"code": 500, "reason": "Internal Server Error"}}`))
+		return
+	}
+
+	// NOTE: The readings which took the place of stored ones are
+	// counted under the policy which handled them.
+	written := map[string]int{"inserted": inserted}
+	switch policy {
+	case usage.DuplicateReplace:
+		written["replaced"] = updated
+	case usage.DuplicateMerge:
+		written["merged"] = updated
+	}
+
+	byt, _ := json.Marshal(written)
+	rw.WriteHeader(201)
+	rw.Write(byt)
+}
+
+func main() {
+
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+
+		if err := runImport(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+
+		if err := runMigrate(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	fmt.Println("Starting with the TLS server")
+
+	// Stage1: Setup the configuration
+	// parameters to be used by the processor.
+	// NOTE: The storage defaults to the bundled SQLite database,
+	// USAGE_DB_DRIVER=postgres with USAGE_DB_LOCATION=<dsn> switches
+	// it to PostgreSQL and USAGE_DB_DRIVER=memory to the in-memory storage.
+	config := usage.Config{
+		Driver:     os.Getenv("USAGE_DB_DRIVER"),
+		DBLocation: "./usage/resource/usage_prod.db",
+	}
+
+	if location := os.Getenv("USAGE_DB_LOCATION"); location != "" {
+		config.DBLocation = location
+	}
+
+	// Stage2: Set up the processor which will be used
+	// by the router which invokes the handler functions for the endpoints.
+	// NOTE: The pending migrations are applied on the way, a database
+	// migrated by a more recent binary is refused.
+	processor, err := usage.NewProcessor(config)
+	if err != nil {
+		panic(err)
+	}
+
+	router := Router{processor: processor}
+
+	http.HandleFunc("/ping", router.pingHandler)
+	http.HandleFunc("/limits", router.getUsageLimitsHandler)
+	http.HandleFunc("/data", router.dataHandler)
+	http.HandleFunc("/data/batch", router.postDataBatchHandler)
+	http.HandleFunc("/data/revisions", router.getRevisionsHandler)
+	http.HandleFunc("/tokens", router.tokensHandler)
+	http.HandleFunc("/user", router.userHandler)
+	http.HandleFunc("/meters", router.metersHandler)
+	http.HandleFunc("/tariffs", router.tariffsHandler)
+	http.HandleFunc("/cost", router.costHandler)
+	http.HandleFunc("/stats", router.statsHandler)
+	http.HandleFunc("/compare", router.compareHandler)
+	http.HandleFunc("/normalized", router.normalizedHandler)
+	http.HandleFunc("/forecast", router.forecastHandler)
+	http.HandleFunc("/anomalies", router.anomaliesHandler)
+	http.HandleFunc("/anomalies/acknowledge", router.acknowledgeAnomalyHandler)
+	http.HandleFunc("/gaps", router.gapsHandler)
+	http.HandleFunc("/budgets", router.budgetsHandler)
+	http.HandleFunc("/alerts", router.alertsHandler)
+	http.HandleFunc("/webhooks", router.webhooksHandler)
+	http.HandleFunc("/webhooks/deliveries", router.getDeliveriesHandler)
+
+	// Stage3: Deliver the webhook events in the background,
+	// the failed deliveries being retried once they are due.
+	go func() {
+		for range time.Tick(5 * time.Second) {
+			if _, err := processor.DeliverWebhooks(time.Now()); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}()
 
-	// Stage3: Bootup the TLS Server.
+	// Stage4: Bootup the TLS Server.
 	err = http.ListenAndServeTLS(":8081", "./cert/cert.pem", "cert/key.pem", nil)
 	if err != nil {
 		panic(err)
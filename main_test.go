@@ -1,97 +1,58 @@
 package main
 
 import (
+	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/babbarshaer/usage-api/usage"
 )
 
-var processor usage.UsageProcessor
-var router Router
-
-var testUsers map[int]usage.User
-
-// Setup the storage layer which will be used to setup the
-// dummy information in the system.
-func setup() error {
-
-	// Stage1: Setup the test users for which
-	// we will be adding the data.
-	testUsers = make(map[int]usage.User)
-	for _, val := range []int{1, 2} {
-
-		testUsers[val] = usage.User{
-			UserId:   val,
-			UserName: fmt.Sprintf("username%d", val),
-			Password: fmt.Sprintf("password%d", val),
-		}
-	}
-
-	// Stage2: Create the necessary structs for the
-	// invoking the endpoints through handlers.
-	var err error
-
-	config := usage.Config{
-		DBLocation: "./usage/resource/usage_test.db",
-	}
-	processor, err = usage.NewProcessor(config)
-
-	if err != nil {
-		return err
-	}
-
-	// Stage3: Setup the router to which we have attached
-	// the handlers.
-	router.processor = processor
+// testUsers are added to the storage behind every test router.
+var testUsers = map[int]usage.User{
+	1: {UserId: 1, UserName: "username1", Password: "password1"},
+	2: {UserId: 2, UserName: "username2", Password: "password2"},
+}
 
-	// Stage4: Finally create the users in the datbase.
-	// But before that truncate the existing table.
-	_, err = router.processor.Storage.DB.Exec(`DELETE FROM user`)
-	_, err = router.processor.Storage.DB.Exec(`DELETE FROM days`)
-	_, err = router.processor.Storage.DB.Exec(`DELETE FROM months`)
+// newTestRouter sets up a router over an in-memory storage of its
+// own holding the test users, so that the tests can run in parallel
+// without stepping on each others data.
+func newTestRouter(t *testing.T) Router {
 
+	processor, err := usage.NewProcessor(usage.Config{Driver: "memory"})
 	if err != nil {
-		return err
+		t.Fatalf("Unable to create the processor: %s", err.Error())
 	}
 
 	for _, user := range testUsers {
 
-		err = router.processor.Storage.AddNewUser(user.UserId,
+		err = processor.AddNewUser(user.UserId,
 			user.UserName,
 			user.Password)
 
 		if err != nil {
-			return err
+			t.Fatalf("Unable to add the test user: %s", err.Error())
 		}
 	}
 
-	return nil
+	return Router{processor: processor}
 }
 
-// TestMain is the function that gets called
-// by the test environment. It can used to setup
-// necessary data for the test
-func TestMain(m *testing.M) {
-
-	fmt.Println("Starting with the setting up data for the test")
-	err := setup()
-
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
+func TestGetLimitsForUnauthorizedRequest(t *testing.T) {
 
-	code := m.Run()
-	os.Exit(code)
-}
+	t.Parallel()
 
-func TestGetLimitsForUnauthorizedRequest(t *testing.T) {
+	router := newTestRouter(t)
 
 	req, err := http.NewRequest("GET", "/limits", nil)
 	if err != nil {
@@ -111,6 +72,10 @@ func TestGetLimitsForUnauthorizedRequest(t *testing.T) {
 
 func TestGetDataForUnauthorizedRequest(t *testing.T) {
 
+	t.Parallel()
+
+	router := newTestRouter(t)
+
 	req, err := http.NewRequest("GET", "/data", nil)
 	if err != nil {
 		t.Errorf("Unable to create the request: %s", err.Error())
@@ -131,8 +96,29 @@ func basicAuth(username, password string) string {
 	return base64.StdEncoding.EncodeToString([]byte(auth))
 }
 
+// send serves the request through the handler, authenticated as the
+// user with basic auth.
+func send(t *testing.T, user usage.User, method string, target string, body string,
+	handler http.HandlerFunc) *httptest.ResponseRecorder {
+
+	req, err := http.NewRequest(method, target, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("Unable to create the request: %s", err.Error())
+	}
+
+	req.Header.Add("Authorization", fmt.Sprintf("Basic %s", basicAuth(user.UserName, user.Password)))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
 func TestGetDataForBadRequest(t *testing.T) {
 
+	t.Parallel()
+
+	router := newTestRouter(t)
+
 	req, err := http.NewRequest("GET", "/data?start=2006-07-19", nil)
 	if err != nil {
 		t.Errorf("Unable to create the request: %s", err.Error())
@@ -153,6 +139,10 @@ func TestGetDataForBadRequest(t *testing.T) {
 
 func TestGetLimitsForInvalidUser(t *testing.T) {
 
+	t.Parallel()
+
+	router := newTestRouter(t)
+
 	invalidUsername := "invalidUsername"
 	invalidPassword := "invalidPassword"
 
@@ -174,8 +164,86 @@ func TestGetLimitsForInvalidUser(t *testing.T) {
 	}
 }
 
+func TestGetLimitsForInvalidPassword(t *testing.T) {
+
+	t.Parallel()
+
+	router := newTestRouter(t)
+
+	validUser := testUsers[1]
+
+	req, err := http.NewRequest("GET", "/limits", nil)
+	if err != nil {
+		t.Errorf("Unable to create the request: %s", err.Error())
+		return
+	}
+
+	req.Header.Add("Authorization",
+		fmt.Sprintf("Basic %s", basicAuth(validUser.UserName, "invalidPassword")))
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(router.getUsageLimitsHandler)
+
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("handler returned code: %d, expected bad response: %d", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestPlaintextPasswordIsRehashedOnLogin(t *testing.T) {
+
+	t.Parallel()
+
+	router := newTestRouter(t)
+
+	legacyUser := usage.User{
+		UserId:   3,
+		UserName: "username3",
+		Password: "password3",
+	}
+
+	// NOTE: Write the password directly to mimic the rows created
+	// before the passwords were hashed.
+	err := router.processor.Storage.AddUser(legacyUser.UserId, legacyUser.UserName, legacyUser.Password)
+	if err != nil {
+		t.Fatalf("Unable to add the legacy user: %s", err.Error())
+	}
+
+	for i := 0; i < 2; i++ {
+
+		req, err := http.NewRequest("GET", "/limits", nil)
+		if err != nil {
+			t.Fatalf("Unable to create the request: %s", err.Error())
+		}
+
+		req.Header.Add("Authorization",
+			fmt.Sprintf("Basic %s", basicAuth(legacyUser.UserName, legacyUser.Password)))
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(router.getUsageLimitsHandler)
+
+		handler.ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusOK)
+		}
+	}
+
+	stored, err := router.processor.Storage.GetUserByName(legacyUser.UserName)
+	if err != nil {
+		t.Fatalf("Unable to read back the legacy user: %s", err.Error())
+	}
+
+	if stored.Password == legacyUser.Password {
+		t.Fatalf("Plaintext password was not rehashed on login")
+	}
+}
+
 func TestGetDefaultData(t *testing.T) {
 
+	t.Parallel()
+
+	router := newTestRouter(t)
+
 	validUser := testUsers[1]
 
 	req, err := http.NewRequest("GET", "/limits", nil)
@@ -193,7 +261,7 @@ func TestGetDefaultData(t *testing.T) {
 	handler.ServeHTTP(rr, req)
 
 	byt, _ := ioutil.ReadAll(rr.Body)
-	expected := `{"daily":{"timestamp":{"minimum":"0001-01-01","maximum":"0001-01-01"},"consumption":{"minimum":0,"maximum":0},"temperature":{"minimum":0,"maximum":0}},"monthly":{"timestamp":{"minimum":"0001-01-01","maximum":"0001-01-01"},"consumption":{"minimum":0,"maximum":0},"temperature":{"minimum":0,"maximum":0}}}`
+	expected := `{"daily":{"timestamp":{"minimum":"0001-01-01","maximum":"0001-01-01"},"consumption":{"minimum":0,"maximum":0},"temperature":{"minimum":0,"maximum":0}},"monthly":{"timestamp":{"minimum":"0001-01-01","maximum":"0001-01-01"},"consumption":{"minimum":0,"maximum":0},"temperature":{"minimum":0,"maximum":0}},"hourly":{"timestamp":{"minimum":"0001-01-01 00:00","maximum":"0001-01-01 00:00"},"consumption":{"minimum":0,"maximum":0},"temperature":{"minimum":0,"maximum":0}},"quarter_hourly":{"timestamp":{"minimum":"0001-01-01 00:00","maximum":"0001-01-01 00:00"},"consumption":{"minimum":0,"maximum":0},"temperature":{"minimum":0,"maximum":0}}}`
 
 	if expected != string(byt) {
 		t.Fatalf("Mismatch between the expected : %s and actual: %s default limits value", expected, string(byt))
@@ -214,7 +282,7 @@ func TestGetDefaultData(t *testing.T) {
 	handler.ServeHTTP(rr, req)
 
 	byt, _ = ioutil.ReadAll(rr.Body)
-	expected = `{"data":null}`
+	expected = `{"data":null,"has_more":false}`
 	if expected != string(byt) {
 		t.Fatalf("Mismatch between the expected : %s and actual: %s default limits value", expected, string(byt))
 	}
@@ -222,6 +290,11 @@ func TestGetDefaultData(t *testing.T) {
 
 func TestGetValidLimitsForAuthorizedUser(t *testing.T) {
 
+	t.Parallel()
+
+	router := newTestRouter(t)
+	processor := router.processor
+
 	validUser := testUsers[1]
 
 	// DATA FORMAT : (day_id, temperature, consumption, timestamp)
@@ -231,11 +304,6 @@ func TestGetValidLimitsForAuthorizedUser(t *testing.T) {
 		[]interface{}{3, 20, 89, "2017-02-05 12:02:13"},
 	}
 
-	defer func() {
-		// NOTE: Each test should clean up after itself.
-		processor.Storage.DB.Exec(`DELETE FROM days WHERE user_id = ?`, validUser.UserId)
-	}()
-
 	for _, data := range dailyTestData {
 
 		err := processor.Storage.AddDailyLimit(validUser.UserId,
@@ -263,7 +331,7 @@ func TestGetValidLimitsForAuthorizedUser(t *testing.T) {
 	handler.ServeHTTP(rr, req)
 	byt, _ := ioutil.ReadAll(rr.Body)
 
-	expected := `{"daily":{"timestamp":{"minimum":"2014-02-05","maximum":"2017-02-05"},"consumption":{"minimum":10,"maximum":100},"temperature":{"minimum":-10,"maximum":20}},"monthly":{"timestamp":{"minimum":"0001-01-01","maximum":"0001-01-01"},"consumption":{"minimum":0,"maximum":0},"temperature":{"minimum":0,"maximum":0}}}`
+	expected := `{"daily":{"timestamp":{"minimum":"2014-02-05","maximum":"2017-02-05"},"consumption":{"minimum":10,"maximum":100},"temperature":{"minimum":-10,"maximum":20}},"monthly":{"timestamp":{"minimum":"0001-01-01","maximum":"0001-01-01"},"consumption":{"minimum":0,"maximum":0},"temperature":{"minimum":0,"maximum":0}},"hourly":{"timestamp":{"minimum":"0001-01-01 00:00","maximum":"0001-01-01 00:00"},"consumption":{"minimum":0,"maximum":0},"temperature":{"minimum":0,"maximum":0}},"quarter_hourly":{"timestamp":{"minimum":"0001-01-01 00:00","maximum":"0001-01-01 00:00"},"consumption":{"minimum":0,"maximum":0},"temperature":{"minimum":0,"maximum":0}}}`
 
 	actual := string(byt)
 
@@ -274,6 +342,11 @@ func TestGetValidLimitsForAuthorizedUser(t *testing.T) {
 
 func TestGetDataForAuthorizedUser(t *testing.T) {
 
+	t.Parallel()
+
+	router := newTestRouter(t)
+	processor := router.processor
+
 	validUser := testUsers[1]
 
 	// DATA FORMAT : (day_id, temperature, consumption, timestamp)
@@ -290,12 +363,6 @@ func TestGetDataForAuthorizedUser(t *testing.T) {
 		[]interface{}{3, 20, 89, "2014-04-05 12:02:13"},
 	}
 
-	defer func() {
-		// NOTE: Each test should clean up after itself.
-		processor.Storage.DB.Exec(`DELETE FROM days WHERE user_id = ?`, validUser.UserId)
-		processor.Storage.DB.Exec(`DELETE FROM months WHERE user_id = ?`, validUser.UserId)
-	}()
-
 	for _, data := range dailyTestData {
 
 		err := processor.Storage.AddDailyLimit(validUser.UserId,
@@ -337,7 +404,7 @@ func TestGetDataForAuthorizedUser(t *testing.T) {
 	handler.ServeHTTP(rr, req)
 	byt, _ := ioutil.ReadAll(rr.Body)
 
-	expected := `{"data":[["2014-03-05",-10,100],["2014-04-05",20,89]]}`
+	expected := `{"data":[["2014-03-05",-10,100],["2014-04-05",20,89]],"has_more":false}`
 	actual := string(byt)
 
 	if actual != expected {
@@ -359,10 +426,1724 @@ func TestGetDataForAuthorizedUser(t *testing.T) {
 	handler.ServeHTTP(rr, req)
 	byt, _ = ioutil.ReadAll(rr.Body)
 
-	expected = `{"data":[["2014-02-06",-10,100],["2014-02-07",20,89]]}`
+	expected = `{"data":[["2014-02-06",-10,100],["2014-02-07",20,89]],"has_more":false}`
 	actual = string(byt)
 
 	if actual != expected {
 		t.Fatalf("Unable to get monthly data for the user expected %s, actual: %s", expected, actual)
 	}
 }
+
+func TestTokenAuthentication(t *testing.T) {
+
+	t.Parallel()
+
+	router := newTestRouter(t)
+
+	validUser := testUsers[1]
+
+	body := bytes.NewBufferString(`{"name": "dashboard", "scopes": ["limits:read"]}`)
+	req, err := http.NewRequest("POST", "/tokens", body)
+	if err != nil {
+		t.Fatalf("Unable to create the request: %s", err.Error())
+	}
+
+	req.Header.Add("Authorization",
+		fmt.Sprintf("Basic %s", basicAuth(validUser.UserName, validUser.Password)))
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(router.tokensHandler)
+
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+	}
+
+	created := struct {
+		Id    int    `json:"id"`
+		Token string `json:"token"`
+	}{}
+
+	if err := json.NewDecoder(rr.Body).Decode(&created); err != nil || created.Token == "" {
+		t.Fatalf("Unable to decode the created token: %v", err)
+	}
+
+	// The token grants access to the limits only.
+	for _, tc := range []struct {
+		endpoint string
+		handler  http.HandlerFunc
+		expected int
+	}{
+		{"/limits", router.getUsageLimitsHandler, http.StatusOK},
+		{"/data?resolution=M&start=2014-01-03&count=1", router.getDataHandler, http.StatusForbidden},
+	} {
+
+		req, err = http.NewRequest("GET", tc.endpoint, nil)
+		if err != nil {
+			t.Fatalf("Unable to create the request: %s", err.Error())
+		}
+
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", created.Token))
+
+		rr = httptest.NewRecorder()
+		tc.handler.ServeHTTP(rr, req)
+
+		if rr.Code != tc.expected {
+			t.Fatalf("handler for %s returned code: %d, expected: %d", tc.endpoint, rr.Code, tc.expected)
+		}
+	}
+
+	// Tokens cannot be used to manage the tokens.
+	req, _ = http.NewRequest("GET", "/tokens", nil)
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", created.Token))
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusUnauthorized)
+	}
+
+	req, _ = http.NewRequest("GET", "/tokens", nil)
+	req.Header.Add("Authorization",
+		fmt.Sprintf("Basic %s", basicAuth(validUser.UserName, validUser.Password)))
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	listed := struct {
+		Tokens []usage.Token `json:"tokens"`
+	}{}
+
+	if err := json.NewDecoder(rr.Body).Decode(&listed); err != nil || len(listed.Tokens) != 1 {
+		t.Fatalf("Unable to list the tokens for the user: %v", err)
+	}
+
+	if listed.Tokens[0].LastUsedAt == "" {
+		t.Fatalf("Last usage of the token was not recorded")
+	}
+
+	req, _ = http.NewRequest("DELETE", fmt.Sprintf("/tokens?id=%d", created.Id), nil)
+	req.Header.Add("Authorization",
+		fmt.Sprintf("Basic %s", basicAuth(validUser.UserName, validUser.Password)))
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusNoContent {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusNoContent)
+	}
+
+	req, _ = http.NewRequest("GET", "/limits", nil)
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", created.Token))
+
+	rr = httptest.NewRecorder()
+	router.getUsageLimitsHandler(rr, req)
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Fatalf("handler returned code: %d for revoked token, expected: %d", rr.Code, http.StatusUnauthorized)
+	}
+
+	if challenge := rr.Header().Get("WWW-Authenticate"); challenge != `Bearer realm="Usage", error="invalid_token"` {
+		t.Fatalf("Unexpected challenge for revoked token: %s", challenge)
+	}
+}
+
+func TestPostDataBatch(t *testing.T) {
+
+	t.Parallel()
+
+	router := newTestRouter(t)
+
+	validUser := testUsers[2]
+
+	post := func(body string, query ...string) *httptest.ResponseRecorder {
+
+		req, err := http.NewRequest("POST", "/data/batch?"+strings.Join(query, "&"), bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("Unable to create the request: %s", err.Error())
+		}
+
+		req.Header.Add("Authorization",
+			fmt.Sprintf("Basic %s", basicAuth(validUser.UserName, validUser.Password)))
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(router.postDataBatchHandler).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// A single invalid row rejects the whole batch.
+	rr := post(`[
+		{"resolution": "D", "timestamp": "2014-02-01", "temperature": 3, "consumption": 10},
+		{"resolution": "X", "timestamp": "2014-02-02", "temperature": 4}
+	]`)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusBadRequest)
+	}
+
+	byt, _ := ioutil.ReadAll(rr.Body)
+	expected := `{"error":{"code":400,"reason":"Invalid readings","rows":[{"index":1,"field":"resolution","reason":"Resolution needs to be one of M, D, H, Q15"},{"index":1,"field":"consumption","reason":"Consumption is missing"}]}}`
+	if expected != string(byt) {
+		t.Fatalf("Mismatch between the expected: %s and actual: %s validation errors", expected, string(byt))
+	}
+
+	rr = post(`[
+		{"resolution": "D", "timestamp": "2014-02-01", "temperature": 3, "consumption": 10},
+		{"resolution": "D", "timestamp": "2014-02-02 00:00:00", "temperature": 4, "consumption": 12},
+		{"resolution": "M", "timestamp": "2014-02-01", "temperature": 2, "consumption": 300}
+	]`)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+	}
+
+	req, _ := http.NewRequest("GET", "/data?start=2014-01-01&count=10&resolution=D", nil)
+	req.Header.Add("Authorization",
+		fmt.Sprintf("Basic %s", basicAuth(validUser.UserName, validUser.Password)))
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(router.getDataHandler).ServeHTTP(rr, req)
+
+	byt, _ = ioutil.ReadAll(rr.Body)
+	expected = `{"data":[["2014-02-01",3,10],["2014-02-02",4,12]],"has_more":false}`
+	if expected != string(byt) {
+		t.Fatalf("Mismatch between the expected: %s and actual: %s stored data", expected, string(byt))
+	}
+
+	// Readings for a timestamp which is already taken.
+	duplicate := `[{"resolution": "D", "timestamp": "2014-02-02", "temperature": 5, "consumption": 3}]`
+	for _, tc := range []struct {
+		query    string
+		code     int
+		written  string
+		expected string
+	}{
+		{"", http.StatusBadRequest, "", `{"data":[["2014-02-02",4,12]],"has_more":false}`},
+		{"duplicates=ignore", http.StatusBadRequest, "", `{"data":[["2014-02-02",4,12]],"has_more":false}`},
+		{"duplicates=merge", http.StatusCreated, `{"inserted":0,"merged":1}`, `{"data":[["2014-02-02",5,15]],"has_more":false}`},
+		{"duplicates=replace", http.StatusCreated, `{"inserted":0,"replaced":1}`, `{"data":[["2014-02-02",5,3]],"has_more":false}`},
+	} {
+
+		rr = post(duplicate, tc.query)
+		if rr.Code != tc.code {
+			t.Fatalf("handler returned code: %d for %s, expected: %d", rr.Code, tc.query, tc.code)
+		}
+
+		if byt, _ := ioutil.ReadAll(rr.Body); tc.written != "" && tc.written != string(byt) {
+			t.Fatalf("Mismatch for %s between the expected: %s and actual: %s response", tc.query, tc.written, string(byt))
+		}
+
+		req, _ := http.NewRequest("GET", "/data?start=2014-02-02&count=1&resolution=D", nil)
+		req.Header.Add("Authorization",
+			fmt.Sprintf("Basic %s", basicAuth(validUser.UserName, validUser.Password)))
+
+		rr = httptest.NewRecorder()
+		http.HandlerFunc(router.getDataHandler).ServeHTTP(rr, req)
+
+		byt, _ = ioutil.ReadAll(rr.Body)
+		if tc.expected != string(byt) {
+			t.Fatalf("Mismatch for %s between the expected: %s and actual: %s stored data", tc.query, tc.expected, string(byt))
+		}
+	}
+
+	// Methods other than GET and POST are refused on /data.
+	rr = send(t, validUser, "DELETE", "/data", "", router.dataHandler)
+	if rr.Code != http.StatusMethodNotAllowed || rr.Header().Get("Allow") != "GET, POST" {
+		t.Fatalf("handler returned code: %d with Allow: %s, expected: %d with GET, POST",
+			rr.Code, rr.Header().Get("Allow"), http.StatusMethodNotAllowed)
+	}
+}
+
+func TestImportFile(t *testing.T) {
+
+	t.Parallel()
+
+	processor := newTestRouter(t).processor
+
+	dir, err := ioutil.TempDir("", "import")
+	if err != nil {
+		t.Fatalf("Unable to create the temporary directory: %s", err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+
+	location := filepath.Join(dir, "readings.csv")
+	content := "user,resolution,timestamp,temperature,consumption\n" +
+		"username2,D,2014-02-01,3,10\n" +
+		"username2,D,2014-02-02,4,12\n" +
+		"unknown,D,2014-02-03,4,12\n" +
+		"username2,D,2014-02-03,four,12\n" +
+		"username2,M,2014-02-01,2,300\n" +
+		"username2,D,2014-02-04,\"4\n\",12\n" +
+		"unknown,D,2014-02-05,4,12\n"
+
+	if err := ioutil.WriteFile(location, []byte(content), 0644); err != nil {
+		t.Fatalf("Unable to write the import file: %s", err.Error())
+	}
+
+	options := importOptions{File: location, BatchSize: 2}
+
+	for _, tc := range []struct {
+		dryRun   bool
+		expected importProgress
+	}{
+		{true, importProgress{Inserted: 4, Duplicates: 0, Rejected: 3}},
+		{false, importProgress{Inserted: 4, Duplicates: 0, Rejected: 3}},
+		{false, importProgress{Inserted: 0, Duplicates: 4, Rejected: 3}},
+	} {
+
+		options.DryRun = tc.dryRun
+		progress, err := importFile(processor, options, ioutil.Discard)
+		if err != nil {
+			t.Fatalf("Unable to import the file: %s", err.Error())
+		}
+
+		if progress.Inserted != tc.expected.Inserted ||
+			progress.Duplicates != tc.expected.Duplicates ||
+			progress.Rejected != tc.expected.Rejected {
+			t.Fatalf("Mismatch between the expected: %+v and actual: %+v import summary", tc.expected, progress)
+		}
+	}
+
+	if _, err := os.Stat(location + ".progress"); !os.IsNotExist(err) {
+		t.Fatalf("Progress file was not removed after a completed import")
+	}
+
+	// Resume from a checkpoint placed after the first data line, into
+	// a storage which only holds the monthly reading of the file.
+	processor = newTestRouter(t).processor
+	processor.Storage.AddMonthlyLimit(testUsers[2].UserId, 1, 2, 300, "2014-02-01 00:00:00")
+
+	info, err := os.Stat(location)
+	if err != nil {
+		t.Fatalf("Unable to inspect the import file: %s", err.Error())
+	}
+
+	header := "user,resolution,timestamp,temperature,consumption\n"
+	checkpoint := importProgress{
+		Size:     info.Size(),
+		ModTime:  info.ModTime().UTC().Format(time.RFC3339Nano),
+		Offset:   int64(len(header) + len("username2,D,2014-02-01,3,10\n")),
+		Line:     2,
+		Inserted: 1,
+	}
+
+	if err := saveProgress(location+".progress", checkpoint); err != nil {
+		t.Fatalf("Unable to write the progress file: %s", err.Error())
+	}
+
+	// The checkpoint of another version of the file is refused.
+	modified := checkpoint
+	modified.Size++
+	saveProgress(location+".progress", modified)
+
+	if _, err := importFile(processor, options, ioutil.Discard); err == nil {
+		t.Fatalf("Expected the progress of a modified file to be refused")
+	}
+
+	saveProgress(location+".progress", checkpoint)
+
+	log := &bytes.Buffer{}
+	progress, err := importFile(processor, options, log)
+	if err != nil {
+		t.Fatalf("Unable to resume the import: %s", err.Error())
+	}
+
+	if progress.Inserted != 3 || progress.Duplicates != 1 || progress.Rejected != 3 {
+		t.Fatalf("Unexpected summary after resuming the import: %+v", progress)
+	}
+
+	expected := "Resuming the import at line 3\nline 4: Unknown user: unknown\nline 5: Invalid temperature: four\n" +
+		"line 9: Unknown user: unknown\n"
+	if log.String() != expected {
+		t.Fatalf("Mismatch between the expected: %q and actual: %q log", expected, log.String())
+	}
+}
+
+func TestGetDataForRange(t *testing.T) {
+
+	t.Parallel()
+
+	router := newTestRouter(t)
+	processor := router.processor
+
+	validUser := testUsers[1]
+
+	// DATA FORMAT : (day_id, temperature, consumption, timestamp)
+	// NOTE: The rows are added out of order on purpose.
+	dailyTestData := [][]interface{}{
+		[]interface{}{1, 20, 89, "2014-02-07 00:00:00"},
+		[]interface{}{2, -1, 10, "2014-02-01 00:00:00"},
+		[]interface{}{3, -10, 100, "2014-02-06 00:00:00"},
+		[]interface{}{4, 5, 50, "2014-02-03 00:00:00"},
+	}
+
+	for _, data := range dailyTestData {
+
+		err := processor.Storage.AddDailyLimit(validUser.UserId,
+			data[0].(int),
+			data[1].(int),
+			data[2].(int),
+			data[3].(string))
+
+		if err != nil {
+			t.Fatalf("Unable to add daily limit for the user: %d, error: %s", validUser.UserId, err.Error())
+		}
+	}
+
+	for _, tc := range []struct {
+		query    string
+		code     int
+		expected string
+	}{
+		{"start=2014-02-01&end=2014-02-07&resolution=D", 200, `[["2014-02-01",-1,10],["2014-02-03",5,50],["2014-02-06",-10,100]]`},
+		{"start=2014-02-01&end=2014-02-07&resolution=D&order=desc&count=2", 200, `[["2014-02-06",-10,100],["2014-02-03",5,50]]`},
+		{"start=2014-02-02&count=2&resolution=D", 200, `[["2014-02-03",5,50],["2014-02-06",-10,100]]`},
+		{"start=2014-02-07&end=2014-02-01&resolution=D", 400, ""},
+		{"start=2014-02-01&end=2014-02-07&resolution=D&order=up", 400, ""},
+	} {
+
+		req, err := http.NewRequest("GET", "/data?"+tc.query, nil)
+		if err != nil {
+			t.Fatalf("Unable to create the request: %s", err.Error())
+		}
+
+		req.Header.Add("Authorization",
+			fmt.Sprintf("Basic %s", basicAuth(validUser.UserName, validUser.Password)))
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(router.getDataHandler).ServeHTTP(rr, req)
+
+		if rr.Code != tc.code {
+			t.Fatalf("handler for %s returned code: %d, expected: %d", tc.query, rr.Code, tc.code)
+		}
+
+		if tc.code != 200 {
+			continue
+		}
+
+		response := struct {
+			Data json.RawMessage `json:"data"`
+		}{}
+
+		json.NewDecoder(rr.Body).Decode(&response)
+		if string(response.Data) != tc.expected {
+			t.Fatalf("Mismatch for %s between the expected: %s and actual: %s", tc.query, tc.expected, string(response.Data))
+		}
+	}
+}
+
+func TestGetDataWithCursor(t *testing.T) {
+
+	t.Parallel()
+
+	router := newTestRouter(t)
+	processor := router.processor
+
+	validUser := testUsers[1]
+
+	// DATA FORMAT : (day_id, temperature, consumption, timestamp)
+	dailyTestData := [][]interface{}{
+		[]interface{}{1, -1, 10, "2014-02-01 00:00:00"},
+		[]interface{}{2, 5, 50, "2014-02-03 00:00:00"},
+		[]interface{}{3, -10, 100, "2014-02-06 00:00:00"},
+	}
+
+	for _, data := range dailyTestData {
+
+		err := processor.Storage.AddDailyLimit(validUser.UserId,
+			data[0].(int),
+			data[1].(int),
+			data[2].(int),
+			data[3].(string))
+
+		if err != nil {
+			t.Fatalf("Unable to add daily limit for the user: %d, error: %s", validUser.UserId, err.Error())
+		}
+	}
+
+	type page struct {
+		Data    [][]interface{} `json:"data"`
+		Next    string          `json:"next"`
+		HasMore bool            `json:"has_more"`
+	}
+
+	fetch := func(query string) page {
+
+		req, err := http.NewRequest("GET", "/data?"+query, nil)
+		if err != nil {
+			t.Fatalf("Unable to create the request: %s", err.Error())
+		}
+
+		req.Header.Add("Authorization",
+			fmt.Sprintf("Basic %s", basicAuth(validUser.UserName, validUser.Password)))
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(router.getDataHandler).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler for %s returned code: %d, expected: %d", query, rr.Code, http.StatusOK)
+		}
+
+		p := page{}
+		json.NewDecoder(rr.Body).Decode(&p)
+		return p
+	}
+
+	first := fetch("start=2014-01-01&count=2&resolution=D")
+	if len(first.Data) != 2 || !first.HasMore || first.Next == "" {
+		t.Fatalf("Unexpected first page: %+v", first)
+	}
+
+	// A reading added before the cursor must not shift the next page.
+	processor.Storage.AddDailyLimit(validUser.UserId, 4, 0, 1, "2014-02-02 00:00:00")
+
+	second := fetch("cursor=" + first.Next + "&count=2&resolution=D")
+	if len(second.Data) != 1 || second.HasMore || second.Next != "" || second.Data[0][0] != "2014-02-06" {
+		t.Fatalf("Unexpected second page: %+v", second)
+	}
+
+	req, _ := http.NewRequest("GET", "/data?cursor="+first.Next+"&count=2&resolution=M", nil)
+	req.Header.Add("Authorization",
+		fmt.Sprintf("Basic %s", basicAuth(validUser.UserName, validUser.Password)))
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(router.getDataHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("handler returned code: %d for a foreign cursor, expected: %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHourlyAndQuarterHourlyData(t *testing.T) {
+
+	t.Parallel()
+
+	router := newTestRouter(t)
+
+	validUser := testUsers[2]
+
+	// Readings need to be aligned to the quarter, midnight or the first
+	// of the month, so that a period is only ever taken once.
+	for _, body := range []string{
+		`[{"resolution": "Q15", "timestamp": "2014-02-01 10:05", "temperature": 3, "consumption": 1}]`,
+		`[{"resolution": "D", "timestamp": "2014-02-01 13:00", "temperature": 3, "consumption": 1}]`,
+		`[{"resolution": "M", "timestamp": "2014-02-15", "temperature": 3, "consumption": 1}]`,
+	} {
+
+		rr := send(t, validUser, "POST", "/data/batch", body, router.postDataBatchHandler)
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("handler returned code: %d for %s, expected: %d", rr.Code, body, http.StatusBadRequest)
+		}
+	}
+
+	rr := send(t, validUser, "POST", "/data/batch", `[
+		{"resolution": "H", "timestamp": "2014-02-01 10:00", "temperature": 3, "consumption": 4},
+		{"resolution": "H", "timestamp": "2014-02-01 11:00:00", "temperature": 5, "consumption": 6},
+		{"resolution": "Q15", "timestamp": "2014-02-01 10:00", "temperature": 3, "consumption": 1},
+		{"resolution": "Q15", "timestamp": "2014-02-01T10:15", "temperature": 3, "consumption": 2}
+	]`, router.postDataBatchHandler)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+	}
+
+	for _, tc := range []struct {
+		query    string
+		expected string
+	}{
+		{"resolution=H&start=2014-02-01&end=2014-02-02", `{"data":[["2014-02-01 10:00",3,4],["2014-02-01 11:00",5,6]],"has_more":false}`},
+		{"resolution=H&start=2014-02-01 10:30&count=5", `{"data":[["2014-02-01 11:00",5,6]],"has_more":false}`},
+		{"resolution=Q15&start=2014-02-01&count=5", `{"data":[["2014-02-01 10:00",3,1],["2014-02-01 10:15",3,2]],"has_more":false}`},
+	} {
+
+		rr = send(t, validUser, "GET", "/data?"+strings.Replace(tc.query, " ", "%20", -1), "", router.getDataHandler)
+
+		byt, _ := ioutil.ReadAll(rr.Body)
+		if string(byt) != tc.expected {
+			t.Fatalf("Mismatch for %s between the expected: %s and actual: %s", tc.query, tc.expected, string(byt))
+		}
+	}
+
+	rr = send(t, validUser, "GET", "/limits", "", router.getUsageLimitsHandler)
+
+	limits := usage.DailyMonthlyLimits{}
+	json.NewDecoder(rr.Body).Decode(&limits)
+
+	if limits.Hourly.MinMaxTimestamp.Maximum != "2014-02-01 11:00" || limits.QuarterHourly.MinMaxConsumption.Maximum != usage.NewDecimal(2) {
+		t.Fatalf("Unexpected limits for the hourly and quarter hourly readings: %+v", limits)
+	}
+}
+
+func TestGetDerivedRollups(t *testing.T) {
+
+	t.Parallel()
+
+	router := newTestRouter(t)
+	processor := router.processor
+
+	validUser := testUsers[1]
+
+	// DATA FORMAT : (day_id, temperature, consumption, timestamp)
+	dailyTestData := [][]interface{}{
+		[]interface{}{1, 2, 10, "2014-01-30 00:00:00"},
+		[]interface{}{2, 4, 20, "2014-01-31 00:00:00"},
+		[]interface{}{3, -1, 5, "2014-02-01 00:00:00"},
+		[]interface{}{4, 5, 7, "2014-02-03 00:00:00"},
+		[]interface{}{5, 0, 1, "2014-04-01 00:00:00"},
+	}
+
+	// DATA FORMAT : (month_id, temperature, consumption, timestamp)
+	monthlyTestData := [][]interface{}{
+		[]interface{}{1, 3, 999, "2014-01-01 00:00:00"},
+	}
+
+	for _, data := range dailyTestData {
+
+		err := processor.Storage.AddDailyLimit(validUser.UserId,
+			data[0].(int),
+			data[1].(int),
+			data[2].(int),
+			data[3].(string))
+
+		if err != nil {
+			t.Fatalf("Unable to add daily limit for the user: %d, error: %s", validUser.UserId, err.Error())
+		}
+	}
+
+	for _, data := range monthlyTestData {
+
+		err := processor.Storage.AddMonthlyLimit(validUser.UserId,
+			data[0].(int),
+			data[1].(int),
+			data[2].(int),
+			data[3].(string))
+
+		if err != nil {
+			t.Fatalf("Unable to add monthly limit for the user: %d, error: %s", validUser.UserId, err.Error())
+		}
+	}
+
+	columns := `"columns":["timestamp","temperature","consumption","temperature_min","temperature_max","days"]`
+
+	for _, tc := range []struct {
+		query    string
+		code     int
+		expected string
+	}{
+		{"resolution=M&start=2014-01-01&count=5", 200, `{"data":[["2014-01-01",3,999]],"has_more":false}`},
+		{"resolution=M&start=2014-01-01&count=5&source=derived", 200, `{` + columns + `,"data":[["2014-01-01",3,30,2,4,2],["2014-02-01",2,12,-1,5,2],["2014-04-01",0,1,0,0,1]],"has_more":false}`},
+		{"resolution=W&start=2014-01-01&count=5", 200, `{` + columns + `,"data":[["2014-01-27",1.67,35,-1,4,3],["2014-02-03",5,7,5,5,1],["2014-03-31",0,1,0,0,1]],"has_more":false}`},
+		{"resolution=Q&start=2014-01-01&count=5", 200, `{` + columns + `,"data":[["2014-01-01",2.5,42,-1,5,4],["2014-04-01",0,1,0,0,1]],"has_more":false}`},
+		{"resolution=Y&start=2014-01-01&end=2015-01-01", 200, `{` + columns + `,"data":[["2014-01-01",2,43,-1,5,5]],"has_more":false}`},
+		{"resolution=W&start=2014-01-01&count=5&source=stored", 400, ""},
+		{"resolution=Q15&start=2014-01-01&count=5&source=derived", 400, ""},
+	} {
+
+		req, err := http.NewRequest("GET", "/data?"+tc.query, nil)
+		if err != nil {
+			t.Fatalf("Unable to create the request: %s", err.Error())
+		}
+
+		req.Header.Add("Authorization",
+			fmt.Sprintf("Basic %s", basicAuth(validUser.UserName, validUser.Password)))
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(router.getDataHandler).ServeHTTP(rr, req)
+
+		if rr.Code != tc.code {
+			t.Fatalf("handler for %s returned code: %d, expected: %d", tc.query, rr.Code, tc.code)
+		}
+
+		byt, _ := ioutil.ReadAll(rr.Body)
+		if tc.code == 200 && string(byt) != tc.expected {
+			t.Fatalf("Mismatch for %s between the expected: %s and actual: %s", tc.query, tc.expected, string(byt))
+		}
+	}
+
+	// Page through the monthly rollup a bucket at a time.
+	var months []string
+	query := "resolution=M&source=derived&start=2014-01-01&count=1"
+
+	for i := 0; i < 5; i++ {
+
+		req, _ := http.NewRequest("GET", "/data?"+query, nil)
+		req.Header.Add("Authorization",
+			fmt.Sprintf("Basic %s", basicAuth(validUser.UserName, validUser.Password)))
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(router.getDataHandler).ServeHTTP(rr, req)
+
+		page := struct {
+			Data    [][]interface{} `json:"data"`
+			Next    string          `json:"next"`
+			HasMore bool            `json:"has_more"`
+		}{}
+
+		json.NewDecoder(rr.Body).Decode(&page)
+		for _, row := range page.Data {
+			months = append(months, row[0].(string))
+		}
+
+		if !page.HasMore {
+			break
+		}
+
+		query = "resolution=M&source=derived&count=1&cursor=" + page.Next
+	}
+
+	if strings.Join(months, ",") != "2014-01-01,2014-02-01,2014-04-01" {
+		t.Fatalf("Unexpected months while paging through the rollup: %v", months)
+	}
+}
+
+func TestTimeZoneAwareData(t *testing.T) {
+
+	t.Parallel()
+
+	router := newTestRouter(t)
+
+	validUser := testUsers[2]
+
+	rr := send(t, validUser, "PUT", "/user", `{"timezone": "Mars/Olympus"}`, router.userHandler)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("handler returned code: %d for an unknown time zone, expected: %d", rr.Code, http.StatusBadRequest)
+	}
+
+	rr = send(t, validUser, "PUT", "/user", `{"timezone": "Europe/Stockholm"}`, router.userHandler)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusOK)
+	}
+
+	// The day starts at local midnight, which is 23:00 UTC the day before.
+	rr = send(t, validUser, "POST", "/data", `{"resolution": "D", "timestamp": "2014-02-01", "temperature": 1, "consumption": 5}`,
+		router.dataHandler)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+	}
+
+	daily, _ := usage.GetResolution("D")
+	stored, err := router.processor.Storage.GetUserData(validUser.UserId, daily, usage.DataQuery{Resolution: "D"})
+	if err != nil || stored.Next == nil || stored.Next.Timestamp != "2014-01-31 23:00:00" {
+		t.Fatalf("Reading was not stored in UTC: %+v", stored.Next)
+	}
+
+	for _, tc := range []struct {
+		query    string
+		expected string
+	}{
+		{"resolution=D&start=2014-02-01&count=5", `{"data":[["2014-02-01",1,5]],"has_more":false}`},
+		{"resolution=D&start=2014-01-31&count=5&tz=UTC",
+			`{"error":{"code":400,"reason":"Daily and monthly readings are only served in the time zone of the user"}}`},
+		{"resolution=D&start=2014-01-31&count=5&tz=Europe/Stockholm", `{"data":[["2014-02-01",1,5]],"has_more":false}`},
+	} {
+
+		rr = send(t, validUser, "GET", "/data?"+tc.query, "", router.getDataHandler)
+
+		byt, _ := ioutil.ReadAll(rr.Body)
+		if string(byt) != tc.expected {
+			t.Fatalf("Mismatch for %s between the expected: %s and actual: %s", tc.query, tc.expected, string(byt))
+		}
+	}
+
+	// Hourly readings over the days on which daylight saving time
+	// starts and ends, which have 23 and 25 hours respectively.
+	var readings []string
+	for _, day := range []string{"2014-03-30", "2014-10-26"} {
+
+		loc, _ := time.LoadLocation("Europe/Stockholm")
+		local, _ := time.ParseInLocation("2006-01-02", day, loc)
+
+		for h := local; h.Before(local.AddDate(0, 0, 1)); h = h.Add(time.Hour) {
+			readings = append(readings, fmt.Sprintf(`{"resolution": "H", "timestamp": "%s", "temperature": 1, "consumption": 1}`,
+				h.Format(time.RFC3339)))
+		}
+	}
+
+	rr = send(t, validUser, "POST", "/data/batch", "["+strings.Join(readings, ",")+"]", router.postDataBatchHandler)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+	}
+
+	rr = send(t, validUser, "GET", "/data?resolution=D&source=derived&start=2014-01-01&count=5", "", router.getDataHandler)
+
+	page := struct {
+		Data [][]interface{} `json:"data"`
+	}{}
+
+	json.NewDecoder(rr.Body).Decode(&page)
+	if len(page.Data) != 2 ||
+		page.Data[0][0] != "2014-03-30" || page.Data[0][2].(float64) != 23 || page.Data[0][5].(float64) != 23 ||
+		page.Data[1][0] != "2014-10-26" || page.Data[1][2].(float64) != 25 || page.Data[1][5].(float64) != 25 {
+		t.Fatalf("Unexpected daily rollup over the DST transitions: %v", page.Data)
+	}
+}
+
+func TestCorrectionsAndAsOf(t *testing.T) {
+
+	t.Parallel()
+
+	router := newTestRouter(t)
+
+	validUser := testUsers[1]
+
+	before := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+
+	for _, body := range []string{
+		`{"resolution": "D", "timestamp": "2014-02-01", "temperature": 3, "consumption": 10}`,
+		`{"resolution": "D", "timestamp": "2014-02-01", "temperature": 4, "consumption": 12}`,
+	} {
+
+		if rr := send(t, validUser, "POST", "/data?duplicates=replace", body, router.dataHandler); rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+		}
+	}
+
+	for _, tc := range []struct {
+		query    string
+		code     int
+		expected string
+	}{
+		{"&as_of=" + before, http.StatusOK, `{"data":null,"has_more":false}`},
+		{"", http.StatusOK, `{"data":[["2014-02-01",4,12]],"has_more":false}`},
+		{"&as_of=yesterday", http.StatusBadRequest, `{"error": {"code": 400, "reason": "Bad Request"}}`},
+	} {
+
+		rr := send(t, validUser, "GET", "/data?resolution=D&start=2014-01-01&count=5"+tc.query, "", router.getDataHandler)
+		if rr.Code != tc.code {
+			t.Fatalf("handler returned code: %d for %s, expected: %d", rr.Code, tc.query, tc.code)
+		}
+
+		byt, _ := ioutil.ReadAll(rr.Body)
+		if string(byt) != tc.expected {
+			t.Fatalf("Mismatch for %s between the expected: %s and actual: %s", tc.query, tc.expected, string(byt))
+		}
+	}
+
+	rr := send(t, validUser, "GET", "/data/revisions?resolution=D&timestamp=2014-02-01", "", router.getRevisionsHandler)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusOK)
+	}
+
+	response := struct {
+		Revisions []usage.Revision `json:"revisions"`
+	}{}
+
+	json.NewDecoder(rr.Body).Decode(&response)
+	if len(response.Revisions) != 1 ||
+		response.Revisions[0].Timestamp != "2014-02-01" ||
+		response.Revisions[0].Consumption != usage.NewDecimal(10) ||
+		response.Revisions[0].ChangedBy != validUser.UserName {
+		t.Fatalf("Unexpected revisions: %+v", response.Revisions)
+	}
+}
+
+func TestMeters(t *testing.T) {
+
+	t.Parallel()
+
+	router := newTestRouter(t)
+
+	validUser := testUsers[1]
+
+	if rr := send(t, validUser, "POST", "/meters", `{"utility": "steam"}`, router.metersHandler); rr.Code != http.StatusBadRequest {
+		t.Fatalf("handler returned code: %d for an unknown utility, expected: %d", rr.Code, http.StatusBadRequest)
+	}
+
+	meters := make(map[string]usage.Meter)
+	for _, body := range []string{
+		`{"utility": "electricity", "label": "garage"}`,
+		`{"utility": "gas", "label": "boiler"}`,
+	} {
+
+		rr := send(t, validUser, "POST", "/meters", body, router.metersHandler)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+		}
+
+		meter := usage.Meter{}
+		json.NewDecoder(rr.Body).Decode(&meter)
+		meters[meter.Label] = meter
+	}
+
+	if meters["boiler"].Unit != "m3" {
+		t.Fatalf("Expected the gas meter to default to m3, got: %+v", meters["boiler"])
+	}
+
+	// Readings without a meter go to the default electricity meter.
+	body := fmt.Sprintf(`[
+		{"resolution": "D", "timestamp": "2014-02-01", "temperature": 3, "consumption": 10},
+		{"resolution": "D", "timestamp": "2014-02-01", "temperature": 3, "consumption": 4, "meter": %d},
+		{"resolution": "D", "timestamp": "2014-02-01", "temperature": 3, "consumption": 7, "meter": %d}
+	]`, meters["garage"].MeterId, meters["boiler"].MeterId)
+
+	if rr := send(t, validUser, "POST", "/data/batch", body, router.postDataBatchHandler); rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+	}
+
+	for _, tc := range []struct {
+		query    string
+		code     int
+		expected string
+	}{
+		{"", http.StatusOK, `{"data":[["2014-02-01",3,14]],"has_more":false}`},
+		{"&utility=gas", http.StatusOK, `{"data":[["2014-02-01",3,7]],"has_more":false}`},
+		{"&utility=water", http.StatusOK, `{"data":null,"has_more":false}`},
+		{fmt.Sprintf("&meter=%d", meters["garage"].MeterId), http.StatusOK, `{"data":[["2014-02-01",3,4]],"has_more":false}`},
+		{"&meter=999", http.StatusBadRequest, `{"error":{"code":400,"reason":"Unknown meter: 999"}}`},
+		{"&meter=x", http.StatusBadRequest, `{"error": {"code": 400, "reason": "Bad Request"}}`},
+	} {
+
+		rr := send(t, validUser, "GET", "/data?resolution=D&start=2014-01-01&count=5"+tc.query, "", router.getDataHandler)
+		if rr.Code != tc.code {
+			t.Fatalf("handler returned code: %d for %s, expected: %d", rr.Code, tc.query, tc.code)
+		}
+
+		byt, _ := ioutil.ReadAll(rr.Body)
+		if string(byt) != tc.expected {
+			t.Fatalf("Mismatch for %s between the expected: %s and actual: %s", tc.query, tc.expected, string(byt))
+		}
+	}
+
+	rr := send(t, validUser, "GET", "/limits?utility=gas", "", router.getUsageLimitsHandler)
+	limits := usage.DailyMonthlyLimits{}
+	json.NewDecoder(rr.Body).Decode(&limits)
+
+	if rr.Code != http.StatusOK || limits.Daily.MinMaxConsumption != (usage.MinMaxConsumption{Minimum: usage.NewDecimal(7), Maximum: usage.NewDecimal(7)}) {
+		t.Fatalf("Unexpected limits of the gas meters: %d, %+v", rr.Code, limits.Daily)
+	}
+
+	rr = send(t, validUser, "GET", "/meters", "", router.metersHandler)
+	response := struct {
+		Meters []usage.Meter `json:"meters"`
+	}{}
+
+	json.NewDecoder(rr.Body).Decode(&response)
+	if len(response.Meters) != 3 || response.Meters[0].Label != "default" {
+		t.Fatalf("Unexpected meters: %+v", response.Meters)
+	}
+}
+
+func TestDecimalsAndUnits(t *testing.T) {
+
+	t.Parallel()
+
+	router := newTestRouter(t)
+
+	validUser := testUsers[1]
+
+	rr := send(t, validUser, "POST", "/meters", `{"utility": "electricity", "unit": "Wh", "label": "plug"}`, router.metersHandler)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+	}
+
+	plug := usage.Meter{}
+	json.NewDecoder(rr.Body).Decode(&plug)
+
+	// The readings of the plug are sent in Wh and summed in kWh.
+	body := fmt.Sprintf(`[
+		{"resolution": "D", "timestamp": "2014-02-01", "temperature": 20.1, "consumption": 0.1},
+		{"resolution": "D", "timestamp": "2014-02-01", "temperature": 20.2, "consumption": 200, "meter": %d},
+		{"resolution": "D", "timestamp": "2014-02-02", "temperature": -0.5, "consumption": 1.25}
+	]`, plug.MeterId)
+
+	if rr := send(t, validUser, "POST", "/data/batch", body, router.postDataBatchHandler); rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+	}
+
+	for _, tc := range []struct {
+		query    string
+		code     int
+		expected string
+	}{
+		{"", http.StatusOK, `{"data":[["2014-02-01",20.15,0.3],["2014-02-02",-0.5,1.25]],"has_more":false}`},
+		{"&units=Wh,°F", http.StatusOK,
+			`{"units":{"consumption":"Wh","temperature":"°F"},"data":[["2014-02-01",68.27,300],["2014-02-02",31.1,1250]],"has_more":false}`},
+		{fmt.Sprintf("&meter=%d&units=kWh", plug.MeterId), http.StatusOK,
+			`{"units":{"consumption":"kWh","temperature":"°C"},"data":[["2014-02-01",20.2,0.2]],"has_more":false}`},
+		{"&units=m3", http.StatusBadRequest, `{"error":{"code":400,"reason":"Unit m3 does not apply to electricity"}}`},
+		{"&units=BTU", http.StatusBadRequest, `{"error":{"code":400,"reason":"Unknown unit: BTU"}}`},
+	} {
+
+		rr := send(t, validUser, "GET", "/data?resolution=D&start=2014-01-01&count=5"+tc.query, "", router.getDataHandler)
+		if rr.Code != tc.code {
+			t.Fatalf("handler returned code: %d for %s, expected: %d", rr.Code, tc.query, tc.code)
+		}
+
+		byt, _ := ioutil.ReadAll(rr.Body)
+		if string(byt) != tc.expected {
+			t.Fatalf("Mismatch for %s between the expected: %s and actual: %s", tc.query, tc.expected, string(byt))
+		}
+	}
+
+	// More decimals than can be stored are rejected.
+	rr = send(t, validUser, "POST", "/data", `{"resolution": "D", "timestamp": "2014-02-03", "temperature": 1, "consumption": 0.0000001}`,
+		router.dataHandler)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusBadRequest)
+	}
+
+	rr = send(t, validUser, "GET", "/limits?units=Wh", "", router.getUsageLimitsHandler)
+	byt, _ := ioutil.ReadAll(rr.Body)
+
+	expected := `"consumption":{"minimum":300,"maximum":1250}`
+	if rr.Code != http.StatusOK || !strings.Contains(string(byt), expected) {
+		t.Fatalf("Expected the daily limits to contain: %s, got: %s", expected, string(byt))
+	}
+}
+
+func TestTariffsAndCost(t *testing.T) {
+
+	t.Parallel()
+
+	router := newTestRouter(t)
+
+	validUser := testUsers[1]
+
+	// A flat tariff is replaced in the middle of the month by a tiered
+	// one, which is followed by a time of use tariff in April.
+	for _, tariff := range []string{
+		`{"name": "flat", "currency": "eur", "valid_from": "2014-03-01", "valid_to": "2014-03-03",
+			"standing_charge": 0.5, "rate": 0.2}`,
+		`{"name": "tiered", "currency": "EUR", "valid_from": "2014-03-03", "valid_to": "2014-04-01",
+			"standing_charge": 1, "tiers": [{"up_to": 10, "rate": 0.1}, {"rate": 0.3}]}`,
+		`{"name": "night", "currency": "EUR", "valid_from": "2014-04-01", "standing_charge": 2.4, "rate": 0.25,
+			"windows": [{"from": "22:00", "to": "02:00", "rate": 0.05}]}`,
+	} {
+		if rr := send(t, validUser, "POST", "/tariffs", tariff, router.tariffsHandler); rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+		}
+	}
+
+	rr := send(t, validUser, "POST", "/tariffs", `{"currency": "EUR", "valid_from": "2014-03-15", "rate": 1}`, router.tariffsHandler)
+	byt, _ := ioutil.ReadAll(rr.Body)
+
+	expected := `{"error":{"code":400,"reason":"Tariff overlaps with the tariff: 2"}}`
+	if string(byt) != expected {
+		t.Fatalf("Mismatch between the expected: %s and actual: %s", expected, string(byt))
+	}
+
+	if rr := send(t, validUser, "DELETE", "/tariffs?id=99", "", router.tariffsHandler); rr.Code != http.StatusNotFound {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusNotFound)
+	}
+
+	body := `[
+		{"resolution": "D", "timestamp": "2014-03-01", "temperature": 5, "consumption": 4},
+		{"resolution": "D", "timestamp": "2014-03-02", "temperature": 5, "consumption": 6},
+		{"resolution": "D", "timestamp": "2014-03-03", "temperature": 5, "consumption": 8},
+		{"resolution": "D", "timestamp": "2014-03-04", "temperature": 5, "consumption": 8},
+		{"resolution": "H", "timestamp": "2014-04-01 00:00", "temperature": 5, "consumption": 1},
+		{"resolution": "H", "timestamp": "2014-04-01 01:00", "temperature": 5, "consumption": 1},
+		{"resolution": "H", "timestamp": "2014-04-01 02:00", "temperature": 5, "consumption": 1},
+		{"resolution": "H", "timestamp": "2014-04-01 03:00", "temperature": 5, "consumption": 1}
+	]`
+
+	if rr := send(t, validUser, "POST", "/data/batch", body, router.postDataBatchHandler); rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+	}
+
+	for _, tc := range []struct {
+		query    string
+		expected string
+	}{
+		{"resolution=D&start=2014-03-01&end=2014-03-05", `{"currency":"EUR",` +
+			`"columns":["timestamp","consumption","energy","standing_charge","cost"],` +
+			`"data":[["2014-03-01",4,0.8,0.5,1.3],["2014-03-02",6,1.2,0.5,1.7],` +
+			`["2014-03-03",8,0.8,1,1.8],["2014-03-04",8,2,1,3]],` +
+			`"total":{"consumption":26,"energy":4.8,"standing_charge":3,"cost":7.8}}`},
+		// The standing charge of the first week only counts from the start of the range.
+		{"resolution=W&start=2014-03-01&end=2014-03-05", `{"currency":"EUR",` +
+			`"columns":["timestamp","consumption","energy","standing_charge","cost"],` +
+			`"data":[["2014-02-24",10,2,1,3],["2014-03-03",16,2.8,2,4.8]],` +
+			`"total":{"consumption":26,"energy":4.8,"standing_charge":3,"cost":7.8}}`},
+		{"resolution=H&start=2014-04-01&end=2014-04-01 04:00", `{"currency":"EUR",` +
+			`"columns":["timestamp","consumption","energy","standing_charge","cost"],` +
+			`"data":[["2014-04-01 00:00",1,0.05,0.1,0.15],["2014-04-01 01:00",1,0.05,0.1,0.15],` +
+			`["2014-04-01 02:00",1,0.25,0.1,0.35],["2014-04-01 03:00",1,0.25,0.1,0.35]],` +
+			`"total":{"consumption":4,"energy":0.6,"standing_charge":0.4,"cost":1}}`},
+	} {
+
+		rr := send(t, validUser, "GET", "/cost?"+strings.Replace(tc.query, " ", "%20", -1), "", router.costHandler)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned code: %d for %s, expected: %d", rr.Code, tc.query, http.StatusOK)
+		}
+
+		byt, _ := ioutil.ReadAll(rr.Body)
+		if string(byt) != tc.expected {
+			t.Fatalf("Mismatch for %s between the expected: %s and actual: %s", tc.query, tc.expected, string(byt))
+		}
+	}
+
+	rr = send(t, validUser, "GET", "/data?resolution=D&start=2014-03-01&count=2&cost=true", "", router.getDataHandler)
+	byt, _ = ioutil.ReadAll(rr.Body)
+
+	expected = `{"columns":["timestamp","temperature","consumption","cost"],` +
+		`"data":[["2014-03-01",5,4,1.3],["2014-03-02",5,6,1.7]],"next":`
+	if rr.Code != http.StatusOK || !strings.HasPrefix(string(byt), expected) {
+		t.Fatalf("Expected the data to start with: %s, got: %s", expected, string(byt))
+	}
+}
+
+func TestBudgetsAndAlerts(t *testing.T) {
+
+	t.Parallel()
+
+	router := newTestRouter(t)
+
+	validUser := testUsers[1]
+
+	rr := send(t, validUser, "POST", "/budgets", `{"name": "weekly", "period": "W", "limit": 10}`, router.budgetsHandler)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusBadRequest)
+	}
+
+	if rr := send(t, validUser, "POST", "/tariffs", `{"currency": "EUR", "valid_from": "2014-01-01", "standing_charge": 0, "rate": 0.5}`,
+		router.tariffsHandler); rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+	}
+
+	for _, budget := range []string{
+		`{"name": "daily", "period": "D", "limit": 24}`,
+		`{"name": "spend", "metric": "cost", "period": "D", "limit": 5}`,
+	} {
+		if rr := send(t, validUser, "POST", "/budgets", budget, router.budgetsHandler); rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+		}
+	}
+
+	hours := func(from int, to int, consumption int) string {
+
+		var readings []string
+		for hour := from; hour < to; hour++ {
+			readings = append(readings, fmt.Sprintf(
+				`{"resolution": "H", "timestamp": "2014-05-01 %02d:00", "temperature": 10, "consumption": %d}`, hour, consumption))
+		}
+
+		return "[" + strings.Join(readings, ",") + "]"
+	}
+
+	// The first six hours are on track for 48 kWh and 24 EUR, the
+	// next six take the day over the limit of the consumption.
+	for _, body := range []string{hours(0, 6, 2), hours(6, 12, 3), hours(12, 13, 3)} {
+		if rr := send(t, validUser, "POST", "/data/batch", body, router.postDataBatchHandler); rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+		}
+	}
+
+	rr = send(t, validUser, "GET", "/alerts", "", router.alertsHandler)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusOK)
+	}
+
+	response := struct {
+		Alerts []usage.Alert `json:"alerts"`
+	}{}
+	json.NewDecoder(rr.Body).Decode(&response)
+
+	var actual []string
+	for _, alert := range response.Alerts {
+		actual = append(actual, fmt.Sprintf("%d %s %s %s %s %s",
+			alert.BudgetId, alert.Kind, alert.Period, alert.Value, alert.Projected, alert.Limit))
+	}
+
+	expected := []string{
+		"1 exceeded 2014-05-01 30 60 24",
+		"2 exceeded 2014-05-01 6 24 5",
+		"1 projected 2014-05-01 12 48 24",
+	}
+
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Mismatch between the expected: %v and actual: %v alerts", expected, actual)
+	}
+
+	if rr := send(t, validUser, "DELETE", "/budgets?id=1", "", router.budgetsHandler); rr.Code != http.StatusNoContent {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusNoContent)
+	}
+
+	rr = send(t, validUser, "GET", "/alerts", "", router.alertsHandler)
+	json.NewDecoder(rr.Body).Decode(&response)
+	if len(response.Alerts) != 1 {
+		t.Fatalf("Expected the alerts of the deleted budget to be gone, got: %v", response.Alerts)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+
+	t.Parallel()
+
+	router := newTestRouter(t)
+
+	validUser := testUsers[1]
+
+	// The receiver fails the first delivery, to have it retried.
+	var mu sync.Mutex
+	var received []*http.Request
+	var bodies [][]byte
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, r)
+		bodies = append(bodies, body)
+
+		if len(received) == 1 {
+			rw.WriteHeader(500)
+		}
+	}))
+	defer receiver.Close()
+
+	rr := send(t, validUser, "POST", "/webhooks", `{"url": "ftp://example.com", "events": ["reading.ingested"]}`, router.webhooksHandler)
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusBadRequest)
+	}
+
+	body := fmt.Sprintf(`{"url": "%s", "events": ["reading.ingested", "data.gap", "budget.exceeded"]}`, receiver.URL)
+	rr = send(t, validUser, "POST", "/webhooks", body, router.webhooksHandler)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+	}
+
+	webhook := usage.Webhook{}
+	json.NewDecoder(rr.Body).Decode(&webhook)
+
+	if webhook.Secret == "" {
+		t.Fatalf("Expected the secret of the webhook to be returned on creation")
+	}
+
+	if rr := send(t, validUser, "POST", "/budgets", `{"name": "daily", "period": "D", "limit": 4}`, router.budgetsHandler); rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+	}
+
+	// The second of June is missing, the third goes over the budget.
+	body = `[
+		{"resolution": "D", "timestamp": "2014-06-01", "temperature": 15, "consumption": 3},
+		{"resolution": "D", "timestamp": "2014-06-03", "temperature": 15, "consumption": 5}
+	]`
+
+	if rr := send(t, validUser, "POST", "/data/batch", body, router.postDataBatchHandler); rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+	}
+
+	// Importing the readings again publishes nothing, none of them are written.
+	temperature, consumption := usage.NewDecimal(15), usage.NewDecimal(3)
+	result, err := router.processor.ImportReadings([]usage.UserReading{
+		{UserId: validUser.UserId, Location: time.UTC, Reading: usage.Reading{
+			Resolution: "D", Timestamp: "2014-06-01", Temperature: &temperature, Consumption: &consumption}},
+	}, false)
+	if err != nil || result.Inserted != 0 || result.Duplicates != 1 {
+		t.Fatalf("Unexpected import of the duplicate reading: %+v, error: %v", result, err)
+	}
+
+	now := time.Now()
+	for _, tc := range []struct {
+		at       time.Time
+		expected int
+	}{
+		{now, 3},
+		{now, 0},
+		{now.Add(time.Minute), 1},
+	} {
+
+		attempted, err := router.processor.DeliverWebhooks(tc.at)
+		if err != nil || attempted != tc.expected {
+			t.Fatalf("Expected %d deliveries to be attempted, got: %d, error: %v", tc.expected, attempted, err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var events []string
+	for i, r := range received {
+
+		signature := usage.SignWebhook(webhook.Secret, r.Header.Get("X-Usage-Timestamp"), bodies[i])
+		if r.Header.Get("X-Usage-Signature") != signature {
+			t.Fatalf("Mismatch between the expected: %s and actual: %s signature", signature, r.Header.Get("X-Usage-Signature"))
+		}
+
+		payload := struct {
+			Event string          `json:"event"`
+			Data  json.RawMessage `json:"data"`
+		}{}
+		json.Unmarshal(bodies[i], &payload)
+
+		events = append(events, payload.Event+" "+string(payload.Data))
+	}
+
+	expected := []string{
+		`reading.ingested {"readings":2,"meters":[1],"resolutions":["D"],"start":"2014-06-01T00:00:00Z","end":"2014-06-03T00:00:00Z"}`,
+		`data.gap {"gaps":[{"meter":1,"resolution":"D","start":"2014-06-02T00:00:00Z","end":"2014-06-03T00:00:00Z"}]}`,
+		`budget.exceeded`,
+		`reading.ingested`,
+	}
+
+	if len(events) != len(expected) {
+		t.Fatalf("Mismatch between the expected: %v and actual: %v events", expected, events)
+	}
+
+	for i := range expected {
+		if !strings.HasPrefix(events[i], expected[i]) {
+			t.Fatalf("Mismatch between the expected: %s and actual: %s event", expected[i], events[i])
+		}
+	}
+
+	rr = send(t, validUser, "GET", fmt.Sprintf("/webhooks/deliveries?id=%d", webhook.WebhookId), "", router.getDeliveriesHandler)
+
+	response := struct {
+		Deliveries []usage.Delivery `json:"deliveries"`
+	}{}
+	json.NewDecoder(rr.Body).Decode(&response)
+
+	retried := response.Deliveries[len(response.Deliveries)-1]
+	if len(response.Deliveries) != 3 || retried.Status != usage.DeliveryDelivered || retried.Attempts != 2 {
+		t.Fatalf("Expected the first delivery to be delivered on the second attempt, got: %+v", response.Deliveries)
+	}
+}
+
+func TestStatsAndLimitsRange(t *testing.T) {
+
+	t.Parallel()
+
+	router := newTestRouter(t)
+
+	validUser := testUsers[1]
+
+	body := `[
+		{"resolution": "D", "timestamp": "2014-07-01", "temperature": 10, "consumption": 1},
+		{"resolution": "D", "timestamp": "2014-07-02", "temperature": 12, "consumption": 2},
+		{"resolution": "D", "timestamp": "2014-07-03", "temperature": 14, "consumption": 3},
+		{"resolution": "D", "timestamp": "2014-07-04", "temperature": 16, "consumption": 4},
+		{"resolution": "D", "timestamp": "2014-07-05", "temperature": 18, "consumption": 10}
+	]`
+
+	if rr := send(t, validUser, "POST", "/data/batch", body, router.postDataBatchHandler); rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+	}
+
+	for _, tc := range []struct {
+		query    string
+		code     int
+		expected string
+	}{
+		{"resolution=D&start=2014-07-01&end=2014-07-06&percentiles=25,90", http.StatusOK, `{"resolution":"D",` +
+			`"consumption":{"count":5,"sum":20,"mean":4,"median":3,"stddev":3.162278,"percentiles":{"p25":2,"p90":7.6}},` +
+			`"temperature":{"count":5,"sum":70,"mean":14,"median":14,"stddev":2.828427,"percentiles":{"p25":12,"p90":17.2}}}`},
+		{"resolution=D&start=2014-07-02&end=2014-07-04&percentiles=50&units=Wh", http.StatusOK, `{"resolution":"D",` +
+			`"units":{"consumption":"Wh","temperature":"°C"},` +
+			`"consumption":{"count":2,"sum":5000,"mean":2500,"median":2500,"stddev":500,"percentiles":{"p50":2500}},` +
+			`"temperature":{"count":2,"sum":26,"mean":13,"median":13,"stddev":1,"percentiles":{"p50":13}}}`},
+		{"resolution=D&start=2014-07-01&end=2014-07-06&percentiles=101", http.StatusBadRequest,
+			`{"error":{"code":400,"reason":"Percentile needs to be between 0 and 100: 101"}}`},
+	} {
+
+		rr := send(t, validUser, "GET", "/stats?"+tc.query, "", router.statsHandler)
+		if rr.Code != tc.code {
+			t.Fatalf("handler returned code: %d for %s, expected: %d", rr.Code, tc.query, tc.code)
+		}
+
+		byt, _ := ioutil.ReadAll(rr.Body)
+		if string(byt) != tc.expected {
+			t.Fatalf("Mismatch for %s between the expected: %s and actual: %s", tc.query, tc.expected, string(byt))
+		}
+	}
+
+	rr := send(t, validUser, "GET", "/limits?start=2014-07-02&end=2014-07-04", "", router.getUsageLimitsHandler)
+	byt, _ := ioutil.ReadAll(rr.Body)
+
+	expected := `"daily":{"timestamp":{"minimum":"2014-07-02","maximum":"2014-07-03"},` +
+		`"consumption":{"minimum":2,"maximum":3},"temperature":{"minimum":12,"maximum":14}}`
+	if rr.Code != http.StatusOK || !strings.Contains(string(byt), expected) {
+		t.Fatalf("Expected the limits to contain: %s, got: %s", expected, string(byt))
+	}
+}
+
+func TestCompare(t *testing.T) {
+
+	t.Parallel()
+
+	router := newTestRouter(t)
+
+	validUser := testUsers[1]
+
+	body := `[
+		{"resolution": "M", "timestamp": "2013-07-01", "temperature": 20, "consumption": 100},
+		{"resolution": "M", "timestamp": "2013-08-01", "temperature": 18, "consumption": 80},
+		{"resolution": "M", "timestamp": "2014-07-01", "temperature": 22, "consumption": 110},
+		{"resolution": "M", "timestamp": "2014-09-01", "temperature": 16, "consumption": 60}
+	]`
+
+	if rr := send(t, validUser, "POST", "/data/batch", body, router.postDataBatchHandler); rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+	}
+
+	columns := `"columns":["timestamp","compare_timestamp","consumption","compare_consumption","consumption_delta","consumption_change",` +
+		`"temperature","compare_temperature","temperature_delta","temperature_change"]`
+	total := `"total":{"buckets":1,"consumption":110,"compare_consumption":100,"consumption_delta":10,"consumption_change":10,` +
+		`"temperature":22,"compare_temperature":20,"temperature_delta":2,"temperature_change":10}}`
+
+	for _, tc := range []struct {
+		query    string
+		code     int
+		expected string
+	}{
+		{"resolution=M&start=2014-07-01&end=2014-10-01&offset=-1y", http.StatusOK, `{"resolution":"M",` +
+			`"range":{"start":"2014-07-01","end":"2014-10-01"},"compare":{"start":"2013-07-01","end":"2013-10-01"},` + columns + `,` +
+			`"data":[["2014-07-01","2013-07-01",110,100,10,10,22,20,2,10],` +
+			`["2014-08-01","2013-08-01",null,80,null,null,null,18,null,null],` +
+			`["2014-09-01","2013-09-01",60,null,null,null,16,null,null,null]],` + total},
+		{"resolution=M&start=2014-07-01&end=2014-10-01&compare_start=2013-07-01&compare_end=2013-09-01", http.StatusOK, `{"resolution":"M",` +
+			`"range":{"start":"2014-07-01","end":"2014-10-01"},"compare":{"start":"2013-07-01","end":"2013-09-01"},` + columns + `,` +
+			`"data":[["2014-07-01","2013-07-01",110,100,10,10,22,20,2,10],` +
+			`["2014-08-01","2013-08-01",null,80,null,null,null,18,null,null],` +
+			`["2014-09-01",null,60,null,null,null,16,null,null,null]],` + total},
+		{"resolution=M&start=2014-07-01&end=2014-10-01&offset=-1y&compare_start=2013-07-01", http.StatusBadRequest,
+			`{"error":{"code":400,"reason":"Comparison needs either an offset or a range to compare to, not both"}}`},
+		{"resolution=M&start=2014-07-01&end=2014-10-01&offset=1x", http.StatusBadRequest,
+			`{"error":{"code":400,"reason":"Offset needs to be like -1y, -3m, -52w or -7d: 1x"}}`},
+	} {
+
+		rr := send(t, validUser, "GET", "/compare?"+tc.query, "", router.compareHandler)
+		if rr.Code != tc.code {
+			t.Fatalf("handler returned code: %d for %s, expected: %d", rr.Code, tc.query, tc.code)
+		}
+
+		byt, _ := ioutil.ReadAll(rr.Body)
+		if string(byt) != tc.expected {
+			t.Fatalf("Mismatch for %s between the expected: %s and actual: %s", tc.query, tc.expected, string(byt))
+		}
+	}
+}
+
+func TestDegreeDaysAndNormalization(t *testing.T) {
+
+	t.Parallel()
+
+	router := newTestRouter(t)
+
+	validUser := testUsers[1]
+
+	// NOTE: The consumption is 2 per day and 0.5 per heating degree
+	// day exactly, and the normal January averages both Januaries.
+	body := `[
+		{"resolution": "M", "timestamp": "2013-01-01", "temperature": 4, "consumption": 279},
+		{"resolution": "M", "timestamp": "2014-01-01", "temperature": 8, "consumption": 217},
+		{"resolution": "M", "timestamp": "2014-02-01", "temperature": 10, "consumption": 168},
+		{"resolution": "M", "timestamp": "2014-03-01", "temperature": 12, "consumption": 155},
+		{"resolution": "M", "timestamp": "2014-04-01", "temperature": 14, "consumption": 120}
+	]`
+
+	if rr := send(t, validUser, "POST", "/data/batch", body, router.postDataBatchHandler); rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+	}
+
+	// NOTE: The days from Monday 2015-01-26 up to Friday 2015-03-13
+	// consume 10 per day and 2 per heating degree day exactly, so that
+	// the last week and March are cut short.
+	var readings []string
+	day := time.Date(2015, 1, 26, 0, 0, 0, 0, time.UTC)
+	for i := 0; day.Before(time.Date(2015, 3, 14, 0, 0, 0, 0, time.UTC)); i++ {
+
+		temperature := 8 + (i%5)*2
+		readings = append(readings, fmt.Sprintf(`{"resolution": "D", "timestamp": "%s", "temperature": %d, "consumption": %d}`,
+			day.Format("2006-01-02"), temperature, 10+2*(18-temperature)))
+		day = day.AddDate(0, 0, 1)
+	}
+
+	if rr := send(t, validUser, "POST", "/data/batch", "["+strings.Join(readings, ",")+"]", router.postDataBatchHandler); rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+	}
+
+	for _, tc := range []struct {
+		target   string
+		handler  http.HandlerFunc
+		code     int
+		expected string
+	}{
+		{"/normalized?resolution=M&start=2013-01-01&end=2014-05-01", router.normalizedHandler, http.StatusOK,
+			`{"resolution":"M","base_temperature":18,` +
+				`"model":{"baseload":2,"heating":0.5,"cooling":0,"observations":5,"r_squared":1,"cv_rmse":0},` +
+				`"columns":["timestamp","temperature","consumption","hdd","cdd","normalized"],` +
+				`"data":[["2013-01-01",4,279,434,0,248],["2014-01-01",8,217,310,0,248],["2014-02-01",10,168,224,0,168],` +
+				`["2014-03-01",12,155,186,0,155],["2014-04-01",14,120,120,0,120]]}`},
+		{"/data?resolution=M&start=2014-01-01&end=2014-03-01&degree_days=true&base=64.4&units=°F", router.getDataHandler, http.StatusOK,
+			`{"columns":["timestamp","temperature","consumption","hdd","cdd"],"units":{"consumption":"kWh","temperature":"°F"},` +
+				`"data":[["2014-01-01",46.4,217,558,0],["2014-02-01",50,168,403.2,0]],"has_more":false}`},
+		{"/data?resolution=M&start=2013-01-01&end=2014-05-01&normalized=true&count=2", router.getDataHandler, http.StatusOK,
+			`"data":[["2013-01-01",4,279,248],["2014-01-01",8,217,248]]`},
+		{"/data?resolution=H&start=2014-01-01&end=2014-02-01&degree_days=true", router.getDataHandler, http.StatusBadRequest,
+			`{"error":{"code":400,"reason":"Degree days need a daily or coarser resolution"}}`},
+		{"/normalized?resolution=M&start=2014-01-01&end=2014-03-01", router.normalizedHandler, http.StatusBadRequest,
+			`{"error":{"code":400,"reason":"Weather model needs more than 2 rows to fit"}}`},
+		{"/normalized?resolution=W&start=2015-01-26&end=2015-03-14", router.normalizedHandler, http.StatusOK,
+			`"model":{"baseload":10,"heating":2,"cooling":0,"observations":7,"r_squared":1,"cv_rmse":0}`},
+		{"/normalized?resolution=W&start=2015-01-26&end=2015-03-14", router.normalizedHandler, http.StatusOK,
+			`["2015-03-09",12,110,30,0,115]]`},
+		{"/normalized?resolution=M&source=derived&start=2015-01-01&end=2015-04-01", router.normalizedHandler, http.StatusOK,
+			`"model":{"baseload":10,"heating":2,"cooling":0,"observations":3,"r_squared":1,"cv_rmse":0}`},
+		{"/normalized?resolution=H&source=derived&start=2015-01-01&end=2015-04-01", router.normalizedHandler, http.StatusBadRequest,
+			`{"error": {"code": 400, "reason": "Bad Request"}}`},
+	} {
+
+		rr := send(t, validUser, "GET", tc.target, "", tc.handler)
+		if rr.Code != tc.code {
+			t.Fatalf("handler returned code: %d for %s, expected: %d", rr.Code, tc.target, tc.code)
+		}
+
+		byt, _ := ioutil.ReadAll(rr.Body)
+		if !strings.Contains(string(byt), tc.expected) {
+			t.Fatalf("Mismatch for %s between the expected: %s and actual: %s", tc.target, tc.expected, string(byt))
+		}
+	}
+}
+
+func TestForecast(t *testing.T) {
+
+	t.Parallel()
+
+	router := newTestRouter(t)
+
+	validUser := testUsers[1]
+
+	// NOTE: The four weeks from Monday 2014-06-02 consume 10 on weekdays
+	// and 14 on weekends plus 0.5 per heating degree day, the last week
+	// being at 13 degrees throughout.
+	var readings []string
+	day := time.Date(2014, 6, 2, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 28; i++ {
+
+		temperature := 10 + (i%4)*2
+		if i >= 21 {
+			temperature = 13
+		}
+
+		baseline := 10.0
+		if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+			baseline = 14
+		}
+
+		readings = append(readings, fmt.Sprintf(`{"resolution": "D", "timestamp": "%s", "temperature": %d, "consumption": %g}`,
+			day.Format("2006-01-02"), temperature, baseline+0.5*float64(18-temperature)))
+		day = day.AddDate(0, 0, 1)
+	}
+
+	if rr := send(t, validUser, "POST", "/data/batch", "["+strings.Join(readings, ",")+"]", router.postDataBatchHandler); rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+	}
+
+	for _, tc := range []struct {
+		query    string
+		code     int
+		expected string
+	}{
+		{"days=3", http.StatusOK, `{"start":"2014-06-30","days":3,"level":95,"base_temperature":18,` +
+			`"model":{"observations":28,"baseline":{"friday":10,"monday":10,"saturday":14,"sunday":14,"thursday":10,"tuesday":10,"wednesday":10},` +
+			`"heating":0.5,"cooling":0,"stddev":0},"columns":["timestamp","temperature","consumption","lower","upper"],` +
+			`"data":[["2014-06-30",13,12.5,12.5,12.5],["2014-07-01",13,12.5,12.5,12.5],["2014-07-02",13,12.5,12.5,12.5]],` +
+			`"total":{"consumption":37.5,"lower":37.5,"upper":37.5}}`},
+		{"days=2&backtest=true", http.StatusOK, `"data":[["2014-06-28",13,16.5,16.5,16.5,16.5],["2014-06-29",13,16.5,16.5,16.5,16.5]],` +
+			`"total":{"consumption":33,"lower":33,"upper":33,"actual":33},` +
+			`"backtest":{"observations":2,"mae":0,"rmse":0,"mape":0,"bias":0,"coverage":100}}`},
+		{"days=7&backtest=true", http.StatusOK,
+			`"backtest":{"observations":7,"mae":0.07,"rmse":0.07,"mape":0.52,"bias":-0.07,"coverage":0}}`},
+		{"days=3&level=50", http.StatusBadRequest, `{"error":{"code":400,"reason":"Level needs to be one of 80, 90, 95, 99"}}`},
+	} {
+
+		rr := send(t, validUser, "GET", "/forecast?"+tc.query, "", router.forecastHandler)
+		if rr.Code != tc.code {
+			t.Fatalf("handler returned code: %d for %s, expected: %d", rr.Code, tc.query, tc.code)
+		}
+
+		byt, _ := ioutil.ReadAll(rr.Body)
+		if !strings.Contains(string(byt), tc.expected) {
+			t.Fatalf("Mismatch for %s between the expected: %s and actual: %s", tc.query, tc.expected, string(byt))
+		}
+	}
+}
+
+func TestAnomalies(t *testing.T) {
+
+	t.Parallel()
+
+	router := newTestRouter(t)
+
+	validUser := testUsers[1]
+
+	// NOTE: Six weeks from Monday 2014-06-02 consume 10 on weekdays and
+	// 14 on weekends give or take a little, but for a spike on 2014-07-10.
+	var readings []string
+	day := time.Date(2014, 6, 2, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 42; i++ {
+
+		consumption := 10 + 0.1*float64(i%3)
+		if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+			consumption += 4
+		}
+		if day.Format("2006-01-02") == "2014-07-10" {
+			consumption = 40
+		}
+
+		readings = append(readings, fmt.Sprintf(`{"resolution": "D", "timestamp": "%s", "temperature": 18, "consumption": %g}`,
+			day.Format("2006-01-02"), consumption))
+		day = day.AddDate(0, 0, 1)
+	}
+
+	if rr := send(t, validUser, "POST", "/data/batch", "["+strings.Join(readings, ",")+"]", router.postDataBatchHandler); rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+	}
+
+	detect := func(query string) []usage.Anomaly {
+
+		rr := send(t, validUser, "GET", "/anomalies?start=2014-06-01&end=2014-07-14"+query, "", router.anomaliesHandler)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusOK)
+		}
+
+		var response struct {
+			Anomalies []usage.Anomaly `json:"anomalies"`
+		}
+
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatalf("Unable to decode the anomalies: %s", err.Error())
+		}
+
+		return response.Anomalies
+	}
+
+	anomalies := detect("")
+	if len(anomalies) != 1 || anomalies[0].Timestamp != "2014-07-10" || anomalies[0].Consumption.String() != "40" ||
+		anomalies[0].Score.Sign() <= 0 || anomalies[0].AcknowledgedAt != "" {
+		t.Fatalf("Unexpected anomalies: %+v", anomalies)
+	}
+
+	rr := send(t, validUser, "GET", "/data?resolution=D&start=2014-07-09&end=2014-07-12&anomalies=true", "", router.getDataHandler)
+	byt, _ := ioutil.ReadAll(rr.Body)
+
+	expected := `{"columns":["timestamp","temperature","consumption","anomaly"],` +
+		`"data":[["2014-07-09",18,10.1,false],["2014-07-10",18,40,true],["2014-07-11",18,10,false]],"has_more":false}`
+	if string(byt) != expected {
+		t.Fatalf("Mismatch between the expected: %s and actual: %s", expected, string(byt))
+	}
+
+	// Once acknowledged, the anomaly is only listed on request.
+	target := fmt.Sprintf("/anomalies/acknowledge?id=%d", anomalies[0].AnomalyId)
+	if rr := send(t, validUser, "POST", target, "", router.acknowledgeAnomalyHandler); rr.Code != http.StatusNoContent {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusNoContent)
+	}
+
+	if anomalies := detect(""); len(anomalies) != 0 {
+		t.Fatalf("Expected the acknowledged anomaly to be left out, got: %+v", anomalies)
+	}
+
+	if anomalies := detect("&acknowledged=true"); len(anomalies) != 1 || anomalies[0].AcknowledgedAt == "" {
+		t.Fatalf("Expected the acknowledged anomaly, got: %+v", anomalies)
+	}
+
+	rr = send(t, validUser, "GET", "/data?resolution=D&start=2014-07-09&end=2014-07-12&anomalies=true", "", router.getDataHandler)
+	byt, _ = ioutil.ReadAll(rr.Body)
+
+	expected = `{"columns":["timestamp","temperature","consumption","anomaly"],` +
+		`"data":[["2014-07-09",18,10.1,false],["2014-07-10",18,40,false],["2014-07-11",18,10,false]],"has_more":false}`
+	if string(byt) != expected {
+		t.Fatalf("Mismatch between the expected: %s and actual: %s", expected, string(byt))
+	}
+
+	if rr := send(t, validUser, "POST", "/anomalies/acknowledge?id=999", "", router.acknowledgeAnomalyHandler); rr.Code != http.StatusNotFound {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestGaps(t *testing.T) {
+
+	t.Parallel()
+
+	router := newTestRouter(t)
+
+	validUser := testUsers[1]
+
+	// NOTE: The readings of 2015-03-03 and 2015-03-04 are missing.
+	rr := send(t, validUser, "POST", "/data/batch", `[
+		{"resolution": "D", "timestamp": "2015-03-01", "temperature": 2, "consumption": 10},
+		{"resolution": "D", "timestamp": "2015-03-02", "temperature": 4, "consumption": 12},
+		{"resolution": "D", "timestamp": "2015-03-05", "temperature": 7, "consumption": 18}
+	]`, router.postDataBatchHandler)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned code: %d, expected: %d", rr.Code, http.StatusCreated)
+	}
+
+	gaps := `"gaps":[{"start":"2015-03-03","end":"2015-03-05","buckets":2},{"start":"2015-03-06","end":"2015-03-07","buckets":1}]`
+	columns := `{"columns":["timestamp","temperature","consumption","estimated"],`
+
+	for _, tc := range []struct {
+		query    string
+		code     int
+		expected string
+	}{
+		{"", http.StatusOK, `{"data":[["2015-03-01",2,10],["2015-03-02",4,12],["2015-03-05",7,18]],"has_more":false}`},
+		{"&gaps=true", http.StatusOK, `{"data":[["2015-03-01",2,10],["2015-03-02",4,12],["2015-03-05",7,18]],` + gaps + `,"has_more":false}`},
+		{"&fill=null", http.StatusOK, columns + `"data":[["2015-03-01",2,10,false],["2015-03-02",4,12,false],` +
+			`["2015-03-03",null,null,true],["2015-03-04",null,null,true],["2015-03-05",7,18,false],["2015-03-06",null,null,true]],` + gaps + `,"has_more":false}`},
+		{"&fill=zero", http.StatusOK, columns + `"data":[["2015-03-01",2,10,false],["2015-03-02",4,12,false],` +
+			`["2015-03-03",null,0,true],["2015-03-04",null,0,true],["2015-03-05",7,18,false],["2015-03-06",null,0,true]],` + gaps + `,"has_more":false}`},
+		{"&fill=linear", http.StatusOK, columns + `"data":[["2015-03-01",2,10,false],["2015-03-02",4,12,false],` +
+			`["2015-03-03",5,14,true],["2015-03-04",6,16,true],["2015-03-05",7,18,false],["2015-03-06",null,null,true]],` + gaps + `,"has_more":false}`},
+		{"&fill=previous&order=desc", http.StatusOK, columns + `"data":[["2015-03-06",7,18,true],["2015-03-05",7,18,false],` +
+			`["2015-03-04",4,12,true],["2015-03-03",4,12,true],["2015-03-02",4,12,false],["2015-03-01",2,10,false]],` + gaps + `,"has_more":false}`},
+		{"&fill=mean", http.StatusBadRequest, `{"error": {"code": 400, "reason": "Bad Request"}}`},
+	} {
+
+		rr := send(t, validUser, "GET", "/data?resolution=D&start=2015-03-01&end=2015-03-07"+tc.query, "", router.getDataHandler)
+		if rr.Code != tc.code {
+			t.Fatalf("handler returned code: %d for %s, expected: %d", rr.Code, tc.query, tc.code)
+		}
+
+		byt, _ := ioutil.ReadAll(rr.Body)
+		if string(byt) != tc.expected {
+			t.Fatalf("Mismatch for %s between the expected: %s and actual: %s", tc.query, tc.expected, string(byt))
+		}
+	}
+
+	// The gaps between the pages are reported on the page which follows.
+	rr = send(t, validUser, "GET", "/data?resolution=D&start=2015-03-01&end=2015-03-07&gaps=true&count=2", "", router.getDataHandler)
+
+	var first struct {
+		Gaps []usage.Gap `json:"gaps"`
+		Next string      `json:"next"`
+	}
+
+	if err := json.NewDecoder(rr.Body).Decode(&first); err != nil || len(first.Gaps) != 0 || first.Next == "" {
+		t.Fatalf("Unexpected first page: %+v", first)
+	}
+
+	rr = send(t, validUser, "GET", "/data?resolution=D&start=2015-03-01&end=2015-03-07&gaps=true&count=2&cursor="+first.Next, "", router.getDataHandler)
+	byt, _ := ioutil.ReadAll(rr.Body)
+
+	expected := `{"data":[["2015-03-05",7,18]],` + gaps + `,"has_more":false}`
+	if string(byt) != expected {
+		t.Fatalf("Mismatch between the expected: %s and actual: %s", expected, string(byt))
+	}
+
+	// The gaps reach from the start of the range, or from the first reading.
+	for _, tc := range []struct {
+		query    string
+		code     int
+		expected string
+	}{
+		{"resolution=D", http.StatusOK, `{"resolution":"D","gaps":[{"start":"2015-03-03","end":"2015-03-05","buckets":2}],"missing":2}`},
+		{"resolution=D&start=2015-02-27&end=2015-03-07", http.StatusOK, `{"resolution":"D","gaps":[` +
+			`{"start":"2015-02-27","end":"2015-03-01","buckets":2},{"start":"2015-03-03","end":"2015-03-05","buckets":2},` +
+			`{"start":"2015-03-06","end":"2015-03-07","buckets":1}],"missing":5}`},
+		{"resolution=H&start=2015-03-01&end=2015-03-02", http.StatusOK, `{"resolution":"H","gaps":[` +
+			`{"start":"2015-03-01 00:00","end":"2015-03-02 00:00","buckets":24}],"missing":24}`},
+		{"resolution=W", http.StatusBadRequest, `{"error":{"code":400,"reason":"Gaps are only found for the stored resolutions: W"}}`},
+	} {
+
+		rr := send(t, validUser, "GET", "/gaps?"+tc.query, "", router.gapsHandler)
+		if rr.Code != tc.code {
+			t.Fatalf("handler returned code: %d for %s, expected: %d", rr.Code, tc.query, tc.code)
+		}
+
+		byt, _ := ioutil.ReadAll(rr.Body)
+		if string(byt) != tc.expected {
+			t.Fatalf("Mismatch for %s between the expected: %s and actual: %s", tc.query, tc.expected, string(byt))
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/babbarshaer/usage-api/usage"
+)
+
+// runMigrate implements the `migrate` subcommand which moves the schema
+// of the database up or down and reports the applied migrations.
+func runMigrate(args []string) error {
+
+	config := usage.Config{}
+	var target int
+
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.StringVar(&config.Driver, "driver", "sqlite3", "storage driver, sqlite3 or postgres")
+	flags.StringVar(&config.DBLocation, "db", "./usage/resource/usage_prod.db", "location of the database, or the connection string")
+	flags.IntVar(&target, "to", -1, "target version (default: latest for up, one step back for down)")
+
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: usage-api migrate [flags] up|down|status")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("Expected exactly one of up, down or status")
+	}
+
+	storage, err := usage.OpenStorage(config)
+	if err != nil {
+		return err
+	}
+
+	defer storage.Close()
+
+	return migrate(storage, flags.Arg(0), target, os.Stdout)
+}
+
+// migrate runs the command against the storage, a negative target
+// selecting the default version of the command.
+func migrate(storage usage.UsageStorage, command string, target int, out io.Writer) error {
+
+	switch command {
+	case "up":
+
+		if target < 0 {
+			target = 0
+		}
+
+		if err := storage.MigrateUp(target); err != nil {
+			return err
+		}
+
+	case "down":
+
+		if target < 0 {
+
+			version, err := storage.SchemaVersion()
+			if err != nil {
+				return err
+			}
+
+			target = version - 1
+			if target < 0 {
+				target = 0
+			}
+		}
+
+		if err := storage.MigrateDown(target); err != nil {
+			return err
+		}
+
+	case "status":
+
+		statuses, err := storage.MigrationStatus()
+		if err != nil {
+			return err
+		}
+
+		for _, status := range statuses {
+
+			applied := "pending"
+			if status.AppliedAt != "" {
+				applied = "applied at " + status.AppliedAt
+			}
+
+			fmt.Fprintf(out, "%4d  %-40s %s\n", status.Version, status.Description, applied)
+		}
+
+	default:
+		return fmt.Errorf("Unknown migrate command: %s", command)
+	}
+
+	version, err := storage.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Schema version: %d, latest: %d\n", version, storage.LatestSchemaVersion())
+	return nil
+}
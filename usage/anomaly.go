@@ -0,0 +1,362 @@
+package usage
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// defaultSensitivity is the robust score past which a day is an
+	// anomaly unless another sensitivity is requested.
+	defaultSensitivity = "3.5"
+	// anomalyWindow is the number of days before a day its consumption
+	// is compared to.
+	anomalyWindow = 28
+	// minAnomalyWindow is the number of days with readings the window
+	// needs for a day to be scored.
+	minAnomalyWindow = 14
+	// anomalyHistory is the number of days before the range the term
+	// of the degree days and the effects of the weekdays are taken from.
+	anomalyHistory = 365
+)
+
+// AnomalyQuery describes the range of the daily readings, from Start up
+// to End as stored timestamps in UTC, to detect the anomalies in at the
+// Sensitivity, the robust score past which a day is an anomaly. The
+// acknowledged anomalies are only listed along when Acknowledged is
+// set. The meters, units and location are selected like in the DataQuery.
+type AnomalyQuery struct {
+	Start        string
+	End          string
+	Sensitivity  string
+	Acknowledged bool
+	Meter        int
+	Utility      string
+	Units        string
+	Location     *time.Location
+}
+
+// dayScore is the score of the consumption of a day against the one
+// expected from the window before it.
+type dayScore struct {
+	row      weatherRow
+	expected Decimal
+	score    Decimal
+	anomaly  bool
+}
+
+// GetAnomaliesForUser detects the anomalies in the daily consumption of
+// the user in the range and stores the ones found for the first time.
+// The anomalies acknowledged are left out unless requested.
+func (processor UsageProcessor) GetAnomaliesForUser(userId int, query AnomalyQuery) ([]Anomaly, error) {
+
+	fmt.Printf("Received request to detect the anomalies for the user: %d\n", userId)
+
+	if query.Start == "" || query.End == "" || query.End <= query.Start {
+		return nil, ValidationError{Reason: "Anomalies need a range with a start before its end"}
+	}
+
+	_, utility, err := processor.resolveMeters(userId, query.Meter, query.Utility)
+	if err != nil {
+		return nil, err
+	}
+
+	units, err := resolveUnits(query.Units, utility)
+	if err != nil {
+		return nil, err
+	}
+
+	dataQuery := DataQuery{Resolution: "D", Location: query.Location, Meter: query.Meter, Utility: query.Utility}
+	scores, err := processor.scoreDays(userId, dataQuery, parseStored(query.Start), parseStored(query.End), query.Sensitivity)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stage1: Store the anomalies, the ones stored before are kept.
+	detectedAt := FormatTimestamp(time.Now())
+
+	var detected []Anomaly
+	for _, s := range scores {
+
+		if !s.anomaly {
+			continue
+		}
+
+		detected = append(detected, Anomaly{
+			UserId:      userId,
+			Utility:     utility,
+			Meter:       query.Meter,
+			Timestamp:   FormatTimestamp(s.row.start),
+			Consumption: s.row.consumption,
+			Expected:    s.expected,
+			Score:       s.score,
+			DetectedAt:  detectedAt,
+		})
+	}
+
+	if len(detected) > 0 {
+		if err := processor.Storage.AddAnomalies(detected); err != nil {
+			return nil, fmt.Errorf("Unable to store the anomalies: %s", err.Error())
+		}
+	}
+
+	stored, err := processor.Storage.GetAnomalies(userId, utility, query.Meter, query.Start, query.End)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch the anomalies: %s", err.Error())
+	}
+
+	// Stage2: List the anomalies detected now, as scored now, along
+	// with when they were first detected and acknowledged.
+	known := make(map[string]Anomaly)
+	for _, a := range stored {
+		known[a.Timestamp] = a
+	}
+
+	anomalies := []Anomaly{}
+	for _, a := range detected {
+
+		previous, ok := known[a.Timestamp]
+		if !ok || (previous.AcknowledgedAt != "" && !query.Acknowledged) {
+			continue
+		}
+
+		a.AnomalyId, a.DetectedAt, a.AcknowledgedAt = previous.AnomalyId, previous.DetectedAt, previous.AcknowledgedAt
+		a.Timestamp = parseStored(a.Timestamp).In(dataQuery.location()).Format("2006-01-02")
+		a.Consumption = fromBase(a.Consumption, units.Consumption)
+		a.Expected = fromBase(a.Expected, units.Consumption)
+
+		anomalies = append(anomalies, a)
+	}
+
+	return anomalies, nil
+}
+
+// AcknowledgeAnomalyForUser acknowledges the anomaly, so that it is not
+// raised again.
+func (processor UsageProcessor) AcknowledgeAnomalyForUser(userId int, anomalyId int) error {
+
+	fmt.Printf("Received request to acknowledge the anomaly: %d for the user: %d\n", anomalyId, userId)
+	return processor.Storage.AcknowledgeAnomaly(userId, anomalyId, FormatTimestamp(time.Now()))
+}
+
+// addAnomalyColumn flags the rows of the page of daily readings whose
+// consumption is an anomaly at the sensitivity of the query, unless
+// the user has acknowledged the anomaly.
+func (processor UsageProcessor) addAnomalyColumn(userId int, query DataQuery, utility string, page *DataPage) error {
+
+	if query.Resolution != "D" || query.Derived {
+		return ValidationError{Reason: "Anomalies need the stored daily resolution"}
+	}
+
+	if page.Columns == nil {
+		page.Columns = []string{"timestamp", "temperature", "consumption"}
+	}
+
+	page.Columns = append(page.Columns, "anomaly")
+	if len(page.times) == 0 {
+		return nil
+	}
+
+	start, end := page.times[0], page.times[len(page.times)-1]
+	if end.Before(start) {
+		start, end = end, start
+	}
+
+	scores, err := processor.scoreDays(userId, query, start, end.AddDate(0, 0, 1), query.Sensitivity)
+	if err != nil {
+		return err
+	}
+
+	anomalies := make(map[int64]bool)
+	for _, s := range scores {
+		anomalies[s.row.start.Unix()] = s.anomaly
+	}
+
+	stored, err := processor.Storage.GetAnomalies(userId, utility, query.Meter,
+		FormatTimestamp(start), FormatTimestamp(end.AddDate(0, 0, 1)))
+	if err != nil {
+		return fmt.Errorf("Unable to fetch the anomalies: %s", err.Error())
+	}
+
+	for _, a := range stored {
+		if a.AcknowledgedAt != "" {
+			anomalies[parseStored(a.Timestamp).Unix()] = false
+		}
+	}
+
+	for i := range page.Data {
+		page.Data[i] = append(page.Data[i], anomalies[page.times[i].Unix()])
+	}
+
+	return nil
+}
+
+// scoreDays scores the daily consumption from start up to end. The
+// consumption of the year before the range and the range itself is
+// decomposed into a term of the degree days, fitted by least squares,
+// an effect of the day of the week, the median of its days less the
+// overall median, and the remainder. The robust score of a day is the
+// deviation of its remainder from the median of the window before it,
+// in units of the scaled median absolute deviation of the window. The
+// scale is at least a hundredth of the mean consumption of the window,
+// so that a flat series does not turn every small change into an
+// anomaly.
+func (processor UsageProcessor) scoreDays(
+	userId int,
+	query DataQuery,
+	start time.Time,
+	end time.Time,
+	sensitivity string) ([]dayScore, error) {
+
+	if sensitivity == "" {
+		sensitivity = defaultSensitivity
+	}
+
+	threshold, err := ParseDecimal(sensitivity)
+	if err != nil || threshold.Sign() <= 0 {
+		return nil, ValidationError{Reason: fmt.Sprintf("Sensitivity needs to be a positive number: %s", sensitivity)}
+	}
+
+	query.Resolution, query.Derived = "D", false
+	query.DegreeDays, query.Normalized, query.Cost, query.Anomalies = false, false, false, false
+	query.Descending, query.After, query.Units = false, nil, ""
+
+	rows, err := processor.dailyRows(userId, query, start.AddDate(0, 0, -anomalyHistory), end,
+		NewDecimal(defaultBaseTemperature))
+	if err != nil {
+		return nil, err
+	}
+
+	// Stage1: Take the weather and the day of the week out.
+	heating, cooling := fitDegreeDays(rows)
+
+	adjusted := make([]float64, len(rows))
+	byWeekday := make(map[time.Weekday][]float64)
+	for i, row := range rows {
+		adjusted[i] = row.consumption.Float64() - heating*row.hdd.Float64() - cooling*row.cdd.Float64()
+		byWeekday[row.start.Weekday()] = append(byWeekday[row.start.Weekday()], adjusted[i])
+	}
+
+	effects := make(map[time.Weekday]float64)
+	if len(rows) > 0 {
+		overall := median(adjusted)
+		for weekday, values := range byWeekday {
+			effects[weekday] = median(values) - overall
+		}
+	}
+
+	residuals := make([]float64, len(rows))
+	for i, row := range rows {
+		residuals[i] = adjusted[i] - effects[row.start.Weekday()]
+	}
+
+	// Stage2: Score the days of the range against their window.
+	var scores []dayScore
+	first := 0
+
+	for i, row := range rows {
+
+		if row.start.Before(start) {
+			continue
+		}
+
+		for first < i && rows[first].start.Before(row.start.AddDate(0, 0, -anomalyWindow)) {
+			first++
+		}
+
+		window := residuals[first:i]
+		if len(window) < minAnomalyWindow {
+			continue
+		}
+
+		var mean float64
+		for j := first; j < i; j++ {
+			mean += math.Abs(rows[j].consumption.Float64())
+		}
+		mean /= float64(len(window))
+
+		center := median(window)
+		deviations := make([]float64, len(window))
+		for j, r := range window {
+			deviations[j] = math.Abs(r - center)
+		}
+
+		scale := math.Max(1.4826*median(deviations), mean/100)
+		if scale == 0 {
+			continue
+		}
+
+		deviation := residuals[i] - center
+		score := decimalFromFloat(deviation / scale).Round(2)
+
+		scores = append(scores, dayScore{
+			row:      row,
+			expected: row.consumption.Sub(decimalFromFloat(deviation)),
+			score:    score,
+			anomaly:  math.Abs(score.Float64()) > threshold.Float64(),
+		})
+	}
+
+	return scores, nil
+}
+
+// fitDegreeDays fits the consumption of the days to a constant and their
+// degree days by least squares, returning the consumption per heating
+// and cooling degree day. The degree days which are zero throughout, or
+// which do not vary enough, are taken to consume nothing.
+func fitDegreeDays(rows []weatherRow) (float64, float64) {
+
+	var heating, cooling bool
+	for _, row := range rows {
+		heating = heating || row.hdd.Sign() != 0
+		cooling = cooling || row.cdd.Sign() != 0
+	}
+
+	regressors := func(row weatherRow) []float64 {
+
+		x := []float64{1}
+		if heating {
+			x = append(x, row.hdd.Float64())
+		}
+		if cooling {
+			x = append(x, row.cdd.Float64())
+		}
+		return x
+	}
+
+	p := len(regressors(weatherRow{}))
+	if p == 1 || len(rows) <= p {
+		return 0, 0
+	}
+
+	beta, ok := leastSquares(rows, regressors)
+	if !ok {
+		return 0, 0
+	}
+
+	var h, c float64
+	if heating {
+		h = beta[1]
+	}
+	if cooling {
+		c = beta[len(beta)-1]
+	}
+
+	return h, c
+}
+
+// median is the median of the values, which it leaves as they are.
+func median(values []float64) float64 {
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
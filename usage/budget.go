@@ -0,0 +1,238 @@
+package usage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// periodNames are the periods a budget can limit.
+var periodNames = map[string]bool{"D": true, "M": true}
+
+// AddBudgetForUser validates and stores a budget of the user. The
+// periods of the budget follow the wall clock of the location.
+func (processor UsageProcessor) AddBudgetForUser(userId int, budget Budget, loc *time.Location) (Budget, error) {
+
+	fmt.Printf("Received request to add a budget for the user: %d\n", userId)
+
+	budget.UserId = userId
+	budget.Name = strings.TrimSpace(budget.Name)
+	budget.TimeZone = loc.String()
+
+	if budget.Metric == "" {
+		budget.Metric = MetricConsumption
+	}
+
+	if budget.Metric != MetricConsumption && budget.Metric != MetricCost {
+		return Budget{}, ValidationError{Reason: fmt.Sprintf("Metric needs to be one of %s, %s", MetricConsumption, MetricCost)}
+	}
+
+	if !periodNames[budget.Period] {
+		return Budget{}, ValidationError{Reason: "Period needs to be one of D, M"}
+	}
+
+	if budget.Limit.Sign() <= 0 {
+		return Budget{}, ValidationError{Reason: "Limit needs to be positive"}
+	}
+
+	_, utility, err := processor.resolveMeters(userId, budget.Meter, budget.Utility)
+	if err != nil {
+		return Budget{}, err
+	}
+
+	budget.Utility = utility
+
+	if budget.BudgetId, err = processor.Storage.AddBudget(budget); err != nil {
+		return Budget{}, fmt.Errorf("Unable to store the budget: %s", err.Error())
+	}
+
+	return budget, nil
+}
+
+// GetBudgetsForUser lists the budgets of the user.
+func (processor UsageProcessor) GetBudgetsForUser(userId int) ([]Budget, error) {
+	return processor.Storage.GetBudgets(userId)
+}
+
+// DeleteBudgetForUser deletes the budget along with the alerts it raised.
+func (processor UsageProcessor) DeleteBudgetForUser(userId int, budgetId int) error {
+
+	fmt.Printf("Received request to delete the budget: %d for the user: %d\n", budgetId, userId)
+	return processor.Storage.DeleteBudget(userId, budgetId)
+}
+
+// GetAlertsForUser lists the alerts raised for the budgets of the user,
+// the latest first.
+func (processor UsageProcessor) GetAlertsForUser(userId int) ([]Alert, error) {
+	return processor.Storage.GetAlerts(userId)
+}
+
+// budgetPeriod is a period of a budget touched by the readings of the
+// resolution.
+type budgetPeriod struct {
+	resolution string
+	start      time.Time
+}
+
+// checkBudgets raises the alerts for the budgets of the user over the
+// periods the readings, as stored, fall into.
+func (processor UsageProcessor) checkBudgets(userId int, readings []Reading) error {
+
+	budgets, err := processor.Storage.GetBudgets(userId)
+	if err != nil {
+		return fmt.Errorf("Unable to fetch the budgets: %s", err.Error())
+	}
+
+	for _, budget := range budgets {
+
+		utility := budget.Utility
+		if budget.Meter != 0 {
+			utility = ""
+		}
+
+		meters, utility, err := processor.resolveMeters(userId, budget.Meter, utility)
+		if err != nil {
+			return err
+		}
+
+		loc, err := time.LoadLocation(budget.TimeZone)
+		if err != nil {
+			loc = time.UTC
+		}
+
+		for _, period := range budgetPeriods(budget, readings, meters, loc) {
+			if err := processor.checkBudget(budget, period, meters, utility, loc); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// budgetPeriods lists the periods of the budget the readings of its
+// meters fall into. Readings coarser than the period are left out, as
+// monthly readings cannot tell the consumption of a day.
+func budgetPeriods(budget Budget, readings []Reading, meters []int, loc *time.Location) []budgetPeriod {
+
+	selected := make(map[int]bool)
+	for _, meter := range meters {
+		selected[meter] = true
+	}
+
+	seen := make(map[budgetPeriod]bool)
+	var periods []budgetPeriod
+
+	for _, reading := range readings {
+
+		resolution := resolutions[reading.Resolution]
+		if !selected[reading.Meter] || (budget.Period == "D" && (resolution.Step == 0 || resolution.Step > 24*time.Hour)) {
+			continue
+		}
+
+		period := budgetPeriod{reading.Resolution, periodStart(budget.Period, parseStored(reading.Timestamp), loc)}
+		if !seen[period] {
+			seen[period] = true
+			periods = append(periods, period)
+		}
+	}
+
+	sort.Slice(periods, func(i, j int) bool {
+		return periods[i].start.Before(periods[j].start)
+	})
+
+	return periods
+}
+
+// periodStart is the start of the day or month containing the instant.
+func periodStart(period string, t time.Time, loc *time.Location) time.Time {
+
+	t = t.In(loc)
+	if period == "M" {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+	}
+
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// checkBudget sums the consumption or cost of the period so far and
+// projects it to the end of the period at the pace of the readings,
+// raising the alerts when the limit is exceeded or on track to be.
+func (processor UsageProcessor) checkBudget(
+	budget Budget,
+	period budgetPeriod,
+	meters []int,
+	utility string,
+	loc *time.Location) error {
+
+	end := period.start.AddDate(0, 0, 1)
+	if budget.Period == "M" {
+		end = period.start.AddDate(0, 1, 0)
+	}
+
+	whole := func(time.Time) (time.Time, time.Time) {
+		return period.start, end
+	}
+
+	buckets, _, err := processor.costBuckets(budget.UserId, resolutions[period.resolution], whole,
+		period.start, end, meters, utility, loc, "")
+	if err != nil {
+		return err
+	}
+
+	if len(buckets) == 0 {
+		return nil
+	}
+
+	// NOTE: The period counts as covered up to the end of the latest
+	// reading, so that the readings sent late are projected alike. The
+	// standing charge is due for the whole period regardless of the pace.
+	b := buckets[0]
+	length := int64(end.Sub(period.start))
+	covered := int64(earliest(b.covered, end).Sub(period.start))
+
+	value := b.consumption
+	projected := b.consumption.mulDiv(length, covered)
+
+	if budget.Metric == MetricCost {
+		value = b.energy.Add(b.standing.mulDiv(covered, length))
+		projected = b.energy.mulDiv(length, covered).Add(b.standing)
+	}
+
+	alert := Alert{
+		UserId:      budget.UserId,
+		BudgetId:    budget.BudgetId,
+		Period:      period.start.Format("2006-01-02"),
+		Value:       value,
+		Projected:   projected,
+		Limit:       budget.Limit,
+		TriggeredAt: FormatTimestamp(time.Now()),
+	}
+
+	switch {
+	case value.millionths > budget.Limit.millionths:
+		alert.Kind = AlertExceeded
+	case projected.millionths > budget.Limit.millionths:
+		alert.Kind = AlertProjected
+	default:
+		return nil
+	}
+
+	added, err := processor.Storage.AddAlert(alert)
+	if err != nil {
+		return fmt.Errorf("Unable to store the alert: %s", err.Error())
+	}
+
+	if !added {
+		return nil
+	}
+
+	fmt.Printf("Raised the %s alert of the budget: %d for the period: %s\n", alert.Kind, budget.BudgetId, alert.Period)
+
+	if alert.Kind == AlertExceeded {
+		return processor.publish(budget.UserId, EventBudgetExceeded, map[string]interface{}{"budget": budget, "alert": alert})
+	}
+
+	return nil
+}
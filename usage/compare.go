@@ -0,0 +1,336 @@
+package usage
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// CompareQuery describes the range from Start up to End compared, at
+// the resolution which may be one of the rollups, to the range from
+// CompareStart up to CompareEnd or, when these are empty, to the range
+// moved by the Offset, e.g. "-1y". The timestamps are stored ones in
+// UTC, the source, meters, units and location are selected like in the
+// DataQuery.
+type CompareQuery struct {
+	Resolution   string
+	Derived      bool
+	Start        string
+	End          string
+	CompareStart string
+	CompareEnd   string
+	Offset       string
+	Meter        int
+	Utility      string
+	Units        string
+	Location     *time.Location
+}
+
+// CompareRange is a range of a comparison, as presented at the resolution.
+type CompareRange struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// CompareTotal sums the consumption and averages the temperature of
+// both ranges over the buckets which have data in both of them.
+type CompareTotal struct {
+	Buckets            int      `json:"buckets"`
+	Consumption        Decimal  `json:"consumption"`
+	CompareConsumption Decimal  `json:"compare_consumption"`
+	ConsumptionDelta   Decimal  `json:"consumption_delta"`
+	ConsumptionChange  *Decimal `json:"consumption_change"`
+	Temperature        Decimal  `json:"temperature"`
+	CompareTemperature Decimal  `json:"compare_temperature"`
+	TemperatureDelta   Decimal  `json:"temperature_delta"`
+	TemperatureChange  *Decimal `json:"temperature_change"`
+}
+
+// Comparison lines up the buckets of the ranges by their position in
+// the range, the n-th bucket of one against the n-th of the other.
+type Comparison struct {
+	Resolution string          `json:"resolution"`
+	Units      *Units          `json:"units,omitempty"`
+	Range      CompareRange    `json:"range"`
+	Compare    CompareRange    `json:"compare"`
+	Columns    []string        `json:"columns"`
+	Data       [][]interface{} `json:"data"`
+	Total      CompareTotal    `json:"total"`
+}
+
+// compareColumns name the values of the rows of a Comparison.
+var compareColumns = []string{
+	"timestamp", "compare_timestamp",
+	"consumption", "compare_consumption", "consumption_delta", "consumption_change",
+	"temperature", "compare_temperature", "temperature_delta", "temperature_change",
+}
+
+// offsetPattern matches offsets like "-1y", "-3m", "+52w" or "-7d".
+var offsetPattern = regexp.MustCompile(`^([+-]?)(\d{1,4})([ymwd])$`)
+
+// compareValues are the consumption and temperature of a bucket.
+type compareValues struct {
+	consumption Decimal
+	temperature Decimal
+}
+
+// GetComparisonForUser compares the data of the user in the range to the
+// one in the other range. Buckets without data in a range, or beyond
+// the end of the shorter range, have null values and deltas.
+func (processor UsageProcessor) GetComparisonForUser(userId int, query CompareQuery) (Comparison, error) {
+
+	fmt.Printf("Received request to compare the data for the user: %d\n", userId)
+
+	_, stored := resolutions[query.Resolution]
+	if !stored && !IsRollup(query.Resolution) {
+		return Comparison{}, ValidationError{Reason: fmt.Sprintf("Unknown resolution: %s", query.Resolution)}
+	}
+
+	if query.Derived && !IsRollup(query.Resolution) {
+		return Comparison{}, ValidationError{Reason: fmt.Sprintf("Resolution cannot be derived: %s", query.Resolution)}
+	}
+
+	stored = stored && !query.Derived
+
+	if query.Start == "" || query.End == "" || query.End <= query.Start {
+		return Comparison{}, ValidationError{Reason: "Comparison needs a range with a start before its end"}
+	}
+
+	loc := query.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	start, end := parseStored(query.Start).In(loc), parseStored(query.End).In(loc)
+
+	var compareStart, compareEnd time.Time
+
+	switch {
+	case query.Offset != "" && (query.CompareStart != "" || query.CompareEnd != ""):
+		return Comparison{}, ValidationError{Reason: "Comparison needs either an offset or a range to compare to, not both"}
+
+	case query.Offset != "":
+		shift, err := parseOffset(query.Offset)
+		if err != nil {
+			return Comparison{}, err
+		}
+		compareStart, compareEnd = shift(start), shift(end)
+
+	case query.CompareStart != "" && query.CompareEnd > query.CompareStart:
+		compareStart, compareEnd = parseStored(query.CompareStart).In(loc), parseStored(query.CompareEnd).In(loc)
+
+	default:
+		return Comparison{}, ValidationError{Reason: "Comparison needs an offset or a range to compare to with a start before its end"}
+	}
+
+	dataQuery := DataQuery{
+		Resolution: query.Resolution,
+		Derived:    !stored,
+		Location:   loc,
+		Meter:      query.Meter,
+		Utility:    query.Utility,
+		Units:      query.Units,
+	}
+
+	// Stage1: Bucket both ranges and fetch the data of each.
+	current, currentValues, units, err := processor.compareRange(userId, dataQuery, start, end, stored)
+	if err != nil {
+		return Comparison{}, err
+	}
+
+	previous, previousValues, _, err := processor.compareRange(userId, dataQuery, compareStart, compareEnd, stored)
+	if err != nil {
+		return Comparison{}, err
+	}
+
+	format := "2006-01-02"
+	if stored {
+		format = resolutions[query.Resolution].Format
+	}
+
+	comparison := Comparison{
+		Resolution: query.Resolution,
+		Units:      units,
+		Range:      CompareRange{start.Format(format), end.Format(format)},
+		Compare:    CompareRange{compareStart.Format(format), compareEnd.Format(format)},
+		Columns:    compareColumns,
+	}
+
+	// Stage2: Line up the buckets by their position in the ranges.
+	var temperature, compareTemperature Decimal
+
+	for i := 0; i < len(current) || i < len(previous); i++ {
+
+		row := make([]interface{}, len(compareColumns))
+
+		a, aok := bucketValues(current, currentValues, i)
+		b, bok := bucketValues(previous, previousValues, i)
+
+		if i < len(current) {
+			row[0] = current[i].Format(format)
+		}
+
+		if i < len(previous) {
+			row[1] = previous[i].Format(format)
+		}
+
+		if aok {
+			row[2], row[6] = a.consumption, a.temperature
+		}
+
+		if bok {
+			row[3], row[7] = b.consumption, b.temperature
+		}
+
+		if aok && bok {
+
+			row[4], row[5] = a.consumption.Sub(b.consumption), change(a.consumption, b.consumption)
+			row[8], row[9] = a.temperature.Sub(b.temperature), change(a.temperature, b.temperature)
+
+			comparison.Total.Buckets++
+			comparison.Total.Consumption = comparison.Total.Consumption.Add(a.consumption)
+			comparison.Total.CompareConsumption = comparison.Total.CompareConsumption.Add(b.consumption)
+			temperature = temperature.Add(a.temperature)
+			compareTemperature = compareTemperature.Add(b.temperature)
+		}
+
+		comparison.Data = append(comparison.Data, row)
+	}
+
+	// Stage3: Total the buckets with data in both of the ranges.
+	total := &comparison.Total
+	total.ConsumptionDelta = total.Consumption.Sub(total.CompareConsumption)
+	total.ConsumptionChange = change(total.Consumption, total.CompareConsumption)
+
+	if total.Buckets > 0 {
+
+		total.Temperature = temperature.quo(int64(total.Buckets), 2)
+		total.CompareTemperature = compareTemperature.quo(int64(total.Buckets), 2)
+		total.TemperatureDelta = total.Temperature.Sub(total.CompareTemperature)
+		total.TemperatureChange = change(total.Temperature, total.CompareTemperature)
+	}
+
+	return comparison, nil
+}
+
+// compareRange lists the starts of the buckets of the range and fetches
+// the values of the ones which have data, keyed by their start.
+func (processor UsageProcessor) compareRange(
+	userId int,
+	query DataQuery,
+	start time.Time,
+	end time.Time,
+	stored bool) ([]time.Time, map[int64]compareValues, *Units, error) {
+
+	starts, err := bucketStarts(query.Resolution, stored, start, end)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	query.Start = FormatTimestamp(start)
+	query.End = FormatTimestamp(end)
+	query.Count = MaxPageSize
+
+	values := make(map[int64]compareValues)
+
+	for {
+
+		page, err := processor.GetDataForUser(userId, query)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		for i, row := range page.Data {
+			values[page.times[i].Unix()] = compareValues{consumption: row[2].(Decimal), temperature: row[1].(Decimal)}
+		}
+
+		if !page.HasMore {
+			return starts, values, page.Units, nil
+		}
+
+		query.After = page.Next
+	}
+}
+
+// bucketStarts lists the starts of the buckets of the resolution in the
+// range, in the location of the range, as stepped by bucketSteps.
+func bucketStarts(name string, stored bool, start time.Time, end time.Time) ([]time.Time, error) {
+
+	first, next := bucketSteps(name, !stored, start.Location())
+
+	var starts []time.Time
+	for t := first(start); t.Before(end); t = next(t) {
+
+		if len(starts) == MaxPageSize {
+			return nil, ValidationError{Reason: fmt.Sprintf("Range exceeds %d buckets", MaxPageSize)}
+		}
+
+		starts = append(starts, t)
+	}
+
+	return starts, nil
+}
+
+// bucketValues looks up the values of the i-th bucket, if it has data.
+func bucketValues(starts []time.Time, values map[int64]compareValues, i int) (compareValues, bool) {
+
+	if i >= len(starts) {
+		return compareValues{}, false
+	}
+
+	v, ok := values[starts[i].Unix()]
+	return v, ok
+}
+
+// change is the change from the previous value to the value in percent
+// of the magnitude of the previous one, rounded to two decimals. Nil
+// when the previous value is zero.
+func change(value Decimal, previous Decimal) *Decimal {
+
+	magnitude := previous.millionths
+	if magnitude < 0 {
+		magnitude = -magnitude
+	}
+
+	if magnitude == 0 {
+		return nil
+	}
+
+	percent := value.Sub(previous).mulDiv(100*decimalScale, magnitude).Round(2)
+	return &percent
+}
+
+// parseOffset reads an offset like "-1y", "-3m", "-52w" or "-7d" into
+// the function moving an instant by it on the wall clock. Moving by
+// months normalizes like time.AddDate, e.g. March 31 less a month is
+// March 3.
+func parseOffset(offset string) (func(time.Time) time.Time, error) {
+
+	match := offsetPattern.FindStringSubmatch(offset)
+	if match == nil {
+		return nil, ValidationError{Reason: fmt.Sprintf("Offset needs to be like -1y, -3m, -52w or -7d: %s", offset)}
+	}
+
+	count, _ := strconv.Atoi(match[2])
+	if match[1] == "-" {
+		count = -count
+	}
+
+	if count == 0 {
+		return nil, ValidationError{Reason: fmt.Sprintf("Offset cannot be zero: %s", offset)}
+	}
+
+	return func(t time.Time) time.Time {
+		switch match[3] {
+		case "y":
+			return t.AddDate(count, 0, 0)
+		case "m":
+			return t.AddDate(0, count, 0)
+		case "w":
+			return t.AddDate(0, 0, 7*count)
+		default:
+			return t.AddDate(0, 0, count)
+		}
+	}, nil
+}
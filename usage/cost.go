@@ -0,0 +1,625 @@
+package usage
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// CostQuery describes the range of the consumption to price, from
+// Start up to End as stored timestamps in UTC, at the resolution,
+// which may be one of the rollups. The consumption is summed over the
+// meters selected like in the DataQuery and bucketed in the Location,
+// Derived picking the monthly rollup over the stored months alike.
+type CostQuery struct {
+	Resolution string
+	Derived    bool
+	Start      string
+	End        string
+	Meter      int
+	Utility    string
+	Location   *time.Location
+
+	meters []int
+}
+
+// CostPage holds the priced buckets of the range along with their totals.
+type CostPage struct {
+	Currency string          `json:"currency"`
+	Columns  []string        `json:"columns"`
+	Data     [][]interface{} `json:"data"`
+	Total    CostTotal       `json:"total"`
+}
+
+// CostTotal sums the consumption and costs of the buckets.
+type CostTotal struct {
+	Consumption    Decimal `json:"consumption"`
+	Energy         Decimal `json:"energy"`
+	StandingCharge Decimal `json:"standing_charge"`
+	Cost           Decimal `json:"cost"`
+}
+
+// costColumns name the values of the rows of a CostPage.
+var costColumns = []string{"timestamp", "consumption", "energy", "standing_charge", "cost"}
+
+// costBucket is a bucket of the consumption along with its price.
+type costBucket struct {
+	start       time.Time
+	end         time.Time
+	consumption Decimal
+	energy      Decimal
+	standing    Decimal
+	// covered is the end of the latest reading in the bucket.
+	covered time.Time
+}
+
+func (b costBucket) cost() Decimal {
+	return b.energy.Add(b.standing)
+}
+
+// GetCostForUser prices the consumption of the user in the range by the
+// tariffs of the utility. Buckets without readings are left out.
+func (processor UsageProcessor) GetCostForUser(userId int, query CostQuery) (CostPage, error) {
+
+	fmt.Printf("Received request to fetch the cost for the user: %d\n", userId)
+
+	_, stored := resolutions[query.Resolution]
+	if !stored && !IsRollup(query.Resolution) {
+		return CostPage{}, ValidationError{Reason: fmt.Sprintf("Unknown resolution: %s", query.Resolution)}
+	}
+
+	if query.Derived && !IsRollup(query.Resolution) {
+		return CostPage{}, ValidationError{Reason: fmt.Sprintf("Resolution cannot be derived: %s", query.Resolution)}
+	}
+
+	stored = stored && !query.Derived
+
+	if query.Start == "" || query.End == "" || query.End <= query.Start {
+		return CostPage{}, ValidationError{Reason: "Cost needs a range with a start before its end"}
+	}
+
+	meters, utility, err := processor.resolveMeters(userId, query.Meter, query.Utility)
+	if err != nil {
+		return CostPage{}, err
+	}
+
+	loc := query.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	base, bucketOf := costBucketing(query.Resolution, !stored)
+	buckets, currency, err := processor.costBuckets(userId, base, bucketOf,
+		parseStored(query.Start), parseStored(query.End), meters, utility, loc, "")
+	if err != nil {
+		return CostPage{}, err
+	}
+
+	format := "2006-01-02"
+	if stored {
+		format = resolutions[query.Resolution].Format
+	}
+
+	page := CostPage{Currency: currency, Columns: costColumns}
+	for _, b := range buckets {
+
+		page.Data = append(page.Data, []interface{}{
+			b.start.In(loc).Format(format),
+			b.consumption,
+			b.energy,
+			b.standing,
+			b.cost(),
+		})
+
+		page.Total.Consumption = page.Total.Consumption.Add(b.consumption)
+		page.Total.Energy = page.Total.Energy.Add(b.energy)
+		page.Total.StandingCharge = page.Total.StandingCharge.Add(b.standing)
+		page.Total.Cost = page.Total.Cost.Add(b.cost())
+	}
+
+	return page, nil
+}
+
+// addCostColumn prices the rows of the page of data and appends the
+// cost as the last column of each of them.
+func (processor UsageProcessor) addCostColumn(
+	userId int,
+	query DataQuery,
+	utility string,
+	page *DataPage) error {
+
+	if page.Columns == nil {
+		page.Columns = []string{"timestamp", "temperature", "consumption"}
+	}
+
+	page.Columns = append(page.Columns, "cost")
+	if len(page.times) == 0 {
+		return nil
+	}
+
+	start, end := page.times[0], page.times[len(page.times)-1]
+	if end.Before(start) {
+		start, end = end, start
+	}
+
+	// NOTE: The range ends behind the bucket of the last row.
+	loc := query.location()
+	if query.Derived {
+		_, end = rollups[query.Resolution].bucket(end.In(loc))
+	} else {
+		end = readingEnd(resolutions[query.Resolution], end, loc)
+	}
+
+	base, bucketOf := costBucketing(query.Resolution, query.Derived)
+	buckets, _, err := processor.costBuckets(userId, base, bucketOf, start, end, query.meters, utility, loc, query.AsOf)
+	if err != nil {
+		return err
+	}
+
+	costs := make(map[int64]Decimal)
+	for _, b := range buckets {
+		costs[b.start.Unix()] = b.cost()
+	}
+
+	for i := range page.Data {
+		page.Data[i] = append(page.Data[i], costs[page.times[i].Unix()])
+	}
+
+	return nil
+}
+
+// costBucketing returns the resolution of the readings priced for the
+// resolution along with the buckets of the rollup, nil for a bucket per
+// reading of the stored resolution.
+func costBucketing(name string, derived bool) (Resolution, func(time.Time) (time.Time, time.Time)) {
+
+	if derived {
+		return resolutions[rollups[name].base], rollups[name].bucket
+	}
+
+	return resolutions[name], nil
+}
+
+// costBuckets prices the readings of the base resolution of the user
+// from start up to end in the buckets, which the bucketOf maps the
+// instants to in the location, one per reading when nil. The readings
+// since the start of the month are priced along, as the tiers count
+// the consumption of the month.
+func (processor UsageProcessor) costBuckets(
+	userId int,
+	base Resolution,
+	bucketOf func(time.Time) (time.Time, time.Time),
+	start time.Time,
+	end time.Time,
+	meters []int,
+	utility string,
+	loc *time.Location,
+	asOf string) ([]costBucket, string, error) {
+
+	tariffs, err := processor.Storage.GetTariffs(userId, utility)
+	if err != nil {
+		return nil, "", fmt.Errorf("Unable to fetch the tariffs: %s", err.Error())
+	}
+
+	currency := ""
+	if len(tariffs) > 0 {
+		currency = tariffs[0].Currency
+	}
+
+	p := newPricing(tariffs, loc)
+
+	query := DataQuery{
+		Resolution: base.Name,
+		Start:      FormatTimestamp(monthStart(start, loc)),
+		End:        FormatTimestamp(end),
+		Count:      MaxPageSize,
+		Location:   loc,
+		AsOf:       asOf,
+		meters:     meters,
+	}
+
+	var buckets []costBucket
+
+	for {
+
+		page, err := processor.Storage.GetUserData(userId, base, query)
+		if err != nil {
+			return nil, "", fmt.Errorf("Unable to fetch the %s data: %s", base.Name, err.Error())
+		}
+
+		for i, row := range page.Data {
+
+			t := page.times[i]
+			consumption := row[2].(Decimal)
+			readEnd := readingEnd(base, t, loc)
+			energy := p.energy(t, readEnd, consumption)
+
+			if t.Before(start) {
+				continue
+			}
+
+			bucketStart, bucketEnd := t, readEnd
+			if bucketOf != nil {
+				bucketStart, bucketEnd = bucketOf(t.In(loc))
+			}
+
+			if len(buckets) == 0 || !buckets[len(buckets)-1].start.Equal(bucketStart) {
+
+				if len(buckets) == MaxPageSize {
+					return nil, "", ValidationError{Reason: fmt.Sprintf("Range exceeds %d buckets", MaxPageSize)}
+				}
+
+				buckets = append(buckets, costBucket{start: bucketStart, end: bucketEnd})
+			}
+
+			b := &buckets[len(buckets)-1]
+			b.consumption = b.consumption.Add(consumption)
+			b.energy = b.energy.Add(energy)
+			b.covered = latest(b.covered, readEnd)
+		}
+
+		if !page.HasMore {
+			break
+		}
+
+		query.After = page.Next
+	}
+
+	// NOTE: The standing charges of the buckets at the edges are only
+	// due for the part of them which falls into the range.
+	for i := range buckets {
+		buckets[i].standing = p.standing(latest(buckets[i].start, start), earliest(buckets[i].end, end))
+	}
+
+	return buckets, currency, nil
+}
+
+// readingEnd is the end of the period covered by the reading of the
+// resolution starting at the instant, in the location of the user.
+func readingEnd(resolution Resolution, t time.Time, loc *time.Location) time.Time {
+
+	switch {
+	case resolution.Step == 0:
+		return t.In(loc).AddDate(0, 1, 0)
+	case resolution.Step == 24*time.Hour:
+		return t.In(loc).AddDate(0, 0, 1)
+	default:
+		return t.Add(resolution.Step)
+	}
+}
+
+func monthStart(t time.Time, loc *time.Location) time.Time {
+
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+}
+
+func latest(a time.Time, b time.Time) time.Time {
+
+	if a.After(b) {
+		return a
+	}
+
+	return b
+}
+
+func earliest(a time.Time, b time.Time) time.Time {
+
+	if a.Before(b) {
+		return a
+	}
+
+	return b
+}
+
+// pricing prices the consumption by the tariffs in the location. It
+// keeps track of the consumption of each month under the tiered
+// tariffs, so the consumption has to be priced in chronological order.
+type pricing struct {
+	tariffs []pricedTariff
+	loc     *time.Location
+	used    map[string]Decimal
+}
+
+// pricedTariff is a tariff with its validity and windows parsed.
+type pricedTariff struct {
+	Tariff
+	from    time.Time
+	to      time.Time
+	windows []window
+}
+
+type window struct {
+	from int
+	to   int
+	days map[time.Weekday]bool
+	rate Decimal
+}
+
+// matches reports whether the window covers the minute of the day
+// on the weekday, with the windows running past midnight being
+// matched against the day they start on.
+func (w window) matches(weekday time.Weekday, minute int) bool {
+
+	onDay := func(day time.Weekday) bool {
+		return w.days == nil || w.days[day]
+	}
+
+	if w.from < w.to {
+		return onDay(weekday) && minute >= w.from && minute < w.to
+	}
+
+	return (onDay(weekday) && minute >= w.from) || (onDay((weekday+6)%7) && minute < w.to)
+}
+
+func newPricing(tariffs []Tariff, loc *time.Location) *pricing {
+
+	p := &pricing{loc: loc, used: make(map[string]Decimal)}
+
+	for _, tariff := range tariffs {
+
+		priced := pricedTariff{Tariff: tariff, from: parseStored(tariff.ValidFrom)}
+		if tariff.ValidTo != "" {
+			priced.to = parseStored(tariff.ValidTo)
+		}
+
+		for _, w := range tariff.Windows {
+
+			from, _ := minuteOfDay(w.From)
+			to, _ := minuteOfDay(w.To)
+			parsed := window{from: from, to: to, rate: w.Rate}
+
+			if len(w.Days) > 0 {
+				parsed.days = make(map[time.Weekday]bool)
+				for _, day := range w.Days {
+					parsed.days[weekdays[day]] = true
+				}
+			}
+
+			priced.windows = append(priced.windows, parsed)
+		}
+
+		p.tariffs = append(p.tariffs, priced)
+	}
+
+	return p
+}
+
+// valid reports whether the tariff is valid at the instant.
+func (tariff pricedTariff) valid(t time.Time) bool {
+	return !t.Before(tariff.from) && (tariff.to.IsZero() || t.Before(tariff.to))
+}
+
+// tariffAt finds the tariff valid at the instant, nil when there is none.
+func (p *pricing) tariffAt(t time.Time) *pricedTariff {
+
+	for i := range p.tariffs {
+		if p.tariffs[i].valid(t) {
+			return &p.tariffs[i]
+		}
+	}
+
+	return nil
+}
+
+// energy prices the consumption of the period from start up to end. The
+// period is split where the tariff, the month or the window changes and
+// the consumption is spread evenly over it, which is exact for readings
+// which are not longer than the windows. Consumption outside of the
+// validity of the tariffs is not priced.
+func (p *pricing) energy(start time.Time, end time.Time, consumption Decimal) Decimal {
+
+	cuts := p.cuts(start, end)
+	total := end.Sub(start)
+
+	var cost, spread, pending Decimal
+	var pendingTariff *pricedTariff
+	var pendingAt time.Time
+	pendingKey := ""
+
+	for i := 0; i+1 < len(cuts); i++ {
+
+		// NOTE: The last part takes the rest so that the parts
+		// add up to the consumption exactly.
+		part := consumption.Sub(spread)
+		if i+2 < len(cuts) {
+			part = consumption.mulDiv(int64(cuts[i+1].Sub(start)), int64(total)).Sub(spread)
+		}
+
+		spread = spread.Add(part)
+
+		// NOTE: The parts priced alike are priced together, which
+		// keeps the rounding of the products from adding up.
+		tariff := p.tariffAt(cuts[i])
+		key := p.priceKey(tariff, cuts[i])
+		if key == pendingKey {
+			pending = pending.Add(part)
+			continue
+		}
+
+		if pendingTariff != nil {
+			cost = cost.Add(p.price(pendingTariff, pendingAt, pending))
+		}
+
+		pending, pendingTariff, pendingAt, pendingKey = part, tariff, cuts[i], key
+	}
+
+	if pendingTariff != nil {
+		cost = cost.Add(p.price(pendingTariff, pendingAt, pending))
+	}
+
+	return cost
+}
+
+// priceKey tells apart the prices of the consumption at the instant,
+// empty when no tariff is valid.
+func (p *pricing) priceKey(tariff *pricedTariff, t time.Time) string {
+
+	if tariff == nil {
+		return ""
+	}
+
+	key := strconv.Itoa(tariff.TariffId) + "|"
+	if len(tariff.Tiers) > 0 {
+		return key + monthStart(t, p.loc).Format(timestampLayout)
+	}
+
+	return key + tariff.rateAt(t.In(p.loc)).String()
+}
+
+// price prices the consumption at the instant by the tariff.
+func (p *pricing) price(tariff *pricedTariff, t time.Time, consumption Decimal) Decimal {
+
+	if len(tariff.Tiers) > 0 {
+
+		key := p.priceKey(tariff, t)
+		used := p.used[key]
+		p.used[key] = used.Add(consumption)
+
+		return tiersCost(tariff.Tiers, used, consumption)
+	}
+
+	return consumption.Mul(tariff.rateAt(t.In(p.loc)))
+}
+
+// rateAt is the rate of the window matching the local time, the rate
+// of the tariff outside of the windows.
+func (tariff pricedTariff) rateAt(local time.Time) Decimal {
+
+	minute := local.Hour()*60 + local.Minute()
+	for _, w := range tariff.windows {
+		if w.matches(local.Weekday(), minute) {
+			return w.rate
+		}
+	}
+
+	return *tariff.Rate
+}
+
+// tiersCost prices the consumption following the consumption already
+// used in the month by the blocks of the tiers.
+func tiersCost(tiers []Tier, used Decimal, consumption Decimal) Decimal {
+
+	var cost, lower Decimal
+	upper := used.Add(consumption)
+
+	for _, tier := range tiers {
+
+		from := latest64(lower, used)
+		to := upper
+		if tier.UpTo != nil && tier.UpTo.millionths < to.millionths {
+			to = *tier.UpTo
+		}
+
+		if to.millionths > from.millionths {
+			cost = cost.Add(to.Sub(from).Mul(tier.Rate))
+		}
+
+		if tier.UpTo != nil {
+			lower = *tier.UpTo
+		}
+	}
+
+	return cost
+}
+
+func latest64(a Decimal, b Decimal) Decimal {
+
+	if a.millionths > b.millionths {
+		return a
+	}
+
+	return b
+}
+
+// cuts lists the instants from start up to end at which the price of
+// the consumption may change.
+func (p *pricing) cuts(start time.Time, end time.Time) []time.Time {
+
+	cuts := []time.Time{start, end}
+	add := func(t time.Time) {
+		if t.After(start) && t.Before(end) {
+			cuts = append(cuts, t)
+		}
+	}
+
+	for _, tariff := range p.tariffs {
+
+		add(tariff.from)
+		add(tariff.to)
+
+		if len(tariff.windows) == 0 {
+			continue
+		}
+
+		// NOTE: The windows starting on the day before may run
+		// past midnight into the period.
+		local := start.In(p.loc)
+		day := time.Date(local.Year(), local.Month(), local.Day()-1, 0, 0, 0, 0, p.loc)
+
+		for ; day.Before(end); day = day.AddDate(0, 0, 1) {
+			for _, w := range tariff.windows {
+
+				add(atMinute(day, w.from))
+				if w.to > w.from {
+					add(atMinute(day, w.to))
+				} else {
+					add(atMinute(day.AddDate(0, 0, 1), w.to))
+				}
+			}
+		}
+	}
+
+	for month := monthStart(start, p.loc).AddDate(0, 1, 0); month.Before(end); month = month.AddDate(0, 1, 0) {
+		add(month)
+	}
+
+	sort.Slice(cuts, func(i, j int) bool {
+		return cuts[i].Before(cuts[j])
+	})
+
+	unique := cuts[:1]
+	for _, t := range cuts[1:] {
+		if !t.Equal(unique[len(unique)-1]) {
+			unique = append(unique, t)
+		}
+	}
+
+	return unique
+}
+
+// atMinute is the wall clock time of the minute of the day.
+func atMinute(day time.Time, minute int) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), minute/60, minute%60, 0, 0, day.Location())
+}
+
+// standing sums the standing charges due from start up to end, each
+// day of the location being charged for the part of it in the period.
+func (p *pricing) standing(start time.Time, end time.Time) Decimal {
+
+	var charge Decimal
+
+	local := start.In(p.loc)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, p.loc)
+
+	for ; day.Before(end); day = day.AddDate(0, 0, 1) {
+
+		next := day.AddDate(0, 0, 1)
+		from, to := latest(day, start), earliest(next, end)
+
+		for _, tariff := range p.tariffs {
+
+			tariffFrom, tariffTo := latest(from, tariff.from), to
+			if !tariff.to.IsZero() {
+				tariffTo = earliest(to, tariff.to)
+			}
+
+			if tariffTo.After(tariffFrom) {
+				charge = charge.Add(tariff.StandingCharge.mulDiv(int64(tariffTo.Sub(tariffFrom)), int64(next.Sub(day))))
+			}
+		}
+	}
+
+	return charge
+}
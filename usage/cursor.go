@@ -0,0 +1,61 @@
+package usage
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxPageSize is the maximum number of rows returned in a single page.
+const MaxPageSize = 1000
+
+// Cursor points at the last row of a page. Rows are summed over the
+// meters per timestamp and ordered by it, so continuing behind the
+// timestamp of the cursor is stable even when readings are added in
+// between requests.
+type Cursor struct {
+	Resolution string
+	Descending bool
+	Timestamp  string
+}
+
+// Encode returns the opaque representation handed out to the client.
+func (cursor Cursor) Encode() string {
+
+	order := "asc"
+	if cursor.Descending {
+		order = "desc"
+	}
+
+	raw := strings.Join([]string{cursor.Resolution, order, cursor.Timestamp}, "|")
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// DecodeCursor parses the cursor sent back by the client.
+func DecodeCursor(encoded string) (Cursor, error) {
+
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("Unable to decode the cursor: %s", err.Error())
+	}
+
+	// NOTE: The cursors handed out before carry a row id as well, which
+	// is ignored.
+	parts := strings.Split(string(raw), "|")
+	if (len(parts) != 3 && len(parts) != 4) || (parts[1] != "asc" && parts[1] != "desc") {
+		return Cursor{}, fmt.Errorf("Malformed cursor: %s", encoded)
+	}
+
+	if len(parts) == 4 {
+		if _, err := strconv.Atoi(parts[3]); err != nil {
+			return Cursor{}, fmt.Errorf("Malformed cursor: %s", encoded)
+		}
+	}
+
+	return Cursor{
+		Resolution: parts[0],
+		Descending: parts[1] == "desc",
+		Timestamp:  parts[2],
+	}, nil
+}
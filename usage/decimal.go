@@ -0,0 +1,197 @@
+package usage
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// decimalScale is the number of millionths in a unit. The readings are
+// stored as integers in millionths, which keeps sums and conversions
+// exact where floats would pick up rounding artifacts.
+const decimalScale = 1000000
+
+// Decimal is a fixed-point number with six decimals, used for the
+// consumption and temperature values.
+type Decimal struct {
+	millionths int64
+}
+
+// NewDecimal returns the decimal of the whole value.
+func NewDecimal(value int) Decimal {
+	return Decimal{int64(value) * decimalScale}
+}
+
+// ParseDecimal reads a decimal number like "12.345" or "-1e-3", failing
+// for the numbers which have more than six decimals.
+func ParseDecimal(value string) (Decimal, error) {
+
+	// NOTE: Rat also reads fractions like 1/2, which are no decimals.
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(value))
+	if !ok || strings.Contains(value, "/") {
+		return Decimal{}, fmt.Errorf("Malformed decimal: %s", value)
+	}
+
+	r.Mul(r, new(big.Rat).SetInt64(decimalScale))
+	if !r.IsInt() {
+		return Decimal{}, fmt.Errorf("More than six decimals: %s", value)
+	}
+
+	if !r.Num().IsInt64() {
+		return Decimal{}, fmt.Errorf("Decimal out of range: %s", value)
+	}
+
+	return Decimal{r.Num().Int64()}, nil
+}
+
+// String formats the decimal without trailing zeros, e.g. "12.5" or "10".
+func (d Decimal) String() string {
+
+	sign := ""
+	millionths := d.millionths
+	if millionths < 0 {
+		sign = "-"
+	}
+
+	whole := millionths / decimalScale
+	fraction := millionths % decimalScale
+	if whole < 0 {
+		whole = -whole
+	}
+	if fraction < 0 {
+		fraction = -fraction
+	}
+
+	if fraction == 0 {
+		return sign + strconv.FormatInt(whole, 10)
+	}
+
+	digits := strings.TrimRight(fmt.Sprintf("%06d", fraction), "0")
+	return sign + strconv.FormatInt(whole, 10) + "." + digits
+}
+
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+
+	parsed, err := ParseDecimal(string(data))
+	if err != nil {
+		return err
+	}
+
+	*d = parsed
+	return nil
+}
+
+// Value stores the decimal as the integer number of millionths.
+func (d Decimal) Value() (driver.Value, error) {
+	return d.millionths, nil
+}
+
+// Scan reads the integer number of millionths stored for the decimal,
+// which aggregates may return as text.
+func (d *Decimal) Scan(src interface{}) error {
+
+	switch value := src.(type) {
+	case int64:
+		d.millionths = value
+	case []byte:
+		return d.Scan(string(value))
+	case string:
+
+		millionths, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Unable to scan the decimal: %s", err.Error())
+		}
+
+		d.millionths = millionths
+
+	default:
+		return fmt.Errorf("Unable to scan the decimal from: %T", src)
+	}
+
+	return nil
+}
+
+// Float64 is the nearest float to the decimal, for the computations
+// which do not need to be exact.
+func (d Decimal) Float64() float64 {
+	return float64(d.millionths) / decimalScale
+}
+
+// Add returns the sum of the decimals.
+func (d Decimal) Add(other Decimal) Decimal {
+	return Decimal{d.millionths + other.millionths}
+}
+
+// Sub returns the difference of the decimals.
+func (d Decimal) Sub(other Decimal) Decimal {
+	return Decimal{d.millionths - other.millionths}
+}
+
+// Mul returns the product of the decimals, rounded to six decimals.
+func (d Decimal) Mul(other Decimal) Decimal {
+	return d.mulDiv(other.millionths, decimalScale)
+}
+
+// Sign is -1, 0 or 1 for a negative, zero and positive decimal.
+func (d Decimal) Sign() int {
+
+	switch {
+	case d.millionths < 0:
+		return -1
+	case d.millionths > 0:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Round rounds the decimal to the number of decimals, halves away from zero.
+func (d Decimal) Round(places int) Decimal {
+	return d.quo(1, places)
+}
+
+// quo divides the decimal by the count, rounding the quotient to the
+// number of decimals, halves away from zero.
+func (d Decimal) quo(count int64, places int) Decimal {
+
+	step := int64(1)
+	for i := places; i < 6; i++ {
+		step *= 10
+	}
+
+	return Decimal{quotient(big.NewInt(d.millionths), big.NewInt(count*step)) * step}
+}
+
+// mulDiv multiplies the decimal by the fraction, rounding the result
+// to six decimals, halves away from zero.
+func (d Decimal) mulDiv(numerator int64, denominator int64) Decimal {
+
+	product := new(big.Int).Mul(big.NewInt(d.millionths), big.NewInt(numerator))
+	return Decimal{quotient(product, big.NewInt(denominator))}
+}
+
+// quotient divides the integers, rounding halves away from zero.
+func quotient(numerator *big.Int, denominator *big.Int) int64 {
+
+	if denominator.Sign() < 0 {
+		numerator = new(big.Int).Neg(numerator)
+		denominator = new(big.Int).Neg(denominator)
+	}
+
+	q, r := new(big.Int).QuoRem(numerator, denominator, new(big.Int))
+
+	// NOTE: The remainder has the sign of the numerator.
+	twice := new(big.Int).Abs(r)
+	twice.Lsh(twice, 1)
+	if twice.Cmp(denominator) >= 0 {
+		q.Add(q, big.NewInt(int64(numerator.Sign())))
+	}
+
+	return q.Int64()
+}
@@ -0,0 +1,480 @@
+package usage
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	// maxForecastDays caps the number of days which can be forecast.
+	maxForecastDays = 92
+	// defaultForecastHistory is the number of days of readings the
+	// forecast is fitted to unless another number is requested.
+	defaultForecastHistory = 365
+	// maxForecastHistory caps the number of days of readings fitted.
+	maxForecastHistory = 3 * 365
+	// climateWindow is the number of days around the same day of the
+	// year whose temperatures in the years before make up the one
+	// expected on a day.
+	climateWindow = 7
+)
+
+// intervalScores are the standard normal scores of the levels in
+// percent the prediction intervals can be given at.
+var intervalScores = map[int]float64{80: 1.281552, 90: 1.644854, 95: 1.959964, 99: 2.575829}
+
+// ForecastQuery describes the forecast of the daily consumption for the
+// Days from Start, a stored timestamp in UTC, by default the day after
+// the latest daily reading. The forecast is fitted to the readings of
+// the History days before Start, and its prediction intervals are at
+// the Level in percent. Backtest forecasts the Days before Start from
+// the readings before them instead, to compare with the readings of
+// those days. The meters, units and location are selected like in the
+// DataQuery.
+type ForecastQuery struct {
+	Start           string
+	Days            int
+	History         int
+	Level           int
+	Backtest        bool
+	Meter           int
+	Utility         string
+	Units           string
+	Location        *time.Location
+	BaseTemperature string
+}
+
+// ForecastModel describes the fit of the daily consumption to a baseline
+// per day of the week and the degree days, with the standard deviation
+// of the residuals the prediction intervals follow from.
+type ForecastModel struct {
+	Observations int                `json:"observations"`
+	Baseline     map[string]Decimal `json:"baseline"`
+	Heating      Decimal            `json:"heating"`
+	Cooling      Decimal            `json:"cooling"`
+	StdDev       Decimal            `json:"stddev"`
+}
+
+// ForecastTotal sums the consumption forecast over the days along with
+// its prediction interval and, when backtesting, the actual consumption.
+type ForecastTotal struct {
+	Consumption Decimal  `json:"consumption"`
+	Lower       Decimal  `json:"lower"`
+	Upper       Decimal  `json:"upper"`
+	Actual      *Decimal `json:"actual,omitempty"`
+}
+
+// Backtest measures the error of the forecast against the days with
+// readings: the mean absolute error, the root mean squared error, the
+// mean absolute percentage error over the days with consumption, the
+// mean of the forecast less the actual consumption and the percentage
+// of the days whose consumption fell into the prediction interval.
+type Backtest struct {
+	Observations int     `json:"observations"`
+	MAE          Decimal `json:"mae"`
+	RMSE         Decimal `json:"rmse"`
+	MAPE         Decimal `json:"mape"`
+	Bias         Decimal `json:"bias"`
+	Coverage     Decimal `json:"coverage"`
+}
+
+// Forecast holds the consumption forecast per day along with the
+// model it follows from.
+type Forecast struct {
+	Start           string          `json:"start"`
+	Days            int             `json:"days"`
+	Level           int             `json:"level"`
+	BaseTemperature Decimal         `json:"base_temperature"`
+	Units           *Units          `json:"units,omitempty"`
+	Model           ForecastModel   `json:"model"`
+	Columns         []string        `json:"columns"`
+	Data            [][]interface{} `json:"data"`
+	Total           ForecastTotal   `json:"total"`
+	Backtest        *Backtest       `json:"backtest,omitempty"`
+}
+
+// GetForecastForUser forecasts the daily consumption of the user from
+// the daily readings. The temperature expected on a day is the mean of
+// the ones around the same day in the years before, or of the latest
+// week when the readings do not reach back as far.
+func (processor UsageProcessor) GetForecastForUser(userId int, query ForecastQuery) (Forecast, error) {
+
+	fmt.Printf("Received request to forecast the consumption for the user: %d\n", userId)
+
+	if query.History == 0 {
+		query.History = defaultForecastHistory
+	}
+
+	if query.Level == 0 {
+		query.Level = 95
+	}
+
+	switch {
+	case query.Days <= 0 || query.Days > maxForecastDays:
+		return Forecast{}, ValidationError{Reason: fmt.Sprintf("Days need to be between 1 and %d", maxForecastDays)}
+	case query.History < 28 || query.History > maxForecastHistory:
+		return Forecast{}, ValidationError{Reason: fmt.Sprintf("History needs to be between 28 and %d days", maxForecastHistory)}
+	case intervalScores[query.Level] == 0:
+		return Forecast{}, ValidationError{Reason: "Level needs to be one of 80, 90, 95, 99"}
+	}
+
+	_, utility, err := processor.resolveMeters(userId, query.Meter, query.Utility)
+	if err != nil {
+		return Forecast{}, err
+	}
+
+	units, err := resolveUnits(query.Units, utility)
+	if err != nil {
+		return Forecast{}, err
+	}
+
+	base, err := parseBaseTemperature(query.BaseTemperature, units)
+	if err != nil {
+		return Forecast{}, err
+	}
+
+	dataQuery := DataQuery{Resolution: "D", Location: query.Location, Meter: query.Meter, Utility: query.Utility}
+	loc := dataQuery.location()
+
+	// Stage1: Find the first day of the forecast.
+	var start time.Time
+	if query.Start != "" {
+		start = periodStart("D", parseStored(query.Start), loc)
+	} else {
+
+		latest := dataQuery
+		latest.Descending = true
+		latest.Count = 1
+
+		page, err := processor.GetDataForUser(userId, latest)
+		if err != nil {
+			return Forecast{}, err
+		}
+
+		if len(page.Data) == 0 {
+			return Forecast{}, ValidationError{Reason: "Forecast needs daily readings to fit"}
+		}
+
+		start = page.times[0].In(loc).AddDate(0, 0, 1)
+	}
+
+	first := start
+	if query.Backtest {
+		first = start.AddDate(0, 0, -query.Days)
+	}
+
+	// Stage2: Fit the model to the days of history before the forecast.
+	history, err := processor.dailyRows(userId, dataQuery, first.AddDate(0, 0, -query.History), first, base)
+	if err != nil {
+		return Forecast{}, err
+	}
+
+	model, err := fitForecast(history)
+	if err != nil {
+		return Forecast{}, err
+	}
+
+	var actuals map[int64]weatherRow
+	if query.Backtest {
+
+		rows, err := processor.dailyRows(userId, dataQuery, first, start, base)
+		if err != nil {
+			return Forecast{}, err
+		}
+
+		actuals = make(map[int64]weatherRow)
+		for _, row := range rows {
+			actuals[row.start.Unix()] = row
+		}
+	}
+
+	forecast := Forecast{
+		Start:           first.Format("2006-01-02"),
+		Days:            query.Days,
+		Level:           query.Level,
+		BaseTemperature: convertTemperature(base, units.Temperature),
+		Model: ForecastModel{
+			Observations: len(history),
+			Baseline:     make(map[string]Decimal),
+			Heating:      perDegreeDay(model.heating, units),
+			Cooling:      perDegreeDay(model.cooling, units),
+			StdDev:       fromBase(decimalFromFloat(model.stddev), units.Consumption),
+		},
+		Columns: []string{"timestamp", "temperature", "consumption", "lower", "upper"},
+	}
+
+	if query.Units != "" {
+		forecast.Units = &units
+	}
+
+	for weekday, baseline := range model.baseline {
+		forecast.Model.Baseline[strings.ToLower(weekday.String())] = fromBase(decimalFromFloat(baseline), units.Consumption)
+	}
+
+	if query.Backtest {
+		forecast.Columns = append(forecast.Columns, "actual")
+	}
+
+	// Stage3: Forecast the days along with their prediction intervals.
+	score := intervalScores[query.Level]
+	margin := decimalFromFloat(score * model.stddev)
+
+	var total, actualTotal Decimal
+	var diffs []float64
+	var percentages []float64
+	var covered int
+
+	for i := 0; i < query.Days; i++ {
+
+		day := first.AddDate(0, 0, i)
+		temperature := expectedTemperature(history, day)
+
+		row := newWeatherRow(dataQuery, day, []interface{}{day, temperature, Decimal{}}, base)
+		consumption := decimalFromFloat(model.predict(row))
+		lower, upper := consumption.Sub(margin), consumption.Add(margin)
+		total = total.Add(consumption)
+
+		values := []interface{}{
+			day.Format("2006-01-02"),
+			convertTemperature(temperature, units.Temperature),
+			fromBase(consumption, units.Consumption),
+			fromBase(lower, units.Consumption),
+			fromBase(upper, units.Consumption),
+		}
+
+		if query.Backtest {
+
+			actual, ok := actuals[day.Unix()]
+			if ok {
+
+				values = append(values, fromBase(actual.consumption, units.Consumption))
+				actualTotal = actualTotal.Add(actual.consumption)
+
+				diff := consumption.Sub(actual.consumption).Float64()
+				diffs = append(diffs, diff)
+				if actual.consumption.Sign() != 0 {
+					percentages = append(percentages, math.Abs(diff/actual.consumption.Float64())*100)
+				}
+
+				if lower.millionths <= actual.consumption.millionths && actual.consumption.millionths <= upper.millionths {
+					covered++
+				}
+			} else {
+				values = append(values, nil)
+			}
+		}
+
+		forecast.Data = append(forecast.Data, values)
+	}
+
+	// NOTE: The errors of the days are taken to be independent, so the
+	// interval of the total widens with the root of the number of days.
+	totalMargin := decimalFromFloat(score * model.stddev * math.Sqrt(float64(query.Days)))
+	forecast.Total = ForecastTotal{
+		Consumption: fromBase(total, units.Consumption),
+		Lower:       fromBase(total.Sub(totalMargin), units.Consumption),
+		Upper:       fromBase(total.Add(totalMargin), units.Consumption),
+	}
+
+	if query.Backtest {
+
+		actual := fromBase(actualTotal, units.Consumption)
+		forecast.Total.Actual = &actual
+		forecast.Backtest = backtest(diffs, percentages, covered, units)
+	}
+
+	return forecast, nil
+}
+
+// dailyRows fetches the daily readings of the user from start up to end
+// as stored, along with their degree days.
+func (processor UsageProcessor) dailyRows(
+	userId int,
+	query DataQuery,
+	start time.Time,
+	end time.Time,
+	base Decimal) ([]weatherRow, error) {
+
+	query.Start = FormatTimestamp(start)
+	query.End = FormatTimestamp(end)
+	query.Count = MaxPageSize
+
+	var rows []weatherRow
+
+	for {
+
+		page, err := processor.GetDataForUser(userId, query)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, data := range page.Data {
+			rows = append(rows, newWeatherRow(query, page.times[i], data, base))
+		}
+
+		if !page.HasMore {
+			return rows, nil
+		}
+
+		query.After = page.Next
+	}
+}
+
+// forecastModel is the fitted baseline per day of the week along with
+// the consumption per degree day and the deviation of the residuals.
+type forecastModel struct {
+	baseline map[time.Weekday]float64
+	heating  float64
+	cooling  float64
+	stddev   float64
+}
+
+func (model forecastModel) predict(row weatherRow) float64 {
+	return model.baseline[row.start.Weekday()] + model.heating*row.hdd.Float64() + model.cooling*row.cdd.Float64()
+}
+
+// fitForecast fits the daily consumption to a baseline per day of the
+// week and the degree days by ordinary least squares. The degree days
+// which are zero throughout the history are left out of the fit.
+func fitForecast(rows []weatherRow) (forecastModel, error) {
+
+	var heating, cooling bool
+	var weekdays [7]bool
+	for _, row := range rows {
+		heating = heating || row.hdd.Sign() != 0
+		cooling = cooling || row.cdd.Sign() != 0
+		weekdays[row.start.Weekday()] = true
+	}
+
+	for _, seen := range weekdays {
+		if !seen {
+			return forecastModel{}, ValidationError{Reason: "Forecast needs daily readings on every day of the week to fit"}
+		}
+	}
+
+	p := 7
+	if heating {
+		p++
+	}
+	if cooling {
+		p++
+	}
+
+	if len(rows) <= p {
+		return forecastModel{}, ValidationError{Reason: fmt.Sprintf("Forecast needs more than %d daily readings to fit", p)}
+	}
+
+	regressors := func(row weatherRow) []float64 {
+
+		x := make([]float64, 7, p)
+		x[row.start.Weekday()] = 1
+		if heating {
+			x = append(x, row.hdd.Float64())
+		}
+		if cooling {
+			x = append(x, row.cdd.Float64())
+		}
+		return x
+	}
+
+	beta, ok := leastSquares(rows, regressors)
+	if !ok {
+		return forecastModel{}, ValidationError{Reason: "Degree days do not vary enough to fit the forecast"}
+	}
+
+	model := forecastModel{baseline: make(map[time.Weekday]float64)}
+	for weekday := time.Sunday; weekday <= time.Saturday; weekday++ {
+		model.baseline[weekday] = beta[weekday]
+	}
+
+	next := 7
+	if heating {
+		model.heating = beta[next]
+		next++
+	}
+	if cooling {
+		model.cooling = beta[next]
+	}
+
+	var residuals float64
+	for _, row := range rows {
+		residual := row.consumption.Float64() - model.predict(row)
+		residuals += residual * residual
+	}
+
+	model.stddev = math.Sqrt(residuals / float64(len(rows)-p))
+
+	return model, nil
+}
+
+// expectedTemperature is the mean temperature of the days of history
+// within the climate window around the same day of the year, at least
+// half a year before the day. Without any, it is the mean temperature
+// of the latest week of history.
+func expectedTemperature(history []weatherRow, day time.Time) Decimal {
+
+	var sum Decimal
+	var count int64
+
+	for _, row := range history {
+
+		distance := row.start.YearDay() - day.YearDay()
+		if distance < 0 {
+			distance = -distance
+		}
+		if distance > 183 {
+			distance = 366 - distance
+		}
+
+		if distance <= climateWindow && row.start.Before(day.AddDate(0, -6, 0)) {
+			sum = sum.Add(row.temperature)
+			count++
+		}
+	}
+
+	if count == 0 {
+		for i := len(history) - 1; i >= 0 && i >= len(history)-7; i-- {
+			sum = sum.Add(history[i].temperature)
+			count++
+		}
+	}
+
+	return sum.quo(count, 2)
+}
+
+// backtest summarizes the errors of the forecast, the forecast less the
+// actual consumption, of the days with readings.
+func backtest(diffs []float64, percentages []float64, covered int, units Units) *Backtest {
+
+	result := &Backtest{Observations: len(diffs)}
+	if len(diffs) == 0 {
+		return result
+	}
+
+	var absolute, squared, sum float64
+	for _, e := range diffs {
+		absolute += math.Abs(e)
+		squared += e * e
+		sum += e
+	}
+
+	n := float64(len(diffs))
+	result.MAE = fromBase(decimalFromFloat(absolute/n), units.Consumption)
+	result.RMSE = fromBase(decimalFromFloat(math.Sqrt(squared/n)), units.Consumption)
+	result.Bias = fromBase(decimalFromFloat(sum/n), units.Consumption)
+	result.Coverage = decimalFromFloat(float64(covered) / n * 100).Round(2)
+
+	if len(percentages) > 0 {
+
+		var mape float64
+		for _, p := range percentages {
+			mape += p
+		}
+
+		result.MAPE = decimalFromFloat(mape / float64(len(percentages))).Round(2)
+	}
+
+	return result
+}
@@ -0,0 +1,399 @@
+package usage
+
+import (
+	"fmt"
+	"time"
+)
+
+// The ways the missing buckets of the data can be filled.
+const (
+	// FillNull fills the missing buckets without values.
+	FillNull = "null"
+	// FillZero fills the missing buckets with zero consumption.
+	FillZero = "zero"
+	// FillPrevious repeats the values of the bucket before.
+	FillPrevious = "previous"
+	// FillLinear interpolates between the buckets around.
+	FillLinear = "linear"
+)
+
+var fills = map[string]bool{FillNull: true, FillZero: true, FillPrevious: true, FillLinear: true}
+
+// GapsQuery describes the range of the readings of the stored resolution
+// to find the missing buckets in, from Start up to End as stored
+// timestamps in UTC. Without a Start or an End, the range starts or ends
+// with the readings. The meters and location are selected like in the
+// DataQuery.
+type GapsQuery struct {
+	Resolution string
+	Start      string
+	End        string
+	Meter      int
+	Utility    string
+	Location   *time.Location
+}
+
+// Gap is a range of buckets without readings, from the Start of the
+// first of them up to the start of the bucket which follows the last,
+// as presented at the resolution.
+type Gap struct {
+	Start   string `json:"start"`
+	End     string `json:"end"`
+	Buckets int    `json:"buckets"`
+}
+
+// Gaps lists the ranges without readings along with the number of the
+// buckets missing over all of them.
+type Gaps struct {
+	Resolution string `json:"resolution"`
+	Gaps       []Gap  `json:"gaps"`
+	Missing    int    `json:"missing"`
+}
+
+// gapSpan is a range of missing buckets, from the start of the first of
+// them up to the start of the bucket which follows the last.
+type gapSpan struct {
+	start   time.Time
+	end     time.Time
+	buckets int
+}
+
+// GetGapsForUser lists the ranges without readings of the user at the
+// stored resolution in the range.
+func (processor UsageProcessor) GetGapsForUser(userId int, query GapsQuery) (Gaps, error) {
+
+	fmt.Printf("Received request to find the gaps for the user: %d\n", userId)
+
+	resolution, ok := resolutions[query.Resolution]
+	if !ok {
+		return Gaps{}, ValidationError{Reason: fmt.Sprintf("Gaps are only found for the stored resolutions: %s", query.Resolution)}
+	}
+
+	if query.Start != "" && query.End != "" && query.End <= query.Start {
+		return Gaps{}, ValidationError{Reason: "Gaps need a range with a start before its end"}
+	}
+
+	dataQuery := DataQuery{
+		Resolution: query.Resolution,
+		Start:      query.Start,
+		End:        query.End,
+		Count:      MaxPageSize,
+		Location:   query.Location,
+		Meter:      query.Meter,
+		Utility:    query.Utility,
+	}
+
+	var times []time.Time
+
+	for {
+
+		page, err := processor.GetDataForUser(userId, dataQuery)
+		if err != nil {
+			return Gaps{}, err
+		}
+
+		times = append(times, page.times...)
+
+		if !page.HasMore {
+			break
+		}
+
+		dataQuery.After = page.Next
+	}
+
+	loc := dataQuery.location()
+	spans := findSpans(query.Resolution, false, times, parseStored(query.Start), parseStored(query.End), loc)
+
+	gaps := Gaps{Resolution: query.Resolution, Gaps: presentGaps(spans, resolution.Format, loc)}
+	for _, span := range spans {
+		gaps.Missing += span.buckets
+	}
+
+	return gaps, nil
+}
+
+// bucketSteps returns the functions mapping an instant to the start of
+// the first bucket of the resolution from it on, and the start of a
+// bucket to the start of the one which follows, in the location. The
+// rollups start with the bucket containing the instant, the stored
+// resolutions with the first reading at or after it.
+func bucketSteps(name string, derived bool, loc *time.Location) (func(time.Time) time.Time, func(time.Time) time.Time) {
+
+	if derived {
+
+		r := rollups[name]
+		first := func(t time.Time) time.Time {
+			start, _ := r.bucket(t.In(loc))
+			return start
+		}
+
+		next := func(t time.Time) time.Time {
+			_, following := r.bucket(t.In(loc))
+			return following
+		}
+
+		return first, next
+	}
+
+	resolution := resolutions[name]
+	next := func(t time.Time) time.Time {
+		return readingEnd(resolution, t, loc)
+	}
+
+	first := func(start time.Time) time.Time {
+
+		start = start.In(loc)
+
+		var t time.Time
+		switch {
+		case resolution.Step == 0:
+			t = time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, loc)
+		case resolution.Step == 24*time.Hour:
+			t = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc)
+		default:
+			minutes := int(resolution.Step / time.Minute)
+			t = time.Date(start.Year(), start.Month(), start.Day(), start.Hour(),
+				start.Minute()-start.Minute()%minutes, 0, 0, loc)
+		}
+
+		if t.Before(start) {
+			t = next(t)
+		}
+
+		return t
+	}
+
+	return first, next
+}
+
+// findSpans finds the ranges of missing buckets between the instants of
+// the rows, in chronological order, and towards the lower and upper
+// bounds of the range unless these are zero. Only the buckets which
+// have ended by the upper bound, and by now, are missing.
+func findSpans(name string, derived bool, times []time.Time, lower time.Time, upper time.Time, loc *time.Location) []gapSpan {
+
+	first, next := bucketSteps(name, derived, loc)
+
+	// span counts the buckets from the expected one which end by the instant.
+	span := func(expected time.Time, until time.Time) gapSpan {
+
+		s := gapSpan{start: expected, end: expected}
+		for following := next(s.end); !following.After(until); following = next(following) {
+			s.end = following
+			s.buckets++
+		}
+
+		return s
+	}
+
+	var spans []gapSpan
+	var expected time.Time
+
+	if !lower.IsZero() {
+		expected = first(lower)
+	}
+
+	for _, t := range times {
+
+		if !expected.IsZero() && t.After(expected) {
+			if s := span(expected, t); s.buckets > 0 {
+				spans = append(spans, s)
+			}
+		}
+
+		if following := next(t); following.After(expected) {
+			expected = following
+		}
+	}
+
+	if now := time.Now(); upper.After(now) {
+		upper = now
+	}
+
+	if !upper.IsZero() && !expected.IsZero() && expected.Before(upper) {
+		if s := span(expected, upper); s.buckets > 0 {
+			spans = append(spans, s)
+		}
+	}
+
+	return spans
+}
+
+// presentGaps presents the ranges of missing buckets in the location.
+func presentGaps(spans []gapSpan, format string, loc *time.Location) []Gap {
+
+	gaps := []Gap{}
+	for _, span := range spans {
+		gaps = append(gaps, Gap{
+			Start:   span.start.In(loc).Format(format),
+			End:     span.end.In(loc).Format(format),
+			Buckets: span.buckets,
+		})
+	}
+
+	return gaps
+}
+
+// fillGaps reports the missing buckets of the page of data, between its
+// rows and towards the bounds of the range which the page reaches, and
+// fills them as requested. The filled rows are marked as estimated in
+// the last column, the values of the columns appended to the rows of
+// the readings left empty. The filled rows come on top of the count of
+// the query and the cursor of the page stays at its last stored row.
+func fillGaps(query DataQuery, page *DataPage, valueColumns int) error {
+
+	loc := query.location()
+
+	_, next := bucketSteps(query.Resolution, query.Derived, loc)
+
+	// Stage1: Find the bounds of the range the page reaches, the pages
+	// continuing a listing start next to the row the cursor points to.
+	var lower, upper time.Time
+	switch {
+	case !query.Descending && query.After != nil:
+		lower = next(parseStored(query.After.Timestamp))
+	case !query.Descending || !page.HasMore:
+		lower = parseStored(query.Start)
+	}
+
+	switch {
+	case query.Descending && query.After != nil:
+		upper = parseStored(query.After.Timestamp)
+	case query.Descending || !page.HasMore:
+		upper = parseStored(query.End)
+	}
+
+	type indexed struct {
+		t   time.Time
+		row []interface{}
+	}
+
+	rows := make([]indexed, len(page.Data))
+	for i := range page.Data {
+		rows[i] = indexed{page.times[i], page.Data[i]}
+	}
+
+	if query.Descending {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+
+	times := make([]time.Time, len(rows))
+	for i, row := range rows {
+		times[i] = row.t
+	}
+
+	spans := findSpans(query.Resolution, query.Derived, times, lower, upper, loc)
+
+	format := "2006-01-02"
+	if !query.Derived {
+		format = resolutions[query.Resolution].Format
+	}
+
+	page.Gaps = presentGaps(spans, format, loc)
+	if query.Fill == "" {
+		return nil
+	}
+
+	// Stage2: Fill the buckets of the spans between the rows around them.
+	missing := 0
+	for _, span := range spans {
+		missing += span.buckets
+	}
+
+	if missing > MaxPageSize {
+		return ValidationError{Reason: fmt.Sprintf("Gaps exceed %d buckets to fill", MaxPageSize)}
+	}
+
+	if page.Columns == nil {
+		page.Columns = []string{"timestamp", "temperature", "consumption"}
+	}
+
+	var filled []indexed
+	j := 0
+
+	for _, span := range spans {
+
+		for ; j < len(rows) && rows[j].t.Before(span.start); j++ {
+			filled = append(filled, indexed{rows[j].t, append(rows[j].row, false)})
+		}
+
+		var before, after indexed
+		if j > 0 {
+			before = rows[j-1]
+		}
+		if j < len(rows) {
+			after = rows[j]
+		}
+
+		for t := span.start; t.Before(span.end); t = next(t) {
+
+			row := make([]interface{}, len(page.Columns)+1)
+			row[0] = t.In(loc).Format(format)
+			row[len(row)-1] = true
+
+			for i := 1; i < valueColumns; i++ {
+				row[i] = fillValue(query.Fill, i, before.row, after.row, before.t, after.t, t)
+			}
+
+			filled = append(filled, indexed{t, row})
+		}
+	}
+
+	for ; j < len(rows); j++ {
+		filled = append(filled, indexed{rows[j].t, append(rows[j].row, false)})
+	}
+
+	if query.Descending {
+		for i, k := 0, len(filled)-1; i < k; i, k = i+1, k-1 {
+			filled[i], filled[k] = filled[k], filled[i]
+		}
+	}
+
+	page.Data, page.times = nil, nil
+	for _, row := range filled {
+		page.Data = append(page.Data, row.row)
+		page.times = append(page.times, row.t)
+	}
+
+	page.Columns = append(page.Columns, "estimated")
+
+	return nil
+}
+
+// fillValue fills the value of the column of the missing bucket starting
+// at the instant, between the rows before and after the gap starting at
+// their instants. Only the decimal values are filled, the counts of the
+// rollups are left empty, and so is the temperature when filling with zero.
+func fillValue(
+	fill string,
+	column int,
+	before []interface{},
+	after []interface{},
+	from time.Time,
+	to time.Time,
+	t time.Time) interface{} {
+
+	var previous, following Decimal
+	var hasPrevious, hasFollowing bool
+
+	if before != nil {
+		previous, hasPrevious = before[column].(Decimal)
+	}
+
+	if after != nil {
+		following, hasFollowing = after[column].(Decimal)
+	}
+
+	switch {
+	case fill == FillZero && column == 2:
+		return Decimal{}
+	case fill == FillPrevious && hasPrevious:
+		return previous
+	case fill == FillLinear && hasPrevious && hasFollowing:
+		return previous.Add(following.Sub(previous).mulDiv(int64(t.Sub(from)), int64(to.Sub(from))))
+	}
+
+	return nil
+}
@@ -0,0 +1,253 @@
+package usage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MaxBatchSize is the maximum number of readings accepted in one batch.
+const MaxBatchSize = 10000
+
+// DuplicatePolicy decides what happens to a reading for a timestamp at
+// which the user already has a reading of the same resolution.
+type DuplicatePolicy string
+
+const (
+	// DuplicateReject fails the batch, the default.
+	DuplicateReject DuplicatePolicy = "reject"
+	// DuplicateReplace overwrites the stored reading.
+	DuplicateReplace DuplicatePolicy = "replace"
+	// DuplicateMerge adds the consumption to the stored reading and
+	// replaces the temperature, for meters reporting a period in parts.
+	DuplicateMerge DuplicatePolicy = "merge"
+)
+
+// duplicateError is returned by the storage when the reading at the
+// index of the batch is rejected as a duplicate.
+type duplicateError struct {
+	index int
+}
+
+func (err duplicateError) Error() string {
+	return fmt.Sprintf("Duplicate reading at index: %d", err.index)
+}
+
+// validateReading checks a single reading and returns it normalized
+// for the storage layer, along with the problems found in it. Timestamps
+// without an offset are read as wall clock time in the location.
+func validateReading(index int, reading Reading, loc *time.Location) (Reading, []RowError) {
+
+	var errs []RowError
+
+	reading.Resolution = strings.TrimSpace(reading.Resolution)
+	resolution, ok := resolutions[reading.Resolution]
+	if !ok {
+		errs = append(errs, RowError{index, "resolution", "Resolution needs to be one of " + strings.Join(resolutionNames, ", ")})
+	}
+
+	parsed, err := ParseTimestamp(reading.Timestamp, loc)
+	if err != nil {
+		errs = append(errs, RowError{index, "timestamp", "Timestamp needs to be formatted as 2006-01-02 or 2006-01-02 15:04:05"})
+	} else if ok && !resolution.aligned(parsed) {
+		errs = append(errs, RowError{index, "timestamp", fmt.Sprintf("Timestamp needs to be aligned to %s", resolution.boundary())})
+	} else {
+		reading.Timestamp = FormatTimestamp(parsed)
+	}
+
+	if reading.Temperature == nil {
+		errs = append(errs, RowError{index, "temperature", "Temperature is missing"})
+	}
+
+	if reading.Consumption == nil {
+		errs = append(errs, RowError{index, "consumption", "Consumption is missing"})
+	} else if reading.Consumption.Sign() < 0 {
+		errs = append(errs, RowError{index, "consumption", "Consumption cannot be negative"})
+	}
+
+	return reading, errs
+}
+
+// AddReadingsForUser validates and stores the readings for the user.
+// The readings are written all-or-nothing, a single invalid reading
+// rejects the whole batch with the problems reported per row. The
+// policy handles the readings for timestamps which are already taken,
+// the readings replaced are kept as revisions changed by the author.
+// It returns the number of readings inserted and of the stored ones
+// replaced or merged into.
+func (processor UsageProcessor) AddReadingsForUser(
+	userId int,
+	loc *time.Location,
+	readings []Reading,
+	policy DuplicatePolicy,
+	author string) (int, int, error) {
+
+	fmt.Printf("Received request to add %d readings for the user: %d\n", len(readings), userId)
+
+	switch policy {
+	case "":
+		policy = DuplicateReject
+	case DuplicateReject, DuplicateReplace, DuplicateMerge:
+	default:
+		return 0, 0, ValidationError{Reason: fmt.Sprintf("Unknown duplicate policy: %s", policy)}
+	}
+
+	if len(readings) == 0 {
+		return 0, 0, ValidationError{Reason: "No readings provided"}
+	}
+
+	if len(readings) > MaxBatchSize {
+		return 0, 0, ValidationError{Reason: fmt.Sprintf("Batch exceeds the maximum of %d readings", MaxBatchSize)}
+	}
+
+	meters, err := processor.Storage.GetMeters(userId)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Unable to fetch the meters: %s", err.Error())
+	}
+
+	var rowErrors []RowError
+	normalized := make([]Reading, len(readings))
+
+	for index, reading := range readings {
+
+		var errs, meterErrs []RowError
+		normalized[index], errs = validateReading(index, reading, loc)
+		normalized[index], meterErrs = assignMeter(index, normalized[index], meters)
+		rowErrors = append(append(rowErrors, errs...), meterErrs...)
+	}
+
+	if len(rowErrors) > 0 {
+		return 0, 0, ValidationError{Reason: "Invalid readings", Rows: rowErrors}
+	}
+
+	inserted, updated, err := processor.Storage.AddReadings(userId, normalized, policy, author, FormatTimestamp(time.Now()))
+	if err != nil {
+
+		if derr, ok := err.(duplicateError); ok {
+			return 0, 0, ValidationError{
+				Reason: "Duplicate readings",
+				Rows:   []RowError{{derr.index, "timestamp", "Reading already exists for the timestamp"}},
+			}
+		}
+
+		return 0, 0, fmt.Errorf("Unable to store the readings: %s", err.Error())
+	}
+
+	processor.afterIngest(userId, normalized, loc)
+
+	return inserted, updated, nil
+}
+
+// UserReading is a reading which is attributed to a user, as used by
+// the bulk import where a single file carries the data of many users.
+// The timestamp is read in the Location, the time zone of the user.
+type UserReading struct {
+	UserId   int
+	Location *time.Location
+	Reading
+}
+
+// ImportResult summarizes the outcome of importing a batch of readings.
+type ImportResult struct {
+	Inserted   int
+	Duplicates int
+	Rejected   []RowError
+}
+
+// ImportReadings validates and writes a batch of readings in a single
+// transaction. Invalid readings are rejected individually instead of
+// failing the batch, and readings already present for the meter and
+// timestamp are skipped so that an import can be safely repeated.
+// With dryRun set the transaction is rolled back at the end.
+func (processor UsageProcessor) ImportReadings(readings []UserReading, dryRun bool) (ImportResult, error) {
+
+	result := ImportResult{}
+	valid := make([]UserReading, 0, len(readings))
+	meters := make(map[int][]Meter)
+
+	for index, reading := range readings {
+
+		loc := reading.Location
+		if loc == nil {
+			loc = time.UTC
+		}
+
+		if _, ok := meters[reading.UserId]; !ok {
+
+			var err error
+			if meters[reading.UserId], err = processor.Storage.GetMeters(reading.UserId); err != nil {
+				return ImportResult{}, fmt.Errorf("Unable to fetch the meters: %s", err.Error())
+			}
+		}
+
+		normalized, errs := validateReading(index, reading.Reading, loc)
+		if len(errs) == 0 {
+			normalized, errs = assignMeter(index, normalized, meters[reading.UserId])
+		}
+
+		if len(errs) > 0 {
+			result.Rejected = append(result.Rejected, errs...)
+			continue
+		}
+
+		valid = append(valid, UserReading{reading.UserId, loc, normalized})
+	}
+
+	inserted, err := processor.Storage.ImportReadings(valid, FormatTimestamp(time.Now()), dryRun)
+	if err != nil {
+		return ImportResult{}, fmt.Errorf("Unable to import the readings: %s", err.Error())
+	}
+
+	result.Inserted = len(inserted)
+	result.Duplicates = len(valid) - len(inserted)
+
+	// NOTE: Only the readings inserted are published, the duplicates
+	// skipped have not been written.
+	if !dryRun {
+
+		byUser := make(map[int][]Reading)
+		locations := make(map[int]*time.Location)
+		for _, reading := range inserted {
+			byUser[reading.UserId] = append(byUser[reading.UserId], reading.Reading)
+			locations[reading.UserId] = reading.Location
+		}
+
+		for userId, readings := range byUser {
+			processor.afterIngest(userId, readings, locations[userId])
+		}
+	}
+
+	return result, nil
+}
+
+// GetRevisionsForUser fetches the earlier values of the reading of the
+// user at the timestamp, which is presented in the location.
+func (processor UsageProcessor) GetRevisionsForUser(
+	userId int,
+	resolution string,
+	timestamp time.Time,
+	loc *time.Location) ([]Revision, error) {
+
+	fmt.Printf("Received request to fetch the revisions of the reading at: %s for the user: %d\n", timestamp, userId)
+
+	r, ok := resolutions[resolution]
+	if !ok {
+		return nil, ValidationError{Reason: fmt.Sprintf("Unknown resolution: %s", resolution)}
+	}
+
+	revisions, err := processor.Storage.GetRevisions(userId, r, FormatTimestamp(timestamp))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch the revisions: %s", err.Error())
+	}
+
+	for i := range revisions {
+		revisions[i].Timestamp = r.formatTimestamp(revisions[i].Timestamp, loc)
+	}
+
+	return revisions, nil
+}
+
+// GetUserByName resolves the username into the user.
+func (processor UsageProcessor) GetUserByName(username string) (User, error) {
+	return processor.Storage.GetUserByName(username)
+}
@@ -0,0 +1,1004 @@
+package usage
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+type memoryReading struct {
+	id          int
+	userId      int
+	meterId     int
+	timestamp   string
+	consumption Decimal
+	temperature Decimal
+	recordedAt  string
+}
+
+type memoryRevision struct {
+	Revision
+	readingId int
+	userId    int
+}
+
+// recordedForever is the instant since which the readings written
+// without one hold their values, like the recorded_at column default.
+const recordedForever = "0001-01-01 00:00:00"
+
+type memoryToken struct {
+	Token
+	hash string
+}
+
+// MemoryStorage keeps everything in maps and follows the same query
+// semantics as the SQL storage. It is meant for tests and demos, the
+// data is gone once the process exits.
+type MemoryStorage struct {
+	mu       sync.RWMutex
+	users    map[int]User
+	meters   []Meter
+	readings map[string][]memoryReading
+	nextId   map[string]int
+	history  []memoryRevision
+	tokens   map[int]memoryToken
+	nextTkn  int
+	tariffs  []Tariff
+	nextTrf  int
+	budgets  []Budget
+	nextBdg  int
+	alerts   []Alert
+	nextAlt  int
+	webhooks []Webhook
+	nextHook int
+	delivery []Delivery
+	nextDlv  int
+	anomaly  []Anomaly
+	nextAnm  int
+}
+
+func NewMemoryStorage() *MemoryStorage {
+
+	fmt.Println("Received request to create the in-memory storage layer")
+
+	return &MemoryStorage{
+		users:    make(map[int]User),
+		readings: make(map[string][]memoryReading),
+		nextId:   make(map[string]int),
+		tokens:   make(map[int]memoryToken),
+		nextTkn:  1,
+	}
+}
+
+func (storage *MemoryStorage) Close() error {
+	return nil
+}
+
+func (storage *MemoryStorage) AddUser(userId int, username string, passwordHash string) error {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if _, ok := storage.users[userId]; ok {
+		return fmt.Errorf("User already exists: %d", userId)
+	}
+
+	for _, user := range storage.users {
+		if user.UserName == username {
+			return fmt.Errorf("Username already exists: %s", username)
+		}
+	}
+
+	storage.users[userId] = User{UserId: userId, UserName: username, Password: passwordHash, TimeZone: "UTC"}
+	storage.addMeter(userId, UtilityElectricity, defaultUnits[UtilityElectricity], "default")
+	return nil
+}
+
+func (storage *MemoryStorage) AddMeter(userId int, utility string, unit string, label string) (int, error) {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	return storage.addMeter(userId, utility, unit, label), nil
+}
+
+func (storage *MemoryStorage) addMeter(userId int, utility string, unit string, label string) int {
+
+	meter := Meter{MeterId: len(storage.meters) + 1, UserId: userId, Utility: utility, Unit: unit, Label: label}
+	storage.meters = append(storage.meters, meter)
+	return meter.MeterId
+}
+
+func (storage *MemoryStorage) GetMeters(userId int) ([]Meter, error) {
+
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	meters := []Meter{}
+	for _, meter := range storage.meters {
+		if meter.UserId == userId {
+			meters = append(meters, meter)
+		}
+	}
+
+	return meters, nil
+}
+
+// defaultMeter is the first electricity meter of the user, 0 when
+// the user has none.
+func (storage *MemoryStorage) defaultMeter(userId int) int {
+
+	for _, meter := range storage.meters {
+		if meter.UserId == userId && meter.Utility == UtilityElectricity {
+			return meter.MeterId
+		}
+	}
+
+	return 0
+}
+
+func (storage *MemoryStorage) GetUserByName(username string) (User, error) {
+
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	for _, user := range storage.users {
+		if user.UserName == username {
+			return user, nil
+		}
+	}
+
+	return User{}, sql.ErrNoRows
+}
+
+func (storage *MemoryStorage) UpdatePassword(userId int, previousHash string, passwordHash string) error {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if user, ok := storage.users[userId]; ok && user.Password == previousHash {
+		user.Password = passwordHash
+		storage.users[userId] = user
+	}
+
+	return nil
+}
+
+func (storage *MemoryStorage) SetUserTimeZone(userId int, timezone string) error {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	user, ok := storage.users[userId]
+	if !ok {
+		return nil
+	}
+
+	from, to := user.Location(), User{TimeZone: timezone}.Location()
+
+	for _, table := range []string{"days", "months"} {
+		for i, reading := range storage.readings[table] {
+			if reading.userId == userId {
+				storage.readings[table][i].timestamp = rezoned(reading.timestamp, from, to)
+			}
+		}
+	}
+
+	for i, revision := range storage.history {
+		if revision.userId == userId && (revision.Resolution == "D" || revision.Resolution == "M") {
+			storage.history[i].Timestamp = rezoned(revision.Timestamp, from, to)
+		}
+	}
+
+	for i, a := range storage.anomaly {
+		if a.UserId == userId {
+			storage.anomaly[i].Timestamp = rezoned(a.Timestamp, from, to)
+		}
+	}
+
+	user.TimeZone = timezone
+	storage.users[userId] = user
+	return nil
+}
+
+// insert appends the reading to the table. A zero id is assigned
+// the next free id, like an INTEGER PRIMARY KEY column, and a single
+// reading is allowed per meter and timestamp.
+func (storage *MemoryStorage) insert(table string, reading memoryReading) error {
+
+	if reading.id == 0 {
+		reading.id = storage.nextId[table] + 1
+	}
+
+	for _, existing := range storage.readings[table] {
+		if existing.id == reading.id {
+			return fmt.Errorf("Reading already exists: %s, %d", table, reading.id)
+		}
+	}
+
+	if storage.find(table, reading.meterId, reading.timestamp) >= 0 {
+		return fmt.Errorf("Reading already exists: %s, %d, %s", table, reading.meterId, reading.timestamp)
+	}
+
+	if reading.id > storage.nextId[table] {
+		storage.nextId[table] = reading.id
+	}
+
+	storage.readings[table] = append(storage.readings[table], reading)
+	return nil
+}
+
+func (storage *MemoryStorage) AddDailyLimit(userId, dayId, temperature, consumption int, timestamp string) error {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	return storage.insert("days", memoryReading{dayId, userId, storage.defaultMeter(userId), timestamp,
+		NewDecimal(consumption), NewDecimal(temperature), recordedForever})
+}
+
+func (storage *MemoryStorage) AddMonthlyLimit(userId, monthId, temperature, consumption int, timestamp string) error {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	return storage.insert("months", memoryReading{monthId, userId, storage.defaultMeter(userId), timestamp,
+		NewDecimal(consumption), NewDecimal(temperature), recordedForever})
+}
+
+func (storage *MemoryStorage) AddReadings(
+	userId int,
+	readings []Reading,
+	policy DuplicatePolicy,
+	author string,
+	recordedAt string) (int, int, error) {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	// Stage1: Reject the batch before touching any of the readings.
+	if policy != DuplicateReplace && policy != DuplicateMerge {
+
+		seen := make(map[string]bool)
+		for index, reading := range readings {
+
+			table := resolutions[reading.Resolution].Table
+			key := fmt.Sprintf("%s|%d|%s", table, reading.Meter, reading.Timestamp)
+
+			if seen[key] || storage.find(table, reading.Meter, reading.Timestamp) >= 0 {
+				return 0, 0, duplicateError{index}
+			}
+
+			seen[key] = true
+		}
+	}
+
+	// Stage2: Write the readings, keeping the values of the ones
+	// already stored as revisions.
+	var inserted, updated int
+	for _, reading := range readings {
+
+		table := resolutions[reading.Resolution].Table
+
+		i := storage.find(table, reading.Meter, reading.Timestamp)
+		if i < 0 {
+			storage.insert(table, memoryReading{0, userId, reading.Meter, reading.Timestamp,
+				*reading.Consumption, *reading.Temperature, recordedAt})
+			inserted++
+			continue
+		}
+
+		stored := &storage.readings[table][i]
+		storage.history = append(storage.history, memoryRevision{
+			Revision: Revision{
+				Resolution:  reading.Resolution,
+				Meter:       stored.meterId,
+				Timestamp:   stored.timestamp,
+				Temperature: stored.temperature,
+				Consumption: stored.consumption,
+				RecordedAt:  stored.recordedAt,
+				ChangedBy:   author,
+				ChangedAt:   recordedAt,
+			},
+			readingId: stored.id,
+			userId:    userId,
+		})
+
+		if policy == DuplicateMerge {
+			stored.consumption = stored.consumption.Add(*reading.Consumption)
+		} else {
+			stored.consumption = *reading.Consumption
+		}
+
+		stored.temperature = *reading.Temperature
+		stored.recordedAt = recordedAt
+		updated++
+	}
+
+	return inserted, updated, nil
+}
+
+// find returns the position of the reading of the meter at the
+// timestamp in the table, -1 when there is none.
+func (storage *MemoryStorage) find(table string, meterId int, timestamp string) int {
+
+	for i, reading := range storage.readings[table] {
+		if reading.meterId == meterId && reading.timestamp == timestamp {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (storage *MemoryStorage) ImportReadings(readings []UserReading, recordedAt string, dryRun bool) ([]UserReading, error) {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	type key struct {
+		table     string
+		meterId   int
+		timestamp string
+	}
+
+	pending := make(map[key]bool)
+	var inserts []UserReading
+
+	for _, reading := range readings {
+
+		table := resolutions[reading.Resolution].Table
+		k := key{table, reading.Meter, reading.Timestamp}
+
+		if pending[k] || storage.find(table, reading.Meter, reading.Timestamp) >= 0 {
+			continue
+		}
+
+		pending[k] = true
+		inserts = append(inserts, reading)
+	}
+
+	if !dryRun {
+		for _, reading := range inserts {
+			storage.insert(resolutions[reading.Resolution].Table,
+				memoryReading{0, reading.UserId, reading.Meter, reading.Timestamp, *reading.Consumption, *reading.Temperature, recordedAt})
+		}
+	}
+
+	return inserts, nil
+}
+
+func (storage *MemoryStorage) GetUserData(userId int, resolution Resolution, query DataQuery) (DataPage, error) {
+
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	// Stage1: Filter the readings of the user in the range of the query.
+	var matched []memoryReading
+	for _, reading := range storage.totals(userId, resolution, query.meters, query.AsOf) {
+
+		if reading.timestamp < query.Start ||
+			(query.End != "" && reading.timestamp >= query.End) {
+			continue
+		}
+
+		if query.After != nil {
+
+			after := reading.timestamp > query.After.Timestamp
+			before := reading.timestamp < query.After.Timestamp
+
+			if (!query.Descending && !after) || (query.Descending && !before) {
+				continue
+			}
+		}
+
+		matched = append(matched, reading)
+	}
+
+	// Stage2: Order them by the timestamp, which is unique once summed
+	// over the meters.
+	sort.Slice(matched, func(i, j int) bool {
+
+		less := matched[i].timestamp < matched[j].timestamp
+
+		if query.Descending {
+			return !less
+		}
+
+		return less
+	})
+
+	limit := query.Count
+	if limit <= 0 || limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+
+	page := DataPage{}
+
+	for _, reading := range matched {
+
+		if len(page.Data) == limit {
+			page.HasMore = true
+			break
+		}
+
+		page.Data = append(page.Data, []interface{}{
+			resolution.formatTimestamp(reading.timestamp, query.location()),
+			reading.temperature,
+			reading.consumption,
+		})
+
+		page.times = append(page.times, parseStored(reading.timestamp))
+
+		page.Next = &Cursor{
+			Resolution: query.Resolution,
+			Descending: query.Descending,
+			Timestamp:  reading.timestamp,
+		}
+	}
+
+	return page, nil
+}
+
+// readingsAsOf returns the readings of the resolution as they were at
+// the instant, the current ones when it is empty.
+func (storage *MemoryStorage) readingsAsOf(resolution Resolution, asOf string) []memoryReading {
+
+	if asOf == "" {
+		return storage.readings[resolution.Table]
+	}
+
+	var readings []memoryReading
+	for _, reading := range storage.readings[resolution.Table] {
+		if reading.recordedAt <= asOf {
+			readings = append(readings, reading)
+		}
+	}
+
+	for _, revision := range storage.history {
+
+		if revision.Resolution != resolution.Name || revision.RecordedAt > asOf || revision.ChangedAt <= asOf {
+			continue
+		}
+
+		readings = append(readings, memoryReading{revision.readingId, revision.userId, revision.Meter, revision.Timestamp,
+			revision.Consumption, revision.Temperature, revision.RecordedAt})
+	}
+
+	return readings
+}
+
+// totals sums the readings of the user per timestamp over the meters,
+// all of them when nil, in the way of the totals of the SQL storage.
+func (storage *MemoryStorage) totals(userId int, resolution Resolution, meters []int, asOf string) []memoryReading {
+
+	selected := make(map[int]bool)
+	for _, meter := range meters {
+		selected[meter] = true
+	}
+
+	type total struct {
+		memoryReading
+		count int
+	}
+
+	byTimestamp := make(map[string]*total)
+	var timestamps []string
+
+	for _, reading := range storage.readingsAsOf(resolution, asOf) {
+
+		if reading.userId != userId || (meters != nil && !selected[reading.meterId]) {
+			continue
+		}
+
+		t, ok := byTimestamp[reading.timestamp]
+		if !ok {
+			t = &total{memoryReading: memoryReading{userId: userId, timestamp: reading.timestamp}}
+			byTimestamp[reading.timestamp] = t
+			timestamps = append(timestamps, reading.timestamp)
+		}
+
+		t.consumption = t.consumption.Add(reading.consumption)
+		t.temperature = t.temperature.Add(reading.temperature)
+		t.count++
+	}
+
+	totals := make([]memoryReading, 0, len(timestamps))
+	for _, timestamp := range timestamps {
+
+		t := byTimestamp[timestamp]
+		t.temperature = t.temperature.quo(int64(t.count), 6)
+		totals = append(totals, t.memoryReading)
+	}
+
+	return totals
+}
+
+func (storage *MemoryStorage) GetRevisions(userId int, resolution Resolution, timestamp string) ([]Revision, error) {
+
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	revisions := []Revision{}
+	for _, revision := range storage.history {
+		if revision.userId == userId && revision.Resolution == resolution.Name && revision.Timestamp == timestamp {
+			revisions = append(revisions, revision.Revision)
+		}
+	}
+
+	return revisions, nil
+}
+
+func (storage *MemoryStorage) GetLimits(userId int, resolution Resolution, query LimitsQuery) (Limits, error) {
+
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	minTimestamp, maxTimestamp := "0001-01-01 00:00:00", "0001-01-01 00:00:00"
+	limits := Limits{}
+	found := false
+
+	for _, reading := range storage.totals(userId, resolution, query.meters, "") {
+
+		if reading.timestamp < query.Start || (query.End != "" && reading.timestamp >= query.End) {
+			continue
+		}
+
+		if !found || reading.timestamp < minTimestamp {
+			minTimestamp = reading.timestamp
+		}
+
+		if !found || reading.timestamp > maxTimestamp {
+			maxTimestamp = reading.timestamp
+		}
+
+		if !found || reading.consumption.millionths < limits.MinMaxConsumption.Minimum.millionths {
+			limits.MinMaxConsumption.Minimum = reading.consumption
+		}
+
+		if !found || reading.consumption.millionths > limits.MinMaxConsumption.Maximum.millionths {
+			limits.MinMaxConsumption.Maximum = reading.consumption
+		}
+
+		if !found || reading.temperature.millionths < limits.MinMaxTemperature.Minimum.millionths {
+			limits.MinMaxTemperature.Minimum = reading.temperature
+		}
+
+		if !found || reading.temperature.millionths > limits.MinMaxTemperature.Maximum.millionths {
+			limits.MinMaxTemperature.Maximum = reading.temperature
+		}
+
+		found = true
+	}
+
+	limits.MinMaxTimestamp.Minimum = resolution.formatTimestamp(minTimestamp, query.location())
+	limits.MinMaxTimestamp.Maximum = resolution.formatTimestamp(maxTimestamp, query.location())
+
+	return limits, nil
+}
+
+func (storage *MemoryStorage) AddToken(
+	userId int,
+	name string,
+	tokenHash string,
+	scopes []string,
+	createdAt string,
+	expiresAt string) (int, error) {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	for _, token := range storage.tokens {
+		if token.hash == tokenHash {
+			return 0, fmt.Errorf("Token already exists")
+		}
+	}
+
+	token := memoryToken{
+		Token: Token{
+			TokenId:   storage.nextTkn,
+			UserId:    userId,
+			Name:      name,
+			Scopes:    append([]string{}, scopes...),
+			CreatedAt: createdAt,
+			ExpiresAt: expiresAt,
+		},
+		hash: tokenHash,
+	}
+
+	storage.tokens[token.TokenId] = token
+	storage.nextTkn++
+
+	return token.TokenId, nil
+}
+
+func (storage *MemoryStorage) GetTokens(userId int) ([]Token, error) {
+
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	tokens := []Token{}
+	for _, token := range storage.tokens {
+		if token.UserId == userId {
+			tokens = append(tokens, token.Token)
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].TokenId < tokens[j].TokenId
+	})
+
+	return tokens, nil
+}
+
+func (storage *MemoryStorage) GetTokenByHash(tokenHash string) (User, Token, error) {
+
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	for _, token := range storage.tokens {
+
+		if token.hash != tokenHash {
+			continue
+		}
+
+		user, ok := storage.users[token.UserId]
+		if !ok {
+			break
+		}
+
+		user.Password = ""
+		return user, token.Token, nil
+	}
+
+	return User{}, Token{}, sql.ErrNoRows
+}
+
+func (storage *MemoryStorage) TouchToken(tokenId int, lastUsedAt string) error {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if token, ok := storage.tokens[tokenId]; ok {
+		token.LastUsedAt = lastUsedAt
+		storage.tokens[tokenId] = token
+	}
+
+	return nil
+}
+
+func (storage *MemoryStorage) DeleteToken(userId int, tokenId int) error {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if token, ok := storage.tokens[tokenId]; !ok || token.UserId != userId {
+		return sql.ErrNoRows
+	}
+
+	delete(storage.tokens, tokenId)
+	return nil
+}
+
+func (storage *MemoryStorage) AddTariff(tariff Tariff) (int, error) {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	storage.nextTrf++
+	tariff.TariffId = storage.nextTrf
+	storage.tariffs = append(storage.tariffs, tariff)
+
+	return tariff.TariffId, nil
+}
+
+func (storage *MemoryStorage) GetTariffs(userId int, utility string) ([]Tariff, error) {
+
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	tariffs := []Tariff{}
+	for _, tariff := range storage.tariffs {
+		if tariff.UserId == userId && tariff.Utility == utility {
+			tariffs = append(tariffs, tariff)
+		}
+	}
+
+	sort.SliceStable(tariffs, func(i, j int) bool {
+		return tariffs[i].ValidFrom < tariffs[j].ValidFrom
+	})
+
+	return tariffs, nil
+}
+
+func (storage *MemoryStorage) DeleteTariff(userId int, tariffId int) error {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	for i, tariff := range storage.tariffs {
+		if tariff.TariffId == tariffId && tariff.UserId == userId {
+			storage.tariffs = append(storage.tariffs[:i], storage.tariffs[i+1:]...)
+			return nil
+		}
+	}
+
+	return sql.ErrNoRows
+}
+
+func (storage *MemoryStorage) AddBudget(budget Budget) (int, error) {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	storage.nextBdg++
+	budget.BudgetId = storage.nextBdg
+	storage.budgets = append(storage.budgets, budget)
+
+	return budget.BudgetId, nil
+}
+
+func (storage *MemoryStorage) GetBudgets(userId int) ([]Budget, error) {
+
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	budgets := []Budget{}
+	for _, budget := range storage.budgets {
+		if budget.UserId == userId {
+			budgets = append(budgets, budget)
+		}
+	}
+
+	return budgets, nil
+}
+
+func (storage *MemoryStorage) DeleteBudget(userId int, budgetId int) error {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	for i, budget := range storage.budgets {
+		if budget.BudgetId == budgetId && budget.UserId == userId {
+
+			storage.budgets = append(storage.budgets[:i], storage.budgets[i+1:]...)
+
+			alerts := storage.alerts[:0]
+			for _, alert := range storage.alerts {
+				if alert.BudgetId != budgetId {
+					alerts = append(alerts, alert)
+				}
+			}
+
+			storage.alerts = alerts
+			return nil
+		}
+	}
+
+	return sql.ErrNoRows
+}
+
+func (storage *MemoryStorage) AddAlert(alert Alert) (bool, error) {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	for _, other := range storage.alerts {
+		if other.BudgetId == alert.BudgetId && other.Kind == alert.Kind && other.Period == alert.Period {
+			return false, nil
+		}
+	}
+
+	storage.nextAlt++
+	alert.AlertId = storage.nextAlt
+	storage.alerts = append(storage.alerts, alert)
+
+	return true, nil
+}
+
+func (storage *MemoryStorage) GetAlerts(userId int) ([]Alert, error) {
+
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	alerts := []Alert{}
+	for i := len(storage.alerts) - 1; i >= 0; i-- {
+		if storage.alerts[i].UserId == userId {
+			alerts = append(alerts, storage.alerts[i])
+		}
+	}
+
+	sort.SliceStable(alerts, func(i, j int) bool {
+		return alerts[i].TriggeredAt > alerts[j].TriggeredAt
+	})
+
+	return alerts, nil
+}
+
+func (storage *MemoryStorage) AddWebhook(webhook Webhook) (int, error) {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	storage.nextHook++
+	webhook.WebhookId = storage.nextHook
+	storage.webhooks = append(storage.webhooks, webhook)
+
+	return webhook.WebhookId, nil
+}
+
+func (storage *MemoryStorage) GetWebhooks(userId int) ([]Webhook, error) {
+
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	webhooks := []Webhook{}
+	for _, webhook := range storage.webhooks {
+		if webhook.UserId == userId {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+
+	return webhooks, nil
+}
+
+func (storage *MemoryStorage) DeleteWebhook(userId int, webhookId int) error {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	for i, webhook := range storage.webhooks {
+		if webhook.WebhookId == webhookId && webhook.UserId == userId {
+
+			storage.webhooks = append(storage.webhooks[:i], storage.webhooks[i+1:]...)
+
+			deliveries := storage.delivery[:0]
+			for _, d := range storage.delivery {
+				if d.WebhookId != webhookId {
+					deliveries = append(deliveries, d)
+				}
+			}
+
+			storage.delivery = deliveries
+			return nil
+		}
+	}
+
+	return sql.ErrNoRows
+}
+
+func (storage *MemoryStorage) AddDeliveries(deliveries []Delivery) error {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	for _, d := range deliveries {
+		storage.nextDlv++
+		d.DeliveryId = storage.nextDlv
+		storage.delivery = append(storage.delivery, d)
+	}
+
+	return nil
+}
+
+func (storage *MemoryStorage) GetDueDeliveries(now string, limit int) ([]Delivery, error) {
+
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	deliveries := []Delivery{}
+	for _, d := range storage.delivery {
+
+		if d.Status != DeliveryPending || d.NextAttemptAt > now {
+			continue
+		}
+
+		for _, webhook := range storage.webhooks {
+			if webhook.WebhookId == d.WebhookId {
+				d.url, d.secret = webhook.URL, webhook.Secret
+			}
+		}
+
+		deliveries = append(deliveries, d)
+	}
+
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].NextAttemptAt < deliveries[j].NextAttemptAt
+	})
+
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+
+	return deliveries, nil
+}
+
+func (storage *MemoryStorage) UpdateDelivery(delivery Delivery) error {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	for i, d := range storage.delivery {
+		if d.DeliveryId == delivery.DeliveryId {
+			delivery.url, delivery.secret = "", ""
+			storage.delivery[i] = delivery
+		}
+	}
+
+	return nil
+}
+
+func (storage *MemoryStorage) GetDeliveries(userId int, webhookId int, limit int) ([]Delivery, error) {
+
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	deliveries := []Delivery{}
+	for i := len(storage.delivery) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		if d := storage.delivery[i]; d.UserId == userId && d.WebhookId == webhookId {
+			deliveries = append(deliveries, d)
+		}
+	}
+
+	return deliveries, nil
+}
+
+func (storage *MemoryStorage) AddAnomalies(anomalies []Anomaly) error {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	for _, a := range anomalies {
+
+		exists := false
+		for _, other := range storage.anomaly {
+			exists = exists || (other.UserId == a.UserId && other.Utility == a.Utility &&
+				other.Meter == a.Meter && other.Timestamp == a.Timestamp)
+		}
+
+		if !exists {
+			storage.nextAnm++
+			a.AnomalyId = storage.nextAnm
+			storage.anomaly = append(storage.anomaly, a)
+		}
+	}
+
+	return nil
+}
+
+func (storage *MemoryStorage) GetAnomalies(userId int, utility string, meter int, start string, end string) ([]Anomaly, error) {
+
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	anomalies := []Anomaly{}
+	for _, a := range storage.anomaly {
+		if a.UserId == userId && a.Utility == utility && a.Meter == meter && a.Timestamp >= start && a.Timestamp < end {
+			anomalies = append(anomalies, a)
+		}
+	}
+
+	sort.SliceStable(anomalies, func(i, j int) bool {
+		return anomalies[i].Timestamp < anomalies[j].Timestamp
+	})
+
+	return anomalies, nil
+}
+
+func (storage *MemoryStorage) AcknowledgeAnomaly(userId int, anomalyId int, acknowledgedAt string) error {
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	for i, a := range storage.anomaly {
+		if a.AnomalyId == anomalyId && a.UserId == userId {
+			if a.AcknowledgedAt == "" {
+				storage.anomaly[i].AcknowledgedAt = acknowledgedAt
+			}
+			return nil
+		}
+	}
+
+	return sql.ErrNoRows
+}
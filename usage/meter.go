@@ -0,0 +1,137 @@
+package usage
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	UtilityElectricity = "electricity"
+	UtilityGas         = "gas"
+	UtilityWater       = "water"
+	UtilityHeat        = "heat"
+)
+
+// defaultUnits is the unit of the readings of a meter
+// of the utility, when none is provided for it.
+var defaultUnits = map[string]string{
+	UtilityElectricity: "kWh",
+	UtilityGas:         "m3",
+	UtilityWater:       "m3",
+	UtilityHeat:        "kWh",
+}
+
+// AddMeterForUser adds a meter for the utility to the user, the unit
+// the readings of the meter are sent in defaulting to the usual unit
+// of the utility.
+func (processor UsageProcessor) AddMeterForUser(userId int, utility string, unit string, label string) (Meter, error) {
+
+	fmt.Printf("Received request to add a %s meter for the user: %d\n", utility, userId)
+
+	utility = strings.TrimSpace(utility)
+	if _, ok := defaultUnits[utility]; !ok {
+		return Meter{}, ValidationError{Reason: fmt.Sprintf("Unknown utility: %s", utility)}
+	}
+
+	if unit = strings.TrimSpace(unit); unit == "" {
+		unit = defaultUnits[utility]
+	}
+
+	unit, u, ok := lookupUnit(unit)
+	if !ok || u.dimension != dimensions[utility] {
+		return Meter{}, ValidationError{Reason: fmt.Sprintf("Unit %s does not apply to %s", unit, utility)}
+	}
+
+	meter := Meter{UserId: userId, Utility: utility, Unit: unit, Label: strings.TrimSpace(label)}
+
+	var err error
+	if meter.MeterId, err = processor.Storage.AddMeter(userId, meter.Utility, meter.Unit, meter.Label); err != nil {
+		return Meter{}, fmt.Errorf("Unable to add the meter: %s", err.Error())
+	}
+
+	return meter, nil
+}
+
+// GetMetersForUser lists the meters of the user, the default
+// electricity meter of the user being the first one.
+func (processor UsageProcessor) GetMetersForUser(userId int) ([]Meter, error) {
+	return processor.Storage.GetMeters(userId)
+}
+
+// resolveMeters picks the meters of the user which the readings are
+// summed over, either the single meter or those of the utility, along
+// with the utility of the meters.
+func (processor UsageProcessor) resolveMeters(userId int, meterId int, utility string) ([]int, string, error) {
+
+	if meterId != 0 && utility != "" {
+		return nil, "", ValidationError{Reason: "Either the meter or the utility can be selected"}
+	}
+
+	if utility == "" {
+		utility = UtilityElectricity
+	}
+
+	if _, ok := defaultUnits[utility]; !ok {
+		return nil, "", ValidationError{Reason: fmt.Sprintf("Unknown utility: %s", utility)}
+	}
+
+	meters, err := processor.Storage.GetMeters(userId)
+	if err != nil {
+		return nil, "", fmt.Errorf("Unable to fetch the meters: %s", err.Error())
+	}
+
+	selected := []int{}
+	for _, meter := range meters {
+
+		if meterId != 0 && meter.MeterId == meterId {
+			return []int{meterId}, meter.Utility, nil
+		}
+
+		if meterId == 0 && meter.Utility == utility {
+			selected = append(selected, meter.MeterId)
+		}
+	}
+
+	if meterId != 0 {
+		return nil, "", ValidationError{Reason: fmt.Sprintf("Unknown meter: %d", meterId)}
+	}
+
+	return selected, utility, nil
+}
+
+// assignMeter sets the meter of a reading which comes without one to
+// the default meter of the user, and rejects the meters which do not
+// belong to the user. The consumption is converted from the unit of
+// the meter to the default unit of its utility, in which it is stored.
+func assignMeter(index int, reading Reading, meters []Meter) (Reading, []RowError) {
+
+	for _, meter := range meters {
+
+		// NOTE: Every user gets a default electricity meter when it is
+		// created, the first one of the user for the utility.
+		if reading.Meter == 0 && meter.Utility == UtilityElectricity {
+			reading.Meter = meter.MeterId
+		}
+
+		if meter.MeterId != reading.Meter {
+			continue
+		}
+
+		if _, u, ok := lookupUnit(meter.Unit); !ok || u.dimension != dimensions[meter.Utility] {
+			return reading, []RowError{{index, "meter", fmt.Sprintf("Unknown unit of the meter: %s", meter.Unit)}}
+		}
+
+		if reading.Consumption != nil {
+			consumption := toBase(*reading.Consumption, meter.Unit)
+			reading.Consumption = &consumption
+		}
+
+		return reading, nil
+	}
+
+	if reading.Meter == 0 {
+		return reading, []RowError{{index, "meter", "User has no electricity meter"}}
+	}
+
+	return reading, []RowError{{index, "meter", fmt.Sprintf("Unknown meter: %d", reading.Meter)}}
+}
@@ -0,0 +1,255 @@
+package usage
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// migration is a numbered change of the schema along with the
+// statements reverting it. The migrations of a dialect are numbered
+// from 1 without gaps, in the order in which they are applied.
+type migration struct {
+	version     int
+	description string
+	up          []string
+	down        []string
+}
+
+// MigrationStatus describes a single migration and when it was
+// applied to the database, AppliedAt is empty when it is pending.
+type MigrationStatus struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+	AppliedAt   string `json:"applied_at,omitempty"`
+}
+
+// schemaVersionTable keeps a row for every migration applied to the
+// database, the highest version being the version of the schema.
+const schemaVersionTable = `CREATE TABLE IF NOT EXISTS schema_version (
+	version INTEGER PRIMARY KEY,
+	description TEXT NOT NULL,
+	applied_at TEXT NOT NULL
+)`
+
+// OpenStorage connects to the SQL storage selected by the config
+// without migrating its schema, for the tools managing the migrations.
+func OpenStorage(config Config) (UsageStorage, error) {
+
+	switch config.Driver {
+	case "", "sqlite3":
+		return openSQLStorage(sqliteDialect, config.DBLocation)
+	case "postgres":
+		return openSQLStorage(postgresDialect, config.DBLocation)
+	default:
+		return UsageStorage{}, fmt.Errorf("Storage driver has no schema to migrate: %s", config.Driver)
+	}
+}
+
+// LatestSchemaVersion is the version of the schema this binary expects.
+func (storage UsageStorage) LatestSchemaVersion() int {
+	return len(storage.dialect.migrations)
+}
+
+// SchemaVersion is the version of the schema of the database, 0 when
+// none of the migrations have been applied yet.
+func (storage UsageStorage) SchemaVersion() (int, error) {
+
+	var version int
+	err := storage.DB.QueryRow(`SELECT COALESCE(max(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+// checkSchemaVersion fetches the version of the schema, failing when
+// the database has been migrated by a more recent binary.
+func (storage UsageStorage) checkSchemaVersion() (int, error) {
+
+	version, err := storage.SchemaVersion()
+	if err != nil {
+		return 0, fmt.Errorf("Unable to fetch the schema version: %s", err.Error())
+	}
+
+	if version > storage.LatestSchemaVersion() {
+		return version, fmt.Errorf("Database schema version %d is ahead of the version %d known to this binary",
+			version, storage.LatestSchemaVersion())
+	}
+
+	return version, nil
+}
+
+// MigrateUp applies the pending migrations up to and including the
+// target version, 0 meaning the latest one.
+func (storage UsageStorage) MigrateUp(target int) error {
+
+	if target <= 0 {
+		target = storage.LatestSchemaVersion()
+	}
+
+	if target > storage.LatestSchemaVersion() {
+		return fmt.Errorf("Unknown schema version: %d", target)
+	}
+
+	version, err := storage.checkSchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	if target < version {
+		return ValidationError{Reason: fmt.Sprintf("Target %d is behind the current version %d, use down", target, version)}
+	}
+
+	for _, m := range storage.dialect.migrations[version:target] {
+
+		fmt.Printf("Applying migration %d: %s\n", m.version, m.description)
+
+		if err := storage.migrate(m, true); err != nil {
+			return fmt.Errorf("Unable to apply migration %d: %s", m.version, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// MigrateDown reverts the applied migrations above the target version.
+func (storage UsageStorage) MigrateDown(target int) error {
+
+	if target < 0 {
+		return fmt.Errorf("Unknown schema version: %d", target)
+	}
+
+	version, err := storage.checkSchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for i := version; i > target; i-- {
+
+		m := storage.dialect.migrations[i-1]
+		fmt.Printf("Reverting migration %d: %s\n", m.version, m.description)
+
+		if err := storage.migrate(m, false); err != nil {
+			return fmt.Errorf("Unable to revert migration %d: %s", m.version, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// MigrationStatus lists the migrations known to this binary along with
+// the ones applied to the database by a more recent binary.
+func (storage UsageStorage) MigrationStatus() ([]MigrationStatus, error) {
+
+	rows, err := storage.DB.Query(`SELECT version, description, applied_at FROM schema_version ORDER BY version`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	applied := make(map[int]MigrationStatus)
+	var ahead []MigrationStatus
+
+	for rows.Next() {
+
+		status := MigrationStatus{}
+		if err := rows.Scan(&status.Version, &status.Description, &status.AppliedAt); err != nil {
+			return nil, err
+		}
+
+		applied[status.Version] = status
+		if status.Version > storage.LatestSchemaVersion() {
+			ahead = append(ahead, status)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	statuses := []MigrationStatus{}
+	for _, m := range storage.dialect.migrations {
+
+		status := MigrationStatus{Version: m.version, Description: m.description}
+		status.AppliedAt = applied[m.version].AppliedAt
+		statuses = append(statuses, status)
+	}
+
+	return append(statuses, ahead...), nil
+}
+
+// migrate applies or reverts the migration along with its row in the
+// schema_version table in a single transaction.
+func (storage UsageStorage) migrate(m migration, up bool) error {
+
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	statements := m.down
+	if up {
+		statements = m.up
+	}
+
+	for _, statement := range statements {
+
+		result, err := tx.Exec(statement)
+		if err != nil {
+			return fmt.Errorf("%s, error: %s", statement, err.Error())
+		}
+
+		// NOTE: The rows deleted by a migration are gone for good, their
+		// count goes to the log so that the loss can be audited.
+		if strings.HasPrefix(statement, "DELETE") {
+			if removed, err := result.RowsAffected(); err == nil && removed > 0 {
+				fmt.Printf("Removed %d rows: %s\n", removed, statement)
+			}
+		}
+	}
+
+	// NOTE: The baseline is created with IF NOT EXISTS so that databases
+	// created before the schema was versioned are adopted, these may still
+	// lack the columns which were added to their tables later on.
+	if up && m.version == 1 {
+		if err := storage.addMissingColumns(tx); err != nil {
+			return err
+		}
+	}
+
+	if up {
+		q := `INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)`
+		_, err = tx.Exec(storage.rebind(q), m.version, m.description, FormatTimestamp(time.Now()))
+	} else {
+		_, err = tx.Exec(storage.rebind(`DELETE FROM schema_version WHERE version = ?`), m.version)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (storage UsageStorage) addMissingColumns(tx *sql.Tx) error {
+
+	for _, alteration := range storage.dialect.alterations {
+
+		exists, err := storage.dialect.hasColumn(tx, alteration.table, alteration.column)
+		if err != nil {
+			return fmt.Errorf("Unable to inspect the table: %s, error: %s", alteration.table, err.Error())
+		}
+
+		if exists {
+			continue
+		}
+
+		if _, err := tx.Exec(alteration.schema); err != nil {
+			return fmt.Errorf("%s, error: %s", alteration.schema, err.Error())
+		}
+	}
+
+	return nil
+}
@@ -1,15 +1,137 @@
 package usage
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type User struct {
 	UserId   int    `db:"user_id"`
 	UserName string `db:"username"`
 	Password string `db:"password"`
+	TimeZone string `db:"timezone"`
+}
+
+// Location returns the time zone of the user, falling
+// back to UTC for users without a valid time zone.
+func (user User) Location() *time.Location {
+
+	loc, err := time.LoadLocation(user.TimeZone)
+	if err != nil || user.TimeZone == "" {
+		return time.UTC
+	}
+
+	return loc
 }
 
 type UserData struct {
-	Timestamp   string `json:"timestamp"`
-	Temperature int    `json:"temperature"`
-	Consumption int    `json:"consumption"`
+	Timestamp   string  `json:"timestamp"`
+	Temperature Decimal `json:"temperature"`
+	Consumption Decimal `json:"consumption"`
+}
+
+// DataQuery describes the range of data requested for a user. The
+// range starts at Start (inclusive) and ends before End (exclusive),
+// with an empty End leaving the range open. Count is capped at
+// MaxPageSize, with zero fetching a full page. A non-nil After
+// continues the listing behind the row the cursor points to. Derived
+// requests the resolution to be rolled up from the daily readings
+// instead of being read from its own table. Start and End are stored
+// timestamps in UTC, while the data is bucketed and presented in the
+// Location, which defaults to UTC.
+type DataQuery struct {
+	Resolution string
+	Start      string
+	End        string
+	Count      int
+	Descending bool
+	After      *Cursor
+	Derived    bool
+	Location   *time.Location
+	// AsOf is the instant, stored UTC, as of which the data is
+	// returned, ignoring the writes since. Empty for the latest data.
+	AsOf string
+	// Meter selects the readings of a single meter, Utility the totals
+	// over the meters of the utility, electricity when neither is set.
+	Meter   int
+	Utility string
+	// Units are the comma separated units the values are presented in,
+	// the units they are stored in by default.
+	Units string
+	// Cost adds a column with the cost of the consumption of the rows,
+	// priced by the tariffs of the utility.
+	Cost bool
+	// DegreeDays adds the heating and cooling degree days of the rows,
+	// Normalized their consumption normalized to the weather, both from
+	// the BaseTemperature in the temperature unit presented.
+	DegreeDays      bool
+	Normalized      bool
+	BaseTemperature string
+	// Anomalies flags the daily rows whose consumption is an anomaly
+	// at the Sensitivity.
+	Anomalies   bool
+	Sensitivity string
+	// Gaps reports the ranges of the buckets missing from the page,
+	// Fill fills them with null, zero, previous or linear values,
+	// marking the rows filled as estimated in the last column.
+	Gaps bool
+	Fill string
+
+	// meters are the meters the readings are summed over, as resolved
+	// by the processor from the Meter and Utility. Nil for all of them.
+	meters []int
+}
+
+func (query DataQuery) location() *time.Location {
+
+	if query.Location == nil {
+		return time.UTC
+	}
+
+	return query.Location
+}
+
+// LimitsQuery selects the meters the limits are computed over, like
+// the Meter and Utility of the DataQuery, and the location in which
+// the timestamps are presented. Start and End bound the readings like
+// in the DataQuery, all of them being covered when left empty.
+type LimitsQuery struct {
+	Start    string
+	End      string
+	Meter    int
+	Utility  string
+	Units    string
+	Location *time.Location
+
+	meters []int
+}
+
+func (query LimitsQuery) location() *time.Location {
+
+	if query.Location == nil {
+		return time.UTC
+	}
+
+	return query.Location
+}
+
+// DataPage is a single page of data along with the cursor
+// pointing at the last row, to fetch the page which follows.
+// Columns names the values of the rows when they deviate from
+// the timestamp, temperature, consumption default.
+type DataPage struct {
+	Data    [][]interface{}
+	Columns []string
+	Next    *Cursor
+	HasMore bool
+	// Units are set when other units than the stored ones are requested.
+	Units *Units
+	// Gaps are the ranges of the buckets missing from the page, when
+	// requested.
+	Gaps []Gap
+
+	// times holds the instants of the rows of the data.
+	times []time.Time
 }
 
 type MinMaxTimestamp struct {
@@ -18,13 +140,13 @@ type MinMaxTimestamp struct {
 }
 
 type MinMaxConsumption struct {
-	Minimum int `json:"minimum"`
-	Maximum int `json:"maximum"`
+	Minimum Decimal `json:"minimum"`
+	Maximum Decimal `json:"maximum"`
 }
 
 type MinMaxTemperature struct {
-	Minimum int `json:"minimum"`
-	Maximum int `json:"maximum"`
+	Minimum Decimal `json:"minimum"`
+	Maximum Decimal `json:"maximum"`
 }
 
 type Limits struct {
@@ -34,6 +156,227 @@ type Limits struct {
 }
 
 type DailyMonthlyLimits struct {
-	Daily   Limits `json:"daily"`
-	Monthly Limits `json:"monthly"`
+	Daily         Limits `json:"daily"`
+	Monthly       Limits `json:"monthly"`
+	Hourly        Limits `json:"hourly"`
+	QuarterHourly Limits `json:"quarter_hourly"`
+	// Units are set when other units than the stored ones are requested.
+	Units *Units `json:"units,omitempty"`
+}
+
+// The scopes which can be granted to an API token.
+const (
+	ScopeLimitsRead = "limits:read"
+	ScopeDataRead   = "data:read"
+	ScopeDataWrite  = "data:write"
+)
+
+type Token struct {
+	TokenId    int      `json:"id"`
+	UserId     int      `json:"-"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"created_at"`
+	ExpiresAt  string   `json:"expires_at,omitempty"`
+	LastUsedAt string   `json:"last_used_at,omitempty"`
+}
+
+// HasScope reports whether the token has been granted the scope.
+func (token Token) HasScope(scope string) bool {
+
+	for _, s := range token.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reading is a single temperature, consumption reading sent by
+// the client for one of the stored resolutions.
+type Reading struct {
+	Resolution  string   `json:"resolution"`
+	Timestamp   string   `json:"timestamp"`
+	Temperature *Decimal `json:"temperature"`
+	Consumption *Decimal `json:"consumption"`
+	// Meter is the id of the meter the reading belongs to, the default
+	// electricity meter of the user when left out.
+	Meter int `json:"meter,omitempty"`
+}
+
+// Meter is a single meter of the user for one of the utilities,
+// its readings being in the unit of the meter.
+type Meter struct {
+	MeterId int    `json:"id"`
+	UserId  int    `json:"-"`
+	Utility string `json:"utility"`
+	Unit    string `json:"unit"`
+	Label   string `json:"label"`
+}
+
+// Revision holds the values a reading had before it was replaced or
+// merged with a correction, along with who changed it and when.
+type Revision struct {
+	Resolution  string  `json:"resolution"`
+	Meter       int     `json:"meter"`
+	Timestamp   string  `json:"timestamp"`
+	Temperature Decimal `json:"temperature"`
+	Consumption Decimal `json:"consumption"`
+	RecordedAt  string  `json:"recorded_at"`
+	ChangedBy   string  `json:"changed_by"`
+	ChangedAt   string  `json:"changed_at"`
+}
+
+// Tariff prices the consumption of a utility of the user while it is
+// valid, from ValidFrom up to ValidTo, which is empty for a tariff
+// without an end. The consumption is priced at the flat Rate, by the
+// Tiers of the monthly consumption, or by the Windows of the time of
+// day with the Rate applying outside of them. The StandingCharge is
+// due for every day the tariff is valid. Prices are per unit of the
+// consumption as stored, e.g. per kWh for electricity.
+type Tariff struct {
+	TariffId       int      `json:"id"`
+	UserId         int      `json:"-"`
+	Utility        string   `json:"utility"`
+	Name           string   `json:"name"`
+	Currency       string   `json:"currency"`
+	ValidFrom      string   `json:"valid_from"`
+	ValidTo        string   `json:"valid_to,omitempty"`
+	StandingCharge Decimal  `json:"standing_charge"`
+	Rate           *Decimal `json:"rate,omitempty"`
+	Tiers          []Tier   `json:"tiers,omitempty"`
+	Windows        []Window `json:"windows,omitempty"`
+}
+
+// Tier is a block of the consumption of a calendar month, priced at
+// the rate up to the consumption of the month. The last tier has no
+// upper bound.
+type Tier struct {
+	UpTo *Decimal `json:"up_to,omitempty"`
+	Rate Decimal  `json:"rate"`
+}
+
+// Window is a time of day, from From up to To on the wall clock of the
+// user, priced at its own rate. Days restricts the window to some days
+// of the week, e.g. "mon", and a window ending before it starts runs
+// past midnight.
+type Window struct {
+	From string   `json:"from"`
+	To   string   `json:"to"`
+	Days []string `json:"days,omitempty"`
+	Rate Decimal  `json:"rate"`
+}
+
+// The metrics a budget can limit.
+const (
+	MetricConsumption = "consumption"
+	MetricCost        = "cost"
+)
+
+// Budget limits the consumption or the cost of a utility of the user,
+// or of a single meter, over each day (D) or month (M). The periods
+// follow the wall clock of the TimeZone, the one of the user when the
+// budget was set. The Limit is in the unit the consumption is stored
+// in, or in the currency of the tariffs for the cost.
+type Budget struct {
+	BudgetId int     `json:"id"`
+	UserId   int     `json:"-"`
+	Name     string  `json:"name"`
+	Utility  string  `json:"utility"`
+	Meter    int     `json:"meter,omitempty"`
+	Metric   string  `json:"metric"`
+	Period   string  `json:"period"`
+	Limit    Decimal `json:"limit"`
+	TimeZone string  `json:"timezone"`
+}
+
+// The kinds of the alerts raised for a budget.
+const (
+	// AlertProjected is raised when the value of the period is on
+	// track to exceed the limit by the end of the period.
+	AlertProjected = "projected"
+	// AlertExceeded is raised when the value of the period is over the limit.
+	AlertExceeded = "exceeded"
+)
+
+// Alert is raised at most once for each kind, budget and period, with
+// the value of the period so far and the value it is projected to
+// reach by the end of it at the time it was raised. Period is the
+// local date the period starts on.
+type Alert struct {
+	AlertId     int     `json:"id"`
+	UserId      int     `json:"-"`
+	BudgetId    int     `json:"budget"`
+	Kind        string  `json:"kind"`
+	Period      string  `json:"period"`
+	Value       Decimal `json:"value"`
+	Projected   Decimal `json:"projected"`
+	Limit       Decimal `json:"limit"`
+	TriggeredAt string  `json:"triggered_at"`
+}
+
+// The events the webhooks can subscribe to.
+const (
+	EventReadingIngested = "reading.ingested"
+	EventBudgetExceeded  = "budget.exceeded"
+	EventDataGap         = "data.gap"
+)
+
+// Webhook posts the events it subscribes to to the URL, signed with the
+// secret. The secret is only returned once, when the webhook is added.
+type Webhook struct {
+	WebhookId int      `json:"id"`
+	UserId    int      `json:"-"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret,omitempty"`
+	CreatedAt string   `json:"created_at"`
+}
+
+// The states of a delivery.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Delivery is the attempt to post an event to a webhook, retried until
+// it is delivered or the attempts run out, along with the outcome of
+// the latest attempt.
+type Delivery struct {
+	DeliveryId    int             `json:"id"`
+	WebhookId     int             `json:"webhook"`
+	UserId        int             `json:"-"`
+	Event         string          `json:"event"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	ResponseCode  int             `json:"response_code,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	CreatedAt     string          `json:"created_at"`
+	NextAttemptAt string          `json:"next_attempt_at,omitempty"`
+	DeliveredAt   string          `json:"delivered_at,omitempty"`
+
+	// url and secret are those of the webhook, for the due deliveries.
+	url    string
+	secret string
+}
+
+// Anomaly is a day whose consumption deviates from the one expected
+// from the days before it, detected over the totals of the Utility or
+// over a single Meter. It is stored once per day, so that it is not
+// raised again once acknowledged. Timestamp is the stored timestamp of
+// the day, presented as its local date.
+type Anomaly struct {
+	AnomalyId      int     `json:"id"`
+	UserId         int     `json:"-"`
+	Utility        string  `json:"utility"`
+	Meter          int     `json:"meter,omitempty"`
+	Timestamp      string  `json:"timestamp"`
+	Consumption    Decimal `json:"consumption"`
+	Expected       Decimal `json:"expected"`
+	Score          Decimal `json:"score"`
+	DetectedAt     string  `json:"detected_at"`
+	AcknowledgedAt string  `json:"acknowledged_at,omitempty"`
 }
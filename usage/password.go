@@ -0,0 +1,103 @@
+package usage
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against when a login fails before a real
+// hash could be checked, so that the response time of a failed login
+// does not reveal whether the username exists.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("usage-api-dummy-password"), bcrypt.DefaultCost)
+
+// hashPassword returns the salted bcrypt hash of the password which
+// is the only form in which the password is persisted.
+func hashPassword(password string) (string, error) {
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// isPasswordHash reports whether the stored value is a bcrypt hash
+// or a legacy plaintext password written before hashing was introduced.
+func isPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") ||
+		strings.HasPrefix(stored, "$2b$") ||
+		strings.HasPrefix(stored, "$2y$")
+}
+
+// verifyPassword checks the password against the stored value. The
+// second return value is set when the stored value is a legacy plaintext
+// password which matched and therefore needs to be rehashed.
+func verifyPassword(stored string, password string) (bool, bool) {
+
+	if isPasswordHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil, false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1 {
+		return true, true
+	}
+
+	// Spend the same amount of time as a failed bcrypt comparison.
+	rejectPassword(password)
+	return false, false
+}
+
+// rejectPassword burns the time of a bcrypt comparison for the cases
+// in which there is no stored hash to compare against.
+func rejectPassword(password string) {
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+// AddNewUser creates the user with the password stored as a hash.
+func (processor UsageProcessor) AddNewUser(userId int, username string, password string) error {
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return fmt.Errorf("Unable to hash the password for the user: %s", err.Error())
+	}
+
+	return processor.Storage.AddUser(userId, username, hash)
+}
+
+// GetUser fetches the user with the provided username and verifies
+// the password against the stored hash. Users still carrying a plaintext
+// password from before hashing was introduced get it rehashed on
+// their first successful login.
+func (processor UsageProcessor) GetUser(username string, password string) (User, error) {
+
+	user, err := processor.Storage.GetUserByName(username)
+	if err != nil {
+		rejectPassword(password)
+		return User{}, err
+	}
+
+	valid, rehash := verifyPassword(user.Password, password)
+	if !valid {
+		return User{}, fmt.Errorf("Invalid password for the user: %s", username)
+	}
+
+	if rehash {
+
+		hash, err := hashPassword(password)
+		if err != nil {
+			return User{}, fmt.Errorf("Unable to hash the password for the user: %s", err.Error())
+		}
+
+		if err := processor.Storage.UpdatePassword(user.UserId, user.Password, hash); err != nil {
+			return User{}, fmt.Errorf("Unable to migrate the password for the user: %s", err.Error())
+		}
+
+		user.Password = hash
+	}
+
+	return user, nil
+}
@@ -1,20 +1,41 @@
 package usage
 
-import "fmt"
-
+import (
+	"fmt"
+	"time"
+)
+
+// Config selects the storage backend through the Driver, either
+// "sqlite3" (the default), "postgres" or "memory". DBLocation is the
+// path of the SQLite database or the connection string of PostgreSQL,
+// the in-memory storage ignores it.
 type Config struct {
+	Driver     string
 	DBLocation string
 }
 
 type UsageProcessor struct {
-	Storage UsageStorage
+	Storage Storage
 }
 
 func NewProcessor(config Config) (UsageProcessor, error) {
 
 	fmt.Println("Received a request to create a new processor")
 
-	storage, err := NewStorage(config.DBLocation)
+	var storage Storage
+	var err error
+
+	switch config.Driver {
+	case "", "sqlite3":
+		storage, err = NewStorage(config.DBLocation)
+	case "postgres":
+		storage, err = NewPostgresStorage(config.DBLocation)
+	case "memory":
+		storage = NewMemoryStorage()
+	default:
+		err = fmt.Errorf("Unknown storage driver: %s", config.Driver)
+	}
+
 	if err != nil {
 		return UsageProcessor{}, err
 	}
@@ -24,41 +45,189 @@ func NewProcessor(config Config) (UsageProcessor, error) {
 	}, nil
 }
 
-// GetLimitsForUser fetches the daily and monthly limits for the
-// temperature, consumption and timestamp for the provided user.
-func (processor UsageProcessor) GetLimitsForUser(userId int) (DailyMonthlyLimits, error) {
+// GetLimitsForUser fetches the limits for the temperature, consumption
+// and timestamp for the provided user at each of the stored resolutions,
+// over the meters selected by the query and in the units requested.
+func (processor UsageProcessor) GetLimitsForUser(userId int, query LimitsQuery) (DailyMonthlyLimits, error) {
 
 	fmt.Printf("Received request to fetch usage limits for the user: %d\n", userId)
 
-	dailyLimits, err := processor.Storage.GetDailyLimits(userId)
+	meters, utility, err := processor.resolveMeters(userId, query.Meter, query.Utility)
+	if err != nil {
+		return DailyMonthlyLimits{}, err
+	}
 
+	units, err := resolveUnits(query.Units, utility)
 	if err != nil {
-		return DailyMonthlyLimits{}, fmt.Errorf("Unable to fetch daily limits: %s", err.Error())
+		return DailyMonthlyLimits{}, err
 	}
 
-	monthlyLimits, err := processor.Storage.GetMonthlyLimits(userId)
+	query.meters = meters
+	limits := DailyMonthlyLimits{}
+
+	for _, target := range []struct {
+		resolution string
+		limits     *Limits
+	}{
+		{"D", &limits.Daily},
+		{"M", &limits.Monthly},
+		{"H", &limits.Hourly},
+		{"Q15", &limits.QuarterHourly},
+	} {
+
+		var err error
+		*target.limits, err = processor.Storage.GetLimits(userId, resolutions[target.resolution], query)
+
+		if err != nil {
+			return DailyMonthlyLimits{}, fmt.Errorf("Unable to fetch %s limits: %s", target.resolution, err.Error())
+		}
+
+		target.limits.MinMaxConsumption.Minimum = fromBase(target.limits.MinMaxConsumption.Minimum, units.Consumption)
+		target.limits.MinMaxConsumption.Maximum = fromBase(target.limits.MinMaxConsumption.Maximum, units.Consumption)
+		target.limits.MinMaxTemperature.Minimum = convertTemperature(target.limits.MinMaxTemperature.Minimum, units.Temperature)
+		target.limits.MinMaxTemperature.Maximum = convertTemperature(target.limits.MinMaxTemperature.Maximum, units.Temperature)
+	}
 
-	if err != nil {
-		return DailyMonthlyLimits{}, fmt.Errorf("Unable to fetch monthly limits: %s", err.Error())
+	if query.Units != "" {
+		limits.Units = &units
 	}
 
-	return DailyMonthlyLimits{
-		Daily:   dailyLimits,
-		Monthly: monthlyLimits,
-	}, nil
+	return limits, nil
 }
 
 // GetDataForUser fetches the temperature, consumption data for the user
-// based on the starting date provided.
-func (processor UsageProcessor) GetDataForUser(
-	userId int,
-	count int,
-	resolution string,
-	start string) ([][]interface{}, error) {
+// in the range described by the query, a page at a time.
+func (processor UsageProcessor) GetDataForUser(userId int, query DataQuery) (DataPage, error) {
+
+	resolution, ok := resolutions[query.Resolution]
+	if !ok && IsRollup(query.Resolution) {
+		query.Derived = true
+	}
+
+	if query.Derived && !IsRollup(query.Resolution) {
+		return DataPage{}, ValidationError{Reason: fmt.Sprintf("Resolution cannot be derived: %s", query.Resolution)}
+	}
+
+	if !ok && !query.Derived {
+		return DataPage{}, ValidationError{Reason: fmt.Sprintf("Unknown resolution: %s", query.Resolution)}
+	}
+
+	if query.Fill != "" && !fills[query.Fill] {
+		return DataPage{}, ValidationError{Reason: fmt.Sprintf("Fill needs to be null, zero, previous or linear: %s", query.Fill)}
+	}
+
+	cursorResolution := query.Resolution
+	if query.Derived {
+		cursorResolution = rollupCursor(query.Resolution)
+	}
+
+	if query.After != nil &&
+		(query.After.Resolution != cursorResolution || query.After.Descending != query.Descending) {
+		return DataPage{}, ValidationError{Reason: "Cursor does not belong to the query"}
+	}
+
+	meters, utility, err := processor.resolveMeters(userId, query.Meter, query.Utility)
+	if err != nil {
+		return DataPage{}, err
+	}
+
+	units, err := resolveUnits(query.Units, utility)
+	if err != nil {
+		return DataPage{}, err
+	}
+
+	query.meters = meters
+
+	var page DataPage
+	if query.Derived {
+		page, err = processor.getRollupForUser(userId, query)
+	} else {
+		page, err = processor.Storage.GetUserData(userId, resolution, query)
+	}
 
-	if resolution == "M" {
-		return processor.Storage.GetMonthlyUserData(userId, count, start)
+	if err != nil {
+		return DataPage{}, err
+	}
+
+	var weather [][]interface{}
+	if query.DegreeDays || query.Normalized {
+		if weather, err = processor.weatherValues(userId, query, units, page); err != nil {
+			return DataPage{}, err
+		}
+	}
+
+	// NOTE: The values are converted once the page is complete, as
+	// the rollups are computed from the values as stored.
+	for _, row := range page.Data {
+		units.convert(row)
+	}
+
+	if weather != nil {
+		addWeatherColumns(query, &page, weather)
 	}
 
-	return processor.Storage.GetDailyUserData(userId, count, start)
+	if query.Units != "" {
+		page.Units = &units
+	}
+
+	if query.Anomalies {
+		if err := processor.addAnomalyColumn(userId, query, utility, &page); err != nil {
+			return DataPage{}, err
+		}
+	}
+
+	if query.Cost {
+		if err := processor.addCostColumn(userId, query, utility, &page); err != nil {
+			return DataPage{}, err
+		}
+	}
+
+	// NOTE: The gaps are filled last, so that the rows filled leave
+	// the columns added above empty.
+	if query.Gaps || query.Fill != "" {
+
+		valueColumns := 3
+		if query.Derived {
+			valueColumns = len(rollups[query.Resolution].columns()) - 1
+		}
+
+		if err := fillGaps(query, &page, valueColumns); err != nil {
+			return DataPage{}, err
+		}
+	}
+
+	return page, nil
+}
+
+// SetTimeZoneForUser changes the time zone in which the data of the
+// user is bucketed and presented. The zone is an IANA name such as
+// Europe/Stockholm.
+func (processor UsageProcessor) SetTimeZoneForUser(userId int, timezone string) error {
+
+	fmt.Printf("Received request to set the time zone: %s for the user: %d\n", timezone, userId)
+
+	if _, err := time.LoadLocation(timezone); err != nil || timezone == "" || timezone == "Local" {
+		return ValidationError{Reason: fmt.Sprintf("Unknown time zone: %s", timezone)}
+	}
+
+	return processor.Storage.SetUserTimeZone(userId, timezone)
+}
+
+// ValidationError is returned when the input provided by the
+// client is rejected, as opposed to a failure of the storage layer.
+// Rows carries the problems of the individual rows of a batch.
+type ValidationError struct {
+	Reason string
+	Rows   []RowError
+}
+
+// RowError describes why a single row of a batch was rejected.
+type RowError struct {
+	Index  int    `json:"index"`
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+func (err ValidationError) Error() string {
+	return err.Reason
 }
@@ -0,0 +1,141 @@
+package usage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Resolution describes how the readings of a resolution are stored
+// and how their timestamps are presented to the client.
+type Resolution struct {
+	Name     string
+	Table    string
+	IdColumn string
+	Format   string
+	// Step is the spacing of the timestamps of the readings,
+	// zero for the calendar based monthly resolution.
+	Step time.Duration
+}
+
+// resolutions are the resolutions backed by a table of their own.
+var resolutions = map[string]Resolution{
+	"M":   {"M", "months", "month_id", "2006-01-02", 0},
+	"D":   {"D", "days", "day_id", "2006-01-02", 24 * time.Hour},
+	"H":   {"H", "hours", "hour_id", "2006-01-02 15:04", time.Hour},
+	"Q15": {"Q15", "quarter_hours", "quarter_hour_id", "2006-01-02 15:04", 15 * time.Minute},
+}
+
+// resolutionNames lists the resolutions in the order presented to the client.
+var resolutionNames = []string{"M", "D", "H", "Q15"}
+
+// GetResolution looks up the stored resolution by its name.
+func GetResolution(name string) (Resolution, bool) {
+
+	resolution, ok := resolutions[name]
+	return resolution, ok
+}
+
+// timestampLayouts are the layouts accepted for timestamps sent by the client.
+var timestampLayouts = []string{
+	timestampLayout,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// ParseTimestamp parses a timestamp sent by the client, which may or
+// may not carry a time component. Timestamps without an explicit offset
+// are interpreted as wall clock time in the location.
+func ParseTimestamp(value string, loc *time.Location) (time.Time, error) {
+
+	value = strings.TrimSpace(value)
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.In(loc), nil
+	}
+
+	for _, layout := range timestampLayouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("Unable to parse the timestamp: %s", value)
+}
+
+// parseStored parses a timestamp as persisted in the database, which
+// is always in UTC.
+func parseStored(stored string) time.Time {
+
+	t, _ := time.Parse(timestampLayout, stored)
+	return t
+}
+
+// formatTimestamp converts the stored timestamp into the presentation
+// of the resolution in the location. The zero time used in place of
+// missing timestamps is left as it is.
+func (resolution Resolution) formatTimestamp(stored string, loc *time.Location) string {
+
+	t := parseStored(stored)
+	if t.IsZero() {
+		return t.Format(resolution.Format)
+	}
+
+	return t.In(loc).Format(resolution.Format)
+}
+
+// rezoned moves the stored timestamp of a daily or monthly reading from
+// the midnight of its day in one location to the midnight of the same
+// day in another.
+func rezoned(stored string, from *time.Location, to *time.Location) string {
+
+	t := parseStored(stored).In(from)
+	return FormatTimestamp(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, to))
+}
+
+// aligned reports whether the timestamp falls on the boundary of a
+// reading of the resolution in its location, e.g. on the full hour for
+// hourly readings, at midnight for daily ones and at the start of the
+// month for monthly ones.
+func (resolution Resolution) aligned(t time.Time) bool {
+
+	sinceMidnight := time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second +
+		time.Duration(t.Nanosecond())
+
+	switch {
+	case resolution.Step == 0:
+		return t.Day() == 1 && sinceMidnight == 0
+	case resolution.Step >= 24*time.Hour:
+		return sinceMidnight == 0
+	}
+
+	return sinceMidnight%resolution.Step == 0
+}
+
+// boundary describes the boundary the readings of the resolution are
+// aligned to.
+func (resolution Resolution) boundary() string {
+
+	switch {
+	case resolution.Step == 0:
+		return "the first of the month"
+	case resolution.Step >= 24*time.Hour:
+		return "midnight"
+	}
+
+	return resolution.Step.String()
+}
+
+// FormatTimestamp formats the time the way timestamps are stored, in
+// UTC, with the zero time formatted as an empty, unbounded timestamp.
+func FormatTimestamp(t time.Time) string {
+
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format(timestampLayout)
+}
@@ -0,0 +1,218 @@
+package usage
+
+import (
+	"fmt"
+	"time"
+)
+
+// rollup describes a resolution which can be derived from the readings
+// of a finer base resolution. The bucket function maps an instant, in
+// the location of the query, to the start of the bucket containing it
+// and the start of the bucket which follows. Unit names the last
+// column of the rows, counting the base readings in the bucket.
+type rollup struct {
+	base   string
+	unit   string
+	bucket func(time.Time) (time.Time, time.Time)
+}
+
+// rollups are the resolutions which can be derived on request. The
+// buckets follow the wall clock of the location so a daily bucket
+// spans 23 or 25 hours on the days of a DST transition.
+var rollups = map[string]rollup{
+
+	"D": {"H", "hours", func(t time.Time) (time.Time, time.Time) {
+		start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		return start, start.AddDate(0, 0, 1)
+	}},
+
+	"W": {"D", "days", func(t time.Time) (time.Time, time.Time) {
+		// NOTE: Weeks start on Monday.
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		start := day.AddDate(0, 0, -((int(t.Weekday()) + 6) % 7))
+		return start, start.AddDate(0, 0, 7)
+	}},
+
+	"M": {"D", "days", func(t time.Time) (time.Time, time.Time) {
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+		return start, start.AddDate(0, 1, 0)
+	}},
+
+	"Q": {"D", "days", func(t time.Time) (time.Time, time.Time) {
+		start := time.Date(t.Year(), ((t.Month()-1)/3)*3+1, 1, 0, 0, 0, 0, t.Location())
+		return start, start.AddDate(0, 3, 0)
+	}},
+
+	"Y": {"D", "days", func(t time.Time) (time.Time, time.Time) {
+		start := time.Date(t.Year(), 1, 1, 0, 0, 0, 0, t.Location())
+		return start, start.AddDate(1, 0, 0)
+	}},
+}
+
+// IsRollup reports whether the resolution can be derived from a finer one.
+func IsRollup(name string) bool {
+
+	_, ok := rollups[name]
+	return ok
+}
+
+func (r rollup) columns() []string {
+	return []string{"timestamp", "temperature", "consumption", "temperature_min", "temperature_max", r.unit}
+}
+
+// bucket accumulates the base readings falling into a rollup period.
+type bucket struct {
+	start          time.Time
+	lastUnit       string
+	units          int
+	readings       int
+	consumption    Decimal
+	temperatureSum Decimal
+	temperatureMin Decimal
+	temperatureMax Decimal
+}
+
+// add accounts for a reading in the bucket. The unit identifies the base
+// period of the reading, several readings in the same period count once.
+func (b *bucket) add(unit string, temperature Decimal, consumption Decimal) {
+
+	if b.readings == 0 || temperature.millionths < b.temperatureMin.millionths {
+		b.temperatureMin = temperature
+	}
+
+	if b.readings == 0 || temperature.millionths > b.temperatureMax.millionths {
+		b.temperatureMax = temperature
+	}
+
+	if unit != b.lastUnit {
+		b.units++
+		b.lastUnit = unit
+	}
+
+	b.readings++
+	b.consumption = b.consumption.Add(consumption)
+	b.temperatureSum = b.temperatureSum.Add(temperature)
+}
+
+func (b *bucket) row() []interface{} {
+
+	average := b.temperatureSum.quo(int64(b.readings), 2)
+
+	return []interface{}{
+		b.start.Format("2006-01-02"),
+		average,
+		b.consumption,
+		b.temperatureMin,
+		b.temperatureMax,
+		b.units,
+	}
+}
+
+// getRollupForUser derives the buckets of the rollup from the base
+// readings of the user, summing the consumption and averaging the
+// temperature. Each bucket reports the number of base periods it covers.
+func (processor UsageProcessor) getRollupForUser(userId int, query DataQuery) (DataPage, error) {
+
+	r := rollups[query.Resolution]
+	base := resolutions[r.base]
+	loc := query.location()
+
+	limit := query.Count
+	if limit <= 0 || limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+
+	baseQuery := DataQuery{
+		Resolution: r.base,
+		Start:      query.Start,
+		End:        query.End,
+		Descending: query.Descending,
+		Count:      MaxPageSize,
+		Location:   loc,
+		AsOf:       query.AsOf,
+		meters:     query.meters,
+	}
+
+	// Stage1: Continue behind the bucket the cursor points to.
+	if query.After != nil {
+
+		cursorStart, err := time.Parse(timestampLayout, query.After.Timestamp)
+		if err != nil {
+			return DataPage{}, ValidationError{Reason: "Malformed cursor"}
+		}
+
+		if query.Descending {
+			if baseQuery.End == "" || query.After.Timestamp < baseQuery.End {
+				baseQuery.End = query.After.Timestamp
+			}
+		} else {
+			_, next := r.bucket(cursorStart.In(loc))
+			if next := FormatTimestamp(next); next > baseQuery.Start {
+				baseQuery.Start = next
+			}
+		}
+	}
+
+	// Stage2: Walk the base readings page by page, until one
+	// bucket more than requested has been started.
+	page := DataPage{Columns: r.columns()}
+
+	var buckets []*bucket
+
+	for !page.HasMore {
+
+		readings, err := processor.Storage.GetUserData(userId, base, baseQuery)
+		if err != nil {
+			return DataPage{}, fmt.Errorf("Unable to fetch the %s data: %s", r.base, err.Error())
+		}
+
+		for i, row := range readings.Data {
+
+			t := readings.times[i].In(loc)
+			start, _ := r.bucket(t)
+
+			if len(buckets) == 0 || !buckets[len(buckets)-1].start.Equal(start) {
+
+				if len(buckets) == limit {
+					page.HasMore = true
+					break
+				}
+
+				buckets = append(buckets, &bucket{start: start})
+			}
+
+			// NOTE: The offset tells apart the repeated wall
+			// clock hour at the end of daylight saving time.
+			unit := t.Format(base.Format + " -0700")
+			buckets[len(buckets)-1].add(unit, row[1].(Decimal), row[2].(Decimal))
+		}
+
+		if !readings.HasMore {
+			break
+		}
+
+		baseQuery.After = readings.Next
+	}
+
+	// Stage3: Present the buckets in the rows of the page.
+	for _, b := range buckets {
+		page.Data = append(page.Data, b.row())
+		page.times = append(page.times, b.start)
+	}
+
+	if len(buckets) > 0 {
+		page.Next = &Cursor{
+			Resolution: rollupCursor(query.Resolution),
+			Descending: query.Descending,
+			Timestamp:  FormatTimestamp(buckets[len(buckets)-1].start),
+		}
+	}
+
+	return page, nil
+}
+
+// rollupCursor distinguishes the cursors of the derived rollups
+// from the ones of the stored readings at the same resolution.
+func rollupCursor(name string) string {
+	return "rollup:" + name
+}
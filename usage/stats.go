@@ -0,0 +1,206 @@
+package usage
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxPercentiles caps the number of percentiles which can be requested.
+const maxPercentiles = 10
+
+// defaultPercentiles are the percentiles computed unless others are requested.
+const defaultPercentiles = "5,25,75,95"
+
+// StatsQuery describes the range of the readings to summarize, from
+// Start up to End at the resolution, which may be one of the rollups.
+// The source, meters, units and location are selected like in the
+// DataQuery. Percentiles are the comma separated percentiles to compute.
+type StatsQuery struct {
+	Resolution  string
+	Derived     bool
+	Start       string
+	End         string
+	Meter       int
+	Utility     string
+	Units       string
+	Location    *time.Location
+	Percentiles string
+}
+
+// Summary describes the distribution of the values of the rows. The
+// standard deviation is the one of the population of the rows and the
+// percentiles, keyed like "p95", interpolate between the closest ranks.
+type Summary struct {
+	Count       int                `json:"count"`
+	Sum         Decimal            `json:"sum"`
+	Mean        Decimal            `json:"mean"`
+	Median      Decimal            `json:"median"`
+	StdDev      Decimal            `json:"stddev"`
+	Percentiles map[string]Decimal `json:"percentiles"`
+}
+
+// Stats summarizes the consumption and the temperature of the rows of
+// the resolution in the range.
+type Stats struct {
+	Resolution  string  `json:"resolution"`
+	Units       *Units  `json:"units,omitempty"`
+	Consumption Summary `json:"consumption"`
+	Temperature Summary `json:"temperature"`
+}
+
+// GetStatsForUser summarizes the rows of the data of the user in the
+// range, as presented by GetDataForUser.
+func (processor UsageProcessor) GetStatsForUser(userId int, query StatsQuery) (Stats, error) {
+
+	fmt.Printf("Received request to fetch the stats for the user: %d\n", userId)
+
+	if query.Start == "" || query.End == "" || query.End <= query.Start {
+		return Stats{}, ValidationError{Reason: "Stats need a range with a start before its end"}
+	}
+
+	if strings.TrimSpace(query.Percentiles) == "" {
+		query.Percentiles = defaultPercentiles
+	}
+
+	percentiles, err := parsePercentiles(query.Percentiles)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	dataQuery := DataQuery{
+		Resolution: query.Resolution,
+		Derived:    query.Derived,
+		Start:      query.Start,
+		End:        query.End,
+		Count:      MaxPageSize,
+		Location:   query.Location,
+		Meter:      query.Meter,
+		Utility:    query.Utility,
+		Units:      query.Units,
+	}
+
+	var consumption, temperature []Decimal
+	stats := Stats{Resolution: query.Resolution}
+
+	for {
+
+		page, err := processor.GetDataForUser(userId, dataQuery)
+		if err != nil {
+			return Stats{}, err
+		}
+
+		for _, row := range page.Data {
+			temperature = append(temperature, row[1].(Decimal))
+			consumption = append(consumption, row[2].(Decimal))
+		}
+
+		stats.Units = page.Units
+
+		if !page.HasMore {
+			break
+		}
+
+		dataQuery.After = page.Next
+	}
+
+	stats.Consumption = summarize(consumption, percentiles)
+	stats.Temperature = summarize(temperature, percentiles)
+
+	return stats, nil
+}
+
+// parsePercentiles reads the comma separated percentiles, each of
+// them between 0 and 100.
+func parsePercentiles(requested string) ([]Decimal, error) {
+
+	var percentiles []Decimal
+	for _, value := range strings.Split(requested, ",") {
+
+		p, err := ParseDecimal(value)
+		if err != nil || p.Sign() < 0 || p.millionths > NewDecimal(100).millionths {
+			return nil, ValidationError{Reason: fmt.Sprintf("Percentile needs to be between 0 and 100: %s", strings.TrimSpace(value))}
+		}
+
+		percentiles = append(percentiles, p)
+	}
+
+	if len(percentiles) > maxPercentiles {
+		return nil, ValidationError{Reason: fmt.Sprintf("At most %d percentiles can be requested", maxPercentiles)}
+	}
+
+	return percentiles, nil
+}
+
+// summarize describes the distribution of the values, which is empty
+// but for the percentiles requested when there are no values.
+func summarize(values []Decimal, percentiles []Decimal) Summary {
+
+	summary := Summary{Count: len(values), Percentiles: make(map[string]Decimal)}
+
+	sorted := append([]Decimal(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].millionths < sorted[j].millionths
+	})
+
+	for _, p := range percentiles {
+		summary.Percentiles["p"+p.String()] = percentile(sorted, p)
+	}
+
+	if len(values) == 0 {
+		return summary
+	}
+
+	for _, value := range values {
+		summary.Sum = summary.Sum.Add(value)
+	}
+
+	summary.Mean = summary.Sum.quo(int64(len(values)), 6)
+	summary.Median = percentile(sorted, NewDecimal(50))
+
+	// NOTE: The deviation is an irrational number in general, so it
+	// is computed in floating point and rounded to six decimals.
+	mean := summary.Sum.Float64() / float64(len(values))
+	var squares float64
+	for _, value := range values {
+		squares += (value.Float64() - mean) * (value.Float64() - mean)
+	}
+
+	summary.StdDev = decimalFromFloat(math.Sqrt(squares / float64(len(values))))
+
+	return summary
+}
+
+// percentile interpolates linearly between the closest ranks of the
+// sorted values, zero for no values.
+func percentile(sorted []Decimal, p Decimal) Decimal {
+
+	if len(sorted) == 0 {
+		return Decimal{}
+	}
+
+	// NOTE: The rank is p / 100 * (n - 1), kept as a fraction so that
+	// the interpolation is exact.
+	numerator := p.millionths * int64(len(sorted)-1)
+	denominator := int64(100 * decimalScale)
+
+	lower := numerator / denominator
+	if lower+1 >= int64(len(sorted)) {
+		return sorted[lower]
+	}
+
+	step := sorted[lower+1].Sub(sorted[lower])
+	return sorted[lower].Add(step.mulDiv(numerator%denominator, denominator))
+}
+
+// decimalFromFloat rounds the float to the nearest decimal.
+func decimalFromFloat(value float64) Decimal {
+
+	if value < 0 {
+		return Decimal{-int64(math.Floor(-value*decimalScale + 0.5))}
+	}
+
+	return Decimal{int64(math.Floor(value*decimalScale + 0.5))}
+}
@@ -2,44 +2,456 @@ package usage
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-var schemas = []string{
-
-	`CREATE TABLE IF NOT EXISTS user (
-		user_id INTEGER PRIMARY KEY,
-		username TEXT NOT NULL UNIQUE,
-		password TEXT NOT NULL
-	)`,
-	`CREATE TABLE IF NOT EXISTS days (
-		day_id INTEGER PRIMARY KEY,
-		user_id INTEGER NOT NULL,
-		timestamp TEXT NOT NULL,
-		consumption INTEGER NOT NULL,
-		temperature INTEGER NOT NULL
-	)`,
-	`CREATE TABLE IF NOT EXISTS months (
-		month_id INTEGER PRIMARY KEY,
-		user_id INTEGER NOT NULL,
-		timestamp TEXT NOT NULL,
-		consumption INTEGER NOT NULL,
-		temperature INTEGER NOT NULL
-	)`,
+// Storage is the storage layer used by the processor for the users,
+// their readings and the limits over them. Each implementation needs
+// to pass the conformance suite in storage_test.go.
+type Storage interface {
+	AddUser(userId int, username string, passwordHash string) error
+	AddMeter(userId int, utility string, unit string, label string) (int, error)
+	GetMeters(userId int) ([]Meter, error)
+	GetUserByName(username string) (User, error)
+	UpdatePassword(userId int, previousHash string, passwordHash string) error
+	SetUserTimeZone(userId int, timezone string) error
+
+	AddDailyLimit(userId, dayId, temperature, consumption int, timestamp string) error
+	AddMonthlyLimit(userId, monthId, temperature, consumption int, timestamp string) error
+	AddReadings(userId int, readings []Reading, policy DuplicatePolicy, author string, recordedAt string) (int, int, error)
+	ImportReadings(readings []UserReading, recordedAt string, dryRun bool) ([]UserReading, error)
+	GetUserData(userId int, resolution Resolution, query DataQuery) (DataPage, error)
+	GetRevisions(userId int, resolution Resolution, timestamp string) ([]Revision, error)
+	GetLimits(userId int, resolution Resolution, query LimitsQuery) (Limits, error)
+
+	AddTariff(tariff Tariff) (int, error)
+	GetTariffs(userId int, utility string) ([]Tariff, error)
+	DeleteTariff(userId int, tariffId int) error
+
+	AddBudget(budget Budget) (int, error)
+	GetBudgets(userId int) ([]Budget, error)
+	DeleteBudget(userId int, budgetId int) error
+	AddAlert(alert Alert) (bool, error)
+	GetAlerts(userId int) ([]Alert, error)
+
+	AddWebhook(webhook Webhook) (int, error)
+	GetWebhooks(userId int) ([]Webhook, error)
+	DeleteWebhook(userId int, webhookId int) error
+	AddDeliveries(deliveries []Delivery) error
+	GetDueDeliveries(now string, limit int) ([]Delivery, error)
+	UpdateDelivery(delivery Delivery) error
+	GetDeliveries(userId int, webhookId int, limit int) ([]Delivery, error)
+
+	AddAnomalies(anomalies []Anomaly) error
+	GetAnomalies(userId int, utility string, meter int, start string, end string) ([]Anomaly, error)
+	AcknowledgeAnomaly(userId int, anomalyId int, acknowledgedAt string) error
+
+	AddToken(userId int, name string, tokenHash string, scopes []string, createdAt string, expiresAt string) (int, error)
+	GetTokens(userId int) ([]Token, error)
+	GetTokenByHash(tokenHash string) (User, Token, error)
+	TouchToken(tokenId int, lastUsedAt string) error
+	DeleteToken(userId int, tokenId int) error
+
+	Close() error
 }
 
+// sqliteMigrations are applied in order by MigrateUp. A change of the
+// schema goes into a new migration at the end, as the ones already
+// applied to a database are never run again.
+var sqliteMigrations = []migration{
+	{
+		version:     1,
+		description: "baseline schema",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS user (
+				user_id INTEGER PRIMARY KEY,
+				username TEXT NOT NULL UNIQUE,
+				password TEXT NOT NULL,
+				timezone TEXT NOT NULL DEFAULT 'UTC'
+			)`,
+			`CREATE TABLE IF NOT EXISTS days (
+				day_id INTEGER PRIMARY KEY,
+				user_id INTEGER NOT NULL,
+				timestamp TEXT NOT NULL,
+				consumption INTEGER NOT NULL,
+				temperature INTEGER NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS months (
+				month_id INTEGER PRIMARY KEY,
+				user_id INTEGER NOT NULL,
+				timestamp TEXT NOT NULL,
+				consumption INTEGER NOT NULL,
+				temperature INTEGER NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS hours (
+				hour_id INTEGER PRIMARY KEY,
+				user_id INTEGER NOT NULL,
+				timestamp TEXT NOT NULL,
+				consumption INTEGER NOT NULL,
+				temperature INTEGER NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS quarter_hours (
+				quarter_hour_id INTEGER PRIMARY KEY,
+				user_id INTEGER NOT NULL,
+				timestamp TEXT NOT NULL,
+				consumption INTEGER NOT NULL,
+				temperature INTEGER NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS token (
+				token_id INTEGER PRIMARY KEY,
+				user_id INTEGER NOT NULL,
+				name TEXT NOT NULL,
+				token_hash TEXT NOT NULL UNIQUE,
+				scopes TEXT NOT NULL,
+				created_at TEXT NOT NULL,
+				expires_at TEXT,
+				last_used_at TEXT,
+				FOREIGN KEY(user_id) REFERENCES user(user_id) ON DELETE CASCADE
+			)`,
+		},
+		down: []string{
+			`DROP TABLE token`,
+			`DROP TABLE quarter_hours`,
+			`DROP TABLE hours`,
+			`DROP TABLE months`,
+			`DROP TABLE days`,
+			`DROP TABLE user`,
+		},
+	},
+	{
+		// NOTE: The unique index doubles as the index for the lookups
+		// by user and range of time. Of the duplicates stored before
+		// it existed the reading written first is kept, the count of the
+		// ones removed is logged.
+		version:     2,
+		description: "unique readings per user and timestamp",
+		up: []string{
+			`DELETE FROM days WHERE day_id NOT IN (SELECT min(day_id) FROM days GROUP BY user_id, timestamp)`,
+			`CREATE UNIQUE INDEX days_user_timestamp ON days (user_id, timestamp)`,
+			`DELETE FROM months WHERE month_id NOT IN (SELECT min(month_id) FROM months GROUP BY user_id, timestamp)`,
+			`CREATE UNIQUE INDEX months_user_timestamp ON months (user_id, timestamp)`,
+			`DELETE FROM hours WHERE hour_id NOT IN (SELECT min(hour_id) FROM hours GROUP BY user_id, timestamp)`,
+			`CREATE UNIQUE INDEX hours_user_timestamp ON hours (user_id, timestamp)`,
+			`DELETE FROM quarter_hours WHERE quarter_hour_id NOT IN (SELECT min(quarter_hour_id) FROM quarter_hours GROUP BY user_id, timestamp)`,
+			`CREATE UNIQUE INDEX quarter_hours_user_timestamp ON quarter_hours (user_id, timestamp)`,
+		},
+		down: []string{
+			`DROP INDEX days_user_timestamp`,
+			`DROP INDEX months_user_timestamp`,
+			`DROP INDEX hours_user_timestamp`,
+			`DROP INDEX quarter_hours_user_timestamp`,
+		},
+	},
+	{
+		// NOTE: recorded_at is the instant since which a reading holds its
+		// values, the readings written before it existed hold them forever.
+		version:     3,
+		description: "revisions of the readings",
+		up: []string{
+			`ALTER TABLE days ADD COLUMN recorded_at TEXT NOT NULL DEFAULT '0001-01-01 00:00:00'`,
+			`ALTER TABLE months ADD COLUMN recorded_at TEXT NOT NULL DEFAULT '0001-01-01 00:00:00'`,
+			`ALTER TABLE hours ADD COLUMN recorded_at TEXT NOT NULL DEFAULT '0001-01-01 00:00:00'`,
+			`ALTER TABLE quarter_hours ADD COLUMN recorded_at TEXT NOT NULL DEFAULT '0001-01-01 00:00:00'`,
+			`CREATE TABLE revisions (
+				revision_id INTEGER PRIMARY KEY,
+				resolution TEXT NOT NULL,
+				reading_id INTEGER NOT NULL,
+				user_id INTEGER NOT NULL,
+				timestamp TEXT NOT NULL,
+				consumption INTEGER NOT NULL,
+				temperature INTEGER NOT NULL,
+				recorded_at TEXT NOT NULL,
+				changed_by TEXT NOT NULL,
+				changed_at TEXT NOT NULL
+			)`,
+			`CREATE INDEX revisions_user_timestamp ON revisions (user_id, resolution, timestamp)`,
+		},
+		down: []string{
+			`DROP TABLE revisions`,
+			`ALTER TABLE days DROP COLUMN recorded_at`,
+			`ALTER TABLE months DROP COLUMN recorded_at`,
+			`ALTER TABLE hours DROP COLUMN recorded_at`,
+			`ALTER TABLE quarter_hours DROP COLUMN recorded_at`,
+		},
+	},
+	{
+		// NOTE: Every user gets a default electricity meter which takes
+		// over the existing readings. Reverting keeps only the readings
+		// of the default meters.
+		version:     4,
+		description: "meters",
+		up: []string{
+			`CREATE TABLE meters (
+				meter_id INTEGER PRIMARY KEY,
+				user_id INTEGER NOT NULL,
+				utility TEXT NOT NULL,
+				unit TEXT NOT NULL,
+				label TEXT NOT NULL
+			)`,
+			`CREATE INDEX meters_user ON meters (user_id)`,
+			`INSERT INTO meters (user_id, utility, unit, label)
+			SELECT user_id, 'electricity', 'kWh', 'default' FROM (
+				SELECT user_id FROM user UNION SELECT user_id FROM days UNION SELECT user_id FROM months
+				UNION SELECT user_id FROM hours UNION SELECT user_id FROM quarter_hours
+			) AS owners ORDER BY user_id`,
+			`ALTER TABLE days ADD COLUMN meter_id INTEGER`,
+			`UPDATE days SET meter_id = (SELECT min(meter_id) FROM meters WHERE meters.user_id = days.user_id)`,
+			`DROP INDEX days_user_timestamp`,
+			`CREATE UNIQUE INDEX days_meter_timestamp ON days (meter_id, timestamp)`,
+			`CREATE INDEX days_user_timestamp ON days (user_id, timestamp)`,
+			`ALTER TABLE months ADD COLUMN meter_id INTEGER`,
+			`UPDATE months SET meter_id = (SELECT min(meter_id) FROM meters WHERE meters.user_id = months.user_id)`,
+			`DROP INDEX months_user_timestamp`,
+			`CREATE UNIQUE INDEX months_meter_timestamp ON months (meter_id, timestamp)`,
+			`CREATE INDEX months_user_timestamp ON months (user_id, timestamp)`,
+			`ALTER TABLE hours ADD COLUMN meter_id INTEGER`,
+			`UPDATE hours SET meter_id = (SELECT min(meter_id) FROM meters WHERE meters.user_id = hours.user_id)`,
+			`DROP INDEX hours_user_timestamp`,
+			`CREATE UNIQUE INDEX hours_meter_timestamp ON hours (meter_id, timestamp)`,
+			`CREATE INDEX hours_user_timestamp ON hours (user_id, timestamp)`,
+			`ALTER TABLE quarter_hours ADD COLUMN meter_id INTEGER`,
+			`UPDATE quarter_hours SET meter_id = (SELECT min(meter_id) FROM meters WHERE meters.user_id = quarter_hours.user_id)`,
+			`DROP INDEX quarter_hours_user_timestamp`,
+			`CREATE UNIQUE INDEX quarter_hours_meter_timestamp ON quarter_hours (meter_id, timestamp)`,
+			`CREATE INDEX quarter_hours_user_timestamp ON quarter_hours (user_id, timestamp)`,
+			`ALTER TABLE revisions ADD COLUMN meter_id INTEGER`,
+			`UPDATE revisions SET meter_id = (SELECT min(meter_id) FROM meters WHERE meters.user_id = revisions.user_id)`,
+		},
+		down: []string{
+			`DELETE FROM days WHERE meter_id <> (SELECT min(meter_id) FROM meters WHERE meters.user_id = days.user_id)`,
+			`DROP INDEX days_user_timestamp`,
+			`DROP INDEX days_meter_timestamp`,
+			`CREATE UNIQUE INDEX days_user_timestamp ON days (user_id, timestamp)`,
+			`ALTER TABLE days DROP COLUMN meter_id`,
+			`DELETE FROM months WHERE meter_id <> (SELECT min(meter_id) FROM meters WHERE meters.user_id = months.user_id)`,
+			`DROP INDEX months_user_timestamp`,
+			`DROP INDEX months_meter_timestamp`,
+			`CREATE UNIQUE INDEX months_user_timestamp ON months (user_id, timestamp)`,
+			`ALTER TABLE months DROP COLUMN meter_id`,
+			`DELETE FROM hours WHERE meter_id <> (SELECT min(meter_id) FROM meters WHERE meters.user_id = hours.user_id)`,
+			`DROP INDEX hours_user_timestamp`,
+			`DROP INDEX hours_meter_timestamp`,
+			`CREATE UNIQUE INDEX hours_user_timestamp ON hours (user_id, timestamp)`,
+			`ALTER TABLE hours DROP COLUMN meter_id`,
+			`DELETE FROM quarter_hours WHERE meter_id <> (SELECT min(meter_id) FROM meters WHERE meters.user_id = quarter_hours.user_id)`,
+			`DROP INDEX quarter_hours_user_timestamp`,
+			`DROP INDEX quarter_hours_meter_timestamp`,
+			`CREATE UNIQUE INDEX quarter_hours_user_timestamp ON quarter_hours (user_id, timestamp)`,
+			`ALTER TABLE quarter_hours DROP COLUMN meter_id`,
+			`DELETE FROM revisions WHERE meter_id <> (SELECT min(meter_id) FROM meters WHERE meters.user_id = revisions.user_id)`,
+			`ALTER TABLE revisions DROP COLUMN meter_id`,
+			`DROP TABLE meters`,
+		},
+	},
+	{
+		// NOTE: The values are stored as integers in millionths from here on,
+		// the consumption in the default unit of the utility of the meter.
+		// Reverting rounds them to whole values in the unit of the meter.
+		version:     5,
+		description: "fixed-point readings",
+		up: []string{
+			`UPDATE days SET temperature = temperature * 1000000, consumption = consumption * (CASE (SELECT unit FROM meters WHERE meters.meter_id = days.meter_id)
+				WHEN 'Wh' THEN 1000 WHEN 'MWh' THEN 1000000000 WHEN 'l' THEN 1000 ELSE 1000000 END)`,
+			`UPDATE months SET temperature = temperature * 1000000, consumption = consumption * (CASE (SELECT unit FROM meters WHERE meters.meter_id = months.meter_id)
+				WHEN 'Wh' THEN 1000 WHEN 'MWh' THEN 1000000000 WHEN 'l' THEN 1000 ELSE 1000000 END)`,
+			`UPDATE hours SET temperature = temperature * 1000000, consumption = consumption * (CASE (SELECT unit FROM meters WHERE meters.meter_id = hours.meter_id)
+				WHEN 'Wh' THEN 1000 WHEN 'MWh' THEN 1000000000 WHEN 'l' THEN 1000 ELSE 1000000 END)`,
+			`UPDATE quarter_hours SET temperature = temperature * 1000000, consumption = consumption * (CASE (SELECT unit FROM meters WHERE meters.meter_id = quarter_hours.meter_id)
+				WHEN 'Wh' THEN 1000 WHEN 'MWh' THEN 1000000000 WHEN 'l' THEN 1000 ELSE 1000000 END)`,
+			`UPDATE revisions SET temperature = temperature * 1000000, consumption = consumption * (CASE (SELECT unit FROM meters WHERE meters.meter_id = revisions.meter_id)
+				WHEN 'Wh' THEN 1000 WHEN 'MWh' THEN 1000000000 WHEN 'l' THEN 1000 ELSE 1000000 END)`,
+		},
+		down: []string{
+			`UPDATE days SET temperature = round(temperature / 1000000.0), consumption = round(consumption * 1.0 / (CASE (SELECT unit FROM meters WHERE meters.meter_id = days.meter_id)
+				WHEN 'Wh' THEN 1000 WHEN 'MWh' THEN 1000000000 WHEN 'l' THEN 1000 ELSE 1000000 END))`,
+			`UPDATE months SET temperature = round(temperature / 1000000.0), consumption = round(consumption * 1.0 / (CASE (SELECT unit FROM meters WHERE meters.meter_id = months.meter_id)
+				WHEN 'Wh' THEN 1000 WHEN 'MWh' THEN 1000000000 WHEN 'l' THEN 1000 ELSE 1000000 END))`,
+			`UPDATE hours SET temperature = round(temperature / 1000000.0), consumption = round(consumption * 1.0 / (CASE (SELECT unit FROM meters WHERE meters.meter_id = hours.meter_id)
+				WHEN 'Wh' THEN 1000 WHEN 'MWh' THEN 1000000000 WHEN 'l' THEN 1000 ELSE 1000000 END))`,
+			`UPDATE quarter_hours SET temperature = round(temperature / 1000000.0), consumption = round(consumption * 1.0 / (CASE (SELECT unit FROM meters WHERE meters.meter_id = quarter_hours.meter_id)
+				WHEN 'Wh' THEN 1000 WHEN 'MWh' THEN 1000000000 WHEN 'l' THEN 1000 ELSE 1000000 END))`,
+			`UPDATE revisions SET temperature = round(temperature / 1000000.0), consumption = round(consumption * 1.0 / (CASE (SELECT unit FROM meters WHERE meters.meter_id = revisions.meter_id)
+				WHEN 'Wh' THEN 1000 WHEN 'MWh' THEN 1000000000 WHEN 'l' THEN 1000 ELSE 1000000 END))`,
+		},
+	},
+	{
+		// NOTE: The tiers and windows of a tariff are kept as JSON in the
+		// definition, along with the rest of the pricing.
+		version:     6,
+		description: "tariffs",
+		up: []string{
+			`CREATE TABLE tariffs (
+				tariff_id INTEGER PRIMARY KEY,
+				user_id INTEGER NOT NULL,
+				utility TEXT NOT NULL,
+				valid_from TEXT NOT NULL,
+				valid_to TEXT NOT NULL,
+				definition TEXT NOT NULL
+			)`,
+			`CREATE INDEX tariffs_user_utility ON tariffs (user_id, utility, valid_from)`,
+		},
+		down: []string{
+			`DROP TABLE tariffs`,
+		},
+	},
+	{
+		// NOTE: An alert is raised once for each kind, budget and
+		// period, which the unique index enforces.
+		version:     7,
+		description: "budgets",
+		up: []string{
+			`CREATE TABLE budgets (
+				budget_id INTEGER PRIMARY KEY,
+				user_id INTEGER NOT NULL,
+				name TEXT NOT NULL,
+				utility TEXT NOT NULL,
+				meter_id INTEGER NOT NULL,
+				metric TEXT NOT NULL,
+				period TEXT NOT NULL,
+				amount BIGINT NOT NULL,
+				timezone TEXT NOT NULL
+			)`,
+			`CREATE INDEX budgets_user ON budgets (user_id)`,
+			`CREATE TABLE alerts (
+				alert_id INTEGER PRIMARY KEY,
+				user_id INTEGER NOT NULL,
+				budget_id INTEGER NOT NULL,
+				kind TEXT NOT NULL,
+				period TEXT NOT NULL,
+				value BIGINT NOT NULL,
+				projected BIGINT NOT NULL,
+				amount BIGINT NOT NULL,
+				triggered_at TEXT NOT NULL
+			)`,
+			`CREATE UNIQUE INDEX alerts_budget_kind_period ON alerts (budget_id, kind, period)`,
+			`CREATE INDEX alerts_user ON alerts (user_id, triggered_at)`,
+		},
+		down: []string{
+			`DROP TABLE alerts`,
+			`DROP TABLE budgets`,
+		},
+	},
+	{
+		// NOTE: The secrets are kept as they are, as the payloads
+		// need to be signed with them.
+		version:     8,
+		description: "webhooks",
+		up: []string{
+			`CREATE TABLE webhooks (
+				webhook_id INTEGER PRIMARY KEY,
+				user_id INTEGER NOT NULL,
+				url TEXT NOT NULL,
+				events TEXT NOT NULL,
+				secret TEXT NOT NULL,
+				created_at TEXT NOT NULL
+			)`,
+			`CREATE INDEX webhooks_user ON webhooks (user_id)`,
+			`CREATE TABLE webhook_deliveries (
+				delivery_id INTEGER PRIMARY KEY,
+				webhook_id INTEGER NOT NULL,
+				user_id INTEGER NOT NULL,
+				event TEXT NOT NULL,
+				payload TEXT NOT NULL,
+				status TEXT NOT NULL,
+				attempts INTEGER NOT NULL,
+				response_code INTEGER NOT NULL,
+				error TEXT NOT NULL,
+				created_at TEXT NOT NULL,
+				next_attempt_at TEXT NOT NULL,
+				delivered_at TEXT NOT NULL
+			)`,
+			`CREATE INDEX webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at)`,
+			`CREATE INDEX webhook_deliveries_webhook ON webhook_deliveries (webhook_id, delivery_id)`,
+		},
+		down: []string{
+			`DROP TABLE webhook_deliveries`,
+			`DROP TABLE webhooks`,
+		},
+	},
+	{
+		// NOTE: An anomaly is stored once per day of the utility or
+		// meter, which the unique index enforces, so that it keeps
+		// being acknowledged when it is detected again.
+		version:     9,
+		description: "anomalies",
+		up: []string{
+			`CREATE TABLE anomalies (
+				anomaly_id INTEGER PRIMARY KEY,
+				user_id INTEGER NOT NULL,
+				utility TEXT NOT NULL,
+				meter_id INTEGER NOT NULL,
+				timestamp TEXT NOT NULL,
+				consumption BIGINT NOT NULL,
+				expected BIGINT NOT NULL,
+				score BIGINT NOT NULL,
+				detected_at TEXT NOT NULL,
+				acknowledged_at TEXT NOT NULL
+			)`,
+			`CREATE UNIQUE INDEX anomalies_user_day ON anomalies (user_id, utility, meter_id, timestamp)`,
+		},
+		down: []string{
+			`DROP TABLE anomalies`,
+		},
+	},
+}
+
+// alteration adds a column introduced to a table before the schema
+// was versioned, for the databases in which the table already exists.
+type alteration struct {
+	table  string
+	column string
+	schema string
+}
+
+var alterations = []alteration{
+	{"user", "timezone", `ALTER TABLE user ADD COLUMN timezone TEXT NOT NULL DEFAULT 'UTC'`},
+}
+
+// timestampLayout is the layout in which the timestamps are
+// persisted in the database, always in UTC.
+const timestampLayout = "2006-01-02 15:04:05"
+
+// dialect captures the differences between the SQL databases
+// UsageStorage can be backed by.
+type dialect struct {
+	driver      string
+	migrations  []migration
+	alterations []alteration
+	// numbered placeholders ($1, $2, ...) instead of question marks.
+	numbered bool
+	// hasColumn reports whether the column exists in the table.
+	hasColumn func(tx *sql.Tx, table string, column string) (bool, error)
+	// syncSequence advances the id sequence of the table after
+	// rows with caller provided ids have been inserted.
+	syncSequence func(db *sql.DB, table string, idColumn string) error
+}
+
+var sqliteDialect = dialect{
+	driver:       "sqlite3",
+	migrations:   sqliteMigrations,
+	alterations:  alterations,
+	hasColumn:    sqliteHasColumn,
+	syncSequence: func(*sql.DB, string, string) error { return nil },
+}
+
+// UsageStorage is the storage layer backed by a SQL database, SQLite
+// as created by NewStorage or PostgreSQL as created by NewPostgresStorage.
 type UsageStorage struct {
-	DB *sql.DB
+	DB      *sql.DB
+	dialect dialect
 }
 
 // connectToDB opens up a connection to the database and pings
 // the database.
-func connectToDB(location string) (*sql.DB, error) {
+func connectToDB(driver string, location string) (*sql.DB, error) {
 
-	db, err := sql.Open("sqlite3", location)
+	db, err := sql.Open(driver, location)
 
 	if err != nil {
 		return nil, err
@@ -48,51 +460,174 @@ func connectToDB(location string) (*sql.DB, error) {
 	return db, db.Ping()
 }
 
+// NewStorage creates the storage layer backed by the SQLite database at the location.
 func NewStorage(location string) (UsageStorage, error) {
+	return newSQLStorage(sqliteDialect, location)
+}
+
+// newSQLStorage connects to the database and migrates its schema
+// to the latest version, refusing databases which are ahead of it.
+func newSQLStorage(d dialect, location string) (UsageStorage, error) {
+
+	storage, err := openSQLStorage(d, location)
+	if err != nil {
+		return UsageStorage{}, err
+	}
+
+	if err := storage.MigrateUp(0); err != nil {
+		storage.Close()
+		return UsageStorage{},
+			fmt.Errorf("Unable to migrate the storage layer: %s", err.Error())
+	}
+
+	return storage, nil
+}
+
+func openSQLStorage(d dialect, location string) (UsageStorage, error) {
 
 	fmt.Println("Received request to create the storage layer")
 
 	// Stage 1: Get hold of connection to the database.
-	db, err := connectToDB(location)
+	db, err := connectToDB(d.driver, location)
 
 	if err != nil {
 		return UsageStorage{},
 			fmt.Errorf("Unable to create the storage layer: %s", err.Error())
 	}
 
-	// Stage 2: Load all the schemas in the database.
-	for _, schema := range schemas {
+	// Stage 2: Create the table tracking the applied migrations.
+	if _, err := db.Exec(schemaVersionTable); err != nil {
+		db.Close()
+		return UsageStorage{},
+			fmt.Errorf("Unable to create the schema version table: %s", err.Error())
+	}
+
+	return UsageStorage{DB: db, dialect: d}, nil
+}
+
+func sqliteHasColumn(tx *sql.Tx, table string, column string) (bool, error) {
+
+	rows, err := tx.Query(`PRAGMA table_info(` + table + `)`)
+	if err != nil {
+		return false, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var cid, notNull, primaryKey int
+		var name, columnType string
+		var defaultValue sql.NullString
+
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			return false, err
+		}
+
+		if name == column {
+			return true, nil
+		}
+	}
+
+	return false, rows.Err()
+}
+
+// rebind rewrites the question mark placeholders of the query
+// into the placeholders used by the dialect.
+func (storage UsageStorage) rebind(q string) string {
+
+	if !storage.dialect.numbered {
+		return q
+	}
 
-		if _, err := db.Exec(schema); err != nil {
-			return UsageStorage{},
-				fmt.Errorf("Unable to create the schema in the storage layer: %s, error: %s", schema, err.Error())
+	var rebound strings.Builder
+	n := 0
+
+	for _, c := range q {
+
+		if c != '?' {
+			rebound.WriteRune(c)
+			continue
 		}
+
+		n++
+		rebound.WriteString("$" + strconv.Itoa(n))
 	}
 
-	return UsageStorage{db}, nil
+	return rebound.String()
+}
+
+func (storage UsageStorage) Close() error {
+	return storage.DB.Close()
 }
 
-func (storage UsageStorage) AddNewUser(userId int, username string, password string) error {
+// AddUser persists a new user along with the default electricity
+// meter of the user. The password is expected to be hashed.
+func (storage UsageStorage) AddUser(userId int, username string, passwordHash string) error {
 
-	q := `INSERT INTO user(user_id, username, password) VALUES (?, ?, ?)`
-	_, err := storage.DB.Exec(q, userId, username, password)
-	return err
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	q := `INSERT INTO "user" (user_id, username, password) VALUES (?, ?, ?)`
+	if _, err := tx.Exec(storage.rebind(q), userId, username, passwordHash); err != nil {
+		return err
+	}
+
+	q = `INSERT INTO meters (user_id, utility, unit, label) VALUES (?, ?, ?, ?)`
+	if _, err := tx.Exec(storage.rebind(q), userId, UtilityElectricity, defaultUnits[UtilityElectricity], "default"); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (storage UsageStorage) GetUser(username string, password string) (User, error) {
+// AddMeter persists a new meter for the user and returns its id.
+func (storage UsageStorage) AddMeter(userId int, utility string, unit string, label string) (int, error) {
 
-	user := User{}
+	var meterId int
 
-	q := `SELECT user_id, username, password FROM user WHERE username=? AND password=?`
-	err := storage.DB.QueryRow(q, username, password).Scan(&user.UserId,
-		&user.UserName,
-		&user.Password)
+	q := `INSERT INTO meters (user_id, utility, unit, label) VALUES (?, ?, ?, ?) RETURNING meter_id`
+	err := storage.DB.QueryRow(storage.rebind(q), userId, utility, unit, label).Scan(&meterId)
+	return meterId, err
+}
+
+// GetMeters lists the meters of the user in the order they were added.
+func (storage UsageStorage) GetMeters(userId int) ([]Meter, error) {
 
+	q := `SELECT meter_id, user_id, utility, unit, label FROM meters WHERE user_id = ? ORDER BY meter_id`
+
+	rows, err := storage.DB.Query(storage.rebind(q), userId)
 	if err != nil {
-		return User{}, err
+		return nil, err
 	}
 
-	return user, nil
+	defer rows.Close()
+
+	meters := []Meter{}
+	for rows.Next() {
+
+		meter := Meter{}
+		if err := rows.Scan(&meter.MeterId, &meter.UserId, &meter.Utility, &meter.Unit, &meter.Label); err != nil {
+			return nil, err
+		}
+
+		meters = append(meters, meter)
+	}
+
+	return meters, rows.Err()
+}
+
+// UpdatePassword replaces the stored password of the user, provided
+// it has not been changed since it was read as previousHash.
+func (storage UsageStorage) UpdatePassword(userId int, previousHash string, passwordHash string) error {
+
+	q := `UPDATE "user" SET password = ? WHERE user_id = ? AND password = ?`
+	_, err := storage.DB.Exec(storage.rebind(q), passwordHash, userId, previousHash)
+	return err
 }
 
 func (storage UsageStorage) AddDailyLimit(
@@ -102,10 +637,16 @@ func (storage UsageStorage) AddDailyLimit(
 	consumption int,
 	timestamp string) error {
 
-	q := `INSERT INTO days (user_id, day_id, timestamp, consumption, temperature) VALUES (?, ?, ?, ?, ?)`
+	q := `INSERT INTO days (user_id, meter_id, day_id, timestamp, consumption, temperature)
+	VALUES (?, (SELECT min(meter_id) FROM meters WHERE user_id = ? AND utility = ?), ?, ?, ?, ?)`
 
-	_, err := storage.DB.Exec(q, userId, dayId, timestamp, consumption, temperature)
-	return err
+	_, err := storage.DB.Exec(storage.rebind(q), userId, userId, UtilityElectricity, dayId, timestamp,
+		NewDecimal(consumption), NewDecimal(temperature))
+	if err != nil {
+		return err
+	}
+
+	return storage.dialect.syncSequence(storage.DB, "days", "day_id")
 }
 
 func (storage UsageStorage) AddMonthlyLimit(
@@ -115,19 +656,34 @@ func (storage UsageStorage) AddMonthlyLimit(
 	consumption int,
 	timestamp string) error {
 
-	q := `INSERT INTO months (user_id, month_id, timestamp, consumption, temperature) VALUES (?, ?, ?, ?, ?)`
+	q := `INSERT INTO months (user_id, meter_id, month_id, timestamp, consumption, temperature)
+	VALUES (?, (SELECT min(meter_id) FROM meters WHERE user_id = ? AND utility = ?), ?, ?, ?, ?)`
 
-	_, err := storage.DB.Exec(q, userId, monthId, timestamp, consumption, temperature)
-	return err
+	_, err := storage.DB.Exec(storage.rebind(q), userId, userId, UtilityElectricity, monthId, timestamp,
+		NewDecimal(consumption), NewDecimal(temperature))
+	if err != nil {
+		return err
+	}
+
+	return storage.dialect.syncSequence(storage.DB, "months", "month_id")
 }
 
 func (storage UsageStorage) GetDailyLimits(userId int) (Limits, error) {
 
 	fmt.Printf("Received request to fetch the daily limits for the user: %d\n", userId)
+	return storage.GetLimits(userId, resolutions["D"], LimitsQuery{})
+}
 
-	q := `SELECT COALESCE(min(timestamp), "0001-01-01 00:00:00"), COALESCE(max(timestamp), "0001-01-01 00:00:00"),
-	COALESCE(min(consumption), 0), COALESCE(max(consumption), 0),
-	COALESCE(min(temperature), 0), COALESCE(max(temperature), 0) from days where user_id = ?`
+func (storage UsageStorage) GetMonthlyLimits(userId int) (Limits, error) {
+
+	fmt.Printf("Received request to fetch monthly limits for the user: %d\n", userId)
+	return storage.GetLimits(userId, resolutions["M"], LimitsQuery{})
+}
+
+// GetLimits fetches the minimum and maximum of the timestamp, consumption
+// and temperature over the readings of the user at the resolution, summed
+// over the meters of the query, with the timestamps presented in its location.
+func (storage UsageStorage) GetLimits(userId int, resolution Resolution, query LimitsQuery) (Limits, error) {
 
 	mmTimestamp := MinMaxTimestamp{}
 	mmConsumption := MinMaxConsumption{}
@@ -136,7 +692,8 @@ func (storage UsageStorage) GetDailyLimits(userId int) (Limits, error) {
 	var timestampMin []byte
 	var timestampMax []byte
 
-	err := storage.DB.QueryRow(q, userId).Scan(&timestampMin, &timestampMax,
+	q, args := storage.limitsQuery(userId, resolution, query)
+	err := storage.DB.QueryRow(storage.rebind(q), args...).Scan(&timestampMin, &timestampMax,
 		&mmConsumption.Minimum, &mmConsumption.Maximum,
 		&mmTemperature.Minimum, &mmTemperature.Maximum)
 
@@ -144,11 +701,8 @@ func (storage UsageStorage) GetDailyLimits(userId int) (Limits, error) {
 		return Limits{}, err
 	}
 
-	t, _ := time.Parse("2006-01-02 15:04:05", string(timestampMin))
-	mmTimestamp.Minimum = t.Format("2006-01-02")
-
-	t, _ = time.Parse("2006-01-02 15:04:05", string(timestampMax))
-	mmTimestamp.Maximum = t.Format("2006-01-02")
+	mmTimestamp.Minimum = resolution.formatTimestamp(string(timestampMin), query.location())
+	mmTimestamp.Maximum = resolution.formatTimestamp(string(timestampMax), query.location())
 
 	return Limits{
 		MinMaxTimestamp:   mmTimestamp,
@@ -157,110 +711,1029 @@ func (storage UsageStorage) GetDailyLimits(userId int) (Limits, error) {
 	}, nil
 }
 
-func (storage UsageStorage) GetMonthlyLimits(userId int) (Limits, error) {
+func (storage UsageStorage) limitsQuery(userId int, resolution Resolution, query LimitsQuery) (string, []interface{}) {
 
-	fmt.Printf("Received request to fetch monthly limits for the user: %d\n", userId)
+	totals, args := storage.totals(userId, resolution, query.meters, "", query.Start, query.End, nil)
 
-	q := `SELECT COALESCE(min(timestamp), "0001-01-01 00:00:00"), COALESCE(max(timestamp), "0001-01-01 00:00:00"),
+	q := `SELECT COALESCE(min(timestamp), '0001-01-01 00:00:00'), COALESCE(max(timestamp), '0001-01-01 00:00:00'),
 	COALESCE(min(consumption), 0), COALESCE(max(consumption), 0),
-	COALESCE(min(temperature), 0), COALESCE(max(temperature), 0) from months where user_id = ?`
+	COALESCE(min(temperature), 0), COALESCE(max(temperature), 0) FROM (` + totals + `) AS readings`
 
-	mmTimestamp := MinMaxTimestamp{}
-	mmConsumption := MinMaxConsumption{}
-	mmTemperature := MinMaxTemperature{}
+	return q, args
+}
 
-	var timestampMin []byte
-	var timestampMax []byte
+// totals builds the query of the readings of the user summed per
+// timestamp over the meters, all of them when nil. The consumption is
+// summed and the temperature averaged, the timestamp identifying the
+// row. With asOf set the readings are
+// those recorded by then, along with the revisions current at the time.
+// A non-nil after only keeps the timestamps behind the one the cursor
+// points to, in the order of the cursor.
+func (storage UsageStorage) totals(
+	userId int,
+	resolution Resolution,
+	meters []int,
+	asOf string,
+	start string,
+	end string,
+	after *Cursor) (string, []interface{}) {
+
+	source := resolution.Table
+	var args []interface{}
+
+	if asOf != "" {
+
+		source = `(SELECT user_id, meter_id, timestamp, temperature, consumption
+		FROM ` + source + ` WHERE user_id = ? AND recorded_at <= ?
+		UNION ALL
+		SELECT user_id, meter_id, timestamp, temperature, consumption FROM revisions
+		WHERE user_id = ? AND resolution = ? AND recorded_at <= ? AND changed_at > ?) AS versions`
+		args = append(args, userId, asOf, userId, resolution.Name, asOf, asOf)
+	}
 
-	err := storage.DB.QueryRow(q, userId).Scan(&timestampMin, &timestampMax,
-		&mmConsumption.Minimum, &mmConsumption.Maximum,
-		&mmTemperature.Minimum, &mmTemperature.Maximum)
+	q := `SELECT timestamp,
+	CAST(round(avg(temperature)) AS BIGINT) AS temperature, sum(consumption) AS consumption
+	FROM ` + source + ` WHERE user_id = ?`
+	args = append(args, userId)
+
+	// NOTE: An empty list of meters selects none of the readings.
+	switch {
+	case meters == nil:
+	case len(meters) == 0:
+		q += ` AND 1 = 0`
+	default:
+
+		q += ` AND meter_id IN (?` + strings.Repeat(`, ?`, len(meters)-1) + `)`
+		for _, meter := range meters {
+			args = append(args, meter)
+		}
+	}
 
-	if err != nil && err != sql.ErrNoRows {
-		return Limits{}, err
+	if start != "" {
+		q += ` AND timestamp >= ?`
+		args = append(args, start)
 	}
 
-	t, _ := time.Parse("2006-01-02 15:04:05", string(timestampMin))
-	mmTimestamp.Minimum = t.Format("2006-01-02")
+	if end != "" {
+		q += ` AND timestamp < ?`
+		args = append(args, end)
+	}
 
-	t, _ = time.Parse("2006-01-02 15:04:05", string(timestampMax))
-	mmTimestamp.Maximum = t.Format("2006-01-02")
+	// NOTE: The timestamps are unique once grouped, so that the cursor
+	// bounds the readings scanned by the timestamp alone.
+	if after != nil {
 
-	return Limits{
-		MinMaxTimestamp:   mmTimestamp,
-		MinMaxConsumption: mmConsumption,
-		MinMaxTemperature: mmTemperature,
-	}, nil
+		op := ">"
+		if after.Descending {
+			op = "<"
+		}
+
+		q += ` AND timestamp ` + op + ` ?`
+		args = append(args, after.Timestamp)
+	}
+
+	return q + ` GROUP BY timestamp`, args
 }
 
-func (storage UsageStorage) GetMonthlyUserData(
-	userId int,
-	count int,
-	start string) ([][]interface{}, error) {
+func (storage UsageStorage) GetMonthlyUserData(userId int, query DataQuery) (DataPage, error) {
+	return storage.GetUserData(userId, resolutions["M"], query)
+}
+
+func (storage UsageStorage) GetDailyUserData(userId int, query DataQuery) (DataPage, error) {
+	return storage.GetUserData(userId, resolutions["D"], query)
+}
+
+// GetUserData fetches a page of the readings of the user at the resolution
+// which fall in the range of the query, in chronological order unless
+// descending order has been requested.
+func (storage UsageStorage) GetUserData(userId int, resolution Resolution, query DataQuery) (DataPage, error) {
 
-	var response [][]interface{}
+	page := DataPage{}
 
-	q := `SELECT timestamp, temperature, consumption from months WHERE user_id = ? and timestamp >= ? LIMIT ?`
-	rows, err := storage.DB.Query(q, userId, start, count)
+	limit := query.Count
+	if limit <= 0 || limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+
+	q, args := storage.dataQuery(userId, resolution, query, limit)
+	rows, err := storage.DB.Query(storage.rebind(q), args...)
 	if err != nil {
-		return nil, err
+		return DataPage{}, err
 	}
 
 	defer rows.Close()
 
 	for rows.Next() {
 
-		var temperature, consumption int
+		var temperature, consumption Decimal
 		var timestamp []byte
 
 		if err := rows.Scan(&timestamp, &temperature, &consumption); err != nil {
-			return nil, err
+			return DataPage{}, err
 		}
 
-		t, _ := time.Parse("2006-01-02 15:04:05", string(timestamp))
+		if len(page.Data) == limit {
+			page.HasMore = true
+			break
+		}
 
-		response = append(response, []interface{}{
-			t.Format("2006-01-02"),
+		page.Data = append(page.Data, []interface{}{
+			resolution.formatTimestamp(string(timestamp), query.location()),
 			temperature,
 			consumption,
 		})
+
+		page.times = append(page.times, parseStored(string(timestamp)))
+
+		page.Next = &Cursor{
+			Resolution: query.Resolution,
+			Descending: query.Descending,
+			Timestamp:  string(timestamp),
+		}
+	}
+
+	return page, rows.Err()
+}
+
+// dataQuery builds the query of a page of GetUserData, which fetches
+// a single row more than the limit to find out whether a page follows.
+func (storage UsageStorage) dataQuery(userId int, resolution Resolution, query DataQuery, limit int) (string, []interface{}) {
+
+	// NOTE: The page is ordered and limited along with the grouping, so
+	// that the readings are read in the order of the index.
+	q, args := storage.totals(userId, resolution, query.meters, query.AsOf, query.Start, query.End, query.After)
+
+	if query.Descending {
+		q += ` ORDER BY timestamp DESC`
+	} else {
+		q += ` ORDER BY timestamp`
 	}
 
-	return response, err
+	q += ` LIMIT ?`
+	args = append(args, limit+1)
+
+	return q, args
 }
 
-func (storage UsageStorage) GetDailyUserData(
+// AddToken persists a new API token for the user. Only the hash of
+// the token is stored, the token itself is handed out once at creation.
+func (storage UsageStorage) AddToken(
 	userId int,
-	count int,
-	start string) ([][]interface{}, error) {
+	name string,
+	tokenHash string,
+	scopes []string,
+	createdAt string,
+	expiresAt string) (int, error) {
+
+	var expires interface{}
+	if expiresAt != "" {
+		expires = expiresAt
+	}
 
-	var response [][]interface{}
+	q := `INSERT INTO token (user_id, name, token_hash, scopes, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?) RETURNING token_id`
 
-	q := `SELECT timestamp, temperature, consumption from days WHERE user_id = ? and timestamp >= ? LIMIT ?`
-	rows, err := storage.DB.Query(q, userId, start, count)
+	var tokenId int
+	err := storage.DB.QueryRow(storage.rebind(q), userId, name, tokenHash, strings.Join(scopes, ","), createdAt, expires).Scan(&tokenId)
+	return tokenId, err
+}
+
+// GetTokens lists all the tokens created by the user.
+func (storage UsageStorage) GetTokens(userId int) ([]Token, error) {
+
+	q := `SELECT token_id, user_id, name, scopes, created_at, expires_at, last_used_at FROM token WHERE user_id = ? ORDER BY token_id`
+	rows, err := storage.DB.Query(storage.rebind(q), userId)
 	if err != nil {
 		return nil, err
 	}
 
 	defer rows.Close()
 
+	tokens := []Token{}
 	for rows.Next() {
 
-		var temperature, consumption int
-		var timestamp []byte
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
 
-		if err := rows.Scan(&timestamp, &temperature, &consumption); err != nil {
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
+
+// GetTokenByHash fetches the token along with the user owning it
+// based on the hash of the token presented by the client.
+func (storage UsageStorage) GetTokenByHash(tokenHash string) (User, Token, error) {
+
+	q := `SELECT t.token_id, t.user_id, t.name, t.scopes, t.created_at, t.expires_at, t.last_used_at, u.username, u.timezone
+	FROM token t JOIN "user" u ON u.user_id = t.user_id WHERE t.token_hash = ?`
+
+	var username, timezone string
+	token, err := scanToken(storage.DB.QueryRow(storage.rebind(q), tokenHash), &username, &timezone)
+	if err != nil {
+		return User{}, Token{}, err
+	}
+
+	return User{UserId: token.UserId, UserName: username, TimeZone: timezone}, token, nil
+}
+
+// TouchToken records the time at which the token was last used.
+func (storage UsageStorage) TouchToken(tokenId int, lastUsedAt string) error {
+
+	q := `UPDATE token SET last_used_at = ? WHERE token_id = ?`
+	_, err := storage.DB.Exec(storage.rebind(q), lastUsedAt, tokenId)
+	return err
+}
+
+// DeleteToken revokes the token belonging to the user. It returns
+// sql.ErrNoRows in case the user has no such token.
+func (storage UsageStorage) DeleteToken(userId int, tokenId int) error {
+
+	q := `DELETE FROM token WHERE token_id = ? AND user_id = ?`
+	result, err := storage.DB.Exec(storage.rebind(q), tokenId, userId)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// AddTariff persists the tariff of the user and returns its id.
+func (storage UsageStorage) AddTariff(tariff Tariff) (int, error) {
+
+	definition, err := json.Marshal(tariff)
+	if err != nil {
+		return 0, err
+	}
+
+	var tariffId int
+
+	q := `INSERT INTO tariffs (user_id, utility, valid_from, valid_to, definition) VALUES (?, ?, ?, ?, ?) RETURNING tariff_id`
+	err = storage.DB.QueryRow(storage.rebind(q), tariff.UserId, tariff.Utility, tariff.ValidFrom, tariff.ValidTo,
+		string(definition)).Scan(&tariffId)
+	return tariffId, err
+}
+
+// GetTariffs lists the tariffs of the user for the utility in the
+// order in which they become valid.
+func (storage UsageStorage) GetTariffs(userId int, utility string) ([]Tariff, error) {
+
+	q := `SELECT tariff_id, definition FROM tariffs WHERE user_id = ? AND utility = ? ORDER BY valid_from, tariff_id`
+
+	rows, err := storage.DB.Query(storage.rebind(q), userId, utility)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	tariffs := []Tariff{}
+	for rows.Next() {
+
+		var tariffId int
+		var definition string
+
+		if err := rows.Scan(&tariffId, &definition); err != nil {
+			return nil, err
+		}
+
+		tariff := Tariff{}
+		if err := json.Unmarshal([]byte(definition), &tariff); err != nil {
+			return nil, fmt.Errorf("Unable to read the tariff: %d, error: %s", tariffId, err.Error())
+		}
+
+		tariff.TariffId = tariffId
+		tariff.UserId = userId
+		tariffs = append(tariffs, tariff)
+	}
+
+	return tariffs, rows.Err()
+}
+
+// DeleteTariff deletes the tariff of the user, sql.ErrNoRows is
+// returned when the user has no such tariff.
+func (storage UsageStorage) DeleteTariff(userId int, tariffId int) error {
+
+	q := `DELETE FROM tariffs WHERE tariff_id = ? AND user_id = ?`
+	result, err := storage.DB.Exec(storage.rebind(q), tariffId, userId)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// AddBudget persists the budget of the user and returns its id.
+func (storage UsageStorage) AddBudget(budget Budget) (int, error) {
+
+	var budgetId int
+
+	q := `INSERT INTO budgets (user_id, name, utility, meter_id, metric, period, amount, timezone)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING budget_id`
+	err := storage.DB.QueryRow(storage.rebind(q), budget.UserId, budget.Name, budget.Utility, budget.Meter,
+		budget.Metric, budget.Period, budget.Limit, budget.TimeZone).Scan(&budgetId)
+	return budgetId, err
+}
+
+// GetBudgets lists the budgets of the user in the order they were added.
+func (storage UsageStorage) GetBudgets(userId int) ([]Budget, error) {
+
+	q := `SELECT budget_id, user_id, name, utility, meter_id, metric, period, amount, timezone
+		FROM budgets WHERE user_id = ? ORDER BY budget_id`
+
+	rows, err := storage.DB.Query(storage.rebind(q), userId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	budgets := []Budget{}
+	for rows.Next() {
+
+		budget := Budget{}
+		err := rows.Scan(&budget.BudgetId, &budget.UserId, &budget.Name, &budget.Utility, &budget.Meter,
+			&budget.Metric, &budget.Period, &budget.Limit, &budget.TimeZone)
+		if err != nil {
 			return nil, err
 		}
 
-		t, _ := time.Parse("2006-01-02 15:04:05", string(timestamp))
+		budgets = append(budgets, budget)
+	}
 
-		response = append(response, []interface{}{
-			t.Format("2006-01-02"),
-			temperature,
-			consumption,
-		})
+	return budgets, rows.Err()
+}
+
+// DeleteBudget deletes the budget of the user along with its alerts,
+// sql.ErrNoRows is returned when the user has no such budget.
+func (storage UsageStorage) DeleteBudget(userId int, budgetId int) error {
+
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	q := `DELETE FROM budgets WHERE budget_id = ? AND user_id = ?`
+	result, err := tx.Exec(storage.rebind(q), budgetId, userId)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	q = `DELETE FROM alerts WHERE budget_id = ?`
+	if _, err := tx.Exec(storage.rebind(q), budgetId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AddAlert persists the alert unless the budget already raised one of
+// the kind for the period, reporting whether it was added.
+func (storage UsageStorage) AddAlert(alert Alert) (bool, error) {
+
+	q := `INSERT INTO alerts (user_id, budget_id, kind, period, value, projected, amount, triggered_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (budget_id, kind, period) DO NOTHING`
+	result, err := storage.DB.Exec(storage.rebind(q), alert.UserId, alert.BudgetId, alert.Kind, alert.Period,
+		alert.Value, alert.Projected, alert.Limit, alert.TriggeredAt)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// GetAlerts lists the alerts of the user, the latest first.
+func (storage UsageStorage) GetAlerts(userId int) ([]Alert, error) {
+
+	q := `SELECT alert_id, user_id, budget_id, kind, period, value, projected, amount, triggered_at
+		FROM alerts WHERE user_id = ? ORDER BY triggered_at DESC, alert_id DESC`
+
+	rows, err := storage.DB.Query(storage.rebind(q), userId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	alerts := []Alert{}
+	for rows.Next() {
+
+		alert := Alert{}
+		err := rows.Scan(&alert.AlertId, &alert.UserId, &alert.BudgetId, &alert.Kind, &alert.Period,
+			&alert.Value, &alert.Projected, &alert.Limit, &alert.TriggeredAt)
+		if err != nil {
+			return nil, err
+		}
+
+		alerts = append(alerts, alert)
+	}
+
+	return alerts, rows.Err()
+}
+
+// AddWebhook persists the webhook of the user and returns its id.
+func (storage UsageStorage) AddWebhook(webhook Webhook) (int, error) {
+
+	var webhookId int
+
+	q := `INSERT INTO webhooks (user_id, url, events, secret, created_at) VALUES (?, ?, ?, ?, ?) RETURNING webhook_id`
+	err := storage.DB.QueryRow(storage.rebind(q), webhook.UserId, webhook.URL, strings.Join(webhook.Events, ","),
+		webhook.Secret, webhook.CreatedAt).Scan(&webhookId)
+	return webhookId, err
+}
+
+// GetWebhooks lists the webhooks of the user, along with their secrets.
+func (storage UsageStorage) GetWebhooks(userId int) ([]Webhook, error) {
+
+	q := `SELECT webhook_id, user_id, url, events, secret, created_at FROM webhooks WHERE user_id = ? ORDER BY webhook_id`
+
+	rows, err := storage.DB.Query(storage.rebind(q), userId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+
+		var events string
+		webhook := Webhook{}
+
+		err := rows.Scan(&webhook.WebhookId, &webhook.UserId, &webhook.URL, &events, &webhook.Secret, &webhook.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		webhook.Events = strings.Split(events, ",")
+		webhooks = append(webhooks, webhook)
+	}
+
+	return webhooks, rows.Err()
+}
+
+// DeleteWebhook deletes the webhook of the user along with its
+// deliveries, sql.ErrNoRows is returned when the user has no such webhook.
+func (storage UsageStorage) DeleteWebhook(userId int, webhookId int) error {
+
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	q := `DELETE FROM webhooks WHERE webhook_id = ? AND user_id = ?`
+	result, err := tx.Exec(storage.rebind(q), webhookId, userId)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	q = `DELETE FROM webhook_deliveries WHERE webhook_id = ?`
+	if _, err := tx.Exec(storage.rebind(q), webhookId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AddDeliveries persists the deliveries of an event in a single transaction.
+func (storage UsageStorage) AddDeliveries(deliveries []Delivery) error {
+
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	q := `INSERT INTO webhook_deliveries (webhook_id, user_id, event, payload, status, attempts, response_code, error,
+		created_at, next_attempt_at, delivered_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	for _, d := range deliveries {
+
+		_, err := tx.Exec(storage.rebind(q), d.WebhookId, d.UserId, d.Event, string(d.Payload), d.Status, d.Attempts,
+			d.ResponseCode, d.Error, d.CreatedAt, d.NextAttemptAt, d.DeliveredAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// deliveryColumns are the columns scanned by scanDelivery.
+const deliveryColumns = `d.delivery_id, d.webhook_id, d.user_id, d.event, d.payload, d.status, d.attempts,
+	d.response_code, d.error, d.created_at, d.next_attempt_at, d.delivered_at`
+
+func scanDelivery(row rowScanner, extra ...interface{}) (Delivery, error) {
+
+	var payload string
+	d := Delivery{}
+
+	err := row.Scan(append([]interface{}{&d.DeliveryId, &d.WebhookId, &d.UserId, &d.Event, &payload, &d.Status,
+		&d.Attempts, &d.ResponseCode, &d.Error, &d.CreatedAt, &d.NextAttemptAt, &d.DeliveredAt}, extra...)...)
+
+	d.Payload = json.RawMessage(payload)
+	return d, err
+}
+
+// GetDueDeliveries lists the pending deliveries of all the users which
+// are due at the instant, the longest due first, along with the url and
+// secret of their webhooks.
+func (storage UsageStorage) GetDueDeliveries(now string, limit int) ([]Delivery, error) {
+
+	q := `SELECT ` + deliveryColumns + `, w.url, w.secret
+		FROM webhook_deliveries d JOIN webhooks w ON w.webhook_id = d.webhook_id
+		WHERE d.status = ? AND d.next_attempt_at <= ?
+		ORDER BY d.next_attempt_at, d.delivery_id LIMIT ?`
+
+	rows, err := storage.DB.Query(storage.rebind(q), DeliveryPending, now, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	deliveries := []Delivery{}
+	for rows.Next() {
+
+		var url, secret string
+		d, err := scanDelivery(rows, &url, &secret)
+		if err != nil {
+			return nil, err
+		}
+
+		d.url, d.secret = url, secret
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// UpdateDelivery records the outcome of the latest attempt of the delivery.
+func (storage UsageStorage) UpdateDelivery(d Delivery) error {
+
+	q := `UPDATE webhook_deliveries SET status = ?, attempts = ?, response_code = ?, error = ?,
+		next_attempt_at = ?, delivered_at = ? WHERE delivery_id = ?`
+	_, err := storage.DB.Exec(storage.rebind(q), d.Status, d.Attempts, d.ResponseCode, d.Error,
+		d.NextAttemptAt, d.DeliveredAt, d.DeliveryId)
+	return err
+}
+
+// GetDeliveries lists the latest deliveries of the webhook of the user.
+func (storage UsageStorage) GetDeliveries(userId int, webhookId int, limit int) ([]Delivery, error) {
+
+	q := `SELECT ` + deliveryColumns + ` FROM webhook_deliveries d
+		WHERE d.user_id = ? AND d.webhook_id = ? ORDER BY d.delivery_id DESC LIMIT ?`
+
+	rows, err := storage.DB.Query(storage.rebind(q), userId, webhookId, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	deliveries := []Delivery{}
+	for rows.Next() {
+
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// AddAnomalies persists the anomalies, leaving the days which already
+// have one as they are.
+func (storage UsageStorage) AddAnomalies(anomalies []Anomaly) error {
+
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	q := `INSERT INTO anomalies (user_id, utility, meter_id, timestamp, consumption, expected, score, detected_at,
+		acknowledged_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (user_id, utility, meter_id, timestamp) DO NOTHING`
+
+	for _, a := range anomalies {
+
+		_, err := tx.Exec(storage.rebind(q), a.UserId, a.Utility, a.Meter, a.Timestamp, a.Consumption, a.Expected,
+			a.Score, a.DetectedAt, a.AcknowledgedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetAnomalies lists the anomalies of the utility or meter of the user
+// from start up to end, in chronological order.
+func (storage UsageStorage) GetAnomalies(userId int, utility string, meter int, start string, end string) ([]Anomaly, error) {
+
+	q := `SELECT anomaly_id, user_id, utility, meter_id, timestamp, consumption, expected, score, detected_at,
+		acknowledged_at FROM anomalies WHERE user_id = ? AND utility = ? AND meter_id = ? AND timestamp >= ?
+		AND timestamp < ? ORDER BY timestamp`
+
+	rows, err := storage.DB.Query(storage.rebind(q), userId, utility, meter, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	anomalies := []Anomaly{}
+	for rows.Next() {
+
+		a := Anomaly{}
+		err := rows.Scan(&a.AnomalyId, &a.UserId, &a.Utility, &a.Meter, &a.Timestamp, &a.Consumption,
+			&a.Expected, &a.Score, &a.DetectedAt, &a.AcknowledgedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		anomalies = append(anomalies, a)
+	}
+
+	return anomalies, rows.Err()
+}
+
+// AcknowledgeAnomaly marks the anomaly of the user as acknowledged,
+// keeping the time it was first acknowledged at.
+func (storage UsageStorage) AcknowledgeAnomaly(userId int, anomalyId int, acknowledgedAt string) error {
+
+	q := `UPDATE anomalies SET acknowledged_at = ? WHERE anomaly_id = ? AND user_id = ? AND acknowledged_at = ''`
+	result, err := storage.DB.Exec(storage.rebind(q), acknowledgedAt, anomalyId, userId)
+	if err != nil {
+		return err
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected > 0 {
+		return err
+	}
+
+	// NOTE: An anomaly acknowledged before is left as it is.
+	var exists int
+	q = `SELECT COUNT(*) FROM anomalies WHERE anomaly_id = ? AND user_id = ?`
+	if err := storage.DB.QueryRow(storage.rebind(q), anomalyId, userId).Scan(&exists); err != nil {
+		return err
+	}
+
+	if exists == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanToken(row rowScanner, extra ...interface{}) (Token, error) {
+
+	token := Token{}
+
+	var scopes string
+	var expiresAt, lastUsedAt sql.NullString
+
+	dest := append([]interface{}{&token.TokenId, &token.UserId, &token.Name,
+		&scopes, &token.CreatedAt, &expiresAt, &lastUsedAt}, extra...)
+
+	if err := row.Scan(dest...); err != nil {
+		return Token{}, err
+	}
+
+	token.Scopes = strings.Split(scopes, ",")
+	token.ExpiresAt = expiresAt.String
+	token.LastUsedAt = lastUsedAt.String
+
+	return token, nil
+}
+
+// AddReadings writes the validated readings of the user in a single
+// transaction, so either all or none of them are persisted. Readings
+// for a timestamp which already has one are handled by the policy, the
+// values they replace are kept as a revision changed by the author.
+// It returns the number of readings inserted and of the stored ones
+// replaced or merged into.
+func (storage UsageStorage) AddReadings(
+	userId int,
+	readings []Reading,
+	policy DuplicatePolicy,
+	author string,
+	recordedAt string) (int, int, error) {
+
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defer tx.Rollback()
+
+	var inserted, updated int
+	for index, reading := range readings {
+
+		resolution := resolutions[reading.Resolution]
+		table, idColumn := resolution.Table, resolution.IdColumn
+
+		var readingId int
+		var consumption, temperature Decimal
+		var previouslyRecordedAt string
+
+		q := `SELECT ` + idColumn + `, consumption, temperature, recorded_at FROM ` + table + ` WHERE meter_id = ? AND timestamp = ?`
+		err := tx.QueryRow(storage.rebind(q), reading.Meter, reading.Timestamp).Scan(&readingId,
+			&consumption,
+			&temperature,
+			&previouslyRecordedAt)
+
+		switch {
+		case err == sql.ErrNoRows:
+
+			q = `INSERT INTO ` + table + ` (user_id, meter_id, timestamp, consumption, temperature, recorded_at) VALUES (?, ?, ?, ?, ?, ?)`
+			_, err = tx.Exec(storage.rebind(q), userId, reading.Meter, reading.Timestamp,
+				*reading.Consumption, *reading.Temperature, recordedAt)
+			inserted++
+
+		case err != nil:
+			return 0, 0, err
+
+		case policy != DuplicateReplace && policy != DuplicateMerge:
+			return 0, 0, duplicateError{index}
+
+		default:
+
+			q = `INSERT INTO revisions (resolution, reading_id, user_id, meter_id, timestamp, consumption, temperature, recorded_at, changed_by, changed_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+			_, err = tx.Exec(storage.rebind(q), reading.Resolution, readingId, userId, reading.Meter, reading.Timestamp,
+				consumption, temperature, previouslyRecordedAt, author, recordedAt)
+
+			if err != nil {
+				return 0, 0, err
+			}
+
+			if policy == DuplicateMerge {
+				consumption = consumption.Add(*reading.Consumption)
+			} else {
+				consumption = *reading.Consumption
+			}
+
+			q = `UPDATE ` + table + ` SET consumption = ?, temperature = ?, recorded_at = ? WHERE ` + idColumn + ` = ?`
+			_, err = tx.Exec(storage.rebind(q), consumption, *reading.Temperature, recordedAt, readingId)
+			updated++
+		}
+
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+
+	return inserted, updated, nil
+}
+
+// ImportReadings writes the readings in a single transaction skipping
+// those for which the meter already has a reading at the timestamp. It
+// returns the readings actually inserted.
+func (storage UsageStorage) ImportReadings(readings []UserReading, recordedAt string, dryRun bool) ([]UserReading, error) {
+
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	var inserted []UserReading
+	for _, reading := range readings {
+
+		table := resolutions[reading.Resolution].Table
+
+		q := `INSERT INTO ` + table + ` (user_id, meter_id, timestamp, consumption, temperature, recorded_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (meter_id, timestamp) DO NOTHING`
+
+		result, err := tx.Exec(storage.rebind(q), reading.UserId, reading.Meter, reading.Timestamp,
+			*reading.Consumption, *reading.Temperature, recordedAt)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		affected, err := result.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		if affected == 0 {
+			continue
+		}
+
+		inserted = append(inserted, reading)
+	}
+
+	if dryRun {
+		return inserted, tx.Rollback()
+	}
+
+	return inserted, tx.Commit()
+}
+
+// GetRevisions fetches the earlier values of the readings of the user
+// at the timestamp, over all the meters of the user, the oldest first.
+func (storage UsageStorage) GetRevisions(userId int, resolution Resolution, timestamp string) ([]Revision, error) {
+
+	q := `SELECT meter_id, timestamp, temperature, consumption, recorded_at, changed_by, changed_at FROM revisions
+	WHERE user_id = ? AND resolution = ? AND timestamp = ? ORDER BY revision_id`
+
+	rows, err := storage.DB.Query(storage.rebind(q), userId, resolution.Name, timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	revisions := []Revision{}
+	for rows.Next() {
+
+		revision := Revision{Resolution: resolution.Name}
+		err := rows.Scan(&revision.Meter,
+			&revision.Timestamp,
+			&revision.Temperature,
+			&revision.Consumption,
+			&revision.RecordedAt,
+			&revision.ChangedBy,
+			&revision.ChangedAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, rows.Err()
+}
+
+// GetUserByName fetches the user, along with the stored password,
+// without verifying any credentials.
+func (storage UsageStorage) GetUserByName(username string) (User, error) {
+
+	user := User{}
+
+	q := `SELECT user_id, username, password, timezone FROM "user" WHERE username = ?`
+	err := storage.DB.QueryRow(storage.rebind(q), username).Scan(&user.UserId,
+		&user.UserName,
+		&user.Password,
+		&user.TimeZone)
+
+	return user, err
+}
+
+// SetUserTimeZone updates the time zone in which the data of the user
+// is bucketed and presented. The daily and monthly readings are stored
+// at the midnight of the zone of the user, these move along with their
+// revisions and anomalies to the midnight of the same day in the new one.
+func (storage UsageStorage) SetUserTimeZone(userId int, timezone string) error {
+
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	user := User{TimeZone: timezone}
+	q := `SELECT timezone FROM "user" WHERE user_id = ?`
+	if err := tx.QueryRow(storage.rebind(q), userId).Scan(&user.TimeZone); err != nil {
+		return err
+	}
+
+	from, to := user.Location(), User{TimeZone: timezone}.Location()
+
+	for _, t := range []struct {
+		table    string
+		idColumn string
+		filter   string
+	}{
+		{"days", "day_id", ""},
+		{"months", "month_id", ""},
+		{"revisions", "revision_id", ` AND resolution IN ('D', 'M')`},
+		{"anomalies", "anomaly_id", ""},
+	} {
+		if err := storage.rezone(tx, t.table, t.idColumn, t.filter, userId, from, to); err != nil {
+			return fmt.Errorf("Unable to move the %s to the time zone: %s, error: %s", t.table, timezone, err.Error())
+		}
+	}
+
+	q = `UPDATE "user" SET timezone = ? WHERE user_id = ?`
+	if _, err := tx.Exec(storage.rebind(q), timezone, userId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// rezone moves the timestamps of the rows of the user in the table from
+// the midnight of their day in one location to the one in another.
+func (storage UsageStorage) rezone(tx *sql.Tx, table string, idColumn string, filter string,
+	userId int, from *time.Location, to *time.Location) error {
+
+	q := fmt.Sprintf(`SELECT %s, timestamp FROM %s WHERE user_id = ?%s ORDER BY timestamp`, idColumn, table, filter)
+	rows, err := tx.Query(storage.rebind(q), userId)
+	if err != nil {
+		return err
+	}
+
+	type move struct {
+		id        int
+		timestamp string
+	}
+
+	var later, earlier []move
+	for rows.Next() {
+
+		var id int
+		var stored string
+		if err := rows.Scan(&id, &stored); err != nil {
+			rows.Close()
+			return err
+		}
+
+		switch moved := rezoned(stored, from, to); {
+		case moved > stored:
+			later = append(later, move{id, moved})
+		case moved < stored:
+			earlier = append(earlier, move{id, moved})
+		}
+	}
+
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// NOTE: The rows moving later are moved from the last one on and the
+	// ones moving earlier from the first one on, so that none of them
+	// takes the timestamp of a row of the next day which has not moved yet.
+	for i, j := 0, len(later)-1; i < j; i, j = i+1, j-1 {
+		later[i], later[j] = later[j], later[i]
+	}
+
+	q = fmt.Sprintf(`UPDATE %s SET timestamp = ? WHERE %s = ?`, table, idColumn)
+	for _, m := range append(later, earlier...) {
+		if _, err := tx.Exec(storage.rebind(q), m.timestamp, m.id); err != nil {
+			return err
+		}
 	}
 
-	return response, err
+	return nil
 }
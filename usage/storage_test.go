@@ -0,0 +1,1080 @@
+package usage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testStorageConformance runs the behaviour every Storage
+// implementation needs to share against a fresh, empty storage.
+func testStorageConformance(t *testing.T, storage Storage) {
+
+	t.Run("Users", func(t *testing.T) {
+		testUsersConformance(t, storage)
+	})
+
+	t.Run("Readings", func(t *testing.T) {
+		testReadingsConformance(t, storage)
+	})
+
+	t.Run("Limits", func(t *testing.T) {
+		testLimitsConformance(t, storage)
+	})
+
+	t.Run("Tokens", func(t *testing.T) {
+		testTokensConformance(t, storage)
+	})
+
+	t.Run("Revisions", func(t *testing.T) {
+		testRevisionsConformance(t, storage)
+	})
+
+	t.Run("Meters", func(t *testing.T) {
+		testMetersConformance(t, storage)
+	})
+
+	t.Run("Tariffs", func(t *testing.T) {
+		testTariffsConformance(t, storage)
+	})
+
+	t.Run("Budgets", func(t *testing.T) {
+		testBudgetsConformance(t, storage)
+	})
+
+	t.Run("Webhooks", func(t *testing.T) {
+		testWebhooksConformance(t, storage)
+	})
+
+	t.Run("Anomalies", func(t *testing.T) {
+		testAnomaliesConformance(t, storage)
+	})
+
+	t.Run("TimeZones", func(t *testing.T) {
+		testTimeZonesConformance(t, storage)
+	})
+}
+
+func decPtr(val int) *Decimal {
+	d := NewDecimal(val)
+	return &d
+}
+
+func mustDecimal(value string) Decimal {
+
+	d, err := ParseDecimal(value)
+	if err != nil {
+		panic(err)
+	}
+
+	return d
+}
+
+// defaultMeter is the electricity meter every user gets when added.
+func defaultMeter(t testing.TB, storage Storage, userId int) int {
+
+	meters, err := storage.GetMeters(userId)
+	if err != nil || len(meters) == 0 {
+		t.Fatalf("Unable to fetch the default meter: %v", err)
+	}
+
+	return meters[0].MeterId
+}
+
+func testUsersConformance(t *testing.T, storage Storage) {
+
+	if err := storage.AddUser(1, "username1", "hash1"); err != nil {
+		t.Fatalf("Unable to add the user: %s", err.Error())
+	}
+
+	if err := storage.AddUser(2, "username1", "hash2"); err == nil {
+		t.Fatalf("Usernames need to be unique")
+	}
+
+	user, err := storage.GetUserByName("username1")
+	if err != nil {
+		t.Fatalf("Unable to fetch the user: %s", err.Error())
+	}
+
+	expected := User{UserId: 1, UserName: "username1", Password: "hash1", TimeZone: "UTC"}
+	if user != expected {
+		t.Fatalf("Mismatch between the expected: %+v and actual: %+v user", expected, user)
+	}
+
+	if _, err := storage.GetUserByName("unknown"); err != sql.ErrNoRows {
+		t.Fatalf("Expected sql.ErrNoRows for an unknown user, got: %v", err)
+	}
+
+	// The password is only replaced when it has not changed in between.
+	storage.UpdatePassword(1, "stale", "hash3")
+	storage.UpdatePassword(1, "hash1", "hash4")
+
+	if err := storage.SetUserTimeZone(1, "Europe/Stockholm"); err != nil {
+		t.Fatalf("Unable to set the time zone: %s", err.Error())
+	}
+
+	user, _ = storage.GetUserByName("username1")
+	if user.Password != "hash4" || user.TimeZone != "Europe/Stockholm" {
+		t.Fatalf("Unexpected user after the updates: %+v", user)
+	}
+}
+
+func testReadingsConformance(t *testing.T, storage Storage) {
+
+	userId := 10
+	storage.AddUser(userId, "readings", "hash")
+	meter := defaultMeter(t, storage, userId)
+
+	// Explicit ids followed by generated ones must not collide.
+	if err := storage.AddDailyLimit(userId, 1, 3, 30, "2014-02-03 00:00:00"); err != nil {
+		t.Fatalf("Unable to add the daily limit: %s", err.Error())
+	}
+
+	_, _, err := storage.AddReadings(userId, []Reading{
+		{"D", "2014-02-01 00:00:00", decPtr(1), decPtr(10), meter},
+		{"D", "2014-02-02 00:00:00", decPtr(2), decPtr(20), meter},
+		{"D", "2014-02-04 00:00:00", decPtr(4), decPtr(40), meter},
+		{"M", "2014-02-01 00:00:00", decPtr(2), decPtr(100), meter},
+	}, DuplicateReject, "test", "2014-03-01 00:00:00")
+
+	if err != nil {
+		t.Fatalf("Unable to add the readings: %s", err.Error())
+	}
+
+	if err := storage.AddDailyLimit(userId, 100, 3, 30, "2014-02-03 00:00:00"); err == nil {
+		t.Fatalf("Readings need to be unique per user and timestamp")
+	}
+
+	// A rejected duplicate leaves the rest of the batch unwritten.
+	_, _, err = storage.AddReadings(userId, []Reading{
+		{"D", "2014-02-10 00:00:00", decPtr(1), decPtr(1), meter},
+		{"D", "2014-02-04 00:00:00", decPtr(1), decPtr(1), meter},
+	}, DuplicateReject, "test", "2014-03-01 00:00:00")
+
+	if derr, ok := err.(duplicateError); !ok || derr.index != 1 {
+		t.Fatalf("Expected the duplicate at index 1 to be rejected, got: %v", err)
+	}
+
+	for _, tc := range []struct {
+		policy      DuplicatePolicy
+		temperature int
+		expected    [][]interface{}
+	}{
+		{DuplicateReplace, 6, [][]interface{}{{"2014-02-04", NewDecimal(6), NewDecimal(5)}}},
+		{DuplicateMerge, 7, [][]interface{}{{"2014-02-04", NewDecimal(7), NewDecimal(10)}}},
+	} {
+
+		inserted, updated, err := storage.AddReadings(userId, []Reading{{"D", "2014-02-04 00:00:00", decPtr(tc.temperature), decPtr(5), meter}},
+			tc.policy, "test", "2014-03-01 00:00:00")
+		if err != nil {
+			t.Fatalf("Unable to %s the duplicate: %s", tc.policy, err.Error())
+		}
+
+		if inserted != 0 || updated != 1 {
+			t.Fatalf("Expected the stored reading to be updated by the %s, found: %d inserted and %d updated",
+				tc.policy, inserted, updated)
+		}
+
+		page, _ := storage.GetUserData(userId, resolutions["D"], DataQuery{Resolution: "D", Start: "2014-02-04 00:00:00"})
+		if !reflect.DeepEqual(page.Data, tc.expected) {
+			t.Fatalf("Mismatch between the expected: %v and actual: %v data after the %s", tc.expected, page.Data, tc.policy)
+		}
+	}
+
+	storage.AddReadings(userId, []Reading{{"D", "2014-02-04 00:00:00", decPtr(4), decPtr(40), meter}},
+		DuplicateReplace, "test", "2014-03-01 00:00:00")
+
+	daily := resolutions["D"]
+
+	page, err := storage.GetUserData(userId, daily, DataQuery{Resolution: "D", Start: "2014-02-02 00:00:00", Count: 2})
+	if err != nil {
+		t.Fatalf("Unable to fetch the data: %s", err.Error())
+	}
+
+	expected := [][]interface{}{{"2014-02-02", NewDecimal(2), NewDecimal(20)}, {"2014-02-03", NewDecimal(3), NewDecimal(30)}}
+	if !reflect.DeepEqual(page.Data, expected) || !page.HasMore {
+		t.Fatalf("Mismatch between the expected: %v and actual: %v data", expected, page.Data)
+	}
+
+	page, err = storage.GetUserData(userId, daily, DataQuery{Resolution: "D", Start: "2014-02-02 00:00:00", Count: 2, After: page.Next})
+	if err != nil {
+		t.Fatalf("Unable to fetch the next page: %s", err.Error())
+	}
+
+	expected = [][]interface{}{{"2014-02-04", NewDecimal(4), NewDecimal(40)}}
+	if !reflect.DeepEqual(page.Data, expected) || page.HasMore {
+		t.Fatalf("Mismatch between the expected: %v and actual: %v next page", expected, page.Data)
+	}
+
+	page, _ = storage.GetUserData(userId, daily, DataQuery{Resolution: "D", End: "2014-02-03 00:00:00", Descending: true})
+	expected = [][]interface{}{{"2014-02-02", NewDecimal(2), NewDecimal(20)}, {"2014-02-01", NewDecimal(1), NewDecimal(10)}}
+	if !reflect.DeepEqual(page.Data, expected) {
+		t.Fatalf("Mismatch between the expected: %v and actual: %v descending data", expected, page.Data)
+	}
+
+	page, _ = storage.GetUserData(userId, resolutions["M"], DataQuery{Resolution: "M"})
+	expected = [][]interface{}{{"2014-02-01", NewDecimal(2), NewDecimal(100)}}
+	if !reflect.DeepEqual(page.Data, expected) {
+		t.Fatalf("Mismatch between the expected: %v and actual: %v monthly data", expected, page.Data)
+	}
+
+	// Imports skip the readings which already exist.
+	imported := []UserReading{
+		{userId, time.UTC, Reading{"D", "2014-02-01 00:00:00", decPtr(1), decPtr(10), meter}},
+		{userId, time.UTC, Reading{"D", "2014-02-05 00:00:00", decPtr(5), decPtr(50), meter}},
+	}
+
+	inserted, err := storage.ImportReadings(imported, "2014-03-01 00:00:00", true)
+	if err != nil || len(inserted) != 1 || inserted[0].Timestamp != "2014-02-05 00:00:00" {
+		t.Fatalf("Unexpected dry run of the import, inserted: %v, error: %v", inserted, err)
+	}
+
+	page, _ = storage.GetUserData(userId, daily, DataQuery{Resolution: "D"})
+	if len(page.Data) != 4 {
+		t.Fatalf("Dry run of the import has written %d readings", len(page.Data)-4)
+	}
+
+	inserted, err = storage.ImportReadings(imported, "2014-03-01 00:00:00", false)
+	if err != nil || len(inserted) != 1 || inserted[0].Timestamp != "2014-02-05 00:00:00" {
+		t.Fatalf("Unexpected import, inserted: %v, error: %v", inserted, err)
+	}
+
+	page, _ = storage.GetUserData(userId, daily, DataQuery{Resolution: "D"})
+	if len(page.Data) != 5 {
+		t.Fatalf("Expected 5 readings after the import, found: %d", len(page.Data))
+	}
+
+	// Decimals are kept exactly, also when merged.
+	for _, value := range []string{"0.1", "0.2"} {
+
+		consumption := mustDecimal(value)
+		reading := Reading{"D", "2014-02-06 00:00:00", &consumption, &consumption, meter}
+		if _, _, err := storage.AddReadings(userId, []Reading{reading}, DuplicateMerge, "test", "2014-03-01 00:00:00"); err != nil {
+			t.Fatalf("Unable to add the decimal reading: %s", err.Error())
+		}
+	}
+
+	page, _ = storage.GetUserData(userId, daily, DataQuery{Resolution: "D", Start: "2014-02-06 00:00:00"})
+	expected = [][]interface{}{{"2014-02-06", mustDecimal("0.2"), mustDecimal("0.3")}}
+	if !reflect.DeepEqual(page.Data, expected) {
+		t.Fatalf("Mismatch between the expected: %v and actual: %v decimal data", expected, page.Data)
+	}
+}
+
+func testLimitsConformance(t *testing.T, storage Storage) {
+
+	userId := 20
+	storage.AddUser(userId, "limits", "hash")
+	meter := defaultMeter(t, storage, userId)
+
+	limits, err := storage.GetLimits(userId, resolutions["D"], LimitsQuery{})
+	if err != nil {
+		t.Fatalf("Unable to fetch the limits: %s", err.Error())
+	}
+
+	expected := Limits{MinMaxTimestamp{"0001-01-01", "0001-01-01"}, MinMaxConsumption{}, MinMaxTemperature{}}
+	if limits != expected {
+		t.Fatalf("Mismatch between the expected: %+v and actual: %+v default limits", expected, limits)
+	}
+
+	storage.AddReadings(userId, []Reading{
+		{"H", "2014-02-01 10:00:00", decPtr(-3), decPtr(10), meter},
+		{"H", "2014-02-01 23:00:00", decPtr(5), decPtr(2), meter},
+	}, DuplicateReject, "test", "2014-03-01 00:00:00")
+
+	loc, _ := time.LoadLocation("Europe/Stockholm")
+	limits, err = storage.GetLimits(userId, resolutions["H"], LimitsQuery{Location: loc})
+	if err != nil {
+		t.Fatalf("Unable to fetch the limits: %s", err.Error())
+	}
+
+	expected = Limits{
+		MinMaxTimestamp{"2014-02-01 11:00", "2014-02-02 00:00"},
+		MinMaxConsumption{NewDecimal(2), NewDecimal(10)},
+		MinMaxTemperature{NewDecimal(-3), NewDecimal(5)},
+	}
+	if limits != expected {
+		t.Fatalf("Mismatch between the expected: %+v and actual: %+v limits", expected, limits)
+	}
+}
+
+func testTokensConformance(t *testing.T, storage Storage) {
+
+	userId := 30
+	storage.AddUser(userId, "tokens", "hash")
+
+	tokenId, err := storage.AddToken(userId, "dashboard", "tokenhash", []string{ScopeDataRead, ScopeLimitsRead},
+		"2014-02-01 00:00:00", "")
+	if err != nil {
+		t.Fatalf("Unable to add the token: %s", err.Error())
+	}
+
+	if err := storage.TouchToken(tokenId, "2014-02-02 00:00:00"); err != nil {
+		t.Fatalf("Unable to touch the token: %s", err.Error())
+	}
+
+	user, token, err := storage.GetTokenByHash("tokenhash")
+	if err != nil {
+		t.Fatalf("Unable to fetch the token: %s", err.Error())
+	}
+
+	expected := Token{
+		TokenId:    tokenId,
+		UserId:     userId,
+		Name:       "dashboard",
+		Scopes:     []string{ScopeDataRead, ScopeLimitsRead},
+		CreatedAt:  "2014-02-01 00:00:00",
+		LastUsedAt: "2014-02-02 00:00:00",
+	}
+
+	if user.UserName != "tokens" || !reflect.DeepEqual(token, expected) {
+		t.Fatalf("Mismatch between the expected: %+v and actual: %+v token", expected, token)
+	}
+
+	tokens, err := storage.GetTokens(userId)
+	if err != nil || len(tokens) != 1 {
+		t.Fatalf("Unable to list the tokens: %v", err)
+	}
+
+	if err := storage.DeleteToken(userId+1, tokenId); err != sql.ErrNoRows {
+		t.Fatalf("Expected sql.ErrNoRows for the token of another user, got: %v", err)
+	}
+
+	if err := storage.DeleteToken(userId, tokenId); err != nil {
+		t.Fatalf("Unable to delete the token: %s", err.Error())
+	}
+
+	if _, _, err := storage.GetTokenByHash("tokenhash"); err != sql.ErrNoRows {
+		t.Fatalf("Expected sql.ErrNoRows for a deleted token, got: %v", err)
+	}
+}
+
+func testRevisionsConformance(t *testing.T, storage Storage) {
+
+	userId := 40
+	storage.AddUser(userId, "revisions", "hash")
+	meter := defaultMeter(t, storage, userId)
+
+	for _, write := range []struct {
+		policy      DuplicatePolicy
+		consumption int
+		author      string
+		recordedAt  string
+	}{
+		{DuplicateReject, 10, "alice", "2014-03-01 00:00:00"},
+		{DuplicateReplace, 12, "bob", "2014-03-05 00:00:00"},
+		{DuplicateMerge, 3, "carol", "2014-03-09 00:00:00"},
+	} {
+
+		readings := []Reading{{"D", "2014-02-01 00:00:00", decPtr(1), decPtr(write.consumption), meter}}
+		if _, _, err := storage.AddReadings(userId, readings, write.policy, write.author, write.recordedAt); err != nil {
+			t.Fatalf("Unable to write the reading: %s", err.Error())
+		}
+	}
+
+	// A reading which has never been corrected.
+	storage.AddReadings(userId, []Reading{{"D", "2014-02-02 00:00:00", decPtr(1), decPtr(7), meter}},
+		DuplicateReject, "alice", "2014-03-05 00:00:00")
+
+	for _, tc := range []struct {
+		asOf     string
+		expected [][]interface{}
+	}{
+		{"2014-02-28 00:00:00", nil},
+		{"2014-03-01 00:00:00", [][]interface{}{{"2014-02-01", NewDecimal(1), NewDecimal(10)}}},
+		{"2014-03-07 00:00:00", [][]interface{}{{"2014-02-01", NewDecimal(1), NewDecimal(12)}, {"2014-02-02", NewDecimal(1), NewDecimal(7)}}},
+		{"", [][]interface{}{{"2014-02-01", NewDecimal(1), NewDecimal(15)}, {"2014-02-02", NewDecimal(1), NewDecimal(7)}}},
+	} {
+
+		page, err := storage.GetUserData(userId, resolutions["D"], DataQuery{Resolution: "D", AsOf: tc.asOf})
+		if err != nil {
+			t.Fatalf("Unable to fetch the data as of %s: %s", tc.asOf, err.Error())
+		}
+
+		if !reflect.DeepEqual(page.Data, tc.expected) {
+			t.Fatalf("Mismatch between the expected: %v and actual: %v data as of %s", tc.expected, page.Data, tc.asOf)
+		}
+	}
+
+	revisions, err := storage.GetRevisions(userId, resolutions["D"], "2014-02-01 00:00:00")
+	if err != nil {
+		t.Fatalf("Unable to fetch the revisions: %s", err.Error())
+	}
+
+	expected := []Revision{
+		{"D", meter, "2014-02-01 00:00:00", NewDecimal(1), NewDecimal(10), "2014-03-01 00:00:00", "bob", "2014-03-05 00:00:00"},
+		{"D", meter, "2014-02-01 00:00:00", NewDecimal(1), NewDecimal(12), "2014-03-05 00:00:00", "carol", "2014-03-09 00:00:00"},
+	}
+
+	if !reflect.DeepEqual(revisions, expected) {
+		t.Fatalf("Mismatch between the expected: %+v and actual: %+v revisions", expected, revisions)
+	}
+}
+
+func testMetersConformance(t *testing.T, storage Storage) {
+
+	userId := 50
+	storage.AddUser(userId, "meters", "hash")
+	main := defaultMeter(t, storage, userId)
+
+	garage, err := storage.AddMeter(userId, UtilityElectricity, "kWh", "garage")
+	if err != nil {
+		t.Fatalf("Unable to add the meter: %s", err.Error())
+	}
+
+	gas, _ := storage.AddMeter(userId, UtilityGas, "m3", "")
+
+	meters, err := storage.GetMeters(userId)
+	if err != nil {
+		t.Fatalf("Unable to fetch the meters: %s", err.Error())
+	}
+
+	expected := []Meter{
+		{main, userId, UtilityElectricity, "kWh", "default"},
+		{garage, userId, UtilityElectricity, "kWh", "garage"},
+		{gas, userId, UtilityGas, "m3", ""},
+	}
+
+	if !reflect.DeepEqual(meters, expected) {
+		t.Fatalf("Mismatch between the expected: %+v and actual: %+v meters", expected, meters)
+	}
+
+	// Every meter has a reading of its own at the same timestamp.
+	_, _, err = storage.AddReadings(userId, []Reading{
+		{"D", "2014-02-01 00:00:00", decPtr(1), decPtr(10), main},
+		{"D", "2014-02-01 00:00:00", decPtr(4), decPtr(5), garage},
+		{"D", "2014-02-01 00:00:00", decPtr(9), decPtr(3), gas},
+		{"D", "2014-02-02 00:00:00", decPtr(2), decPtr(20), main},
+	}, DuplicateReject, "test", "2014-03-01 00:00:00")
+
+	if err != nil {
+		t.Fatalf("Unable to add the readings: %s", err.Error())
+	}
+
+	for _, tc := range []struct {
+		meters   []int
+		expected [][]interface{}
+	}{
+		{[]int{main, garage}, [][]interface{}{{"2014-02-01", mustDecimal("2.5"), NewDecimal(15)}, {"2014-02-02", NewDecimal(2), NewDecimal(20)}}},
+		{[]int{garage}, [][]interface{}{{"2014-02-01", NewDecimal(4), NewDecimal(5)}}},
+		{[]int{gas}, [][]interface{}{{"2014-02-01", NewDecimal(9), NewDecimal(3)}}},
+		{[]int{}, nil},
+	} {
+
+		page, err := storage.GetUserData(userId, resolutions["D"], DataQuery{Resolution: "D", meters: tc.meters})
+		if err != nil {
+			t.Fatalf("Unable to fetch the data: %s", err.Error())
+		}
+
+		if !reflect.DeepEqual(page.Data, tc.expected) {
+			t.Fatalf("Mismatch between the expected: %v and actual: %v data of the meters %v", tc.expected, page.Data, tc.meters)
+		}
+	}
+
+	limits, err := storage.GetLimits(userId, resolutions["D"], LimitsQuery{meters: []int{main, garage}})
+	if err != nil {
+		t.Fatalf("Unable to fetch the limits: %s", err.Error())
+	}
+
+	expectedLimits := Limits{
+		MinMaxTimestamp{"2014-02-01", "2014-02-02"},
+		MinMaxConsumption{NewDecimal(15), NewDecimal(20)},
+		MinMaxTemperature{NewDecimal(2), mustDecimal("2.5")},
+	}
+	if limits != expectedLimits {
+		t.Fatalf("Mismatch between the expected: %+v and actual: %+v limits", expectedLimits, limits)
+	}
+}
+
+func testTariffsConformance(t *testing.T, storage Storage) {
+
+	userId := 60
+	storage.AddUser(userId, "tariffs", "hash")
+
+	night := mustDecimal("0.05")
+	upTo := NewDecimal(100)
+
+	tariffs := []Tariff{
+		{UserId: userId, Utility: UtilityElectricity, Name: "night", Currency: "EUR",
+			ValidFrom: "2014-04-01 00:00:00", StandingCharge: mustDecimal("0.3"), Rate: decPtr(1),
+			Windows: []Window{{From: "22:00", To: "06:00", Days: []string{"mon"}, Rate: night}}},
+		{UserId: userId, Utility: UtilityElectricity, Name: "tiered", Currency: "EUR",
+			ValidFrom: "2014-01-01 00:00:00", ValidTo: "2014-04-01 00:00:00",
+			Tiers: []Tier{{UpTo: &upTo, Rate: mustDecimal("0.1")}, {Rate: mustDecimal("0.2")}}},
+		{UserId: userId, Utility: UtilityGas, Name: "gas", Currency: "EUR",
+			ValidFrom: "2014-01-01 00:00:00", Rate: decPtr(2)},
+	}
+
+	for i := range tariffs {
+
+		id, err := storage.AddTariff(tariffs[i])
+		if err != nil {
+			t.Fatalf("Unable to add the tariff: %s", err.Error())
+		}
+
+		tariffs[i].TariffId = id
+	}
+
+	// The tariffs of the utility are listed by the start of their validity.
+	stored, err := storage.GetTariffs(userId, UtilityElectricity)
+	if err != nil {
+		t.Fatalf("Unable to fetch the tariffs: %s", err.Error())
+	}
+
+	expected := []Tariff{tariffs[1], tariffs[0]}
+	if !reflect.DeepEqual(stored, expected) {
+		t.Fatalf("Mismatch between the expected: %+v and actual: %+v tariffs", expected, stored)
+	}
+
+	if err := storage.DeleteTariff(userId+1, tariffs[0].TariffId); err != sql.ErrNoRows {
+		t.Fatalf("Expected sql.ErrNoRows for the tariff of another user, got: %v", err)
+	}
+
+	if err := storage.DeleteTariff(userId, tariffs[0].TariffId); err != nil {
+		t.Fatalf("Unable to delete the tariff: %s", err.Error())
+	}
+
+	stored, _ = storage.GetTariffs(userId, UtilityElectricity)
+	if !reflect.DeepEqual(stored, []Tariff{tariffs[1]}) {
+		t.Fatalf("Expected only the tiered tariff to remain, got: %+v", stored)
+	}
+}
+
+func testBudgetsConformance(t *testing.T, storage Storage) {
+
+	userId := 70
+	storage.AddUser(userId, "budgets", "hash")
+
+	budget := Budget{UserId: userId, Name: "daily", Utility: UtilityElectricity, Metric: MetricConsumption,
+		Period: "D", Limit: mustDecimal("12.5"), TimeZone: "Europe/Stockholm"}
+
+	budgetId, err := storage.AddBudget(budget)
+	if err != nil {
+		t.Fatalf("Unable to add the budget: %s", err.Error())
+	}
+
+	budget.BudgetId = budgetId
+
+	budgets, err := storage.GetBudgets(userId)
+	if err != nil {
+		t.Fatalf("Unable to fetch the budgets: %s", err.Error())
+	}
+
+	if !reflect.DeepEqual(budgets, []Budget{budget}) {
+		t.Fatalf("Mismatch between the expected: %+v and actual: %+v budgets", []Budget{budget}, budgets)
+	}
+
+	alert := Alert{UserId: userId, BudgetId: budgetId, Kind: AlertProjected, Period: "2014-05-01",
+		Value: NewDecimal(5), Projected: NewDecimal(20), Limit: budget.Limit, TriggeredAt: "2014-05-01 06:00:00"}
+
+	// An alert is only raised once for the kind, budget and period.
+	for _, expected := range []bool{true, false} {
+
+		added, err := storage.AddAlert(alert)
+		if err != nil || added != expected {
+			t.Fatalf("Expected the alert to be added: %v, got: %v, error: %v", expected, added, err)
+		}
+	}
+
+	exceeded := alert
+	exceeded.Kind, exceeded.TriggeredAt = AlertExceeded, "2014-05-01 12:00:00"
+	storage.AddAlert(exceeded)
+
+	alerts, err := storage.GetAlerts(userId)
+	if err != nil {
+		t.Fatalf("Unable to fetch the alerts: %s", err.Error())
+	}
+
+	if len(alerts) != 2 || alerts[0].Kind != AlertExceeded || alerts[1].Kind != AlertProjected {
+		t.Fatalf("Expected the alerts with the latest first, got: %+v", alerts)
+	}
+
+	alert.AlertId = alerts[1].AlertId
+	if alerts[1] != alert {
+		t.Fatalf("Mismatch between the expected: %+v and actual: %+v alert", alert, alerts[1])
+	}
+
+	if err := storage.DeleteBudget(userId+1, budgetId); err != sql.ErrNoRows {
+		t.Fatalf("Expected sql.ErrNoRows for the budget of another user, got: %v", err)
+	}
+
+	if err := storage.DeleteBudget(userId, budgetId); err != nil {
+		t.Fatalf("Unable to delete the budget: %s", err.Error())
+	}
+
+	if alerts, _ := storage.GetAlerts(userId); len(alerts) != 0 {
+		t.Fatalf("Expected the alerts to be deleted along with the budget, got: %+v", alerts)
+	}
+}
+
+func testWebhooksConformance(t *testing.T, storage Storage) {
+
+	userId := 80
+	storage.AddUser(userId, "webhooks", "hash")
+
+	webhook := Webhook{UserId: userId, URL: "https://example.com/hook", Events: []string{EventReadingIngested, EventDataGap},
+		Secret: "secret", CreatedAt: "2014-06-01 00:00:00"}
+
+	webhookId, err := storage.AddWebhook(webhook)
+	if err != nil {
+		t.Fatalf("Unable to add the webhook: %s", err.Error())
+	}
+
+	webhook.WebhookId = webhookId
+
+	webhooks, err := storage.GetWebhooks(userId)
+	if err != nil || !reflect.DeepEqual(webhooks, []Webhook{webhook}) {
+		t.Fatalf("Mismatch between the expected: %+v and actual: %+v webhooks, error: %v", []Webhook{webhook}, webhooks, err)
+	}
+
+	pending := func(nextAttemptAt string) Delivery {
+		return Delivery{WebhookId: webhookId, UserId: userId, Event: EventReadingIngested, Payload: json.RawMessage(`{"event":"reading.ingested"}`),
+			Status: DeliveryPending, CreatedAt: "2014-06-01 00:00:00", NextAttemptAt: nextAttemptAt}
+	}
+
+	err = storage.AddDeliveries([]Delivery{pending("2014-06-01 00:05:00"), pending("2014-06-01 00:01:00"), pending("2014-06-01 01:00:00")})
+	if err != nil {
+		t.Fatalf("Unable to add the deliveries: %s", err.Error())
+	}
+
+	// Only the deliveries which are due are fetched, the longest due first.
+	due, err := storage.GetDueDeliveries("2014-06-01 00:10:00", 10)
+	if err != nil {
+		t.Fatalf("Unable to fetch the due deliveries: %s", err.Error())
+	}
+
+	if len(due) != 2 || due[0].NextAttemptAt != "2014-06-01 00:01:00" || due[0].url != webhook.URL || due[0].secret != webhook.Secret ||
+		string(due[0].Payload) != `{"event":"reading.ingested"}` {
+		t.Fatalf("Unexpected due deliveries: %+v", due)
+	}
+
+	delivered := due[0]
+	delivered.Status, delivered.Attempts, delivered.ResponseCode = DeliveryDelivered, 1, 200
+	delivered.NextAttemptAt, delivered.DeliveredAt = "", "2014-06-01 00:10:00"
+
+	if err := storage.UpdateDelivery(delivered); err != nil {
+		t.Fatalf("Unable to update the delivery: %s", err.Error())
+	}
+
+	deliveries, err := storage.GetDeliveries(userId, webhookId, 2)
+	if err != nil || len(deliveries) != 2 {
+		t.Fatalf("Expected the two latest deliveries, got: %+v, error: %v", deliveries, err)
+	}
+
+	delivered.url, delivered.secret = "", ""
+	if !reflect.DeepEqual(deliveries[1], delivered) {
+		t.Fatalf("Mismatch between the expected: %+v and actual: %+v delivery", delivered, deliveries[1])
+	}
+
+	if err := storage.DeleteWebhook(userId, webhookId); err != nil {
+		t.Fatalf("Unable to delete the webhook: %s", err.Error())
+	}
+
+	if due, _ := storage.GetDueDeliveries("2014-06-02 00:00:00", 10); len(due) != 0 {
+		t.Fatalf("Expected the deliveries to be deleted along with the webhook, got: %+v", due)
+	}
+}
+
+func testAnomaliesConformance(t *testing.T, storage Storage) {
+
+	userId := 90
+	storage.AddUser(userId, "anomalies", "hash")
+
+	anomaly := func(timestamp string, consumption int) Anomaly {
+		return Anomaly{UserId: userId, Utility: "electricity", Timestamp: timestamp, Consumption: NewDecimal(consumption),
+			Expected: NewDecimal(10), Score: mustDecimal("12.5"), DetectedAt: "2014-07-01 00:00:00"}
+	}
+
+	if err := storage.AddAnomalies([]Anomaly{anomaly("2014-06-20 00:00:00", 40), anomaly("2014-06-10 00:00:00", 30)}); err != nil {
+		t.Fatalf("Unable to add the anomalies: %s", err.Error())
+	}
+
+	anomalies, err := storage.GetAnomalies(userId, "electricity", 0, "2014-06-01 00:00:00", "2014-07-01 00:00:00")
+	if err != nil || len(anomalies) != 2 || anomalies[0].Timestamp != "2014-06-10 00:00:00" ||
+		anomalies[1].Consumption != NewDecimal(40) || anomalies[1].Score != mustDecimal("12.5") {
+		t.Fatalf("Unexpected anomalies: %+v, error: %v", anomalies, err)
+	}
+
+	if err := storage.AcknowledgeAnomaly(userId, anomalies[0].AnomalyId, "2014-07-02 00:00:00"); err != nil {
+		t.Fatalf("Unable to acknowledge the anomaly: %s", err.Error())
+	}
+
+	// Acknowledging again keeps the time of the first acknowledgement,
+	// and detecting the day again keeps the anomaly as it is.
+	storage.AcknowledgeAnomaly(userId, anomalies[0].AnomalyId, "2014-07-03 00:00:00")
+	storage.AddAnomalies([]Anomaly{anomaly("2014-06-10 00:00:00", 35)})
+
+	anomalies, err = storage.GetAnomalies(userId, "electricity", 0, "2014-06-01 00:00:00", "2014-06-15 00:00:00")
+	if err != nil || len(anomalies) != 1 || anomalies[0].AcknowledgedAt != "2014-07-02 00:00:00" ||
+		anomalies[0].Consumption != NewDecimal(30) {
+		t.Fatalf("Unexpected anomalies: %+v, error: %v", anomalies, err)
+	}
+
+	if anomalies, _ := storage.GetAnomalies(userId, "gas", 0, "2014-06-01 00:00:00", "2014-07-01 00:00:00"); len(anomalies) != 0 {
+		t.Fatalf("Expected no anomalies of another utility, got: %+v", anomalies)
+	}
+
+	if err := storage.AcknowledgeAnomaly(userId+1, anomalies[0].AnomalyId, "2014-07-02 00:00:00"); err != sql.ErrNoRows {
+		t.Fatalf("Expected sql.ErrNoRows for the anomaly of another user, got: %v", err)
+	}
+}
+
+// testTimeZonesConformance checks that the daily and monthly readings
+// stay on their day, along with their revisions and anomalies, when the
+// time zone of the user changes.
+func testTimeZonesConformance(t *testing.T, storage Storage) {
+
+	userId := 90
+	storage.AddUser(userId, "timezones", "hash")
+	meter := defaultMeter(t, storage, userId)
+
+	for _, policy := range []DuplicatePolicy{DuplicateReject, DuplicateReplace} {
+		storage.AddReadings(userId, []Reading{
+			{"D", "2014-02-01 00:00:00", decPtr(1), decPtr(10), meter},
+			{"D", "2014-02-02 00:00:00", decPtr(2), decPtr(20), meter},
+			{"M", "2014-02-01 00:00:00", decPtr(2), decPtr(30), meter},
+			{"H", "2014-02-01 00:00:00", decPtr(1), decPtr(10), meter},
+		}, policy, "test", "2014-03-01 00:00:00")
+	}
+
+	storage.AddAnomalies([]Anomaly{{UserId: userId, Utility: UtilityElectricity,
+		Timestamp: "2014-02-02 00:00:00", DetectedAt: "2014-03-01 00:00:00"}})
+
+	if err := storage.SetUserTimeZone(userId, "Europe/Stockholm"); err != nil {
+		t.Fatalf("Unable to set the time zone: %s", err.Error())
+	}
+
+	loc, _ := time.LoadLocation("Europe/Stockholm")
+
+	for _, tc := range []struct {
+		resolution string
+		expected   [][]interface{}
+	}{
+		{"D", [][]interface{}{{"2014-02-01", NewDecimal(1), NewDecimal(10)}, {"2014-02-02", NewDecimal(2), NewDecimal(20)}}},
+		{"M", [][]interface{}{{"2014-02-01", NewDecimal(2), NewDecimal(30)}}},
+		{"H", [][]interface{}{{"2014-02-01 01:00", NewDecimal(1), NewDecimal(10)}}},
+	} {
+
+		page, err := storage.GetUserData(userId, resolutions[tc.resolution],
+			DataQuery{Resolution: tc.resolution, Location: loc})
+		if err != nil || !reflect.DeepEqual(page.Data, tc.expected) {
+			t.Fatalf("Mismatch between the expected: %v and actual: %v %s data in the new time zone, error: %v",
+				tc.expected, page.Data, tc.resolution, err)
+		}
+	}
+
+	revisions, err := storage.GetRevisions(userId, resolutions["D"], "2014-01-31 23:00:00")
+	if err != nil || len(revisions) != 1 || revisions[0].Timestamp != "2014-01-31 23:00:00" {
+		t.Fatalf("Unexpected revisions in the new time zone: %+v, error: %v", revisions, err)
+	}
+
+	anomalies, err := storage.GetAnomalies(userId, UtilityElectricity, 0, "2014-02-01 00:00:00", "2014-03-01 00:00:00")
+	if err != nil || len(anomalies) != 1 || anomalies[0].Timestamp != "2014-02-01 23:00:00" {
+		t.Fatalf("Unexpected anomalies in the new time zone: %+v, error: %v", anomalies, err)
+	}
+}
+
+func TestSQLiteStorageConformance(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "usage")
+	if err != nil {
+		t.Fatalf("Unable to create the temporary directory: %s", err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+
+	storage, err := NewStorage(filepath.Join(dir, "usage.db"))
+	if err != nil {
+		t.Fatalf("Unable to create the storage: %s", err.Error())
+	}
+
+	defer storage.Close()
+
+	testStorageConformance(t, storage)
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "usage")
+	if err != nil {
+		t.Fatalf("Unable to create the temporary directory: %s", err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+
+	location := filepath.Join(dir, "usage.db")
+
+	// Stage1: A database created before the schema was versioned.
+	db, err := sql.Open("sqlite3", location)
+	if err != nil {
+		t.Fatalf("Unable to open the database: %s", err.Error())
+	}
+
+	for _, q := range []string{
+		`CREATE TABLE user (user_id INTEGER PRIMARY KEY, username TEXT NOT NULL UNIQUE, password TEXT NOT NULL)`,
+		`CREATE TABLE days (day_id INTEGER PRIMARY KEY, user_id INTEGER NOT NULL, timestamp TEXT NOT NULL,
+			consumption INTEGER NOT NULL, temperature INTEGER NOT NULL)`,
+		`INSERT INTO user (user_id, username, password) VALUES (1, 'legacy', 'hash')`,
+		`INSERT INTO days (user_id, timestamp, consumption, temperature) VALUES (1, '2014-09-01 00:00:00', 10, 20)`,
+		`INSERT INTO days (user_id, timestamp, consumption, temperature) VALUES (1, '2014-09-01 00:00:00', 11, 21)`,
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("Unable to set up the legacy database: %s", err.Error())
+		}
+	}
+
+	db.Close()
+
+	storage, err := NewStorage(location)
+	if err != nil {
+		t.Fatalf("Unable to adopt the legacy database: %s", err.Error())
+	}
+
+	latest := storage.LatestSchemaVersion()
+	if version, err := storage.SchemaVersion(); err != nil || version != latest {
+		t.Fatalf("Expected the schema version: %d, found: %d, error: %v", latest, version, err)
+	}
+
+	if user, err := storage.GetUserByName("legacy"); err != nil || user.TimeZone != "UTC" {
+		t.Fatalf("Unexpected user in the adopted database: %+v, error: %v", user, err)
+	}
+
+	var dayId, count int
+	err = storage.DB.QueryRow(`SELECT min(day_id), count(*) FROM days WHERE user_id = 1`).Scan(&dayId, &count)
+	if err != nil || dayId != 1 || count != 1 {
+		t.Fatalf("Expected the reading written first to be kept, found: %d of %d, error: %v", dayId, count, err)
+	}
+
+	// Stage2: Revert all the migrations and apply them again.
+	if err := storage.MigrateDown(0); err != nil {
+		t.Fatalf("Unable to revert the migrations: %s", err.Error())
+	}
+
+	if _, err := storage.GetUserByName("legacy"); err == nil {
+		t.Fatalf("User table still exists after reverting the migrations")
+	}
+
+	if err := storage.MigrateUp(0); err != nil {
+		t.Fatalf("Unable to apply the migrations: %s", err.Error())
+	}
+
+	if _, ok := storage.MigrateUp(2).(ValidationError); !ok {
+		t.Fatalf("Expected a target behind the current version to be refused")
+	}
+
+	statuses, err := storage.MigrationStatus()
+	if err != nil || len(statuses) != latest || statuses[latest-1].AppliedAt == "" {
+		t.Fatalf("Unexpected migration status: %+v, error: %v", statuses, err)
+	}
+
+	// Stage3: A database migrated by a more recent binary is refused.
+	_, err = storage.DB.Exec(`INSERT INTO schema_version (version, description, applied_at) VALUES (?, 'future', '')`,
+		latest+1)
+	if err != nil {
+		t.Fatalf("Unable to bump the schema version: %s", err.Error())
+	}
+
+	storage.Close()
+
+	if _, err := NewStorage(location); err == nil {
+		t.Fatalf("Database ahead of the binary was not refused")
+	}
+}
+
+// BenchmarkSQLiteQueries runs the queries behind /data and /limits
+// against a generated database of USAGE_BENCH_ROWS daily readings,
+// 2,000,000 by default, and logs the query plans picked for them.
+//
+//	go test ./usage -run NONE -bench SQLiteQueries -v
+func BenchmarkSQLiteQueries(b *testing.B) {
+
+	rows := 2000000
+	if value := os.Getenv("USAGE_BENCH_ROWS"); value != "" {
+		rows, _ = strconv.Atoi(value)
+	}
+
+	dir, err := ioutil.TempDir("", "usage")
+	if err != nil {
+		b.Fatalf("Unable to create the temporary directory: %s", err.Error())
+	}
+
+	defer os.RemoveAll(dir)
+
+	storage, err := NewStorage(filepath.Join(dir, "usage.db"))
+	if err != nil {
+		b.Fatalf("Unable to create the storage: %s", err.Error())
+	}
+
+	defer storage.Close()
+
+	// Stage1: Ten years of daily readings for each of the users, on
+	// a single meter with the same id as the user.
+	days := 3650
+	users := (rows + days - 1) / days
+	start := time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tx, _ := storage.DB.Begin()
+	for userId := 1; userId <= users; userId++ {
+		if _, err := tx.Exec(`INSERT INTO meters (meter_id, user_id, utility, unit, label) VALUES (?, ?, 'electricity', 'kWh', '')`,
+			userId, userId); err != nil {
+			b.Fatalf("Unable to generate the meters: %s", err.Error())
+		}
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO days (user_id, meter_id, timestamp, consumption, temperature) VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		b.Fatalf("Unable to prepare the insert: %s", err.Error())
+	}
+
+	for i := 0; i < rows; i++ {
+
+		timestamp := FormatTimestamp(start.AddDate(0, 0, i%days))
+		if _, err := stmt.Exec(i/days+1, i/days+1, timestamp, i%50, i%30-10); err != nil {
+			b.Fatalf("Unable to generate the readings: %s", err.Error())
+		}
+	}
+
+	stmt.Close()
+	if err := tx.Commit(); err != nil {
+		b.Fatalf("Unable to commit the readings: %s", err.Error())
+	}
+
+	storage.DB.Exec(`ANALYZE`)
+
+	// Stage2: The plans of the queries issued by GetUserData and GetLimits,
+	// with the meters resolved like the processor does.
+	daily := resolutions["D"]
+	ranged := DataQuery{Resolution: "D", Start: "2012-01-01 00:00:00", End: "2013-01-01 00:00:00", Count: 100, meters: []int{1}}
+	descending := DataQuery{Resolution: "D", Descending: true, Count: 100, meters: []int{1}}
+	continued := DataQuery{Resolution: "D", Count: 100, meters: []int{1},
+		After: &Cursor{Resolution: "D", Timestamp: "2012-01-01 00:00:00"}}
+
+	type explained struct {
+		q    string
+		args []interface{}
+	}
+
+	var queries []explained
+	for _, query := range []DataQuery{ranged, descending, continued} {
+		q, args := storage.dataQuery(1, daily, query, query.Count)
+		queries = append(queries, explained{q, args})
+	}
+
+	q, args := storage.limitsQuery(1, daily, LimitsQuery{meters: []int{1}})
+	queries = append(queries, explained{q, args})
+
+	for _, query := range queries {
+
+		plan, err := storage.DB.Query(`EXPLAIN QUERY PLAN `+query.q, query.args...)
+		if err != nil {
+			b.Fatalf("Unable to explain the query: %s", err.Error())
+		}
+
+		b.Logf("%s %v", query.q, query.args)
+		for plan.Next() {
+
+			var id, parent, unused int
+			var detail string
+
+			plan.Scan(&id, &parent, &unused, &detail)
+			b.Logf("    %s", detail)
+		}
+
+		plan.Close()
+	}
+
+	b.Run("GetUserData", func(b *testing.B) {
+
+		for i := 0; i < b.N; i++ {
+
+			query := ranged
+			query.meters = []int{i%users + 1}
+			if _, err := storage.GetUserData(i%users+1, daily, query); err != nil {
+				b.Fatalf("Unable to fetch the data: %s", err.Error())
+			}
+		}
+	})
+
+	b.Run("GetLimits", func(b *testing.B) {
+
+		for i := 0; i < b.N; i++ {
+			if _, err := storage.GetLimits(i%users+1, daily, LimitsQuery{meters: []int{i%users + 1}}); err != nil {
+				b.Fatalf("Unable to fetch the limits: %s", err.Error())
+			}
+		}
+	})
+}
+
+func TestMemoryStorageConformance(t *testing.T) {
+	testStorageConformance(t, NewMemoryStorage())
+}
+
+// TestPostgresStorageConformance runs against the empty database behind
+// USAGE_POSTGRES_DSN or else against a local instance started for the
+// test, provided the PostgreSQL binaries are on the PATH.
+func TestPostgresStorageConformance(t *testing.T) {
+
+	dsn := os.Getenv("USAGE_POSTGRES_DSN")
+	if dsn == "" {
+
+		var stop func()
+		dsn, stop = startPostgres(t)
+		defer stop()
+	}
+
+	storage, err := NewPostgresStorage(dsn)
+	if err != nil {
+		t.Fatalf("Unable to create the storage: %s", err.Error())
+	}
+
+	defer storage.Close()
+
+	testStorageConformance(t, storage)
+}
+
+// startPostgres initializes and starts a throwaway PostgreSQL instance
+// listening on a unix socket in a temporary directory.
+func startPostgres(t *testing.T) (string, func()) {
+
+	initdb, err := exec.LookPath("initdb")
+	if err != nil {
+		t.Skip("Neither USAGE_POSTGRES_DSN is set nor initdb is on the PATH")
+	}
+
+	pgCtl, err := exec.LookPath("pg_ctl")
+	if err != nil {
+		t.Skip("Neither USAGE_POSTGRES_DSN is set nor pg_ctl is on the PATH")
+	}
+
+	dir, err := ioutil.TempDir("", "postgres")
+	if err != nil {
+		t.Fatalf("Unable to create the temporary directory: %s", err.Error())
+	}
+
+	data := filepath.Join(dir, "data")
+	if out, err := exec.Command(initdb, "-D", data, "-U", "usage", "--auth=trust").CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Unable to initialize the database: %s, %s", err.Error(), out)
+	}
+
+	options := fmt.Sprintf("-c listen_addresses='' -k %s", dir)
+	if out, err := exec.Command(pgCtl, "-D", data, "-o", options, "-w", "start").CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Unable to start the database: %s, %s", err.Error(), out)
+	}
+
+	stop := func() {
+		exec.Command(pgCtl, "-D", data, "-m", "immediate", "stop").Run()
+		os.RemoveAll(dir)
+	}
+
+	return fmt.Sprintf("host=%s user=usage dbname=postgres sslmode=disable", dir), stop
+}
@@ -0,0 +1,197 @@
+package usage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// weekdays are the names of the days of the week in the windows.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// AddTariffForUser validates and stores a tariff of the user. The
+// validity period is read in the location like the timestamps of the
+// readings, and may not overlap with the other tariffs of the utility.
+func (processor UsageProcessor) AddTariffForUser(userId int, tariff Tariff, loc *time.Location) (Tariff, error) {
+
+	fmt.Printf("Received request to add a tariff for the user: %d\n", userId)
+
+	tariff.UserId = userId
+	if tariff.Utility == "" {
+		tariff.Utility = UtilityElectricity
+	}
+
+	if err := validateTariff(&tariff, loc); err != nil {
+		return Tariff{}, err
+	}
+
+	existing, err := processor.Storage.GetTariffs(userId, tariff.Utility)
+	if err != nil {
+		return Tariff{}, fmt.Errorf("Unable to fetch the tariffs: %s", err.Error())
+	}
+
+	for _, other := range existing {
+
+		// NOTE: The costs over the tariffs are summed up, so all
+		// the tariffs of a utility need to be in the same currency.
+		if other.Currency != tariff.Currency {
+			return Tariff{}, ValidationError{Reason: fmt.Sprintf("Tariffs for %s are in %s", tariff.Utility, other.Currency)}
+		}
+
+		if (other.ValidTo == "" || tariff.ValidFrom < other.ValidTo) &&
+			(tariff.ValidTo == "" || other.ValidFrom < tariff.ValidTo) {
+			return Tariff{}, ValidationError{Reason: fmt.Sprintf("Tariff overlaps with the tariff: %d", other.TariffId)}
+		}
+	}
+
+	if tariff.TariffId, err = processor.Storage.AddTariff(tariff); err != nil {
+		return Tariff{}, fmt.Errorf("Unable to store the tariff: %s", err.Error())
+	}
+
+	return tariff, nil
+}
+
+// GetTariffsForUser lists the tariffs of the user for the utility,
+// electricity when none is provided.
+func (processor UsageProcessor) GetTariffsForUser(userId int, utility string) ([]Tariff, error) {
+
+	if utility == "" {
+		utility = UtilityElectricity
+	}
+
+	if _, ok := defaultUnits[utility]; !ok {
+		return nil, ValidationError{Reason: fmt.Sprintf("Unknown utility: %s", utility)}
+	}
+
+	return processor.Storage.GetTariffs(userId, utility)
+}
+
+// DeleteTariffForUser deletes the tariff, which no longer prices the
+// consumption from then on.
+func (processor UsageProcessor) DeleteTariffForUser(userId int, tariffId int) error {
+
+	fmt.Printf("Received request to delete the tariff: %d for the user: %d\n", tariffId, userId)
+	return processor.Storage.DeleteTariff(userId, tariffId)
+}
+
+// validateTariff checks the pricing of the tariff and stores its
+// validity period as UTC timestamps.
+func validateTariff(tariff *Tariff, loc *time.Location) error {
+
+	if _, ok := defaultUnits[tariff.Utility]; !ok {
+		return ValidationError{Reason: fmt.Sprintf("Unknown utility: %s", tariff.Utility)}
+	}
+
+	if tariff.Currency = strings.ToUpper(strings.TrimSpace(tariff.Currency)); tariff.Currency == "" {
+		return ValidationError{Reason: "Currency of the tariff is missing"}
+	}
+
+	from, err := ParseTimestamp(tariff.ValidFrom, loc)
+	if err != nil {
+		return ValidationError{Reason: "Start of the validity needs to be formatted as 2006-01-02 or 2006-01-02 15:04:05"}
+	}
+
+	tariff.ValidFrom = FormatTimestamp(from)
+
+	if tariff.ValidTo != "" {
+
+		to, err := ParseTimestamp(tariff.ValidTo, loc)
+		if err != nil || !to.After(from) {
+			return ValidationError{Reason: "End of the validity needs to follow its start"}
+		}
+
+		tariff.ValidTo = FormatTimestamp(to)
+	}
+
+	if tariff.StandingCharge.Sign() < 0 {
+		return ValidationError{Reason: "Standing charge cannot be negative"}
+	}
+
+	switch {
+	case len(tariff.Tiers) > 0 && len(tariff.Windows) > 0:
+		return ValidationError{Reason: "Tariff can either have tiers or windows"}
+	case len(tariff.Tiers) > 0:
+		return validateTiers(tariff.Tiers)
+	case tariff.Rate == nil:
+		return ValidationError{Reason: "Rate of the tariff is missing"}
+	case tariff.Rate.Sign() < 0:
+		return ValidationError{Reason: "Rate cannot be negative"}
+	default:
+		return validateWindows(tariff.Windows)
+	}
+}
+
+func validateTiers(tiers []Tier) error {
+
+	var lower Decimal
+	for i, tier := range tiers {
+
+		if tier.Rate.Sign() < 0 {
+			return ValidationError{Reason: "Rate cannot be negative"}
+		}
+
+		last := i == len(tiers)-1
+		if last != (tier.UpTo == nil) {
+			return ValidationError{Reason: "Only the last tier is without an upper bound"}
+		}
+
+		if tier.UpTo != nil {
+
+			if tier.UpTo.millionths <= lower.millionths {
+				return ValidationError{Reason: "Tiers need to be in ascending order"}
+			}
+
+			lower = *tier.UpTo
+		}
+	}
+
+	return nil
+}
+
+func validateWindows(windows []Window) error {
+
+	for _, w := range windows {
+
+		from, okFrom := minuteOfDay(w.From)
+		to, okTo := minuteOfDay(w.To)
+		if !okFrom || !okTo || from == to {
+			return ValidationError{Reason: "Window needs a distinct start and end formatted as 15:04"}
+		}
+
+		if w.Rate.Sign() < 0 {
+			return ValidationError{Reason: "Rate cannot be negative"}
+		}
+
+		for _, day := range w.Days {
+			if _, ok := weekdays[day]; !ok {
+				return ValidationError{Reason: fmt.Sprintf("Unknown day of the week: %s", day)}
+			}
+		}
+	}
+
+	return nil
+}
+
+// minuteOfDay reads a wall clock time like 07:30 into the minutes
+// since midnight, accepting 24:00 for the end of the day.
+func minuteOfDay(value string) (int, bool) {
+
+	if value == "24:00" {
+		return 24 * 60, true
+	}
+
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, false
+	}
+
+	return t.Hour()*60 + t.Minute(), true
+}
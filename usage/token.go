@@ -0,0 +1,128 @@
+package usage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// tokenPrefix makes the API tokens recognizable when they
+// end up in logs or configuration files.
+const tokenPrefix = "usg_"
+
+var validScopes = map[string]bool{
+	ScopeLimitsRead: true,
+	ScopeDataRead:   true,
+	ScopeDataWrite:  true,
+}
+
+// hashToken returns the hash under which the token is persisted. The
+// tokens carry 256 bits of randomness so a fast hash is sufficient.
+func hashToken(token string) string {
+
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateToken() (string, error) {
+
+	byt := make([]byte, 32)
+	if _, err := rand.Read(byt); err != nil {
+		return "", err
+	}
+
+	return tokenPrefix + hex.EncodeToString(byt), nil
+}
+
+// CreateToken creates a new API token for the user with the provided
+// scopes. A zero expiresAt creates a token which never expires. The
+// token itself is only returned here and cannot be fetched later.
+func (processor UsageProcessor) CreateToken(
+	userId int,
+	name string,
+	scopes []string,
+	expiresAt time.Time) (Token, string, error) {
+
+	fmt.Printf("Received request to create a token for the user: %d\n", userId)
+
+	if len(scopes) == 0 {
+		return Token{}, "", ValidationError{Reason: "At least one scope is needed for the token"}
+	}
+
+	for _, scope := range scopes {
+		if !validScopes[scope] {
+			return Token{}, "", ValidationError{Reason: fmt.Sprintf("Unknown scope for the token: %s", scope)}
+		}
+	}
+
+	now := time.Now().UTC()
+	if !expiresAt.IsZero() && !expiresAt.After(now) {
+		return Token{}, "", ValidationError{Reason: "Expiry of the token lies in the past"}
+	}
+
+	secret, err := generateToken()
+	if err != nil {
+		return Token{}, "", fmt.Errorf("Unable to generate the token: %s", err.Error())
+	}
+
+	token := Token{
+		UserId:    userId,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: now.Format(timestampLayout),
+	}
+
+	if !expiresAt.IsZero() {
+		token.ExpiresAt = expiresAt.UTC().Format(timestampLayout)
+	}
+
+	token.TokenId, err = processor.Storage.AddToken(userId,
+		token.Name,
+		hashToken(secret),
+		token.Scopes,
+		token.CreatedAt,
+		token.ExpiresAt)
+
+	if err != nil {
+		return Token{}, "", fmt.Errorf("Unable to store the token: %s", err.Error())
+	}
+
+	return token, secret, nil
+}
+
+// GetTokensForUser lists the tokens of the user without the secrets.
+func (processor UsageProcessor) GetTokensForUser(userId int) ([]Token, error) {
+	return processor.Storage.GetTokens(userId)
+}
+
+// RevokeToken deletes the token so that it can no longer be used.
+func (processor UsageProcessor) RevokeToken(userId int, tokenId int) error {
+
+	fmt.Printf("Received request to revoke the token: %d for the user: %d\n", tokenId, userId)
+	return processor.Storage.DeleteToken(userId, tokenId)
+}
+
+// GetUserForToken resolves the token presented by the client into
+// the user owning it. Expired tokens are rejected and for valid ones
+// the time of usage is recorded.
+func (processor UsageProcessor) GetUserForToken(secret string) (User, Token, error) {
+
+	user, token, err := processor.Storage.GetTokenByHash(hashToken(secret))
+	if err != nil {
+		return User{}, Token{}, err
+	}
+
+	now := time.Now().UTC().Format(timestampLayout)
+	if token.ExpiresAt != "" && token.ExpiresAt <= now {
+		return User{}, Token{}, fmt.Errorf("Token has expired at: %s", token.ExpiresAt)
+	}
+
+	if err := processor.Storage.TouchToken(token.TokenId, now); err != nil {
+		return User{}, Token{}, fmt.Errorf("Unable to record the token usage: %s", err.Error())
+	}
+
+	token.LastUsedAt = now
+	return user, token, nil
+}
@@ -0,0 +1,142 @@
+package usage
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	dimensionEnergy      = "energy"
+	dimensionVolume      = "volume"
+	dimensionTemperature = "temperature"
+)
+
+// TemperatureUnit is the unit the temperatures are stored in.
+const TemperatureUnit = "°C"
+
+// unit is a unit of one of the dimensions along with the value of one
+// of it in the base unit of the dimension, in millionths. The
+// temperatures are converted by convertTemperature instead.
+type unit struct {
+	dimension string
+	factor    int64
+}
+
+// units are the units the readings can be sent and presented in. The
+// consumption is stored in the default unit of the utility of the meter.
+var units = map[string]unit{
+	"Wh":  {dimensionEnergy, decimalScale / 1000},
+	"kWh": {dimensionEnergy, decimalScale},
+	"MWh": {dimensionEnergy, decimalScale * 1000},
+	"l":   {dimensionVolume, decimalScale / 1000},
+	"m3":  {dimensionVolume, decimalScale},
+	"°C":  {dimensionTemperature, 0},
+	"°F":  {dimensionTemperature, 0},
+}
+
+// unitAliases are the other spellings accepted for the units.
+var unitAliases = map[string]string{
+	"m³":   "m3",
+	"L":    "l",
+	"C":    "°C",
+	"degC": "°C",
+	"F":    "°F",
+	"degF": "°F",
+}
+
+// dimensions of the consumption of the utilities.
+var dimensions = map[string]string{
+	UtilityElectricity: dimensionEnergy,
+	UtilityGas:         dimensionVolume,
+	UtilityWater:       dimensionVolume,
+	UtilityHeat:        dimensionEnergy,
+}
+
+// Units are the units the consumption and temperature are presented in.
+type Units struct {
+	Consumption string `json:"consumption"`
+	Temperature string `json:"temperature"`
+}
+
+// lookupUnit finds the unit by its name or one of its aliases.
+func lookupUnit(name string) (string, unit, bool) {
+
+	name = strings.TrimSpace(name)
+	if alias, ok := unitAliases[name]; ok {
+		name = alias
+	}
+
+	u, ok := units[name]
+	return name, u, ok
+}
+
+// resolveUnits reads the comma separated units requested for the data
+// of the utility, the units a dimension is stored in being the default.
+func resolveUnits(requested string, utility string) (Units, error) {
+
+	resolved := Units{Consumption: defaultUnits[utility], Temperature: TemperatureUnit}
+	if strings.TrimSpace(requested) == "" {
+		return resolved, nil
+	}
+
+	for _, name := range strings.Split(requested, ",") {
+
+		name, u, ok := lookupUnit(name)
+		switch {
+		case !ok:
+			return Units{}, ValidationError{Reason: fmt.Sprintf("Unknown unit: %s", name)}
+		case u.dimension == dimensionTemperature:
+			resolved.Temperature = name
+		case u.dimension == dimensions[utility]:
+			resolved.Consumption = name
+		default:
+			return Units{}, ValidationError{Reason: fmt.Sprintf("Unit %s does not apply to %s", name, utility)}
+		}
+	}
+
+	return resolved, nil
+}
+
+// toBase converts the consumption in the unit to the default unit of
+// the dimension, the unit being known to be of the dimension.
+func toBase(value Decimal, name string) Decimal {
+	return value.mulDiv(units[name].factor, decimalScale)
+}
+
+// fromBase converts the consumption in the default unit of the
+// dimension to the unit.
+func fromBase(value Decimal, name string) Decimal {
+	return value.mulDiv(decimalScale, units[name].factor)
+}
+
+// convertTemperature converts the temperature in degrees Celsius to
+// the unit.
+func convertTemperature(value Decimal, name string) Decimal {
+
+	if name != "°F" {
+		return value
+	}
+
+	return value.mulDiv(9, 5).Add(NewDecimal(32))
+}
+
+// convert presents the values of the row in the units, the columns
+// being those of the stored readings or of a rollup.
+func (presented Units) convert(row []interface{}) {
+
+	for i, value := range row {
+
+		d, ok := value.(Decimal)
+		if !ok {
+			continue
+		}
+
+		// NOTE: The consumption is the third column of both the stored
+		// readings and the rollups, the other decimals are temperatures.
+		if i == 2 {
+			row[i] = fromBase(d, presented.Consumption)
+		} else {
+			row[i] = convertTemperature(d, presented.Temperature)
+		}
+	}
+}
@@ -0,0 +1,615 @@
+package usage
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// defaultBaseTemperature is the base temperature, in degrees Celsius,
+// of the degree days unless another one is requested.
+const defaultBaseTemperature = 18
+
+// NormalizedQuery describes the range of the readings, from Start up to
+// End at the resolution, which may be one of the rollups, the weather
+// model is fitted to. BaseTemperature is the base of the degree days in
+// the temperature unit presented. The source, meters, units and location
+// are selected like in the DataQuery.
+type NormalizedQuery struct {
+	Resolution      string
+	Derived         bool
+	Start           string
+	End             string
+	Meter           int
+	Utility         string
+	Units           string
+	Location        *time.Location
+	BaseTemperature string
+}
+
+// WeatherModel is the fit of the consumption of the buckets to a
+// baseload per day, a heating consumption per heating degree day and a
+// cooling consumption per cooling degree day, along with the goodness
+// of the fit. CVRMSE is the root mean squared error in percent of the
+// mean consumption.
+type WeatherModel struct {
+	Baseload     Decimal `json:"baseload"`
+	Heating      Decimal `json:"heating"`
+	Cooling      Decimal `json:"cooling"`
+	Observations int     `json:"observations"`
+	RSquared     Decimal `json:"r_squared"`
+	CVRMSE       Decimal `json:"cv_rmse"`
+}
+
+// Normalization holds the weather model fitted to the range along with
+// the rows of the range, their degree days and normalized consumption.
+type Normalization struct {
+	Resolution      string          `json:"resolution"`
+	Units           *Units          `json:"units,omitempty"`
+	BaseTemperature Decimal         `json:"base_temperature"`
+	Model           WeatherModel    `json:"model"`
+	Columns         []string        `json:"columns"`
+	Data            [][]interface{} `json:"data"`
+}
+
+// weatherColumns name the columns added for the degree days and the
+// normalized consumption.
+var weatherColumns = []string{"hdd", "cdd", "normalized"}
+
+// weatherRow is a bucket with its degree days, as stored in degrees
+// Celsius and the default unit of the utility.
+type weatherRow struct {
+	start       time.Time
+	days        int64
+	temperature Decimal
+	consumption Decimal
+	hdd         Decimal
+	cdd         Decimal
+}
+
+// weatherModel is the fitted model along with the normal degree days
+// per day of each calendar month, averaged over the fitted buckets.
+type weatherModel struct {
+	baseload float64
+	heating  float64
+	cooling  float64
+	n        int
+	rSquared float64
+	cvRMSE   float64
+	normals  map[time.Month][2]float64
+}
+
+// GetNormalizedForUser fits the weather model to the data of the user in
+// the range and normalizes the consumption of its buckets to the normal
+// degree days of their calendar month.
+func (processor UsageProcessor) GetNormalizedForUser(userId int, query NormalizedQuery) (Normalization, error) {
+
+	fmt.Printf("Received request to normalize the data for the user: %d\n", userId)
+
+	if query.Start == "" || query.End == "" || query.End <= query.Start {
+		return Normalization{}, ValidationError{Reason: "Normalization needs a range with a start before its end"}
+	}
+
+	_, stored := resolutions[query.Resolution]
+	if !stored && !IsRollup(query.Resolution) {
+		return Normalization{}, ValidationError{Reason: fmt.Sprintf("Unknown resolution: %s", query.Resolution)}
+	}
+
+	if query.Derived && !IsRollup(query.Resolution) {
+		return Normalization{}, ValidationError{Reason: fmt.Sprintf("Resolution cannot be derived: %s", query.Resolution)}
+	}
+
+	stored = stored && !query.Derived
+
+	if !dailyOrCoarser(query.Resolution, !stored) {
+		return Normalization{}, ValidationError{Reason: "Degree days need a daily or coarser resolution"}
+	}
+
+	_, utility, err := processor.resolveMeters(userId, query.Meter, query.Utility)
+	if err != nil {
+		return Normalization{}, err
+	}
+
+	units, err := resolveUnits(query.Units, utility)
+	if err != nil {
+		return Normalization{}, err
+	}
+
+	base, err := parseBaseTemperature(query.BaseTemperature, units)
+	if err != nil {
+		return Normalization{}, err
+	}
+
+	dataQuery := DataQuery{
+		Resolution: query.Resolution,
+		Start:      query.Start,
+		End:        query.End,
+		Derived:    !stored,
+		Location:   query.Location,
+		Meter:      query.Meter,
+		Utility:    query.Utility,
+	}
+
+	model, rows, err := processor.fitWeather(userId, dataQuery, base)
+	if err != nil {
+		return Normalization{}, err
+	}
+
+	normalization := Normalization{
+		Resolution:      query.Resolution,
+		BaseTemperature: convertTemperature(base, units.Temperature),
+		Model: WeatherModel{
+			Baseload:     fromBase(decimalFromFloat(model.baseload), units.Consumption),
+			Heating:      perDegreeDay(model.heating, units),
+			Cooling:      perDegreeDay(model.cooling, units),
+			Observations: model.n,
+			RSquared:     decimalFromFloat(model.rSquared).Round(4),
+			CVRMSE:       decimalFromFloat(model.cvRMSE).Round(2),
+		},
+		Columns: append([]string{"timestamp", "temperature", "consumption"}, weatherColumns...),
+	}
+
+	if query.Units != "" {
+		normalization.Units = &units
+	}
+
+	format := "2006-01-02"
+	if stored {
+		format = resolutions[query.Resolution].Format
+	}
+
+	for _, row := range rows {
+
+		values := []interface{}{row.start.In(dataQuery.location()).Format(format), row.temperature, row.consumption}
+		units.convert(values)
+
+		normalization.Data = append(normalization.Data, append(values, model.present(row, units)...))
+	}
+
+	return normalization, nil
+}
+
+// weatherValues computes the degree days and, when requested, the
+// normalized consumption of the rows of the page of data as stored,
+// to be appended to the rows once they are presented in the units.
+func (processor UsageProcessor) weatherValues(userId int, query DataQuery, units Units, page DataPage) ([][]interface{}, error) {
+
+	if !dailyOrCoarser(query.Resolution, query.Derived) {
+		return nil, ValidationError{Reason: "Degree days need a daily or coarser resolution"}
+	}
+
+	base, err := parseBaseTemperature(query.BaseTemperature, units)
+	if err != nil {
+		return nil, err
+	}
+
+	model := weatherModel{}
+	if query.Normalized {
+
+		if query.Start == "" || query.End == "" {
+			return nil, ValidationError{Reason: "Normalized consumption needs a range with a start and an end"}
+		}
+
+		model, _, err = processor.fitWeather(userId, DataQuery{
+			Resolution: query.Resolution,
+			Start:      query.Start,
+			End:        query.End,
+			Derived:    query.Derived,
+			Location:   query.Location,
+			AsOf:       query.AsOf,
+			Meter:      query.Meter,
+			Utility:    query.Utility,
+		}, base)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := processor.weatherRows(userId, query, page, base)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([][]interface{}, len(page.Data))
+	for i, row := range rows {
+
+		presented := model.present(row, units)
+		switch {
+		case !query.Normalized:
+			values[i] = presented[:2]
+		case !query.DegreeDays:
+			values[i] = presented[2:]
+		default:
+			values[i] = presented
+		}
+	}
+
+	return values, nil
+}
+
+// addWeatherColumns appends the degree days and the normalized
+// consumption requested to the rows of the page.
+func addWeatherColumns(query DataQuery, page *DataPage, weather [][]interface{}) {
+
+	if page.Columns == nil {
+		page.Columns = []string{"timestamp", "temperature", "consumption"}
+	}
+
+	if query.DegreeDays {
+		page.Columns = append(page.Columns, weatherColumns[:2]...)
+	}
+
+	if query.Normalized {
+		page.Columns = append(page.Columns, weatherColumns[2])
+	}
+
+	for i := range page.Data {
+		page.Data[i] = append(page.Data[i], weather[i]...)
+	}
+}
+
+// fitWeather fetches the rows of the range as stored and fits the
+// weather model to them by ordinary least squares. The degree days
+// which are zero throughout the range are left out of the fit.
+func (processor UsageProcessor) fitWeather(userId int, query DataQuery, base Decimal) (weatherModel, []weatherRow, error) {
+
+	query.Count = MaxPageSize
+
+	var rows []weatherRow
+
+	for {
+
+		page, err := processor.GetDataForUser(userId, query)
+		if err != nil {
+			return weatherModel{}, nil, err
+		}
+
+		pageRows, err := processor.weatherRows(userId, query, page, base)
+		if err != nil {
+			return weatherModel{}, nil, err
+		}
+
+		rows = append(rows, pageRows...)
+
+		if !page.HasMore {
+			break
+		}
+
+		query.After = page.Next
+	}
+
+	// Stage1: Pick the regressors which vary over the range.
+	var heating, cooling bool
+	for _, row := range rows {
+		heating = heating || row.hdd.Sign() != 0
+		cooling = cooling || row.cdd.Sign() != 0
+	}
+
+	regressors := func(row weatherRow) []float64 {
+
+		x := []float64{float64(row.days)}
+		if heating {
+			x = append(x, row.hdd.Float64())
+		}
+		if cooling {
+			x = append(x, row.cdd.Float64())
+		}
+		return x
+	}
+
+	p := 1
+	if heating {
+		p++
+	}
+	if cooling {
+		p++
+	}
+
+	if len(rows) <= p {
+		return weatherModel{}, nil, ValidationError{Reason: fmt.Sprintf("Weather model needs more than %d rows to fit", p)}
+	}
+
+	// Stage2: Fit the coefficients.
+	beta, ok := leastSquares(rows, regressors)
+	if !ok {
+		return weatherModel{}, nil, ValidationError{Reason: "Degree days do not vary enough to fit the weather model"}
+	}
+
+	model := weatherModel{baseload: beta[0], n: len(rows), normals: make(map[time.Month][2]float64)}
+
+	next := 1
+	if heating {
+		model.heating = beta[next]
+		next++
+	}
+	if cooling {
+		model.cooling = beta[next]
+	}
+
+	// Stage3: Measure the goodness of the fit.
+	var sum, residuals, total float64
+	for _, row := range rows {
+		sum += row.consumption.Float64()
+	}
+
+	mean := sum / float64(len(rows))
+	for _, row := range rows {
+
+		y := row.consumption.Float64()
+		residual := y - model.predict(row.days, row.hdd.Float64(), row.cdd.Float64())
+
+		residuals += residual * residual
+		total += (y - mean) * (y - mean)
+	}
+
+	model.rSquared = 1
+	if total > 0 {
+		model.rSquared = 1 - residuals/total
+	}
+
+	if mean != 0 {
+		model.cvRMSE = math.Sqrt(residuals/float64(len(rows)-p)) / mean * 100
+	}
+
+	// Stage4: Average the degree days per day of each calendar month.
+	days := make(map[time.Month]int64)
+	sums := make(map[time.Month][2]float64)
+	for _, row := range rows {
+
+		month := row.start.In(query.location()).Month()
+		days[month] += row.days
+		sums[month] = [2]float64{sums[month][0] + row.hdd.Float64(), sums[month][1] + row.cdd.Float64()}
+	}
+
+	for month, s := range sums {
+		model.normals[month] = [2]float64{s[0] / float64(days[month]), s[1] / float64(days[month])}
+	}
+
+	return model, rows, nil
+}
+
+func (model weatherModel) predict(days int64, hdd float64, cdd float64) float64 {
+	return model.baseload*float64(days) + model.heating*hdd + model.cooling*cdd
+}
+
+// present lists the degree days and the normalized consumption of the
+// row in the units. The normalized consumption takes the consumption
+// the model attributes to the weather of the row out, and the one it
+// attributes to the normal weather of its calendar month in.
+func (model weatherModel) present(row weatherRow, units Units) []interface{} {
+
+	hdd, cdd := row.hdd, row.cdd
+	if units.Temperature == "°F" {
+		hdd, cdd = hdd.mulDiv(9, 5), cdd.mulDiv(9, 5)
+	}
+
+	normal, ok := model.normals[row.start.Month()]
+	if !ok {
+		return []interface{}{hdd, cdd, nil}
+	}
+
+	days := float64(row.days)
+	adjustment := model.heating*(row.hdd.Float64()-normal[0]*days) + model.cooling*(row.cdd.Float64()-normal[1]*days)
+	normalized := row.consumption.Sub(decimalFromFloat(adjustment))
+
+	return []interface{}{hdd, cdd, fromBase(normalized, units.Consumption)}
+}
+
+// weatherRows computes the degree days of the rows of the page of data
+// as stored. The rollups of the daily readings sum the degree days of
+// the days with readings in the range instead, so that a bucket cut
+// short by the range or by a gap only counts the days it covers, and a
+// month swinging around the base temperature counts the degree days of
+// each of its days.
+func (processor UsageProcessor) weatherRows(userId int, query DataQuery, page DataPage, base Decimal) ([]weatherRow, error) {
+
+	rows := make([]weatherRow, len(page.Data))
+	for i, data := range page.Data {
+		rows[i] = newWeatherRow(query, page.times[i], data, base)
+	}
+
+	r := rollups[query.Resolution]
+	if !query.Derived || r.base != "D" || len(rows) == 0 {
+		return rows, nil
+	}
+
+	// Stage1: Fetch the days of the buckets which fall in the range.
+	loc := query.location()
+	first, last := page.times[0], page.times[len(page.times)-1]
+	if last.Before(first) {
+		first, last = last, first
+	}
+
+	_, end := r.bucket(last.In(loc))
+	if query.Start != "" && parseStored(query.Start).After(first) {
+		first = parseStored(query.Start)
+	}
+
+	if query.End != "" && parseStored(query.End).Before(end) {
+		end = parseStored(query.End)
+	}
+
+	daily := DataQuery{Resolution: "D", Location: query.Location, AsOf: query.AsOf, Meter: query.Meter, Utility: query.Utility}
+	days, err := processor.dailyRows(userId, daily, first, end, base)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stage2: Sum the degree days of the days into their bucket.
+	buckets := make(map[int64]int)
+	for i, row := range rows {
+		buckets[row.start.Unix()] = i
+		rows[i].days, rows[i].hdd, rows[i].cdd = 0, Decimal{}, Decimal{}
+	}
+
+	for _, day := range days {
+
+		start, _ := r.bucket(day.start)
+		i, ok := buckets[start.Unix()]
+		if !ok {
+			continue
+		}
+
+		rows[i].days += day.days
+		rows[i].hdd = rows[i].hdd.Add(day.hdd)
+		rows[i].cdd = rows[i].cdd.Add(day.cdd)
+	}
+
+	return rows, nil
+}
+
+// newWeatherRow computes the degree days of the row of data as stored,
+// from the mean temperature of its bucket and the days the bucket spans.
+func newWeatherRow(query DataQuery, t time.Time, data []interface{}, base Decimal) weatherRow {
+
+	loc := query.location()
+
+	var end time.Time
+	if query.Derived {
+		_, end = rollups[query.Resolution].bucket(t.In(loc))
+	} else {
+		end = readingEnd(resolutions[query.Resolution], t, loc)
+	}
+
+	row := weatherRow{
+		start:       t.In(loc),
+		days:        int64(math.Round(end.Sub(t).Hours() / 24)),
+		temperature: data[1].(Decimal),
+		consumption: data[2].(Decimal),
+	}
+
+	below := base.Sub(row.temperature)
+	if below.Sign() > 0 {
+		row.hdd = below.mulDiv(row.days, 1)
+	} else {
+		row.cdd = below.mulDiv(-row.days, 1)
+	}
+
+	return row
+}
+
+// perDegreeDay presents the consumption per degree day in the units. A
+// degree day in Fahrenheit is five ninths of one in Celsius, so the
+// consumption per degree day shrinks alike.
+func perDegreeDay(value float64, units Units) Decimal {
+
+	d := fromBase(decimalFromFloat(value), units.Consumption)
+	if units.Temperature == "°F" {
+		d = d.mulDiv(5, 9)
+	}
+
+	return d
+}
+
+// dailyOrCoarser reports whether the buckets of the resolution span
+// whole days, which the degree days are counted in.
+func dailyOrCoarser(name string, derived bool) bool {
+
+	if derived {
+		return true
+	}
+
+	step := resolutions[name].Step
+	return step == 0 || step == 24*time.Hour
+}
+
+// parseBaseTemperature reads the base temperature of the degree days in
+// the temperature unit presented and converts it to degrees Celsius.
+func parseBaseTemperature(value string, units Units) (Decimal, error) {
+
+	if value == "" {
+		return NewDecimal(defaultBaseTemperature), nil
+	}
+
+	base, err := ParseDecimal(value)
+	if err != nil {
+		return Decimal{}, ValidationError{Reason: fmt.Sprintf("Malformed base temperature: %s", value)}
+	}
+
+	if units.Temperature == "°F" {
+		base = base.Sub(NewDecimal(32)).mulDiv(5, 9)
+	}
+
+	return base, nil
+}
+
+// leastSquares fits the consumption of the rows to the regressors of
+// the rows by ordinary least squares, solving the normal equations.
+func leastSquares(rows []weatherRow, regressors func(weatherRow) []float64) ([]float64, bool) {
+
+	if len(rows) == 0 {
+		return nil, false
+	}
+
+	p := len(regressors(rows[0]))
+	xtx := make([][]float64, p)
+	xty := make([]float64, p)
+	for i := range xtx {
+		xtx[i] = make([]float64, p)
+	}
+
+	for _, row := range rows {
+
+		x := regressors(row)
+		y := row.consumption.Float64()
+
+		for i := 0; i < p; i++ {
+			xty[i] += x[i] * y
+			for j := 0; j < p; j++ {
+				xtx[i][j] += x[i] * x[j]
+			}
+		}
+	}
+
+	return solve(xtx, xty)
+}
+
+// solve solves the linear equations by Gaussian elimination with
+// partial pivoting, failing when the matrix is close to singular.
+func solve(a [][]float64, b []float64) ([]float64, bool) {
+
+	n := len(b)
+
+	scale := 0.0
+	for i := range a {
+		scale = math.Max(scale, math.Abs(a[i][i]))
+	}
+
+	for col := 0; col < n; col++ {
+
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+
+		if math.Abs(a[pivot][col]) <= 1e-9*scale {
+			return nil, false
+		}
+
+		a[col], a[pivot] = a[pivot], a[col]
+		b[col], b[pivot] = b[pivot], b[col]
+
+		for row := col + 1; row < n; row++ {
+
+			factor := a[row][col] / a[col][col]
+			for k := col; k < n; k++ {
+				a[row][k] -= factor * a[col][k]
+			}
+			b[row] -= factor * b[col]
+		}
+	}
+
+	x := make([]float64, n)
+	for row := n - 1; row >= 0; row-- {
+
+		sum := b[row]
+		for k := row + 1; k < n; k++ {
+			sum -= a[row][k] * x[k]
+		}
+		x[row] = sum / a[row][row]
+	}
+
+	return x, true
+}
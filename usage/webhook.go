@@ -0,0 +1,430 @@
+package usage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// webhookAttempts is the number of attempts after which a delivery
+	// is given up on.
+	webhookAttempts = 8
+	// webhookBackoff is the delay before the first retry of a delivery,
+	// which doubles with each further attempt.
+	webhookBackoff = 30 * time.Second
+	// webhookBatch is the number of deliveries attempted in one go.
+	webhookBatch = 100
+	// deliveryLogSize is the number of deliveries listed for a webhook.
+	deliveryLogSize = 100
+)
+
+// webhookClient posts the deliveries, a receiver which does not answer
+// in time counts as a failed attempt.
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+var validEvents = map[string]bool{
+	EventReadingIngested: true,
+	EventBudgetExceeded:  true,
+	EventDataGap:         true,
+}
+
+// SignWebhook computes the signature sent in the X-Usage-Signature
+// header, the hex encoded HMAC-SHA256 of the timestamp sent in the
+// X-Usage-Timestamp header, a dot and the payload, keyed with the
+// secret of the webhook.
+func SignWebhook(secret string, timestamp string, payload []byte) string {
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// AddWebhookForUser registers the URL to receive the events of the
+// user. The secret the payloads are signed with is only returned here.
+func (processor UsageProcessor) AddWebhookForUser(userId int, target string, events []string) (Webhook, error) {
+
+	fmt.Printf("Received request to add a webhook for the user: %d\n", userId)
+
+	parsed, err := url.Parse(target)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return Webhook{}, ValidationError{Reason: "URL of the webhook needs to be an absolute http or https URL"}
+	}
+
+	if len(events) == 0 {
+		return Webhook{}, ValidationError{Reason: "At least one event is needed for the webhook"}
+	}
+
+	seen := make(map[string]bool)
+	var unique []string
+
+	for _, event := range events {
+
+		if !validEvents[event] {
+			return Webhook{}, ValidationError{Reason: fmt.Sprintf("Unknown event for the webhook: %s", event)}
+		}
+
+		if !seen[event] {
+			seen[event] = true
+			unique = append(unique, event)
+		}
+	}
+
+	byt := make([]byte, 32)
+	if _, err := rand.Read(byt); err != nil {
+		return Webhook{}, fmt.Errorf("Unable to generate the secret: %s", err.Error())
+	}
+
+	webhook := Webhook{
+		UserId:    userId,
+		URL:       target,
+		Events:    unique,
+		Secret:    hex.EncodeToString(byt),
+		CreatedAt: FormatTimestamp(time.Now()),
+	}
+
+	if webhook.WebhookId, err = processor.Storage.AddWebhook(webhook); err != nil {
+		return Webhook{}, fmt.Errorf("Unable to store the webhook: %s", err.Error())
+	}
+
+	return webhook, nil
+}
+
+// GetWebhooksForUser lists the webhooks of the user, without their secrets.
+func (processor UsageProcessor) GetWebhooksForUser(userId int) ([]Webhook, error) {
+
+	webhooks, err := processor.Storage.GetWebhooks(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+
+	return webhooks, nil
+}
+
+// DeleteWebhookForUser deletes the webhook along with its deliveries,
+// the pending ones included.
+func (processor UsageProcessor) DeleteWebhookForUser(userId int, webhookId int) error {
+
+	fmt.Printf("Received request to delete the webhook: %d for the user: %d\n", webhookId, userId)
+	return processor.Storage.DeleteWebhook(userId, webhookId)
+}
+
+// GetDeliveriesForUser lists the latest deliveries of the webhook,
+// sql.ErrNoRows is returned when the user has no such webhook.
+func (processor UsageProcessor) GetDeliveriesForUser(userId int, webhookId int) ([]Delivery, error) {
+
+	webhooks, err := processor.Storage.GetWebhooks(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, webhook := range webhooks {
+		if webhook.WebhookId == webhookId {
+			return processor.Storage.GetDeliveries(userId, webhookId, deliveryLogSize)
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// subscribers are the webhooks of the user subscribed to the event.
+func (processor UsageProcessor) subscribers(userId int, event string) ([]Webhook, error) {
+
+	webhooks, err := processor.Storage.GetWebhooks(userId)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch the webhooks: %s", err.Error())
+	}
+
+	var subscribed []Webhook
+	for _, webhook := range webhooks {
+		for _, e := range webhook.Events {
+			if e == event {
+				subscribed = append(subscribed, webhook)
+			}
+		}
+	}
+
+	return subscribed, nil
+}
+
+// publish queues a delivery of the event to each of the webhooks of the
+// user which subscribe to it. The deliveries are attempted by
+// DeliverWebhooks.
+func (processor UsageProcessor) publish(userId int, event string, data interface{}) error {
+
+	webhooks, err := processor.subscribers(userId, event)
+	if err != nil || len(webhooks) == 0 {
+		return err
+	}
+
+	now := time.Now().UTC()
+
+	payload, err := json.Marshal(struct {
+		Event     string      `json:"event"`
+		CreatedAt string      `json:"created_at"`
+		Data      interface{} `json:"data"`
+	}{event, now.Format(time.RFC3339), data})
+	if err != nil {
+		return fmt.Errorf("Unable to encode the %s event: %s", event, err.Error())
+	}
+
+	deliveries := make([]Delivery, len(webhooks))
+	for i, webhook := range webhooks {
+		deliveries[i] = Delivery{
+			WebhookId:     webhook.WebhookId,
+			UserId:        userId,
+			Event:         event,
+			Payload:       payload,
+			Status:        DeliveryPending,
+			CreatedAt:     FormatTimestamp(now),
+			NextAttemptAt: FormatTimestamp(now),
+		}
+	}
+
+	if err := processor.Storage.AddDeliveries(deliveries); err != nil {
+		return fmt.Errorf("Unable to queue the %s event: %s", event, err.Error())
+	}
+
+	return nil
+}
+
+// DeliverWebhooks attempts the deliveries which are due at the instant
+// and returns the number attempted. A failed delivery is retried with
+// an exponential backoff, until it runs out of attempts. The server
+// calls it periodically, the deliveries are thus made at least once.
+func (processor UsageProcessor) DeliverWebhooks(now time.Time) (int, error) {
+
+	due, err := processor.Storage.GetDueDeliveries(FormatTimestamp(now), webhookBatch)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to fetch the due deliveries: %s", err.Error())
+	}
+
+	for _, delivery := range due {
+
+		attemptDelivery(&delivery, now)
+
+		if err := processor.Storage.UpdateDelivery(delivery); err != nil {
+			return 0, fmt.Errorf("Unable to update the delivery: %d, error: %s", delivery.DeliveryId, err.Error())
+		}
+	}
+
+	return len(due), nil
+}
+
+// attemptDelivery posts the payload of the delivery to its webhook and
+// records the outcome, any 2xx response counting as delivered.
+func attemptDelivery(delivery *Delivery, now time.Time) {
+
+	delivery.Attempts++
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest("POST", delivery.url, bytes.NewReader(delivery.Payload))
+	if err == nil {
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Usage-Event", delivery.Event)
+		req.Header.Set("X-Usage-Delivery", strconv.Itoa(delivery.DeliveryId))
+		req.Header.Set("X-Usage-Timestamp", timestamp)
+		req.Header.Set("X-Usage-Signature", SignWebhook(delivery.secret, timestamp, delivery.Payload))
+
+		var resp *http.Response
+		if resp, err = webhookClient.Do(req); err == nil {
+
+			// NOTE: The body is drained for the connection to be reused.
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+
+			delivery.ResponseCode = resp.StatusCode
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				err = fmt.Errorf("Unexpected status of the response: %d", resp.StatusCode)
+			}
+		}
+	}
+
+	if err == nil {
+		delivery.Status = DeliveryDelivered
+		delivery.Error = ""
+		delivery.NextAttemptAt = ""
+		delivery.DeliveredAt = FormatTimestamp(now)
+		return
+	}
+
+	delivery.Error = err.Error()
+	if delivery.Attempts >= webhookAttempts {
+		delivery.Status = DeliveryFailed
+		delivery.NextAttemptAt = ""
+		return
+	}
+
+	delivery.NextAttemptAt = FormatTimestamp(now.Add(webhookBackoff << uint(delivery.Attempts-1)))
+}
+
+// gap is a period without readings between two readings of a meter.
+type gap struct {
+	Meter      int    `json:"meter"`
+	Resolution string `json:"resolution"`
+	Start      string `json:"start"`
+	End        string `json:"end"`
+}
+
+// afterIngest publishes the events for the readings of the user, as
+// stored, and checks the budgets over them. The readings are stored by
+// then, so the failures are only logged.
+func (processor UsageProcessor) afterIngest(userId int, readings []Reading, loc *time.Location) {
+
+	if err := processor.publishIngested(userId, readings, loc); err != nil {
+		fmt.Printf("Unable to publish the events for the user: %d, error: %s\n", userId, err.Error())
+	}
+
+	if err := processor.checkBudgets(userId, readings); err != nil {
+		fmt.Printf("Unable to check the budgets for the user: %d, error: %s\n", userId, err.Error())
+	}
+}
+
+// publishIngested publishes the readings ingested along with the gaps
+// which precede them.
+func (processor UsageProcessor) publishIngested(userId int, readings []Reading, loc *time.Location) error {
+
+	var meters []int
+	var names []string
+	seenMeters := make(map[int]bool)
+	seenNames := make(map[string]bool)
+	start, end := readings[0].Timestamp, readings[0].Timestamp
+
+	for _, reading := range readings {
+
+		if !seenMeters[reading.Meter] {
+			seenMeters[reading.Meter] = true
+			meters = append(meters, reading.Meter)
+		}
+
+		if !seenNames[reading.Resolution] {
+			seenNames[reading.Resolution] = true
+			names = append(names, reading.Resolution)
+		}
+
+		if reading.Timestamp < start {
+			start = reading.Timestamp
+		}
+
+		if reading.Timestamp > end {
+			end = reading.Timestamp
+		}
+	}
+
+	sort.Ints(meters)
+	sort.Strings(names)
+
+	ingested := struct {
+		Readings    int      `json:"readings"`
+		Meters      []int    `json:"meters"`
+		Resolutions []string `json:"resolutions"`
+		Start       string   `json:"start"`
+		End         string   `json:"end"`
+	}{
+		len(readings),
+		meters,
+		names,
+		parseStored(start).Format(time.RFC3339),
+		parseStored(end).Format(time.RFC3339),
+	}
+
+	if err := processor.publish(userId, EventReadingIngested, ingested); err != nil {
+		return err
+	}
+
+	if webhooks, err := processor.subscribers(userId, EventDataGap); err != nil || len(webhooks) == 0 {
+		return err
+	}
+
+	gaps, err := processor.findGaps(userId, readings, loc)
+	if err != nil || len(gaps) == 0 {
+		return err
+	}
+
+	return processor.publish(userId, EventDataGap, map[string][]gap{"gaps": gaps})
+}
+
+// findGaps finds the periods without readings of the meters which end
+// at one of the readings, going back to the reading stored before the
+// earliest of them.
+func (processor UsageProcessor) findGaps(userId int, readings []Reading, loc *time.Location) ([]gap, error) {
+
+	type series struct {
+		meter      int
+		resolution string
+	}
+
+	timestamps := make(map[series][]string)
+	var keys []series
+
+	for _, reading := range readings {
+
+		key := series{reading.Meter, reading.Resolution}
+		if _, ok := timestamps[key]; !ok {
+			keys = append(keys, key)
+		}
+
+		timestamps[key] = append(timestamps[key], reading.Timestamp)
+	}
+
+	var gaps []gap
+
+	for _, key := range keys {
+
+		resolution := resolutions[key.resolution]
+		stamps := timestamps[key]
+		sort.Strings(stamps)
+
+		previous, err := processor.Storage.GetUserData(userId, resolution, DataQuery{
+			Resolution: key.resolution,
+			End:        stamps[0],
+			Count:      1,
+			Descending: true,
+			Location:   loc,
+			meters:     []int{key.meter},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to fetch the previous reading: %s", err.Error())
+		}
+
+		var times []time.Time
+		times = append(times, previous.times...)
+		for _, stamp := range stamps {
+			times = append(times, parseStored(stamp))
+		}
+
+		for i := 1; i < len(times); i++ {
+
+			if end := readingEnd(resolution, times[i-1], loc); end.Before(times[i]) {
+				gaps = append(gaps, gap{
+					Meter:      key.meter,
+					Resolution: key.resolution,
+					Start:      end.UTC().Format(time.RFC3339),
+					End:        times[i].UTC().Format(time.RFC3339),
+				})
+			}
+		}
+	}
+
+	return gaps, nil
+}